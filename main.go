@@ -15,6 +15,10 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 
@@ -24,6 +28,16 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		os.Exit(backup(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(restore(os.Args[2:]))
+	}
+
 	log.Printf("pz-workflow starting...")
 
 	sys, logWriter, auditWriter := makeClients()
@@ -54,16 +68,25 @@ func makeClients() (
 	pzsyslog.Writer,
 	pzsyslog.Writer) {
 
+	// with file storage there is no Elasticsearch, for the indices or the logs
+	fileStorage := os.Getenv("PZ_WORKFLOW_STORAGE") == pzworkflow.StorageFile
+
 	required := []piazza.ServiceName{
-		piazza.PzElasticSearch,
 		piazza.PzRabbitMQ,
 	}
+	if !fileStorage {
+		required = append(required, piazza.PzElasticSearch)
+	}
 
 	sys, err := piazza.NewSystemConfig(piazza.PzWorkflow, required)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if fileStorage {
+		return sys, &pzsyslog.StderrWriter{}, &pzsyslog.StdoutWriter{}
+	}
+
 	loggerIndex, err := pzsyslog.GetRequiredEnvVars()
 	if err != nil {
 		log.Fatal(err)
@@ -76,3 +99,152 @@ func makeClients() (
 
 	return sys, logWriter, auditWriter
 }
+
+// migrate runs "pz-workflow migrate status|up|verify" against the
+// Elasticsearch indices, and returns the exit code.
+func migrate(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: pz-workflow migrate status|up|verify")
+		return 2
+	}
+
+	sys, err := piazza.NewSystemConfig(piazza.PzWorkflow, []piazza.ServiceName{piazza.PzElasticSearch})
+	if err != nil {
+		log.Fatal(err)
+	}
+	esURL, err := sys.GetURL(piazza.PzElasticSearch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	migrator, err := pzworkflow.NewElasticsearchMigrator(esURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Printf("%4d  applied %s  %s\n", status.Version, status.AppliedOn.String(), status.Description)
+			} else {
+				fmt.Printf("%4d  pending  %s\n", status.Version, status.Description)
+			}
+		}
+	case "up":
+		done, err := migrator.Up()
+		for _, migration := range done {
+			fmt.Printf("%4d  applied  %s\n", migration.Version, migration.Description)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(done) == 0 {
+			fmt.Println("The indices are up to date")
+		}
+	case "verify":
+		diffs, err := migrator.Verify()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(diffs) != 0 {
+			for _, diff := range diffs {
+				fmt.Println(diff)
+			}
+			return 1
+		}
+		fmt.Println("The indices match their schemas")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command: %s\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+// defaultWorkflowURL is where a pz-workflow run locally listens.
+var defaultWorkflowURL = piazza.DefaultProtocol + "://localhost:" + piazza.LocalPortNumbers[piazza.PzWorkflow]
+
+func newWorkflowClient(url string) *pzworkflow.Client {
+	logger := pzsyslog.NewLogger(&pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, "pz-workflow-cli", "")
+	client, err := pzworkflow.NewClient(url, "", logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
+
+// backup runs "pz-workflow backup [-url url] [-events] [-alerts] [-o file]"
+// against a running pz-workflow, writing the archive to the file or to
+// stdout, and returns the exit code.
+func backup(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	url := flags.String("url", defaultWorkflowURL, "the pz-workflow to back up")
+	events := flags.Bool("events", false, "include the events")
+	alerts := flags.Bool("alerts", false, "include the alerts")
+	out := flags.String("o", "", "the file to write the archive to, instead of stdout")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: pz-workflow backup [-url url] [-events] [-alerts] [-o file]")
+		return 2
+	}
+
+	archive, err := newWorkflowClient(*url).Backup(*events, *alerts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	byts, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		fmt.Println(string(byts))
+		return 0
+	}
+	if err = ioutil.WriteFile(*out, byts, 0600); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Backed up %d eventTypes, %d triggers, %d crons, %d events and %d alerts to %s\n",
+		len(archive.EventTypes), len(archive.Triggers), len(archive.Crons), len(archive.Events), len(archive.Alerts), *out)
+	return 0
+}
+
+// restore runs "pz-workflow restore [-url url] [-preserve-ids] file" against
+// a running pz-workflow, and returns the exit code: 1 if anything in the
+// archive couldn't be restored.
+func restore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	url := flags.String("url", defaultWorkflowURL, "the pz-workflow to restore to")
+	preserveIDs := flags.Bool("preserve-ids", false, "keep the IDs in the archive, instead of giving new ones")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: pz-workflow restore [-url url] [-preserve-ids] file")
+		return 2
+	}
+
+	byts, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	archive := &pzworkflow.Backup{}
+	if err = json.Unmarshal(byts, archive); err != nil {
+		log.Fatal(err)
+	}
+
+	report, err := newWorkflowClient(*url).Restore(archive, *preserveIDs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Restored %d eventTypes, %d triggers, %d crons, %d events and %d alerts\n",
+		report.EventTypes, report.Triggers, report.Crons, report.Events, report.Alerts)
+	for from, to := range report.IDs {
+		fmt.Printf("%s  ->  %s\n", from, to)
+	}
+	for _, msg := range report.Errors {
+		fmt.Println(msg)
+	}
+	if len(report.Errors) != 0 {
+		return 1
+	}
+	return 0
+}
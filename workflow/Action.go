@@ -0,0 +1,329 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The built-in trigger action kinds
+const (
+	ActionTypeJob     = "job"
+	ActionTypeWebhook = "webhook"
+	ActionTypeAMQP    = "amqp"
+	ActionTypeEvent   = "event"
+)
+
+// maxEventChainDepth limits how many events in a row may be emitted by
+// "event" actions, so that triggers which emit each other's events can't
+// loop forever.
+const maxEventChainDepth = 8
+
+// ActionContext is what an action is run with: the trigger that fired, and
+// the event that fired it.
+type ActionContext struct {
+	Service   *Service
+	Trigger   *Trigger
+	Event     *Event
+	EventType *EventType
+	// Data is the event's own data, not wrapped in the EventType name
+	Data map[string]interface{}
+	// Depth is the number of event actions that led to this event
+	Depth int
+}
+
+// TemplateContext returns the values the action's templates are rendered with.
+func (ctx *ActionContext) TemplateContext() map[string]interface{} {
+	return newJobTemplateContext(ctx.Event, ctx.Data)
+}
+
+// ActionKind is one kind of trigger action.
+type ActionKind interface {
+	// Validate checks a trigger's action when the trigger is posted or updated
+	Validate(service *Service, trigger *Trigger, eventType *EventType) error
+	// Render returns what the action would send for the event, without sending it
+	Render(ctx *ActionContext) (string, error)
+	// Run performs the action, and returns the id of the job it created, if any
+	Run(ctx *ActionContext) (piazza.Ident, error)
+}
+
+var actionKinds = map[string]ActionKind{
+	ActionTypeJob:     jobActionKind{},
+	ActionTypeWebhook: webhookActionKind{},
+	ActionTypeAMQP:    amqpActionKind{},
+	ActionTypeEvent:   eventActionKind{},
+}
+var actionKindsLock sync.RWMutex
+
+// RegisterActionKind adds a kind of trigger action, or replaces a built-in one.
+func RegisterActionKind(name string, kind ActionKind) {
+	actionKindsLock.Lock()
+	defer actionKindsLock.Unlock()
+	actionKinds[name] = kind
+}
+
+func getActionKind(name string) (ActionKind, error) {
+	actionKindsLock.RLock()
+	defer actionKindsLock.RUnlock()
+	kind, ok := actionKinds[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown trigger action type: %s", name)
+	}
+	return kind, nil
+}
+
+// ActionType returns the trigger's action type; a trigger with no action
+// submits its Job.
+func (trigger *Trigger) ActionType() string {
+	if trigger.Action == nil || trigger.Action.Type == "" {
+		return ActionTypeJob
+	}
+	return trigger.Action.Type
+}
+
+// validateAction checks the trigger's action, including that its templates
+// only refer to fields of the EventType.
+func (service *Service) validateAction(trigger *Trigger, eventType *EventType) error {
+	kind, err := getActionKind(trigger.ActionType())
+	if err != nil {
+		return err
+	}
+	return kind.Validate(service, trigger, eventType)
+}
+
+func validateActionTemplate(value interface{}, service *Service, eventType *EventType) error {
+	return validateTemplate(value, eventType.Name, service.removeUniqueParams(eventType.Name, eventType.Mapping))
+}
+
+// defaultActionBody is sent by webhook and amqp actions that don't give a body.
+func defaultActionBody(ctx *ActionContext) map[string]interface{} {
+	return map[string]interface{}{
+		"triggerId":   ctx.Trigger.TriggerID,
+		"eventId":     ctx.Event.EventID,
+		"eventTypeId": ctx.Event.EventTypeID,
+		"data":        ctx.Data,
+	}
+}
+
+func renderActionBody(body interface{}, ctx *ActionContext) (string, error) {
+	if body == nil {
+		byts, err := json.Marshal(defaultActionBody(ctx))
+		return string(byts), err
+	}
+	rendered, err := renderTemplate(body, ctx.TemplateContext())
+	if err != nil {
+		return "", err
+	}
+	byts, err := json.Marshal(rendered)
+	return string(byts), err
+}
+
+//------------------------------------------------------------------------------
+
+// jobActionKind submits the trigger's Job to the job manager, by way of the
+// dispatch outbox.
+type jobActionKind struct{}
+
+func (jobActionKind) Validate(service *Service, trigger *Trigger, eventType *EventType) error {
+	if trigger.Job.JobType.Type == "" {
+		return errors.New("A job action needs job.jobType.type")
+	}
+	if trigger.Job.JobType.Data == nil {
+		return errors.New("A job action needs job.jobType.data")
+	}
+	return validateActionTemplate(trigger.Job, service, eventType)
+}
+
+func (jobActionKind) Render(ctx *ActionContext) (string, error) {
+	return renderJobTemplate(ctx.Trigger.Job, ctx.TemplateContext())
+}
+
+func (kind jobActionKind) Run(ctx *ActionContext) (piazza.Ident, error) {
+	jobString, err := kind.Render(ctx)
+	if err != nil {
+		return "", err
+	}
+	jobID := ctx.Service.newIdent()
+	ctx.Service.syslogger.Info("job [%s] submission by event [%s] using trigger [%s]: %s\n", jobID, ctx.Event.EventID, ctx.Trigger.TriggerID, jobString)
+	dispatch := &Dispatch{
+		JobID:     jobID,
+		TriggerID: ctx.Trigger.TriggerID,
+		EventID:   ctx.Event.EventID,
+		Job:       jobString,
+		CreatedBy: ctx.Trigger.CreatedBy,
+	}
+	if err = ctx.Service.dispatcher.Enqueue(dispatch); err != nil {
+		return "", err
+	}
+	return jobID, nil
+}
+
+//------------------------------------------------------------------------------
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// webhookActionKind sends an HTTP request.
+type webhookActionKind struct{}
+
+func (webhookActionKind) Validate(service *Service, trigger *Trigger, eventType *EventType) error {
+	webhook := trigger.Action.Webhook
+	if webhook == nil {
+		return errors.New("A webhook action needs action.webhook")
+	}
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("A webhook action needs an http or https url, not [%s]", webhook.URL)
+	}
+	switch strings.ToUpper(webhook.Method) {
+	case "", "POST", "PUT":
+	default:
+		return fmt.Errorf("A webhook action's method must be POST or PUT, not %s", webhook.Method)
+	}
+	return validateActionTemplate(webhook.Body, service, eventType)
+}
+
+func (webhookActionKind) Render(ctx *ActionContext) (string, error) {
+	return renderActionBody(ctx.Trigger.Action.Webhook.Body, ctx)
+}
+
+func (kind webhookActionKind) Run(ctx *ActionContext) (piazza.Ident, error) {
+	webhook := ctx.Trigger.Action.Webhook
+	body, err := kind.Render(ctx)
+	if err != nil {
+		return "", err
+	}
+	method := strings.ToUpper(webhook.Method)
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, webhook.URL, bytes.NewBufferString(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range webhook.Headers {
+		req.Header.Set(k, v)
+	}
+	ctx.Service.syslogger.Audit(ctx.Trigger.CreatedBy, "callingWebhook", webhook.URL, "Event [%s] firing trigger [%s] is calling webhook", ctx.Event.EventID, ctx.Trigger.TriggerID)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return "", LoggedError("Webhook %s failed: %s", webhook.URL, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", LoggedError("Webhook %s failed: %s", webhook.URL, resp.Status)
+	}
+	return "", nil
+}
+
+//------------------------------------------------------------------------------
+
+// amqpActionKind publishes a message to an exchange of the Piazza RabbitMQ.
+type amqpActionKind struct{}
+
+func (amqpActionKind) Validate(service *Service, trigger *Trigger, eventType *EventType) error {
+	amqpAction := trigger.Action.AMQP
+	if amqpAction == nil {
+		return errors.New("An amqp action needs action.amqp")
+	}
+	if amqpAction.Exchange == "" {
+		return errors.New("An amqp action needs action.amqp.exchange")
+	}
+	return validateActionTemplate(amqpAction.Body, service, eventType)
+}
+
+func (amqpActionKind) Render(ctx *ActionContext) (string, error) {
+	return renderActionBody(ctx.Trigger.Action.AMQP.Body, ctx)
+}
+
+func (kind amqpActionKind) Run(ctx *ActionContext) (piazza.Ident, error) {
+	amqpAction := ctx.Trigger.Action.AMQP
+	body, err := kind.Render(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "", ctx.Service.publishToRabbitMQ(amqpAction.Exchange, amqpAction.RoutingKey, false, body, ctx.Trigger.CreatedBy)
+}
+
+//------------------------------------------------------------------------------
+
+// eventActionKind posts a new event, which may fire other triggers in turn.
+type eventActionKind struct{}
+
+func (eventActionKind) Validate(service *Service, trigger *Trigger, eventType *EventType) error {
+	eventAction := trigger.Action.Event
+	if eventAction == nil {
+		return errors.New("An event action needs action.event")
+	}
+	if eventAction.EventTypeID == "" {
+		return errors.New("An event action needs action.event.eventTypeId")
+	}
+	if _, found, err := service.eventTypeDB.GetOne(eventAction.EventTypeID, "pz-workflow"); err != nil || !found {
+		return fmt.Errorf("An event action's eventType %s could not be found", eventAction.EventTypeID)
+	}
+	return validateActionTemplate(eventAction.Data, service, eventType)
+}
+
+func (eventActionKind) render(ctx *ActionContext) (map[string]interface{}, error) {
+	rendered, err := renderTemplate(ctx.Trigger.Action.Event.Data, ctx.TemplateContext())
+	if err != nil {
+		return nil, err
+	}
+	data, _ := rendered.(map[string]interface{})
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	return data, nil
+}
+
+func (kind eventActionKind) Render(ctx *ActionContext) (string, error) {
+	data, err := kind.render(ctx)
+	if err != nil {
+		return "", err
+	}
+	byts, err := json.Marshal(&Event{EventTypeID: ctx.Trigger.Action.Event.EventTypeID, Data: data})
+	return string(byts), err
+}
+
+func (kind eventActionKind) Run(ctx *ActionContext) (piazza.Ident, error) {
+	if ctx.Depth >= maxEventChainDepth {
+		return "", LoggedError("Event action of trigger %s not run: more than %d events in a row were emitted by triggers", ctx.Trigger.TriggerID, maxEventChainDepth)
+	}
+	data, err := kind.render(ctx)
+	if err != nil {
+		return "", err
+	}
+	event := &Event{
+		EventTypeID: ctx.Trigger.Action.Event.EventTypeID,
+		Data:        data,
+		CreatedBy:   ctx.Trigger.CreatedBy,
+	}
+	if resp := ctx.Service.postEvent(event, ctx.Depth+1, false); resp.IsError() {
+		return "", fmt.Errorf("Event action of trigger %s failed: %s", ctx.Trigger.TriggerID, resp.Message)
+	}
+	return "", nil
+}
@@ -36,18 +36,42 @@ func NewAlertDB(service *Service, esi elasticsearch.IIndex) (*AlertDB, error) {
 	return &ardb, nil
 }
 
+// Mapping returns the type the Alerts are kept under.
+func (db *AlertDB) Mapping() string {
+	return db.mapping
+}
+
 func (db *AlertDB) PostData(alert *Alert) error {
-	indexResult, err := db.Esi.PostData(db.mapping, alert.AlertID.String(), alert)
+	stored := *alert
+	stored.Version = 0
+	indexResult, err := db.Esi.PostData(db.mapping, alert.AlertID.String(), &stored)
 	if err != nil {
 		return LoggedError("AlertDB.PostData failed: %s", err)
 	}
 	if !indexResult.Created {
 		return LoggedError("AlertDB.PostData failed: not created")
 	}
+	alert.Version = int64(indexResult.Version)
 
 	return nil
 }
 
+// PutData replaces an Alert, if it is still at the version, or in any case
+// if the version is 0
+func (db *AlertDB) PutData(alert *Alert, version int64) error {
+	stored := *alert
+	stored.Version = 0
+	newVersion, err := db.putVersioned(db.mapping, alert.AlertID, &stored, version)
+	if err == ErrVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("AlertDB.PutData failed: %s", err)
+	}
+	alert.Version = newVersion
+	return nil
+}
+
 func (db *AlertDB) GetAll(format *piazza.JsonPagination, actor string) ([]Alert, int64, error) {
 	alerts := []Alert{}
 
@@ -126,7 +150,7 @@ func (db *AlertDB) GetAllByTrigger(format *piazza.JsonPagination, triggerID piaz
 	// This will be an Elasticsearch term query of roughly the following structure:
 	// { "term": { "_id": triggerId } }
 	// This matches the '_id' field of the Elasticsearch document exactly
-	searchResult, err := db.Esi.FilterByTermQuery(db.mapping, "triggerId", triggerID, format)
+	searchResult, err := db.Esi.FilterByTermQuery(db.mapping, "triggerId", triggerID.String(), format)
 	if err != nil {
 		return nil, 0, LoggedError("AlertDB.GetAllByTrigger failed: %s", err)
 	}
@@ -153,35 +177,26 @@ func (db *AlertDB) GetAllByTrigger(format *piazza.JsonPagination, triggerID piaz
 }
 
 func (db *AlertDB) GetOne(id piazza.Ident, actor string) (*Alert, bool, error) {
-	getResult, err := db.Esi.GetByID(db.mapping, id.String())
-	if err != nil {
-		return nil, false, fmt.Errorf("AlertDB.GetOne failed: %s", err)
-	}
-	if getResult == nil {
-		return nil, true, fmt.Errorf("AlertDB.GetOne failed: %s no getResult", id.String())
-	}
-
-	src := getResult.Source
 	var alert Alert
-	if err = json.Unmarshal(*src, &alert); err != nil {
-		return nil, getResult.Found, err
+	found, version, err := db.getVersioned(db.mapping, id, &alert)
+	if err != nil {
+		return nil, found, fmt.Errorf("AlertDB.GetOne failed: %s", err)
 	}
+	alert.Version = version
 
-	return &alert, getResult.Found, nil
+	return &alert, found, nil
 }
 
-func (db *AlertDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
-	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
-	if err != nil {
-		return deleteResult.Found, fmt.Errorf("AlertDB.DeleteById failed: %s", err)
-	}
-	if deleteResult == nil {
-		return false, fmt.Errorf("AlertDB.DeleteById failed: no deleteResult")
+// DeleteByID deletes an alert, if it is still at the version, or in any case
+// if the version is 0.
+func (db *AlertDB) DeleteByID(id piazza.Ident, version int64, actor string) (bool, error) {
+	found, err := db.deleteVersioned(db.mapping, id, version)
+	if err == ErrVersionConflict {
+		return false, err
 	}
-
-	if !deleteResult.Found {
-		return false, fmt.Errorf("AlertDB.DeleteById failed: not found")
+	if err != nil {
+		return found, fmt.Errorf("AlertDB.DeleteById failed: %s", err)
 	}
 
-	return deleteResult.Found, nil
+	return found, nil
 }
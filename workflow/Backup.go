@@ -0,0 +1,407 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// BackupVersion is the version of the archives this service writes. It goes
+// up when the archive changes in a way an older service can't read.
+const BackupVersion = 1
+
+// Backup is an archive of the workflow resources. The EventType mappings,
+// the Event data and the CronJob data are as they are posted, without the
+// EventType name around them, and the Trigger conditions are as they are
+// posted, with "data." paths.
+type Backup struct {
+	Version    int              `json:"version"`
+	CreatedOn  piazza.TimeStamp `json:"createdOn"`
+	EventTypes []EventType      `json:"eventTypes"`
+	Triggers   []Trigger        `json:"triggers"`
+	Crons      []CronJob        `json:"crons"`
+	Events     []Event          `json:"events,omitempty"`
+	Alerts     []Alert          `json:"alerts,omitempty"`
+}
+
+// RestoreReport tells what a restore made. IDs maps the IDs in the archive
+// to the ones they were restored under, where they differ, and Errors lists
+// the resources that couldn't be restored.
+type RestoreReport struct {
+	EventTypes int                           `json:"eventTypes"`
+	Triggers   int                           `json:"triggers"`
+	Crons      int                           `json:"crons"`
+	Events     int                           `json:"events"`
+	Alerts     int                           `json:"alerts"`
+	IDs        map[piazza.Ident]piazza.Ident `json:"ids"`
+	Errors     []string                      `json:"errors"`
+}
+
+//---------------------------------------------------------------------------
+
+// ExportBackup archives the EventTypes, Triggers and repeating events, and,
+// if asked, the Events and Alerts.
+func (service *Service) ExportBackup(withEvents bool, withAlerts bool) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit("pz-workflow", "exportingBackup", "", "Service.ExportBackup: User is exporting a backup")
+
+	backup, err := service.exportBackup(withEvents, withAlerts)
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "exportingBackupFailure", "", "Service.ExportBackup: User failed to export a backup")
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "exportedBackup", "", "Service.ExportBackup: User exported %d eventTypes, %d triggers and %d crons", len(backup.EventTypes), len(backup.Triggers), len(backup.Crons))
+	return service.statusOK(backup)
+}
+
+func (service *Service) exportBackup(withEvents bool, withAlerts bool) (*Backup, error) {
+	backup := &Backup{
+		Version:    BackupVersion,
+		CreatedOn:  piazza.NewTimeStamp(),
+		EventTypes: []EventType{},
+		Triggers:   []Trigger{},
+		Crons:      []CronJob{},
+	}
+	names := map[piazza.Ident]string{}
+
+	const perPage = 100
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "eventTypeId", Order: piazza.SortOrderAscending}
+		eventTypes, _, err := service.eventTypeDB.GetAll(format, "pz-workflow")
+		if err != nil {
+			return nil, LoggedError("Service.ExportBackup: Unable to get the eventTypes: %s", err)
+		}
+		for _, eventType := range eventTypes {
+			eventType.Mapping = service.removeUniqueParams(eventType.Name, eventType.Mapping)
+			names[eventType.EventTypeID] = eventType.Name
+			backup.EventTypes = append(backup.EventTypes, eventType)
+		}
+		if len(eventTypes) < perPage {
+			break
+		}
+	}
+
+	// the TriggerDB gives the conditions back as they were posted
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "triggerId", Order: piazza.SortOrderAscending}
+		triggers, _, err := service.triggerDB.GetAll(format, "pz-workflow")
+		if err != nil {
+			return nil, LoggedError("Service.ExportBackup: Unable to get the triggers: %s", err)
+		}
+		backup.Triggers = append(backup.Triggers, triggers...)
+		if len(triggers) < perPage {
+			break
+		}
+	}
+
+	if ok, err := service.cronDB.Exists("pz-workflow"); err != nil {
+		return nil, LoggedError("Service.ExportBackup: Unable to get the crons: %s", err)
+	} else if ok {
+		for page := 0; ; page++ {
+			format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "eventId", Order: piazza.SortOrderAscending}
+			jobs, _, err := service.cronDB.GetAll(format, "pz-workflow")
+			if err != nil {
+				return nil, LoggedError("Service.ExportBackup: Unable to get the crons: %s", err)
+			}
+			for _, job := range jobs {
+				job.Data = service.removeUniqueParams(names[job.EventTypeID], job.Data)
+				backup.Crons = append(backup.Crons, job)
+			}
+			if len(jobs) < perPage {
+				break
+			}
+		}
+	}
+
+	if withEvents {
+		backup.Events = []Event{}
+		for page := 0; ; page++ {
+			format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "eventId", Order: piazza.SortOrderAscending}
+			events, _, err := service.eventDB.GetAll("", format, "pz-workflow")
+			if err != nil {
+				return nil, LoggedError("Service.ExportBackup: Unable to get the events: %s", err)
+			}
+			for _, event := range events {
+				// the percolation queries are in the same index
+				name, ok := names[event.EventTypeID]
+				if event.EventID == "" || !ok {
+					continue
+				}
+				event.Data = service.removeUniqueParams(name, event.Data)
+				backup.Events = append(backup.Events, event)
+			}
+			if len(events) < perPage {
+				break
+			}
+		}
+	}
+
+	if withAlerts {
+		backup.Alerts = []Alert{}
+		for page := 0; ; page++ {
+			format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "alertId", Order: piazza.SortOrderAscending}
+			alerts, _, err := service.alertDB.GetAll(format, "pz-workflow")
+			if err != nil {
+				return nil, LoggedError("Service.ExportBackup: Unable to get the alerts: %s", err)
+			}
+			backup.Alerts = append(backup.Alerts, alerts...)
+			if len(alerts) < perPage {
+				break
+			}
+		}
+	}
+
+	return backup, nil
+}
+
+//---------------------------------------------------------------------------
+
+// ImportBackup restores an archive. The resources are given new IDs, unless
+// preserveIDs is set, and the references between them are remapped to
+// match. An EventType whose name is already taken, such as one of the system
+// EventTypes, is not restored; the resources of the archive that refer to it
+// are given the existing one. Each EventType's mapping is added to the
+// EventDB and each Trigger's percolation query registered again, as when
+// they are posted. A resource that can't be restored is listed in the
+// report, and the rest carry on.
+func (service *Service) ImportBackup(backup *Backup, preserveIDs bool) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if backup.Version < 1 || backup.Version > BackupVersion {
+		return service.statusBadRequest(LoggedError("Backup version %d is not supported, only up to %d", backup.Version, BackupVersion))
+	}
+
+	service.syslogger.Audit("pz-workflow", "importingBackup", "", "Service.ImportBackup: User is importing a backup from %s", backup.CreatedOn.String())
+
+	restore := &backupRestore{
+		service:     service,
+		preserveIDs: preserveIDs,
+		ids:         map[piazza.Ident]piazza.Ident{},
+		names:       map[piazza.Ident]string{},
+		report:      &RestoreReport{IDs: map[piazza.Ident]piazza.Ident{}, Errors: []string{}},
+	}
+	restore.eventTypes(backup.EventTypes)
+	restore.triggers(backup.Triggers)
+	restore.crons(backup.Crons)
+	restore.events(backup.Events, backup.Crons)
+	restore.alerts(backup.Alerts)
+
+	for from, to := range restore.ids {
+		if from != to {
+			restore.report.IDs[from] = to
+		}
+	}
+
+	service.syslogger.Audit("pz-workflow", "importedBackup", "", "Service.ImportBackup: User imported %d eventTypes, %d triggers and %d crons, with %d errors", restore.report.EventTypes, restore.report.Triggers, restore.report.Crons, len(restore.report.Errors))
+	return service.statusOK(restore.report)
+}
+
+// backupRestore is the state of one ImportBackup.
+type backupRestore struct {
+	service     *Service
+	preserveIDs bool
+	// ids maps the IDs in the archive to the ones restored, or matched
+	ids map[piazza.Ident]piazza.Ident
+	// names maps the restored EventType IDs to their names
+	names  map[piazza.Ident]string
+	report *RestoreReport
+}
+
+func (restore *backupRestore) newID(id piazza.Ident) piazza.Ident {
+	if restore.preserveIDs {
+		return id
+	}
+	return restore.service.newIdent()
+}
+
+func (restore *backupRestore) fail(kind string, id piazza.Ident, format string, args ...interface{}) {
+	restore.report.Errors = append(restore.report.Errors, fmt.Sprintf("%s %s: %s", kind, id, fmt.Sprintf(format, args...)))
+}
+
+// eventType returns the restored ID and name of an EventType of the archive.
+func (restore *backupRestore) eventType(id piazza.Ident) (piazza.Ident, string, bool) {
+	to, ok := restore.ids[id]
+	if !ok {
+		return "", "", false
+	}
+	return to, restore.names[to], true
+}
+
+func (restore *backupRestore) eventTypes(eventTypes []EventType) {
+	service := restore.service
+	for i := range eventTypes {
+		eventType := eventTypes[i]
+		from := eventType.EventTypeID
+
+		existing, found, err := service.eventTypeDB.GetIDByName(nil, eventType.Name, "pz-workflow")
+		if err != nil {
+			restore.fail("eventType", from, "%s", err)
+			continue
+		}
+		if found {
+			restore.ids[from] = *existing
+			restore.names[*existing] = eventType.Name
+			continue
+		}
+
+		eventType.EventTypeID = restore.newID(from)
+		if resp := service.createEventType(&eventType); resp.IsError() {
+			restore.fail("eventType", from, "%s", resp.Message)
+			continue
+		}
+		restore.ids[from] = eventType.EventTypeID
+		restore.names[eventType.EventTypeID] = eventType.Name
+		restore.report.EventTypes++
+	}
+}
+
+func (restore *backupRestore) triggers(triggers []Trigger) {
+	service := restore.service
+	for i := range triggers {
+		trigger := triggers[i]
+		from := trigger.TriggerID
+
+		var ok bool
+		if trigger.EventTypeID, _, ok = restore.eventType(trigger.EventTypeID); !ok {
+			restore.fail("trigger", from, "eventType %s was not restored", triggers[i].EventTypeID)
+			continue
+		}
+		if trigger.Action != nil && trigger.Action.Event != nil {
+			action, event := *trigger.Action, *trigger.Action.Event
+			if event.EventTypeID, _, ok = restore.eventType(event.EventTypeID); !ok {
+				restore.fail("trigger", from, "eventType %s was not restored", trigger.Action.Event.EventTypeID)
+				continue
+			}
+			action.Event = &event
+			trigger.Action = &action
+		}
+
+		trigger.TriggerID = restore.newID(from)
+		// the query of a trigger that is already there would be replaced
+		if _, found, _ := service.triggerDB.GetOne(trigger.TriggerID, "pz-workflow"); found {
+			restore.fail("trigger", from, "already exists")
+			continue
+		}
+		if resp := service.createTrigger(&trigger); resp.IsError() {
+			restore.fail("trigger", from, "%s", resp.Message)
+			continue
+		}
+		restore.ids[from] = trigger.TriggerID
+		restore.report.Triggers++
+	}
+}
+
+func (restore *backupRestore) crons(jobs []CronJob) {
+	service := restore.service
+	for i := range jobs {
+		job := jobs[i]
+		from := job.EventID
+
+		eventTypeID, name, ok := restore.eventType(job.EventTypeID)
+		if !ok {
+			restore.fail("cron", from, "eventType %s was not restored", job.EventTypeID)
+			continue
+		}
+		job.EventTypeID = eventTypeID
+		if err := validateCronTemplate(job.Data); err != nil {
+			restore.fail("cron", from, "%s", err)
+			continue
+		}
+
+		job.EventID = restore.newID(from)
+		if found, _ := service.cronDB.itemExists(job.EventID, "pz-workflow"); found {
+			restore.fail("cron", from, "already exists")
+			continue
+		}
+		job.Data = service.addUniqueParams(name, job.Data)
+		seedData, err := service.renderCronSeedData(&job, name)
+		if err != nil {
+			restore.fail("cron", from, "%s", err)
+			continue
+		}
+		seed := job.Event
+		seed.Data = seedData
+
+		if err = service.storeCronJob(&job, &seed, name); err != nil {
+			restore.fail("cron", from, "%s", err)
+			continue
+		}
+		restore.ids[from] = job.EventID
+		restore.report.Crons++
+	}
+}
+
+func (restore *backupRestore) events(events []Event, jobs []CronJob) {
+	service := restore.service
+	// the seed events were restored with their crons
+	seeds := map[piazza.Ident]bool{}
+	for _, job := range jobs {
+		seeds[job.EventID] = true
+	}
+
+	for i := range events {
+		event := events[i]
+		from := event.EventID
+		if seeds[from] {
+			continue
+		}
+
+		eventTypeID, name, ok := restore.eventType(event.EventTypeID)
+		if !ok {
+			restore.fail("event", from, "eventType %s was not restored", event.EventTypeID)
+			continue
+		}
+		event.EventTypeID = eventTypeID
+		// the events a cron fired are created by it
+		if to, ok := restore.ids[piazza.Ident(event.CreatedBy)]; ok {
+			event.CreatedBy = to.String()
+		}
+
+		event.EventID = restore.newID(from)
+		event.Data = service.addUniqueParams(name, event.Data)
+		if err := service.eventDB.PostData(&event, name); err != nil {
+			restore.fail("event", from, "%s", err)
+			continue
+		}
+		restore.ids[from] = event.EventID
+		restore.report.Events++
+	}
+}
+
+func (restore *backupRestore) alerts(alerts []Alert) {
+	service := restore.service
+	for i := range alerts {
+		alert := alerts[i]
+		from := alert.AlertID
+
+		// an alert of a trigger or event that is gone keeps its IDs
+		if to, ok := restore.ids[alert.TriggerID]; ok {
+			alert.TriggerID = to
+		}
+		if to, ok := restore.ids[alert.EventID]; ok {
+			alert.EventID = to
+		}
+
+		alert.AlertID = restore.newID(from)
+		if err := service.alertDB.PostData(&alert); err != nil {
+			restore.fail("alert", from, "%s", err)
+			continue
+		}
+		restore.ids[from] = alert.AlertID
+		restore.report.Alerts++
+	}
+}
@@ -15,7 +15,9 @@
 package workflow
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 
 	"fmt"
@@ -140,6 +142,40 @@ func (c *Client) deleteObject(endpoint string) error {
 	return nil
 }
 
+// ifMatchObject makes a PUT or DELETE that is done only if the resource is
+// still at the version; if it isn't, the error is a 412.
+func (c *Client) ifMatchObject(verb string, obj interface{}, endpoint string, version int64, out interface{}) error {
+	var body io.Reader
+	if obj != nil {
+		byts, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(byts)
+	}
+	headers := piazza.NewHeaderBuilder().AddJsonContentType().AddHeader("If-Match", formatETag(version))
+	if c.h.ApiKey != "" {
+		headers.AddBasicAuth(c.h.ApiKey, "")
+	}
+
+	code, byts, _, err := piazza.HTTP(verb, c.url+endpoint, headers.GetHeader(), body)
+	if err != nil {
+		return err
+	}
+	resp := &piazza.JsonResponse{}
+	if err = json.Unmarshal(byts, resp); err != nil {
+		return err
+	}
+	resp.StatusCode = code
+	if resp.StatusCode != http.StatusOK {
+		return resp.ToError()
+	}
+	if out == nil {
+		return nil
+	}
+	return resp.ExtractData(out)
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetVersion() (*piazza.Version, error) {
@@ -186,17 +222,58 @@ func (c *Client) QueryEventTypes(query map[string]interface{}) (*[]EventType, er
 	return out, err
 }
 
+// PutEventType adds the fields of the eventType's mapping that it doesn't
+// have yet.
 func (c *Client) PutEventType(eventType *EventType) (*EventType, error) {
 	out := &EventType{}
 	err := c.putObject(eventType, "/eventType", out)
 	return out, err
 }
 
+// PutEventTypeIfMatch is PutEventType, done only if the eventType is still at
+// the version.
+func (c *Client) PutEventTypeIfMatch(eventType *EventType, version int64) (*EventType, error) {
+	out := &EventType{}
+	err := c.ifMatchObject("PUT", eventType, "/eventType", version, out)
+	return out, err
+}
+
 func (c *Client) DeleteEventType(id piazza.Ident) error {
 	err := c.deleteObject("/eventType/" + id.String())
 	return err
 }
 
+// DeleteEventTypeIfMatch deletes the eventType if it is still at the version.
+func (c *Client) DeleteEventTypeIfMatch(id piazza.Ident, version int64) error {
+	return c.ifMatchObject("DELETE", nil, "/eventType/"+id.String(), version, nil)
+}
+
+// GetEventTypeDependencies lists what refers to the EventType.
+func (c *Client) GetEventTypeDependencies(id piazza.Ident) (*EventTypeDependencies, error) {
+	out := &EventTypeDependencies{}
+	err := c.getObject("/eventType/"+id.String()+"/dependencies", out)
+	return out, err
+}
+
+// DeleteEventTypeCascade deletes the EventType and everything that refers
+// to it, and returns what was deleted.
+func (c *Client) DeleteEventTypeCascade(id piazza.Ident) (*EventTypeDependencies, error) {
+	resp := c.h.PzDelete("/eventType/" + id.String() + "?cascade=true")
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	out := &EventTypeDependencies{}
+	err := resp.ExtractData(out)
+	return out, err
+}
+
+// RestoreEventType takes a deleted EventType out of the trash.
+func (c *Client) RestoreEventType(id piazza.Ident) (*EventType, error) {
+	out := &EventType{}
+	err := c.postObject(nil, "/eventType/"+id.String()+"/restore", out)
+	return out, err
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetEvent(id piazza.Ident) (*Event, error) {
@@ -228,12 +305,34 @@ func (c *Client) PostEvent(event *Event) (*Event, error) {
 	return out, err
 }
 
+// PostEventAsync posts the event without waiting for its triggers to run;
+// GetEventResults tells what they did.
+func (c *Client) PostEventAsync(event *Event) (*Event, error) {
+	resp := c.h.PzPost("/event?async=true", event)
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, resp.ToError()
+	}
+	out := &Event{}
+	err := resp.ExtractData(out)
+	return out, err
+}
+
+func (c *Client) GetEventResults(id piazza.Ident) (*EventResults, error) {
+	out := &EventResults{}
+	err := c.getObject("/event/"+id.String()+"/results", out)
+	return out, err
+}
+
 func (c *Client) QueryEvents(query map[string]interface{}) (*[]Event, error) {
 	out := &[]Event{}
 	err := c.postObject(query, "/event/query", out)
 	return out, err
 }
 
+// PutEvent corrects the data of the event.
 func (c *Client) PutEvent(event *Event) (*Event, error) {
 	out := &Event{}
 	err := c.putObject(event, "/event", out)
@@ -283,11 +382,56 @@ func (c *Client) PutTrigger(id piazza.Ident, triggerUpdate *TriggerUpdate) error
 	return err
 }
 
+func (c *Client) TestTrigger(test *TriggerTest) (*[]TriggerTestResult, error) {
+	out := &[]TriggerTestResult{}
+	err := c.postObject(test, "/trigger/test", out)
+	return out, err
+}
+
+// UpdateTrigger replaces the trigger's name, eventTypeId, condition, job and
+// enabled fields, keeping its id.
+func (c *Client) UpdateTrigger(id piazza.Ident, trigger *Trigger) (*Trigger, error) {
+	out := &Trigger{}
+	err := c.putObject(trigger, "/trigger/"+id.String(), out)
+	return out, err
+}
+
+// UpdateTriggerIfMatch is UpdateTrigger, done only if the trigger is still at
+// the version.
+func (c *Client) UpdateTriggerIfMatch(id piazza.Ident, trigger *Trigger, version int64) (*Trigger, error) {
+	out := &Trigger{}
+	err := c.ifMatchObject("PUT", trigger, "/trigger/"+id.String(), version, out)
+	return out, err
+}
+
 func (c *Client) DeleteTrigger(id piazza.Ident) error {
 	err := c.deleteObject("/trigger/" + id.String())
 	return err
 }
 
+// DeleteTriggerIfMatch deletes the trigger if it is still at the version.
+func (c *Client) DeleteTriggerIfMatch(id piazza.Ident, version int64) error {
+	return c.ifMatchObject("DELETE", nil, "/trigger/"+id.String(), version, nil)
+}
+
+// RestoreTrigger takes a deleted trigger out of the trash.
+func (c *Client) RestoreTrigger(id piazza.Ident) (*Trigger, error) {
+	out := &Trigger{}
+	err := c.postObject(nil, "/trigger/"+id.String()+"/restore", out)
+	return out, err
+}
+
+//------------------------------------------------------------------------------
+
+// GetTrash lists the deleted triggers and eventTypes, or those of one kind
+// if it is given.
+func (c *Client) GetTrash(kind string, perPage int, page int) (*[]TrashItem, error) {
+	out := &[]TrashItem{}
+	path := fmt.Sprintf("/trash?kind=%s&perPage=%d&page=%d", kind, perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetAlert(id piazza.Ident) (*Alert, error) {
@@ -326,9 +470,18 @@ func (c *Client) QueryAlerts(query map[string]interface{}) (*[]Alert, error) {
 	return out, err
 }
 
-func (c *Client) PutAlert(alert *Alert) (*Alert, error) {
+// PutAlert changes the status or the annotation of the alert.
+func (c *Client) PutAlert(update *AlertUpdate) (*Alert, error) {
 	out := &Alert{}
-	err := c.putObject(alert, "/alert", out)
+	err := c.putObject(update, "/alert", out)
+	return out, err
+}
+
+// PutAlertIfMatch is PutAlert, done only if the alert is still at the
+// version.
+func (c *Client) PutAlertIfMatch(update *AlertUpdate, version int64) (*Alert, error) {
+	out := &Alert{}
+	err := c.ifMatchObject("PUT", update, "/alert", version, out)
 	return out, err
 }
 
@@ -336,6 +489,68 @@ func (c *Client) DeleteAlert(id piazza.Ident) error {
 	return c.deleteObject("/alert/" + id.String())
 }
 
+// DeleteAlertIfMatch deletes the alert if it is still at the version.
+func (c *Client) DeleteAlertIfMatch(id piazza.Ident, version int64) error {
+	return c.ifMatchObject("DELETE", nil, "/alert/"+id.String(), version, nil)
+}
+
+//------------------------------------------------------------------------------
+
+func (c *Client) GetAllCronJobs(perPage int, page int) (*[]CronJobInfo, error) {
+	out := &[]CronJobInfo{}
+	path := fmt.Sprintf("/cron?perPage=%d&page=%d", perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+func (c *Client) GetCronJob(id piazza.Ident) (*CronJobInfo, error) {
+	out := &CronJobInfo{}
+	err := c.getObject("/cron/"+id.String(), out)
+	return out, err
+}
+
+// GetCronJobEvents lists the events a repeating event has fired.
+func (c *Client) GetCronJobEvents(id piazza.Ident, perPage int, page int) (*[]Event, error) {
+	out := &[]Event{}
+	path := fmt.Sprintf("/cron/%s/events?perPage=%d&page=%d", id, perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+// GetCronJobRuns lists the runs of a repeating event.
+func (c *Client) GetCronJobRuns(id piazza.Ident, perPage int, page int) (*[]CronRun, error) {
+	out := &[]CronRun{}
+	path := fmt.Sprintf("/cron/%s/runs?perPage=%d&page=%d", id, perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+func (c *Client) PutCronJob(id piazza.Ident, update *CronUpdate) (*CronJobInfo, error) {
+	out := &CronJobInfo{}
+	err := c.putObject(update, "/cron/"+id.String(), out)
+	return out, err
+}
+
+// PutCronJobIfMatch is PutCronJob, done only if the repeating event is still
+// at the version.
+func (c *Client) PutCronJobIfMatch(id piazza.Ident, update *CronUpdate, version int64) (*CronJobInfo, error) {
+	out := &CronJobInfo{}
+	err := c.ifMatchObject("PUT", update, "/cron/"+id.String(), version, out)
+	return out, err
+}
+
+func (c *Client) PauseCronJob(id piazza.Ident) (*CronJobInfo, error) {
+	out := &CronJobInfo{}
+	err := c.postObject(nil, "/cron/"+id.String()+"/pause", out)
+	return out, err
+}
+
+func (c *Client) ResumeCronJob(id piazza.Ident) (*CronJobInfo, error) {
+	out := &CronJobInfo{}
+	err := c.postObject(nil, "/cron/"+id.String()+"/resume", out)
+	return out, err
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) TestElasticsearchGetVersion() (*string, error) {
@@ -365,3 +580,41 @@ func (c *Client) GetStats() (*Stats, error) {
 	return out, err
 
 }
+
+// GetAllDispatches lists the jobs in the outbox with the given status, or all
+// of them if the status is empty.
+func (c *Client) GetAllDispatches(status string, perPage int, page int) (*[]Dispatch, error) {
+	out := &[]Dispatch{}
+	path := fmt.Sprintf("/admin/dispatch?status=%s&perPage=%d&page=%d", status, perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+func (c *Client) GetDispatch(id piazza.Ident) (*Dispatch, error) {
+	out := &Dispatch{}
+	err := c.getObject("/admin/dispatch/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) ReplayDispatch(id piazza.Ident) (*Dispatch, error) {
+	out := &Dispatch{}
+	err := c.postObject(nil, "/admin/dispatch/"+id.String()+"/replay", out)
+	return out, err
+}
+
+// Backup archives the workflow resources, with the events and the alerts
+// if asked.
+func (c *Client) Backup(events bool, alerts bool) (*Backup, error) {
+	out := &Backup{}
+	path := fmt.Sprintf("/admin/backup?events=%t&alerts=%t", events, alerts)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+// Restore restores an archive, keeping its IDs if preserveIDs is set.
+func (c *Client) Restore(backup *Backup, preserveIDs bool) (*RestoreReport, error) {
+	out := &RestoreReport{}
+	path := fmt.Sprintf("/admin/restore?preserveIds=%t", preserveIDs)
+	err := c.postObject(backup, path, out)
+	return out, err
+}
@@ -0,0 +1,972 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file is an in-process evaluator for the part of the Elasticsearch
+// query DSL that trigger conditions use: bool (must, filter, should,
+// must_not), term, terms, match, range, exists, geo_distance and match_all.
+// It follows the Elasticsearch 2.x rules for each query, including the
+// standard analyzer for string fields, so that a condition evaluated here
+// matches the same events it would match as a percolation query.
+
+// conditionNode is one compiled query clause.
+type conditionNode interface {
+	matches(doc *conditionDoc) bool
+}
+
+// conditionDoc is a document, for a condition an event's {"data": {...}},
+// along with a lookup of its field types.
+type conditionDoc struct {
+	source map[string]interface{}
+	types  func(path string) string
+}
+
+func newConditionDoc(data map[string]interface{}, mapping map[string]interface{}) *conditionDoc {
+	return &conditionDoc{
+		source: map[string]interface{}{"data": data},
+		types:  func(path string) string { return eventFieldType(mapping, path) },
+	}
+}
+
+// values returns all non-null values found at the dotted path, flattening
+// arrays the way Elasticsearch does when indexing.
+func (doc *conditionDoc) values(path string) []interface{} {
+	return collectValues(doc.source, strings.Split(path, "."))
+}
+
+func collectValues(node interface{}, path []string) []interface{} {
+	switch t := node.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		out := []interface{}{}
+		for _, v := range t {
+			out = append(out, collectValues(v, path)...)
+		}
+		return out
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return nil
+		}
+		return collectValues(t[path[0]], path[1:])
+	default:
+		if len(path) != 0 {
+			return nil
+		}
+		return []interface{}{t}
+	}
+}
+
+// fieldType returns the mapping type of a path, or "" if it isn't mapped.
+func (doc *conditionDoc) fieldType(path string) string {
+	return doc.types(path)
+}
+
+// eventFieldType returns the EventType mapping type of a "data." path, or ""
+// if the path isn't in the mapping.
+func eventFieldType(mapping map[string]interface{}, path string) string {
+	if !strings.HasPrefix(path, "data.") {
+		return ""
+	}
+	var node interface{} = mapping
+	for _, part := range strings.Split(strings.TrimPrefix(path, "data."), ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		node = m[part]
+	}
+	typ, ok := node.(string)
+	if !ok {
+		return ""
+	}
+	return strings.Trim(typ, "[]")
+}
+
+//------------------------------------------------------------------------------
+
+// compileCondition parses a trigger condition. A top level "query" wrapper,
+// as used when registering a percolator, is accepted.
+func compileCondition(condition map[string]interface{}) (conditionNode, error) {
+	if query, ok := condition["query"]; ok && len(condition) == 1 {
+		q, ok := query.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Condition: query must be an object")
+		}
+		return compileClause(q)
+	}
+	return compileClause(condition)
+}
+
+func compileClause(clause map[string]interface{}) (conditionNode, error) {
+	if len(clause) != 1 {
+		return nil, fmt.Errorf("Condition: query clause must have exactly one key, found %d", len(clause))
+	}
+	for name, body := range clause {
+		obj, ok := body.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Condition: [%s] query must be an object", name)
+		}
+		switch name {
+		case "bool":
+			return compileBool(obj)
+		case "term":
+			return compileTerm(obj)
+		case "terms":
+			return compileTerms(obj)
+		case "match":
+			return compileMatch(obj)
+		case "range":
+			return compileRange(obj)
+		case "exists":
+			return compileExists(obj)
+		case "geo_distance":
+			return compileGeoDistance(obj)
+		case "match_all":
+			return matchAllNode{}, nil
+		default:
+			return nil, fmt.Errorf("Condition: unsupported query type [%s]", name)
+		}
+	}
+	return nil, nil
+}
+
+// singleField returns the one field name in a query body, skipping the
+// given option keys.
+func singleField(name string, obj map[string]interface{}, options ...string) (string, interface{}, error) {
+	field := ""
+	var value interface{}
+	for k, v := range obj {
+		if contains(options, k) {
+			continue
+		}
+		if field != "" {
+			return "", nil, fmt.Errorf("Condition: [%s] query may only name one field", name)
+		}
+		field, value = k, v
+	}
+	if field == "" {
+		return "", nil, fmt.Errorf("Condition: [%s] query must name a field", name)
+	}
+	return field, value, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
+
+type matchAllNode struct{}
+
+func (matchAllNode) matches(doc *conditionDoc) bool {
+	return true
+}
+
+//------------------------------------------------------------------------------
+
+type boolNode struct {
+	must               []conditionNode
+	should             []conditionNode
+	mustNot            []conditionNode
+	minimumShouldMatch int
+}
+
+func compileBool(obj map[string]interface{}) (conditionNode, error) {
+	node := &boolNode{}
+	var msm interface{}
+	for k, v := range obj {
+		var err error
+		switch k {
+		case "must", "filter":
+			var clauses []conditionNode
+			clauses, err = compileClauseList(v)
+			node.must = append(node.must, clauses...)
+		case "should":
+			node.should, err = compileClauseList(v)
+		case "must_not":
+			node.mustNot, err = compileClauseList(v)
+		case "minimum_should_match":
+			msm = v
+		case "boost", "disable_coord", "_name":
+		default:
+			err = fmt.Errorf("Condition: unsupported [bool] option [%s]", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// With no must or filter clauses, at least one should clause has to
+	// match; otherwise should clauses only affect scoring.
+	if len(node.must) == 0 && len(node.should) > 0 {
+		node.minimumShouldMatch = 1
+	}
+	if msm != nil {
+		n, err := parseMinimumShouldMatch(msm, len(node.should))
+		if err != nil {
+			return nil, err
+		}
+		node.minimumShouldMatch = n
+	}
+	return node, nil
+}
+
+func compileClauseList(v interface{}) ([]conditionNode, error) {
+	var list []interface{}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		list = []interface{}{t}
+	case []interface{}:
+		list = t
+	default:
+		return nil, fmt.Errorf("Condition: [bool] clauses must be an object or an array")
+	}
+	nodes := []conditionNode{}
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Condition: [bool] clauses must be objects")
+		}
+		node, err := compileClause(obj)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func parseMinimumShouldMatch(v interface{}, optional int) (int, error) {
+	s := strings.TrimSpace(fmt.Sprintf("%v", v))
+	var n int
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("Condition: bad minimum_should_match [%s]", s)
+		}
+		n = int(float64(optional) * math.Abs(pct) / 100)
+		if pct < 0 {
+			n = optional - n
+		}
+	} else {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Condition: bad minimum_should_match [%s]", s)
+		}
+		n = int(f)
+		if n < 0 {
+			n = optional + n
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, nil
+}
+
+func (node *boolNode) matches(doc *conditionDoc) bool {
+	for _, c := range node.must {
+		if !c.matches(doc) {
+			return false
+		}
+	}
+	for _, c := range node.mustNot {
+		if c.matches(doc) {
+			return false
+		}
+	}
+	if node.minimumShouldMatch > 0 {
+		count := 0
+		for _, c := range node.should {
+			if c.matches(doc) {
+				count++
+			}
+		}
+		if count < node.minimumShouldMatch {
+			return false
+		}
+	}
+	return true
+}
+
+//------------------------------------------------------------------------------
+
+type termNode struct {
+	field  string
+	values []interface{}
+}
+
+func compileTerm(obj map[string]interface{}) (conditionNode, error) {
+	field, value, err := singleField("term", obj, "boost", "_name")
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		if value, ok = m["value"]; !ok {
+			if value, ok = m["term"]; !ok {
+				return nil, fmt.Errorf("Condition: [term] query on [%s] has no value", field)
+			}
+		}
+	}
+	if err = checkScalar("term", value); err != nil {
+		return nil, err
+	}
+	return &termNode{field: field, values: []interface{}{value}}, nil
+}
+
+func compileTerms(obj map[string]interface{}) (conditionNode, error) {
+	field, value, err := singleField("terms", obj, "boost", "_name", "minimum_should_match", "disable_coord")
+	if err != nil {
+		return nil, err
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Condition: [terms] query on [%s] must be an array", field)
+	}
+	for _, v := range values {
+		if err = checkScalar("terms", v); err != nil {
+			return nil, err
+		}
+	}
+	return &termNode{field: field, values: values}, nil
+}
+
+func checkScalar(name string, v interface{}) error {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}, nil:
+		return fmt.Errorf("Condition: [%s] values must be strings, numbers or booleans", name)
+	}
+	return nil
+}
+
+func (node *termNode) matches(doc *conditionDoc) bool {
+	typ := doc.fieldType(node.field)
+	for _, docValue := range doc.values(node.field) {
+		for _, v := range node.values {
+			if termEquals(typ, docValue, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// termEquals compares a query term to one indexed value. Terms are not
+// analyzed, so against an analyzed string field a term only matches one of
+// the lowercased tokens.
+func termEquals(typ string, docValue interface{}, term interface{}) bool {
+	switch valueKind(typ, docValue) {
+	case kindNumber:
+		a, ok1 := toFloat(docValue)
+		b, ok2 := toFloat(term)
+		return ok1 && ok2 && a == b
+	case kindDate:
+		a, ok1 := toMillis(docValue)
+		b, ok2 := toMillis(term)
+		return ok1 && ok2 && a == b
+	case kindBool:
+		a, ok1 := toBool(docValue)
+		b, ok2 := toBool(term)
+		return ok1 && ok2 && a == b
+	case kindKeyword:
+		return fmt.Sprintf("%v", docValue) == fmt.Sprintf("%v", term)
+	case kindString:
+		t := fmt.Sprintf("%v", term)
+		for _, token := range analyze(fmt.Sprintf("%v", docValue)) {
+			if token == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
+
+type matchNode struct {
+	field       string
+	query       interface{}
+	operatorAnd bool
+}
+
+func compileMatch(obj map[string]interface{}) (conditionNode, error) {
+	field, value, err := singleField("match", obj)
+	if err != nil {
+		return nil, err
+	}
+	node := &matchNode{field: field, query: value}
+	if m, ok := value.(map[string]interface{}); ok {
+		if node.query, ok = m["query"]; !ok {
+			return nil, fmt.Errorf("Condition: [match] query on [%s] has no query", field)
+		}
+		if op, ok := m["operator"]; ok {
+			switch strings.ToLower(fmt.Sprintf("%v", op)) {
+			case "and":
+				node.operatorAnd = true
+			case "or":
+			default:
+				return nil, fmt.Errorf("Condition: [match] operator must be \"and\" or \"or\"")
+			}
+		}
+	}
+	if err = checkScalar("match", node.query); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// matches analyzes the query text for string fields, so "Quick Fox" is the
+// tokens quick and fox; one of them (or all, with operator "and") must be
+// in the field. Other field types compare the query as a single value.
+func (node *matchNode) matches(doc *conditionDoc) bool {
+	typ := doc.fieldType(node.field)
+	values := doc.values(node.field)
+	if len(values) == 0 {
+		return false
+	}
+	if valueKind(typ, values[0]) != kindString {
+		for _, v := range values {
+			if termEquals(typ, v, node.query) {
+				return true
+			}
+		}
+		return false
+	}
+
+	tokens := map[string]bool{}
+	for _, v := range values {
+		for _, token := range analyze(fmt.Sprintf("%v", v)) {
+			tokens[token] = true
+		}
+	}
+	queryTokens := analyze(fmt.Sprintf("%v", node.query))
+	if len(queryTokens) == 0 {
+		return false
+	}
+	for _, token := range queryTokens {
+		if tokens[token] && !node.operatorAnd {
+			return true
+		}
+		if !tokens[token] && node.operatorAnd {
+			return false
+		}
+	}
+	return node.operatorAnd
+}
+
+//------------------------------------------------------------------------------
+
+type rangeNode struct {
+	field  string
+	bounds map[string]interface{}
+}
+
+func compileRange(obj map[string]interface{}) (conditionNode, error) {
+	field, value, err := singleField("range", obj)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Condition: [range] query on [%s] must be an object", field)
+	}
+	node := &rangeNode{field: field, bounds: map[string]interface{}{}}
+	includeLower, includeUpper := true, true
+	if v, ok := m["include_lower"].(bool); ok {
+		includeLower = v
+	}
+	if v, ok := m["include_upper"].(bool); ok {
+		includeUpper = v
+	}
+	for k, v := range m {
+		if v == nil {
+			continue
+		}
+		switch k {
+		case "gt", "gte", "lt", "lte":
+			node.bounds[k] = v
+		case "from":
+			if includeLower {
+				node.bounds["gte"] = v
+			} else {
+				node.bounds["gt"] = v
+			}
+		case "to":
+			if includeUpper {
+				node.bounds["lte"] = v
+			} else {
+				node.bounds["lt"] = v
+			}
+		case "include_lower", "include_upper", "boost", "format", "time_zone", "_name":
+		default:
+			return nil, fmt.Errorf("Condition: unsupported [range] option [%s]", k)
+		}
+		if err = checkScalar("range", v); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func (node *rangeNode) matches(doc *conditionDoc) bool {
+	typ := doc.fieldType(node.field)
+	for _, v := range doc.values(node.field) {
+		switch valueKind(typ, v) {
+		case kindNumber:
+			if f, ok := toFloat(v); ok && node.inRange(func(bound interface{}) (int, bool) {
+				b, ok := toFloat(bound)
+				return compareFloat(f, b), ok
+			}) {
+				return true
+			}
+		case kindDate:
+			if ms, ok := toMillis(v); ok && node.inRange(func(bound interface{}) (int, bool) {
+				b, ok := toMillis(bound)
+				return compareFloat(float64(ms), float64(b)), ok
+			}) {
+				return true
+			}
+		case kindKeyword:
+			s := fmt.Sprintf("%v", v)
+			if node.inRange(func(bound interface{}) (int, bool) {
+				return strings.Compare(s, fmt.Sprintf("%v", bound)), true
+			}) {
+				return true
+			}
+		case kindString:
+			for _, token := range analyze(fmt.Sprintf("%v", v)) {
+				if node.inRange(func(bound interface{}) (int, bool) {
+					return strings.Compare(token, fmt.Sprintf("%v", bound)), true
+				}) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// inRange checks each bound; cmp returns the sign of (value - bound).
+func (node *rangeNode) inRange(cmp func(bound interface{}) (int, bool)) bool {
+	for op, bound := range node.bounds {
+		c, ok := cmp(bound)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "gt":
+			ok = c > 0
+		case "gte":
+			ok = c >= 0
+		case "lt":
+			ok = c < 0
+		case "lte":
+			ok = c <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+//------------------------------------------------------------------------------
+
+type existsNode struct {
+	field string
+}
+
+func compileExists(obj map[string]interface{}) (conditionNode, error) {
+	field, ok := obj["field"].(string)
+	if !ok || field == "" {
+		return nil, fmt.Errorf("Condition: [exists] query must have a field")
+	}
+	return &existsNode{field: field}, nil
+}
+
+// matches ignores strings that analyze to no tokens, since nothing would
+// have been indexed for them.
+func (node *existsNode) matches(doc *conditionDoc) bool {
+	typ := doc.fieldType(node.field)
+	for _, v := range doc.values(node.field) {
+		if valueKind(typ, v) == kindString && len(analyze(fmt.Sprintf("%v", v))) == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
+
+// earthMeanRadius is the radius, in meters, Elasticsearch uses for distances.
+const earthMeanRadius = 6371008.7714
+
+type geoPoint struct {
+	lat, lon float64
+}
+
+type geoDistanceNode struct {
+	field    string
+	origin   geoPoint
+	distance float64
+}
+
+func compileGeoDistance(obj map[string]interface{}) (conditionNode, error) {
+	field, value, err := singleField("geo_distance", obj,
+		"distance", "unit", "distance_type", "optimize_bbox", "validation_method", "_name", "boost")
+	if err != nil {
+		return nil, err
+	}
+	origin, ok := toGeoPoint(value)
+	if !ok {
+		return nil, fmt.Errorf("Condition: [geo_distance] query on [%s] has a bad point", field)
+	}
+	unit := "m"
+	if u, ok := obj["unit"].(string); ok {
+		unit = u
+	}
+	distance, err := parseDistance(obj["distance"], unit)
+	if err != nil {
+		return nil, err
+	}
+	return &geoDistanceNode{field: field, origin: origin, distance: distance}, nil
+}
+
+func (node *geoDistanceNode) matches(doc *conditionDoc) bool {
+	raw := collectGeoValues(doc.source, strings.Split(node.field, "."))
+	for _, v := range raw {
+		if p, ok := toGeoPoint(v); ok && haversine(node.origin, p) <= node.distance {
+			return true
+		}
+	}
+	return false
+}
+
+// collectGeoValues is like collectValues, but keeps {"lat","lon"} objects and
+// [lon, lat] arrays whole.
+func collectGeoValues(node interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		if arr, ok := node.([]interface{}); ok {
+			if _, ok := toGeoPoint(arr); ok {
+				return []interface{}{arr}
+			}
+			out := []interface{}{}
+			for _, v := range arr {
+				out = append(out, collectGeoValues(v, path)...)
+			}
+			return out
+		}
+		if node == nil {
+			return nil
+		}
+		return []interface{}{node}
+	}
+	switch t := node.(type) {
+	case []interface{}:
+		out := []interface{}{}
+		for _, v := range t {
+			out = append(out, collectGeoValues(v, path)...)
+		}
+		return out
+	case map[string]interface{}:
+		return collectGeoValues(t[path[0]], path[1:])
+	}
+	return nil
+}
+
+func toGeoPoint(v interface{}) (geoPoint, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		lat, ok1 := toFloat(t["lat"])
+		lon, ok2 := toFloat(t["lon"])
+		return geoPoint{lat: lat, lon: lon}, ok1 && ok2 && len(t) == 2
+	case []interface{}:
+		if len(t) != 2 {
+			return geoPoint{}, false
+		}
+		lon, ok1 := t[0].(float64)
+		lat, ok2 := t[1].(float64)
+		return geoPoint{lat: lat, lon: lon}, ok1 && ok2
+	case string:
+		parts := strings.Split(t, ",")
+		if len(parts) != 2 {
+			return geoPoint{}, false
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		return geoPoint{lat: lat, lon: lon}, err1 == nil && err2 == nil
+	}
+	return geoPoint{}, false
+}
+
+func haversine(a, b geoPoint) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.lat - a.lat)
+	dLon := toRad(b.lon - a.lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.lat))*math.Cos(toRad(b.lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthMeanRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// distanceUnits gives the number of meters in each Elasticsearch distance unit.
+var distanceUnits = map[string]float64{
+	"in": 0.0254, "inch": 0.0254,
+	"yd": 0.9144, "yards": 0.9144,
+	"ft": 0.3048, "feet": 0.3048,
+	"km": 1000, "kilometers": 1000,
+	"NM": 1852, "nmi": 1852, "nauticalmiles": 1852,
+	"mm": 0.001, "millimeters": 0.001,
+	"cm": 0.01, "centimeters": 0.01,
+	"mi": 1609.344, "miles": 1609.344,
+	"m": 1, "meters": 1,
+}
+
+var distancePattern = regexp.MustCompile(`^\s*([0-9.eE+-]+)\s*([a-zA-Z]*)\s*$`)
+
+func parseDistance(v interface{}, defaultUnit string) (float64, error) {
+	if v == nil {
+		return 0, fmt.Errorf("Condition: [geo_distance] query must have a distance")
+	}
+	if f, ok := v.(float64); ok {
+		v = fmt.Sprintf("%v", f)
+	}
+	s, ok := v.(string)
+	match := distancePattern.FindStringSubmatch(s)
+	if !ok || match == nil {
+		return 0, fmt.Errorf("Condition: bad distance [%v]", v)
+	}
+	f, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Condition: bad distance [%v]", v)
+	}
+	unit := match[2]
+	if unit == "" {
+		unit = defaultUnit
+	}
+	meters, ok := distanceUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("Condition: unknown distance unit [%s]", unit)
+	}
+	return f * meters, nil
+}
+
+//------------------------------------------------------------------------------
+
+type valueKindType int
+
+const (
+	kindOther valueKindType = iota
+	kindString
+	kindKeyword
+	kindNumber
+	kindDate
+	kindBool
+)
+
+// valueKind decides how to compare a value: by the mapping type if there is
+// one, or else the way Elasticsearch would have dynamically mapped it.
+func valueKind(typ string, v interface{}) valueKindType {
+	switch typ {
+	case "string":
+		return kindString
+	case "keyword":
+		// a not_analyzed string
+		return kindKeyword
+	case "long", "integer", "short", "byte", "double", "float":
+		return kindNumber
+	case "date":
+		return kindDate
+	case "boolean":
+		return kindBool
+	case "":
+		switch v.(type) {
+		case string:
+			return kindString
+		case bool:
+			return kindBool
+		case float64, float32, int, int64, int32:
+			return kindNumber
+		}
+	}
+	return kindOther
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toBool(v interface{}) (bool, bool) {
+	switch t := v.(type) {
+	case bool:
+		return t, true
+	case string:
+		switch t {
+		case "true":
+			return true, true
+		case "false", "":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+var dateMathUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'H': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// toMillis parses a date the way the default strict_date_optional_time ||
+// epoch_millis format does, plus "now" with simple +/- offsets.
+func toMillis(v interface{}) (int64, bool) {
+	if f, ok := v.(float64); ok {
+		return int64(f), true
+	}
+	if i, ok := v.(int); ok {
+		return int64(i), true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, false
+	}
+	if strings.HasPrefix(s, "now") {
+		return dateMath(s)
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano() / int64(time.Millisecond), true
+		}
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	return 0, false
+}
+
+var dateMathPattern = regexp.MustCompile(`([+-])(\d+)([yMwdhHms])`)
+
+func dateMath(s string) (int64, bool) {
+	t := time.Now()
+	rest := strings.TrimPrefix(s, "now")
+	matches := dateMathPattern.FindAllStringSubmatchIndex(rest, -1)
+	consumed := 0
+	for _, m := range matches {
+		if m[0] != consumed {
+			return 0, false
+		}
+		consumed = m[1]
+		n, _ := strconv.Atoi(rest[m[4]:m[5]])
+		if rest[m[2]:m[3]] == "-" {
+			n = -n
+		}
+		switch unit := rest[m[6]]; unit {
+		case 'y':
+			t = t.AddDate(n, 0, 0)
+		case 'M':
+			t = t.AddDate(0, n, 0)
+		default:
+			t = t.Add(time.Duration(n) * dateMathUnits[unit])
+		}
+	}
+	if consumed != len(rest) {
+		return 0, false
+	}
+	return t.UnixNano() / int64(time.Millisecond), true
+}
+
+//------------------------------------------------------------------------------
+
+// analyze approximates the Elasticsearch standard analyzer: text is split on
+// word boundaries and lowercased. Letters, digits and underscores make up
+// words; a period or apostrophe between two of those doesn't split the word.
+func analyze(text string) []string {
+	runes := []rune(text)
+	isWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || unicode.Is(unicode.Mn, r)
+	}
+	tokens := []string{}
+	var current []rune
+	for i, r := range runes {
+		switch {
+		case isWord(r):
+			current = append(current, unicode.ToLower(r))
+		case (r == '.' || r == '\'') && len(current) > 0 && i+1 < len(runes) && isWord(runes[i+1]):
+			current = append(current, r)
+		default:
+			if len(current) > 0 {
+				tokens = append(tokens, string(current))
+				current = nil
+			}
+		}
+	}
+	if len(current) > 0 {
+		tokens = append(tokens, string(current))
+	}
+	return tokens
+}
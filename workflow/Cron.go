@@ -0,0 +1,639 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+	cron "github.com/venicegeo/vegertar-cron"
+)
+
+// cronSchedules keeps track of the cron.Cron entry of each repeating event.
+// All use of the cron goes through it, since the cron can't be started or
+// stopped safely while it is being changed.
+//
+// cron.Cron only drops a removed entry the next time it comes due, and drops
+// every entry with the removed key when it does. So that a rescheduled event
+// isn't dropped along with its old entry, each entry gets a key of its own,
+// and only the latest key of each event is current.
+type cronSchedules struct {
+	cron    *cron.Cron
+	entries map[piazza.Ident]cronSchedule
+	seq     int
+	running bool
+	lock    sync.Mutex
+}
+
+type cronSchedule struct {
+	key string
+	// signature is the job as it was scheduled, to tell when it has changed
+	signature string
+	last      *cronLastRun
+}
+
+func newCronSchedules(c *cron.Cron) *cronSchedules {
+	return &cronSchedules{cron: c, entries: map[piazza.Ident]cronSchedule{}}
+}
+
+// add schedules the job, replacing any entry the event already has, unless
+// the job hasn't changed since it was scheduled.
+func (schedules *cronSchedules) add(job *CronJob, eventTypeName string, service *Service) error {
+	schedule, err := parseCronSchedule(&job.Event)
+	if err != nil {
+		return err
+	}
+	// the last run and the count of runs change on every run, and aren't a
+	// change to the schedule
+	unrun := *job
+	unrun.LastRun = nil
+	unrun.Runs = 0
+	byts, err := json.Marshal(&unrun)
+	if err != nil {
+		return err
+	}
+	signature := string(byts)
+
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	entry, ok := schedules.entries[job.EventID]
+	if ok && entry.signature == signature {
+		return nil
+	}
+	if ok {
+		schedules.cron.Remove(entry.key)
+	}
+	schedules.seq++
+	key := fmt.Sprintf("%s#%d", job.EventID, schedules.seq)
+	last := &cronLastRun{time: time.Now()}
+	schedules.entries[job.EventID] = cronSchedule{key: key, signature: signature, last: last}
+	schedules.cron.Schedule(schedule, cronEvent{&job.Event, eventTypeName, service, key, schedule, last})
+	return nil
+}
+
+// remove unschedules the event, if it is scheduled.
+func (schedules *cronSchedules) remove(id piazza.Ident) {
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	if entry, ok := schedules.entries[id]; ok {
+		schedules.cron.Remove(entry.key)
+		delete(schedules.entries, id)
+	}
+}
+
+// isCurrent says whether the key is that of the event's entry.
+func (schedules *cronSchedules) isCurrent(id piazza.Ident, key string) bool {
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	entry, ok := schedules.entries[id]
+	return ok && entry.key == key
+}
+
+// ids returns the events that are scheduled.
+func (schedules *cronSchedules) ids() []piazza.Ident {
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	ids := []piazza.Ident{}
+	for id := range schedules.entries {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// next returns when the event will next fire, or nil if it isn't scheduled.
+// On a replica whose cron isn't running, that is when it would fire.
+func (schedules *cronSchedules) next(id piazza.Ident) *piazza.TimeStamp {
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	entry, ok := schedules.entries[id]
+	if !ok {
+		return nil
+	}
+
+	for _, e := range schedules.cron.Entries() {
+		job, ok := e.Job.(cronEvent)
+		if !ok || job.key != entry.key {
+			continue
+		}
+		next := e.Next
+		if next.IsZero() {
+			// the cron isn't running, so hasn't worked it out
+			var keepOn bool
+			if next, keepOn = e.Schedule.Next(time.Now()); !keepOn {
+				return nil
+			}
+		}
+		ts := piazza.TimeStamp(next)
+		return &ts
+	}
+	return nil
+}
+
+func (schedules *cronSchedules) start() {
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	if !schedules.running {
+		// runs due before now were dealt with as missed runs
+		now := time.Now()
+		for _, entry := range schedules.entries {
+			entry.last.set(now)
+		}
+		schedules.cron.Start()
+		schedules.running = true
+	}
+}
+
+func (schedules *cronSchedules) stop() {
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	if schedules.running {
+		schedules.cron.Stop()
+		schedules.running = false
+	}
+}
+
+func (schedules *cronSchedules) isRunning() bool {
+	schedules.lock.Lock()
+	defer schedules.lock.Unlock()
+	return schedules.running
+}
+
+//------------------------------------------------------------------------------
+
+// newCronElector returns the elector that picks which replica runs the cron.
+// The leader loads the repeating events when it is elected, and on each
+// renewal of its lease picks up those that other replicas have changed and
+// purges the trash.
+func (service *Service) newCronElector(store LeaseStore, holder string) *LeaderElector {
+	elector := NewLeaderElector(store, cronLeaseName, holder)
+	elector.Elected = func() error {
+		if err := service.syncCron(elector.Holding); err != nil {
+			return err
+		}
+		service.cronSchedules.start()
+		service.syslogger.Info("Cron: %s is now running the cron", holder)
+		return nil
+	}
+	elector.Deposed = func() {
+		service.cronSchedules.stop()
+		service.syslogger.Info("Cron: %s is no longer running the cron", holder)
+	}
+	elector.Leading = func() {
+		if err := service.syncCron(nil); err != nil {
+			service.syslogger.Warning("Cron: unable to sync the cron: %s", err)
+		}
+		if _, err := service.purgeTrash(); err != nil {
+			service.syslogger.Warning("Trash: unable to purge the trash: %s", err)
+		}
+	}
+	return elector
+}
+
+// syncCron brings the cron up to date with the CronDB. When holding is given,
+// the runs each event missed are dealt with first, for as long as it says the
+// lease on the cron is held.
+func (service *Service) syncCron(holding func() bool) error {
+	ok, err := service.cronDB.Exists("pz-workflow")
+	if err != nil || !ok {
+		return err
+	}
+
+	scheduled := map[piazza.Ident]bool{}
+	names := map[piazza.Ident]string{}
+	const perPage = 100
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "eventId", Order: piazza.SortOrderAscending}
+		jobs, _, err := service.cronDB.GetAll(format, "pz-workflow")
+		if err != nil {
+			return LoggedError("WorkflowService.syncCron: Unable to get all from CronDB")
+		}
+
+		for i := range jobs {
+			job := &jobs[i]
+			if job.Paused {
+				continue
+			}
+			name, ok := names[job.EventTypeID]
+			if !ok {
+				eventType, found, err := service.eventTypeDB.GetOne(job.EventTypeID, "pz-workflow")
+				if !found || err != nil {
+					return LoggedError("WorkflowService.syncCron: Unable to retrieve event type for cron event %#v", job.Event)
+				}
+				name = eventType.Name
+				names[job.EventTypeID] = name
+			}
+			if holding != nil {
+				if !holding() {
+					return LoggedError("WorkflowService.syncCron: Lost the lease on the cron while catching up")
+				}
+				service.catchUpCronJob(job, name, time.Now(), holding)
+				// the runs it caught up on may have used it up
+				var found bool
+				if job, found, err = service.cronDB.GetOne(job.EventID, "pz-workflow"); !found || err != nil {
+					continue
+				}
+			}
+			if cronJobExhausted(job, time.Now()) {
+				service.retireCronJob(job.EventID)
+				continue
+			}
+			if err = service.cronSchedules.add(job, name, service); err != nil {
+				return LoggedError("WorkflowService.syncCron: Unable to register cron event %#v", job.Event)
+			}
+			scheduled[job.EventID] = true
+		}
+
+		if len(jobs) < perPage {
+			break
+		}
+	}
+
+	// a search may not yet see a job that was just posted, so a job is only
+	// unscheduled once it is gone, or paused, when fetched by its ID
+	for _, id := range service.cronSchedules.ids() {
+		if scheduled[id] {
+			continue
+		}
+		job, found, _ := service.cronDB.GetOne(id, "pz-workflow")
+		if !found || job == nil || job.Paused {
+			service.cronSchedules.remove(id)
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// boundedSchedule is a cron schedule that is evaluated in a time zone, and
+// only runs from start until end, if they are set.
+type boundedSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+	start    time.Time
+	end      time.Time
+}
+
+func (s boundedSchedule) Next(t time.Time) (time.Time, bool) {
+	from := t
+	if !s.start.IsZero() && from.Before(s.start) {
+		// the first run may be at the start itself
+		from = s.start.Add(-time.Nanosecond)
+	}
+	next, keepOn := s.schedule.Next(from.In(s.location))
+	if !keepOn || (!s.end.IsZero() && next.After(s.end)) {
+		return time.Time{}, false
+	}
+	return next.In(t.Location()), true
+}
+
+// parseCronSchedule returns the schedule of a repeating event, in its time
+// zone and between its start and end times.
+func parseCronSchedule(event *Event) (cron.Schedule, error) {
+	schedule, err := cron.Parse(event.CronSchedule)
+	if err != nil {
+		return nil, err
+	}
+	location := time.Local
+	if event.TimeZone != "" {
+		if location, err = time.LoadLocation(event.TimeZone); err != nil {
+			return nil, fmt.Errorf("Unknown time zone %s: %s", event.TimeZone, err)
+		}
+	}
+	bounded := boundedSchedule{schedule: schedule, location: location}
+	if event.StartTime != nil {
+		bounded.start = time.Time(*event.StartTime)
+	}
+	if event.EndTime != nil {
+		bounded.end = time.Time(*event.EndTime)
+	}
+	return bounded, nil
+}
+
+// validateCronJob checks that a repeating event that is being posted or
+// updated has a schedule it can run on.
+func validateCronJob(job *CronJob, now time.Time) error {
+	if _, err := parseCronSchedule(&job.Event); err != nil {
+		return err
+	}
+	if err := validateMissedRunPolicy(job.MissedRunPolicy); err != nil {
+		return err
+	}
+	if job.MaxRuns < 0 {
+		return fmt.Errorf("maxRuns must not be negative, was %d", job.MaxRuns)
+	}
+	if job.MaxRuns > 0 && job.Runs >= job.MaxRuns {
+		return fmt.Errorf("maxRuns must be more than the %d runs already fired, was %d", job.Runs, job.MaxRuns)
+	}
+	if job.EndTime != nil {
+		end := time.Time(*job.EndTime)
+		if job.StartTime != nil && !end.After(time.Time(*job.StartTime)) {
+			return fmt.Errorf("endTime %s must be after startTime %s", end, time.Time(*job.StartTime))
+		}
+		if !end.After(now) {
+			return fmt.Errorf("endTime %s has passed", end)
+		}
+	}
+	return nil
+}
+
+// remainingRuns is how many more times the job may fire, or nil if that isn't
+// limited.
+func (job *CronJob) remainingRuns() *int {
+	if job.MaxRuns <= 0 {
+		return nil
+	}
+	remaining := job.MaxRuns - job.Runs
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
+}
+
+// cronJobExhausted says whether the job has fired as many times as it may, or
+// has no runs left before its end time.
+func cronJobExhausted(job *CronJob, now time.Time) bool {
+	if remaining := job.remainingRuns(); remaining != nil && *remaining == 0 {
+		return true
+	}
+	if job.EndTime == nil {
+		return false
+	}
+	schedule, err := parseCronSchedule(&job.Event)
+	if err != nil {
+		return false
+	}
+	since := now
+	if job.LastRun != nil {
+		since = time.Time(*job.LastRun)
+	}
+	_, keepOn := schedule.Next(since)
+	return !keepOn
+}
+
+// retireCronJob takes a repeating event that won't fire again out of the
+// CronDB and the cron. Its seed event, the events it fired and its runs are
+// kept.
+func (service *Service) retireCronJob(id piazza.Ident) {
+	service.syslogger.Audit("pz-workflow", "retiringCronEvent", id, "Cron: cron event [%s] has no runs left and is being retired", id)
+	service.cronSchedules.remove(id)
+	if _, err := service.cronDB.DeleteByID(id, "pz-workflow"); err != nil {
+		service.syslogger.Audit("pz-workflow", "retiringCronEventFailure", id, "Cron: cron event [%s] could not be retired: %s", id, err)
+		return
+	}
+	service.syslogger.Audit("pz-workflow", "retiredCronEvent", id, "Cron: cron event [%s] was retired", id)
+}
+
+func validateMissedRunPolicy(policy string) error {
+	switch policy {
+	case "", CronMissedRunSkip, CronMissedRunFireOnce, CronMissedRunFireAll:
+		return nil
+	}
+	return fmt.Errorf("Unknown missed run policy %s, must be one of %s, %s or %s", policy, CronMissedRunSkip, CronMissedRunFireOnce, CronMissedRunFireAll)
+}
+
+// maxMissedCronRuns is the most missed runs of an event that are fired; any
+// before them are skipped. At most maxMissedCronRunsCounted are counted.
+const (
+	maxMissedCronRuns        = 100
+	maxMissedCronRunsCounted = 100000
+)
+
+// maxCronJobWriteTries is how many times a change, such as a run or a pause,
+// is applied to a repeating event before giving up, when the event keeps
+// being changed meanwhile.
+const maxCronJobWriteTries = 5
+
+// catchUpCronJob deals with the runs of a repeating event that were due while
+// no replica was running the cron, as its missed run policy says. Runs are
+// only fired while holding says the lease on the cron is held, so that a
+// replica that has lost it doesn't fire runs the new leader will fire too.
+func (service *Service) catchUpCronJob(job *CronJob, eventTypeName string, now time.Time, holding func() bool) {
+	schedule, err := parseCronSchedule(&job.Event)
+	if err != nil {
+		return
+	}
+	since := time.Time(job.CreatedOn)
+	if job.LastRun != nil {
+		since = time.Time(*job.LastRun)
+	}
+	if since.IsZero() {
+		return
+	}
+
+	// the most recent missed runs, and the last of those before them
+	missed := []time.Time{}
+	var dropped time.Time
+	total := 0
+	for t := since; total < maxMissedCronRunsCounted; total++ {
+		next, keepOn := schedule.Next(t)
+		if !keepOn || next.After(now) {
+			break
+		}
+		missed = append(missed, next)
+		if len(missed) > maxMissedCronRuns {
+			dropped = missed[0]
+			missed = missed[1:]
+		}
+		t = next
+	}
+	if total == 0 {
+		return
+	}
+
+	c := cronEvent{Event: &job.Event, eventTypeName: eventTypeName, service: service}
+	latest := missed[len(missed)-1]
+	service.syslogger.Info("Cron: cron event %s missed %d runs since %s", job.EventID, total, since)
+
+	switch job.MissedRunPolicy {
+	case CronMissedRunFireOnce:
+		if holding() {
+			service.fireCronJob(c, latest, total)
+		}
+	case CronMissedRunFireAll:
+		// it may not have enough runs left to fire them all
+		if remaining := job.remainingRuns(); remaining != nil && *remaining < len(missed) {
+			dropped = missed[len(missed)-*remaining-1]
+			missed = missed[len(missed)-*remaining:]
+		}
+		if skipped := total - len(missed); skipped > 0 {
+			service.skipCronJob(job.EventID, dropped, skipped)
+		}
+		for _, t := range missed {
+			if !holding() {
+				service.syslogger.Warning("Cron: lost the lease on the cron while catching up cron event %s", job.EventID)
+				return
+			}
+			service.fireCronJob(c, t, 1)
+		}
+	default:
+		service.skipCronJob(job.EventID, latest, total)
+	}
+}
+
+// fireCronJob posts the event for one run of a repeating event, with the
+// placeholders in its data filled in, and records the run. The run stands for
+// missed runs, if any.
+func (service *Service) fireCronJob(c cronEvent, scheduled time.Time, missed int) *CronRun {
+	uniqueMap, _ := c.Data[c.eventTypeName].(map[string]interface{})
+	if uniqueMap == nil {
+		uniqueMap = make(map[string]interface{})
+	}
+	// the count of runs and the previous run are kept in the CronDB
+	job, found, err := service.cronDB.GetOne(c.EventID, "pz-workflow")
+	if !found || err != nil {
+		job = &CronJob{Event: *c.Event}
+	}
+
+	firedOn := piazza.NewTimeStamp()
+	ev := &Event{
+		EventTypeID: c.EventTypeID,
+		CreatedOn:   firedOn,
+		CreatedBy:   c.EventID.String(),
+	}
+	var resp *piazza.JsonResponse
+	if ev.Data, err = renderCronData(uniqueMap, newCronTemplateRun(job, scheduled, time.Time(firedOn))); err != nil {
+		resp = service.statusInternalError(err)
+	} else {
+		resp = service.PostEvent(ev)
+	}
+
+	run := &CronRun{
+		CronID:       c.EventID,
+		ScheduledFor: piazza.TimeStamp(scheduled),
+		FiredOn:      &firedOn,
+		Status:       CronRunFired,
+		StatusCode:   resp.StatusCode,
+		Missed:       missed,
+	}
+	if resp.IsError() {
+		run.Status = CronRunFailed
+		run.Message = resp.Message
+		service.syslogger.Warning("Cron: run of cron event %s scheduled for %s failed: %s", c.EventID, scheduled, resp.Message)
+	} else {
+		run.EventID = ev.EventID
+	}
+	service.recordCronRun(run)
+	return run
+}
+
+// skipCronJob records that missed runs of a repeating event were skipped.
+func (service *Service) skipCronJob(id piazza.Ident, scheduled time.Time, missed int) *CronRun {
+	run := &CronRun{
+		CronID:       id,
+		ScheduledFor: piazza.TimeStamp(scheduled),
+		Status:       CronRunSkipped,
+		Message:      fmt.Sprintf("%d runs missed while the service was down were skipped", missed),
+		Missed:       missed,
+	}
+	service.recordCronRun(run)
+	return run
+}
+
+// recordCronRun saves the run, counts it and moves the repeating event's last
+// run up to it, and retires the event if it has no runs left.
+func (service *Service) recordCronRun(run *CronRun) {
+	run.RunID = service.newIdent()
+	if err := service.cronRunDB.PostData(run); err != nil {
+		service.syslogger.Error("Cron: run of cron event %s could not be recorded: %s", run.CronID, err)
+	}
+
+	// the job is written back at the version it was read at, so that a change
+	// made to it meanwhile, such as a pause, isn't undone; it is read again
+	// and the run applied to that instead
+	for tries := 1; ; tries++ {
+		job, found, err := service.cronDB.GetOne(run.CronID, "pz-workflow")
+		if !found || err != nil {
+			// deleted since
+			return
+		}
+		if run.Status != CronRunSkipped {
+			job.Runs++
+		}
+		if job.LastRun == nil || time.Time(run.ScheduledFor).After(time.Time(*job.LastRun)) {
+			job.LastRun = &run.ScheduledFor
+		}
+		err = service.cronDB.PutData(job, job.Version)
+		if err == ErrVersionConflict && tries < maxCronJobWriteTries {
+			continue
+		}
+		if err != nil {
+			service.syslogger.Error("Cron: last run of cron event %s could not be updated: %s", run.CronID, err)
+			return
+		}
+		if cronJobExhausted(job, time.Now()) {
+			service.retireCronJob(job.EventID)
+		}
+		return
+	}
+}
+
+//------------------------------------------------------------------------------
+
+type cronEvent struct {
+	*Event
+	eventTypeName string
+	service       *Service
+	key           string
+	schedule      cron.Schedule
+	last          *cronLastRun
+}
+
+// cronLastRun is the scheduled time of the last run of a cron entry. It is
+// shared by the copies of the entry's cronEvent.
+type cronLastRun struct {
+	time time.Time
+	lock sync.Mutex
+}
+
+func (last *cronLastRun) set(t time.Time) {
+	last.lock.Lock()
+	defer last.lock.Unlock()
+	last.time = t
+}
+
+// Run fires the run that is due now. The cron doesn't say which run that is,
+// so it is worked out from the schedule: the last one due since the previous
+// run.
+func (c cronEvent) Run() {
+	// the event may have been retired, or rescheduled, since the cron
+	// started this run
+	if !c.service.cronSchedules.isCurrent(c.EventID, c.key) {
+		return
+	}
+	now := time.Now()
+	c.last.lock.Lock()
+	scheduled := c.last.time
+	for {
+		next, keepOn := c.schedule.Next(scheduled)
+		if !keepOn || next.After(now) {
+			break
+		}
+		scheduled = next
+	}
+	if !scheduled.After(c.last.time) {
+		scheduled = now
+	}
+	c.last.time = scheduled
+	c.last.lock.Unlock()
+
+	c.service.fireCronJob(c, scheduled, 0)
+}
+
+func (c cronEvent) Key() string {
+	return c.key
+}
@@ -16,6 +16,7 @@ package workflow
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
@@ -37,48 +38,84 @@ func NewCronDB(service *Service, esi elasticsearch.IIndex) (*CronDB, error) {
 	return &crdb, nil
 }
 
+// Mapping returns the type the cron jobs are kept under.
+func (db *CronDB) Mapping() string {
+	return db.mapping
+}
+
 // PostData TODO
-func (db *CronDB) PostData(event *Event) error {
-	indexResult, err := db.Esi.PostData(db.mapping, event.EventID.String(), event)
+func (db *CronDB) PostData(job *CronJob) error {
+	stored := *job
+	stored.Version = 0
+	indexResult, err := db.Esi.PostData(db.mapping, job.EventID.String(), &stored)
 	if err != nil {
 		return LoggedError("CronDB.PostData failed: %s", err)
 	} else if !indexResult.Created {
 		return LoggedError("CronDB.PostData failed: not created")
 	}
+	job.Version = int64(indexResult.Version)
 
 	return nil
 }
 
-// GetAll TODO
-func (db *CronDB) GetAll(actor string) (*[]Event, error) {
-	var events []Event
+// PutData replaces a CronJob, if it is still at the version, or in any case
+// if the version is 0
+func (db *CronDB) PutData(job *CronJob, version int64) error {
+	stored := *job
+	stored.Version = 0
+	newVersion, err := db.putVersioned(db.mapping, job.EventID, &stored, version)
+	if err == ErrVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("CronDB.PutData failed: %s", err)
+	}
+	job.Version = newVersion
+	return nil
+}
+
+// GetAll returns a page of the CronJobs
+func (db *CronDB) GetAll(format *piazza.JsonPagination, actor string) ([]CronJob, int64, error) {
+	jobs := []CronJob{}
 
 	exists, err := db.Esi.TypeExists(db.mapping)
 	if err != nil {
-		return &events, err
+		return jobs, 0, err
 	}
 	if !exists {
-		return nil, LoggedError("Type %s does not exist", db.mapping)
+		return nil, 0, LoggedError("Type %s does not exist", db.mapping)
 	}
 
-	searchResult, err := db.Esi.GetAllElements(db.mapping)
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
 	if err != nil {
-		return nil, LoggedError("CronDB.GetAll failed: %s", err)
+		return nil, 0, LoggedError("CronDB.GetAll failed: %s", err)
 	} else if searchResult == nil {
-		return nil, LoggedError("CronDB.GetAll failed: no searchResult")
+		return nil, 0, LoggedError("CronDB.GetAll failed: no searchResult")
 	}
 
-	if searchResult != nil && searchResult.GetHits() != nil {
+	if searchResult.GetHits() != nil {
 		for _, hit := range *searchResult.GetHits() {
-			var event Event
-			if err := json.Unmarshal(*hit.Source, &event); err != nil {
-				return nil, LoggedError("CronDB.GetAll failed: %s", err)
+			var job CronJob
+			if err := json.Unmarshal(*hit.Source, &job); err != nil {
+				return nil, 0, LoggedError("CronDB.GetAll failed: %s", err)
 			}
-			events = append(events, event)
+			jobs = append(jobs, job)
 		}
 	}
 
-	return &events, nil
+	return jobs, searchResult.TotalHits(), nil
+}
+
+// GetOne TODO
+func (db *CronDB) GetOne(id piazza.Ident, actor string) (*CronJob, bool, error) {
+	var job CronJob
+	found, version, err := db.getVersioned(db.mapping, id, &job)
+	if err != nil {
+		return nil, found, fmt.Errorf("CronDB.GetOne failed: %s", err)
+	}
+	job.Version = version
+
+	return &job, found, nil
 }
 
 // Exists checks to see if the database exists
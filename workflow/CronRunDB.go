@@ -0,0 +1,82 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// CronRunDB is the history of the runs of the repeating events.
+type CronRunDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewCronRunDB(service *Service, esi elasticsearch.IIndex) (*CronRunDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	crdb := CronRunDB{ResourceDB: rdb, mapping: CronRunDBMapping}
+	return &crdb, nil
+}
+
+func (db *CronRunDB) PostData(run *CronRun) error {
+	indexResult, err := db.Esi.PostData(db.mapping, run.RunID.String(), run)
+	if err != nil {
+		return LoggedError("CronRunDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("CronRunDB.PostData failed: not created")
+	}
+
+	return nil
+}
+
+// GetAllByCron returns the runs of one repeating event.
+func (db *CronRunDB) GetAllByCron(format *piazza.JsonPagination, cronID piazza.Ident, actor string) ([]CronRun, int64, error) {
+	runs := []CronRun{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return runs, 0, err
+	}
+	if !exists {
+		return runs, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByTermQuery(db.mapping, "cronId", cronID.String(), format)
+	if err != nil {
+		return nil, 0, LoggedError("CronRunDB.GetAllByCron failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("CronRunDB.GetAllByCron failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var run CronRun
+			if err := json.Unmarshal(*hit.Source, &run); err != nil {
+				return nil, 0, err
+			}
+			runs = append(runs, run)
+		}
+	}
+
+	return runs, searchResult.TotalHits(), nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The seed data of a repeating event may hold placeholders, in the same
+// ${...} form as job templates, that are filled in each time it fires:
+//
+//   ${now}           when the run fired
+//   ${scheduledFor}  when the run was due
+//   ${previousRun}   when the previous run was due; for the first run, when
+//                    the event was created, or its startTime
+//   ${run}           the number of the run, counting from 1
+//   ${cronId}        the eventId of the seed event
+//   ${last.1h}       the start of a window of that length that ends when the
+//                    run was due: a Go duration with no fraction, such as 90m,
+//                    or a number of days, such as 7d
+//
+// Times are RFC3339 strings, in UTC.
+
+// cronTemplateFields are the placeholders, besides windows, that seed data may
+// use.
+var cronTemplateFields = []string{"now", "scheduledFor", "previousRun", "run", "cronId"}
+
+const cronTemplateWindowPrefix = "last."
+
+// cronTemplateRun is what a run of a repeating event fills its seed data in
+// with.
+type cronTemplateRun struct {
+	cronID    piazza.Ident
+	run       int
+	previous  time.Time
+	scheduled time.Time
+	now       time.Time
+}
+
+// newCronTemplateRun returns the values for the next run of the job.
+func newCronTemplateRun(job *CronJob, scheduled time.Time, now time.Time) *cronTemplateRun {
+	previous := time.Time(job.CreatedOn)
+	if job.StartTime != nil && time.Time(*job.StartTime).After(previous) {
+		previous = time.Time(*job.StartTime)
+	}
+	if job.LastRun != nil {
+		previous = time.Time(*job.LastRun)
+	}
+	return &cronTemplateRun{cronID: job.EventID, run: job.Runs + 1, previous: previous, scheduled: scheduled, now: now}
+}
+
+// context returns the values for the placeholders in the given paths.
+func (run *cronTemplateRun) context(paths []string) map[string]interface{} {
+	windows := map[string]interface{}{}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, cronTemplateWindowPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(path, cronTemplateWindowPrefix)
+		if length, err := parseCronTemplateWindow(name); err == nil {
+			windows[name] = piazza.TimeStamp(run.scheduled.Add(-length)).String()
+		}
+	}
+	return map[string]interface{}{
+		"now":          piazza.TimeStamp(run.now).String(),
+		"scheduledFor": piazza.TimeStamp(run.scheduled).String(),
+		"previousRun":  piazza.TimeStamp(run.previous).String(),
+		"run":          run.run,
+		"cronId":       run.cronID.String(),
+		"last":         windows,
+	}
+}
+
+// renderCronData returns the seed data, not wrapped in the EventType name,
+// with its placeholders filled in for the run.
+func renderCronData(data map[string]interface{}, run *cronTemplateRun) (map[string]interface{}, error) {
+	tree, err := templateTree(data)
+	if err != nil {
+		return nil, err
+	}
+	rendered := renderTemplateNode(tree, run.context(templatePaths(tree)))
+
+	// back to the plain JSON types that posted event data has
+	byts, err := json.Marshal(rendered)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	if err = json.Unmarshal(byts, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// validateCronTemplate checks that every placeholder in the seed data is one
+// that a run fills in.
+func validateCronTemplate(data map[string]interface{}) error {
+	tree, err := templateTree(data)
+	if err != nil {
+		return err
+	}
+	for _, path := range templatePaths(tree) {
+		if contains(cronTemplateFields, path) {
+			continue
+		}
+		if strings.HasPrefix(path, cronTemplateWindowPrefix) {
+			if _, err = parseCronTemplateWindow(strings.TrimPrefix(path, cronTemplateWindowPrefix)); err != nil {
+				return fmt.Errorf("Cron data field ${%s} is not a valid window: %s", path, err)
+			}
+			continue
+		}
+		return fmt.Errorf("Cron data field ${%s} must be one of %s or a window like ${%s1h}", path, strings.Join(cronTemplateFields, ", "), cronTemplateWindowPrefix)
+	}
+	return nil
+}
+
+// parseCronTemplateWindow reads the length of a window: a Go duration, such
+// as 90m, or a whole number of days, such as 7d.
+func parseCronTemplateWindow(s string) (time.Duration, error) {
+	if strings.Contains(s, ".") {
+		// a dot would end the placeholder's path
+		return 0, fmt.Errorf("%s has a fraction, use a smaller unit", s)
+	}
+	var length time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("%s is not a number of days", s)
+		}
+		length = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if length, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if length <= 0 {
+		return 0, fmt.Errorf("%s is not a positive length", s)
+	}
+	return length, nil
+}
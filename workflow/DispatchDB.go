@@ -0,0 +1,165 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// DispatchDB is the outbox of jobs waiting to be sent to the job manager.
+type DispatchDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewDispatchDB(service *Service, esi elasticsearch.IIndex) (*DispatchDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	ddb := DispatchDB{ResourceDB: rdb, mapping: DispatchDBMapping}
+	return &ddb, nil
+}
+
+func (db *DispatchDB) PostData(dispatch *Dispatch) error {
+	stored := *dispatch
+	stored.Version = 0
+	indexResult, err := db.Esi.PostData(db.mapping, dispatch.DispatchID.String(), &stored)
+	if err != nil {
+		return LoggedError("DispatchDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("DispatchDB.PostData failed: not created")
+	}
+	dispatch.Version = int64(indexResult.Version)
+
+	return nil
+}
+
+// PutData replaces a Dispatch, if it is still at the version, or in any case
+// if the version is 0
+func (db *DispatchDB) PutData(dispatch *Dispatch, version int64) error {
+	stored := *dispatch
+	stored.Version = 0
+	newVersion, err := db.putVersioned(db.mapping, dispatch.DispatchID, &stored, version)
+	if err == ErrVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("DispatchDB.PutData failed: %s", err)
+	}
+	dispatch.Version = newVersion
+	return nil
+}
+
+// GetAll returns the dispatches, or only those with the given status.
+func (db *DispatchDB) GetAll(format *piazza.JsonPagination, status string, actor string) ([]Dispatch, int64, error) {
+	dispatches := []Dispatch{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return dispatches, 0, err
+	}
+	if !exists {
+		return dispatches, 0, nil
+	}
+
+	var searchResult *elasticsearch.SearchResult
+	if status == "" {
+		searchResult, err = db.Esi.FilterByMatchAll(db.mapping, format)
+	} else {
+		searchResult, err = db.Esi.FilterByTermQuery(db.mapping, "status", status, format)
+	}
+	if err != nil {
+		return nil, 0, LoggedError("DispatchDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("DispatchDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var dispatch Dispatch
+			if err := json.Unmarshal(*hit.Source, &dispatch); err != nil {
+				return nil, 0, err
+			}
+			dispatches = append(dispatches, dispatch)
+		}
+	}
+
+	return dispatches, searchResult.TotalHits(), nil
+}
+
+// GetAlertPending returns the sent dispatches whose Alerts haven't been
+// recorded.
+func (db *DispatchDB) GetAlertPending(format *piazza.JsonPagination) ([]Dispatch, error) {
+	dispatches := []Dispatch{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil || !exists {
+		return dispatches, err
+	}
+
+	searchResult, err := db.Esi.FilterByTermQuery(db.mapping, "alertPending", true, format)
+	if err != nil {
+		return nil, LoggedError("DispatchDB.GetAlertPending failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, LoggedError("DispatchDB.GetAlertPending failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var dispatch Dispatch
+			if err := json.Unmarshal(*hit.Source, &dispatch); err != nil {
+				return nil, err
+			}
+			dispatches = append(dispatches, dispatch)
+		}
+	}
+
+	return dispatches, nil
+}
+
+func (db *DispatchDB) GetOne(id piazza.Ident, actor string) (*Dispatch, bool, error) {
+	var dispatch Dispatch
+	found, version, err := db.getVersioned(db.mapping, id, &dispatch)
+	if err != nil {
+		return nil, found, fmt.Errorf("DispatchDB.GetOne failed: %s", err)
+	}
+	dispatch.Version = version
+
+	return &dispatch, found, nil
+}
+
+func (db *DispatchDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
+	if err != nil {
+		return false, fmt.Errorf("DispatchDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, fmt.Errorf("DispatchDB.DeleteById failed: no deleteResult")
+	}
+
+	if !deleteResult.Found {
+		return false, fmt.Errorf("DispatchDB.DeleteById failed: not found")
+	}
+
+	return deleteResult.Found, nil
+}
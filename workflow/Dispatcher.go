@@ -0,0 +1,318 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const (
+	defaultDispatchMaxAttempts = 8
+	defaultDispatchBaseDelay   = 5 * time.Second
+	defaultDispatchMaxDelay    = 10 * time.Minute
+	defaultDispatchInterval    = 5 * time.Second
+	defaultDispatchClaimFor    = time.Minute
+)
+
+// Dispatcher sends the jobs in the outbox to the job manager. A job is tried
+// as soon as it is enqueued; if that fails it is retried in the background,
+// with the delay doubling after each attempt, and dead-lettered after
+// MaxAttempts tries. The job's Alert is recorded when the broker acks it,
+// and, should that fail, by the retry loop.
+//
+// Every replica runs the retry loop, so before a job is sent the replica
+// claims its dispatch, pushing its NextAttempt on by ClaimFor with a write
+// conditional on the version it read. A replica that finds the dispatch has
+// changed since leaves it to the one that changed it, and one that stops
+// mid-attempt leaves it to be claimed again once ClaimFor has passed.
+type Dispatcher struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Interval    time.Duration
+	ClaimFor    time.Duration
+
+	service *Service
+	send    func(dispatch *Dispatch) error
+	record  func(alert *Alert) error
+
+	// inFlight holds the dispatches being attempted by this replica, so that
+	// the background loop and a replay don't both try to claim one
+	inFlight map[piazza.Ident]bool
+	lock     sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDispatcher returns a stopped dispatcher that sends jobs to RabbitMQ.
+func NewDispatcher(service *Service) *Dispatcher {
+	dispatcher := &Dispatcher{
+		MaxAttempts: defaultDispatchMaxAttempts,
+		BaseDelay:   defaultDispatchBaseDelay,
+		MaxDelay:    defaultDispatchMaxDelay,
+		Interval:    defaultDispatchInterval,
+		ClaimFor:    defaultDispatchClaimFor,
+		service:     service,
+		inFlight:    map[piazza.Ident]bool{},
+	}
+	dispatcher.send = func(dispatch *Dispatch) error {
+		return service.sendToRabbitMQ(dispatch.Job, dispatch.JobID, dispatch.CreatedBy)
+	}
+	dispatcher.record = func(alert *Alert) error {
+		if resp := service.PostAlert(alert); resp.IsError() {
+			return errors.New(resp.Message)
+		}
+		return nil
+	}
+	return dispatcher
+}
+
+// Start runs the background retry loop.
+func (dispatcher *Dispatcher) Start() {
+	dispatcher.stop = make(chan struct{})
+	dispatcher.done = make(chan struct{})
+	go func() {
+		defer close(dispatcher.done)
+		ticker := time.NewTicker(dispatcher.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-dispatcher.stop:
+				return
+			case <-ticker.C:
+				if _, err := dispatcher.RetryDue(); err != nil {
+					dispatcher.service.syslogger.Warning("Dispatcher: retry failed: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the background retry loop, waiting for the current pass to finish.
+func (dispatcher *Dispatcher) Stop() {
+	if dispatcher.stop == nil {
+		return
+	}
+	close(dispatcher.stop)
+	<-dispatcher.done
+	dispatcher.stop = nil
+}
+
+// Enqueue saves the job to the outbox and tries to send it. Only a failure
+// to save it is returned; a failure to send it is left for the retry loop.
+func (dispatcher *Dispatcher) Enqueue(dispatch *Dispatch) error {
+	dispatch.DispatchID = dispatcher.service.newIdent()
+	dispatch.Status = DispatchPending
+	dispatch.Attempts = 0
+	dispatch.CreatedOn = piazza.NewTimeStamp()
+	// not due yet, so the retry loop leaves it alone while it is first tried
+	dispatch.NextAttempt = piazza.TimeStamp(time.Time(dispatch.CreatedOn).Add(dispatcher.BaseDelay))
+
+	if err := dispatcher.service.dispatchDB.PostData(dispatch); err != nil {
+		return err
+	}
+	dispatcher.attempt(dispatch)
+	return nil
+}
+
+// RetryDue tries each pending dispatch that is due, and the Alert of each
+// sent one whose Alert is due to be recorded, and returns how many were
+// tried.
+func (dispatcher *Dispatcher) RetryDue() (int, error) {
+	const perPage = 100
+	now := time.Now()
+	due := []Dispatch{}
+
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "dispatchId", Order: piazza.SortOrderAscending}
+		dispatches, _, err := dispatcher.service.dispatchDB.GetAll(format, DispatchPending, "pz-workflow")
+		if err != nil {
+			return 0, err
+		}
+		for _, dispatch := range dispatches {
+			if !time.Time(dispatch.NextAttempt).After(now) {
+				due = append(due, dispatch)
+			}
+		}
+		if len(dispatches) < perPage {
+			break
+		}
+	}
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "dispatchId", Order: piazza.SortOrderAscending}
+		dispatches, err := dispatcher.service.dispatchDB.GetAlertPending(format)
+		if err != nil {
+			return 0, err
+		}
+		for _, dispatch := range dispatches {
+			if !time.Time(dispatch.NextAttempt).After(now) {
+				due = append(due, dispatch)
+			}
+		}
+		if len(dispatches) < perPage {
+			break
+		}
+	}
+
+	// the searches don't give the versions the claims are made against,
+	// and another replica may have tried one since
+	sort.Sort(dispatchesByNextAttempt(due))
+	tried := 0
+	for _, found := range due {
+		dispatch, ok, err := dispatcher.service.dispatchDB.GetOne(found.DispatchID, "pz-workflow")
+		if err != nil || !ok {
+			continue
+		}
+		if (dispatch.Status != DispatchPending && !dispatch.AlertPending) || time.Time(dispatch.NextAttempt).After(now) {
+			continue
+		}
+		if dispatcher.attempt(dispatch) {
+			tried++
+		}
+	}
+	return tried, nil
+}
+
+// Replay resets a dead-lettered or pending dispatch, as it was read, and
+// tries it again.
+func (dispatcher *Dispatcher) Replay(dispatch *Dispatch) error {
+	if dispatch.Status == DispatchSent {
+		return errors.New("Dispatch has already been sent")
+	}
+	dispatch.Status = DispatchPending
+	dispatch.Attempts = 0
+	if !dispatcher.attempt(dispatch) {
+		return errors.New("Dispatch is being tried elsewhere")
+	}
+	return nil
+}
+
+// attempt claims the dispatch, as of its version, sends the job once, if it
+// hasn't been sent, and records how that went, and then its Alert. It says
+// whether the dispatch was claimed.
+func (dispatcher *Dispatcher) attempt(dispatch *Dispatch) bool {
+	if !dispatcher.claim(dispatch.DispatchID) {
+		return false
+	}
+	defer dispatcher.release(dispatch.DispatchID)
+
+	service := dispatcher.service
+	claimed := *dispatch
+	claimed.NextAttempt = piazza.TimeStamp(time.Now().Add(dispatcher.ClaimFor))
+	if err := service.dispatchDB.PutData(&claimed, dispatch.Version); err != nil {
+		if err != ErrVersionConflict {
+			service.syslogger.Error("Dispatcher: dispatch %s of job %s could not be claimed: %s", dispatch.DispatchID, dispatch.JobID, err)
+		}
+		return false
+	}
+	*dispatch = claimed
+
+	if dispatch.Status == DispatchPending {
+		if !dispatcher.sendJob(dispatch) {
+			return true
+		}
+	}
+	if dispatch.AlertPending {
+		dispatcher.recordAlert(dispatch)
+	}
+	return true
+}
+
+// sendJob sends the job of a claimed dispatch, and records how that went. It
+// says whether that was recorded.
+func (dispatcher *Dispatcher) sendJob(dispatch *Dispatch) bool {
+	service := dispatcher.service
+	dispatch.Attempts++
+	if err := dispatcher.send(dispatch); err != nil {
+		dispatch.LastError = err.Error()
+		if dispatch.Attempts >= dispatcher.MaxAttempts {
+			dispatch.Status = DispatchDead
+			service.syslogger.Audit("pz-workflow", "deadLetteringJob", dispatch.JobID.String(), "Dispatcher: job [%s] of trigger [%s] was dead-lettered after %d attempts: %s", dispatch.JobID, dispatch.TriggerID, dispatch.Attempts, err)
+		} else {
+			dispatch.NextAttempt = piazza.TimeStamp(time.Now().Add(dispatcher.backoff(dispatch.Attempts)))
+		}
+	} else {
+		dispatch.Status = DispatchSent
+		dispatch.LastError = ""
+		dispatch.AlertPending = true
+		service.updateStats((*Stats).IncrTriggerJobs)
+	}
+
+	if err := service.dispatchDB.PutData(dispatch, dispatch.Version); err != nil {
+		service.syslogger.Error("Dispatcher: dispatch %s of job %s could not be updated: %s", dispatch.DispatchID, dispatch.JobID, err)
+		return false
+	}
+	return true
+}
+
+// recordAlert records the Alert of a sent dispatch. One that can't be is
+// left pending, for the retry loop to record once the claim has run out.
+func (dispatcher *Dispatcher) recordAlert(dispatch *Dispatch) {
+	service := dispatcher.service
+	alert := Alert{EventID: dispatch.EventID, TriggerID: dispatch.TriggerID, JobID: dispatch.JobID, Action: ActionTypeJob, CreatedBy: dispatch.CreatedBy}
+	if err := dispatcher.record(&alert); err != nil {
+		service.syslogger.Error("Dispatcher: alert for job %s could not be recorded: %s", dispatch.JobID, err)
+		return
+	}
+
+	dispatch.AlertID = alert.AlertID
+	dispatch.AlertPending = false
+	if err := service.dispatchDB.PutData(dispatch, dispatch.Version); err != nil {
+		service.syslogger.Error("Dispatcher: dispatch %s of job %s could not be updated: %s", dispatch.DispatchID, dispatch.JobID, err)
+	}
+}
+
+// backoff is the delay before the next attempt, after the given number of
+// attempts: BaseDelay, doubling each time, up to MaxDelay.
+func (dispatcher *Dispatcher) backoff(attempts int) time.Duration {
+	delay := dispatcher.BaseDelay
+	for i := 1; i < attempts && delay < dispatcher.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > dispatcher.MaxDelay {
+		delay = dispatcher.MaxDelay
+	}
+	return delay
+}
+
+func (dispatcher *Dispatcher) claim(id piazza.Ident) bool {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	if dispatcher.inFlight[id] {
+		return false
+	}
+	dispatcher.inFlight[id] = true
+	return true
+}
+
+func (dispatcher *Dispatcher) release(id piazza.Ident) {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	delete(dispatcher.inFlight, id)
+}
+
+type dispatchesByNextAttempt []Dispatch
+
+func (a dispatchesByNextAttempt) Len() int      { return len(a) }
+func (a dispatchesByNextAttempt) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a dispatchesByNextAttempt) Less(i, j int) bool {
+	return time.Time(a[i].NextAttempt).Before(time.Time(a[j].NextAttempt))
+}
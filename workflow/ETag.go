@@ -0,0 +1,117 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The EventTypes, Triggers, Alerts and cron jobs are sent with their version
+// as their ETag. A GET with an If-None-Match naming the ETag gets a 304, and
+// a PUT or DELETE with an If-Match naming another version gets a 412.
+
+// versioned is a resource sent with its version as its ETag.
+type versioned interface {
+	version() int64
+}
+
+func (eventType *EventType) version() int64 { return eventType.Version }
+func (trigger *Trigger) version() int64     { return trigger.Version }
+func (alert *Alert) version() int64         { return alert.Version }
+func (job *CronJob) version() int64         { return job.Version }
+
+func formatETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseETag returns the version of a strong ETag.
+func parseETag(etag string) (int64, error) {
+	etag = strings.TrimSpace(etag)
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, fmt.Errorf("%s is not a strong ETag", etag)
+	}
+	version, err := strconv.ParseInt(etag[1:len(etag)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("%s is not the ETag of a version", etag)
+	}
+	return version, nil
+}
+
+// ifMatch returns the version the If-Match header of the request names, or 0
+// if there isn't one or it is "*", as the resource must exist anyway to be
+// changed.
+func ifMatch(c *gin.Context) (int64, error) {
+	header := strings.TrimSpace(c.Request.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	version, err := parseETag(header)
+	if err != nil {
+		return 0, fmt.Errorf("If-Match must name a single ETag: %s", err)
+	}
+	return version, nil
+}
+
+// ifNoneMatch reports whether the If-None-Match header of the request names
+// the ETag; as it only saves sending the resource again, weak ETags match too.
+func ifNoneMatch(c *gin.Context, etag string) bool {
+	header := strings.TrimSpace(c.Request.Header.Get("If-None-Match"))
+	if header == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// returnVersioned returns the response, with the version of the resource in
+// it as the ETag. If the request is a GET whose If-None-Match names the ETag,
+// only the 304 is returned.
+func (server *Server) returnVersioned(c *gin.Context, resp *piazza.JsonResponse) {
+	if v, ok := resp.Data.(versioned); ok && resp.StatusCode == http.StatusOK && v.version() != 0 {
+		etag := formatETag(v.version())
+		c.Header("ETag", etag)
+		if c.Request.Method == "GET" && ifNoneMatch(c, etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	piazza.GinReturnJson(c, resp)
+}
+
+// ifMatchVersion returns the version the If-Match header of the request
+// names, or returns a 400 and false if it can't be read.
+func (server *Server) ifMatchVersion(c *gin.Context) (int64, bool) {
+	version, err := ifMatch(c)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return 0, false
+	}
+	return version, true
+}
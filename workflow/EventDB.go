@@ -17,6 +17,8 @@ package workflow
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
@@ -35,12 +37,55 @@ func NewEventDB(service *Service, esi elasticsearch.IIndex) (*EventDB, error) {
 	return &erdb, nil
 }
 
+// reader is the index the events are searched in: the events alias when
+// they are partitioned
+func (db *EventDB) reader() elasticsearch.IIndex {
+	if partitions := db.service.eventPartitions; partitions != nil {
+		return partitions.Reader
+	}
+	return db.Esi
+}
+
+// holding returns the index an event is in, the base index or one of the
+// partitions of its EventType. The EventType is looked up by name if its id
+// isn't given.
+func (db *EventDB) holding(mapping string, eventTypeID piazza.Ident, id piazza.Ident, actor string) (elasticsearch.IIndex, error) {
+	partitions := db.service.eventPartitions
+	if partitions == nil {
+		return db.Esi, nil
+	}
+	if eventTypeID == "" {
+		found, ok, err := db.service.eventTypeDB.GetIDByName(nil, mapping, actor)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return db.Esi, nil
+		}
+		eventTypeID = *found
+	}
+	esi, _, err := partitions.Holding(eventTypeID, mapping, id)
+	return esi, err
+}
+
 func (db *EventDB) PostData(event *Event, typ string) error {
-	if err := db.verifyEventReadyToPost(event); err != nil {
+	eventType, err := db.verifyEventReadyToPost(event)
+	if err != nil {
 		return err
 	}
 
-	indexResult, err := db.Esi.PostData(typ, event.EventID.String(), event)
+	esi := db.Esi
+	if partitions := db.service.eventPartitions; partitions != nil {
+		on := time.Time(event.CreatedOn)
+		if on.IsZero() {
+			on = time.Now()
+		}
+		if esi, err = partitions.Writer(eventType, on); err != nil {
+			return LoggedError("EventDB.PostData failed: %s", err)
+		}
+	}
+
+	indexResult, err := esi.PostData(typ, event.EventID.String(), event)
 	if err != nil {
 		return LoggedError("EventDB.PostData failed: %s", err)
 	}
@@ -48,20 +93,46 @@ func (db *EventDB) PostData(event *Event, typ string) error {
 		return LoggedError("EventDB.PostData failed: not created")
 	}
 
+	// the events of an EventType with a retention are found by searching
+	// its partitions, so their lookups don't outlive them; a lookup that
+	// can't be recorded is logged, and the event found by a scan instead
+	if eventType.Retention == nil {
+		_ = db.service.eventLookupDB.PostData(event.EventID, typ)
+	}
+
+	return nil
+}
+
+// PutData replaces an event, which must still match its EventType
+func (db *EventDB) PutData(event *Event, typ string) error {
+	if _, err := db.verifyEventReadyToPost(event); err != nil {
+		return err
+	}
+
+	esi, err := db.holding(typ, event.EventTypeID, event.EventID, event.CreatedBy)
+	if err != nil {
+		return LoggedError("EventDB.PutData failed: %s", err)
+	}
+	if _, err := esi.PutData(typ, event.EventID.String(), event); err != nil {
+		return LoggedError("EventDB.PutData failed: %s", err)
+	}
+
 	return nil
 }
 
-func (db *EventDB) verifyEventReadyToPost(event *Event) error {
+// verifyEventReadyToPost checks the event against its EventType, which it
+// returns
+func (db *EventDB) verifyEventReadyToPost(event *Event) (*EventType, error) {
 	eventTypeJson := db.service.GetEventType(event.EventTypeID, event.CreatedBy)
 	eventTypeObj := eventTypeJson.Data
 	eventType, ok := eventTypeObj.(*EventType)
 	if !ok {
-		return LoggedError("EventDB.PostData failed: unable to obtain specified eventtype")
+		return nil, LoggedError("EventDB.PostData failed: unable to obtain specified eventtype")
 	}
 	eventTypeMapping := eventType.Mapping
 	eventTypeMappingVars, err := piazza.GetVarsFromStruct(eventTypeMapping)
 	if err != nil {
-		return LoggedError("EventDB.PostData failed: %s", err)
+		return nil, LoggedError("EventDB.PostData failed: %s", err)
 	}
 	exclude := map[string]bool{}
 	for k, v := range eventTypeMappingVars {
@@ -72,7 +143,7 @@ func (db *EventDB) verifyEventReadyToPost(event *Event) error {
 	eventdata := db.service.removeUniqueParams(eventType.Name, event.Data)
 	eventDataVars, err := piazza.GetVarsFromStructSkip(eventdata, exclude)
 	if err != nil {
-		return LoggedError("EventDB.PostData failed: %s", err)
+		return nil, LoggedError("EventDB.PostData failed: %s", err)
 	}
 	if len(eventTypeMappingVars) > len(eventDataVars) {
 		notFound := []string{}
@@ -81,7 +152,7 @@ func (db *EventDB) verifyEventReadyToPost(event *Event) error {
 				notFound = append(notFound, k)
 			}
 		}
-		return LoggedError("EventDB.PostData failed: the variables %s were specified in the EventType but were not found in the Event", notFound)
+		return nil, LoggedError("EventDB.PostData failed: the variables %s were specified in the EventType but were not found in the Event", notFound)
 	} else if len(eventTypeMappingVars) < len(eventDataVars) {
 		extra := []string{}
 		for k, _ := range eventDataVars {
@@ -89,25 +160,25 @@ func (db *EventDB) verifyEventReadyToPost(event *Event) error {
 				extra = append(extra, k)
 			}
 		}
-		return LoggedError("EventDB.PostData failed: the variables %s were not specified in the EventType but were found in the Event", extra)
+		return nil, LoggedError("EventDB.PostData failed: the variables %s were not specified in the EventType but were found in the Event", extra)
 	}
 	for k, v := range eventTypeMappingVars {
 		for k2, v2 := range eventDataVars {
 			if k2 == k {
 				if !elasticsearch.IsValidArrayTypeMapping(v) {
 					if piazza.ValueIsValidArray(v2) {
-						return LoggedError("EventDB.PostData failed: an array was passed into the non-array field %s", k)
+						return nil, LoggedError("EventDB.PostData failed: an array was passed into the non-array field %s", k)
 					}
 				} else {
 					if !piazza.ValueIsValidArray(v2) {
-						return LoggedError("EventDB.PostData failed: a non-array was pasted into the array field %s", k)
+						return nil, LoggedError("EventDB.PostData failed: a non-array was pasted into the array field %s", k)
 					}
 				}
 				break
 			}
 		}
 	}
-	return nil
+	return eventType, nil
 }
 
 func (db *EventDB) GetAll(mapping string, format *piazza.JsonPagination, actor string) ([]Event, int64, error) {
@@ -124,7 +195,7 @@ func (db *EventDB) GetAll(mapping string, format *piazza.JsonPagination, actor s
 		return nil, 0, fmt.Errorf("Type %s does not exist (1)", mapping)
 	}
 
-	searchResult, err := db.Esi.FilterByMatchAll(mapping, format)
+	searchResult, err := db.reader().FilterByMatchAll(mapping, format)
 	if err != nil {
 		return nil, 0, LoggedError("EventDB.GetAll failed: %s", err)
 	}
@@ -160,7 +231,7 @@ func (db *EventDB) GetEventsByDslQuery(mapping string, jsnString string, actor s
 		return nil, 0, fmt.Errorf("Type %s does not exist (2)", mapping)
 	}
 
-	searchResult, err := db.Esi.SearchByJSON(mapping, jsnString)
+	searchResult, err := db.reader().SearchByJSON(mapping, jsnString)
 	if err != nil {
 		return nil, 0, LoggedError("EventDB.GetEventsByDslQuery failed: %s", err)
 	}
@@ -195,7 +266,7 @@ func (db *EventDB) GetEventsByEventTypeID(format *piazza.JsonPagination, mapping
 		return nil, 0, fmt.Errorf("Type %s does not exist (3)", mapping)
 	}
 
-	searchResult, err := db.Esi.FilterByTermQuery(mapping, "eventTypeId", eventTypeID, format)
+	searchResult, err := db.reader().FilterByTermQuery(mapping, "eventTypeId", eventTypeID.String(), format)
 	if err != nil {
 		return nil, 0, LoggedError("EventDB.GetEventsByEventTypeId failed: %s", err)
 	}
@@ -216,28 +287,165 @@ func (db *EventDB) GetEventsByEventTypeID(format *piazza.JsonPagination, mapping
 	return events, searchResult.TotalHits(), nil
 }
 
-func (db *EventDB) lookupEventTypeNameByEventID(id piazza.Ident, actor string) (string, error) {
-	var mapping string
+// GetEventsByCreator returns the events of one EventType with the given
+// createdBy, such as those fired by a repeating event
+func (db *EventDB) GetEventsByCreator(format *piazza.JsonPagination, mapping string, createdBy string, actor string) ([]Event, int64, error) {
+	events := []Event{}
 
-	types, err := db.Esi.GetTypes()
+	exists, err := db.Esi.TypeExists(mapping)
 	if err != nil {
-		return "", err
+		return events, 0, err
 	}
-	for _, typ := range types {
-		ok, err := db.Esi.ItemExists(typ, id.String())
-		if err != nil {
-			return "", err
+	if !exists {
+		return events, 0, nil
+	}
+
+	searchResult, err := db.reader().FilterByTermQuery(mapping, "createdBy", createdBy, format)
+	if err != nil {
+		return nil, 0, LoggedError("EventDB.GetEventsByCreator failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("EventDB.GetEventsByCreator failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var event Event
+			if err := json.Unmarshal(*hit.Source, &event); err != nil {
+				return nil, 0, err
+			}
+			events = append(events, event)
 		}
-		if ok {
-			mapping = typ
-			break
+	}
+
+	return events, searchResult.TotalHits(), nil
+}
+
+// CountEventsByEventTypeID returns how many events an EventType has.
+func (db *EventDB) CountEventsByEventTypeID(mapping string, eventTypeID piazza.Ident) (int64, error) {
+	exists, err := db.Esi.TypeExists(mapping)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventTypeID}},
+		"size":  0,
+	}
+	byts, err := json.Marshal(query)
+	if err != nil {
+		return 0, err
+	}
+	searchResult, err := db.reader().SearchByJSON(mapping, string(byts))
+	if err != nil {
+		return 0, LoggedError("EventDB.CountEventsByEventTypeID failed: %s", err)
+	}
+	if searchResult == nil {
+		return 0, LoggedError("EventDB.CountEventsByEventTypeID failed: no searchResult")
+	}
+	return searchResult.TotalHits(), nil
+}
+
+// GetEventIDsByEventTypeID returns, in order, the IDs of up to size of the
+// events of an EventType that come after the given ID, or the first of them
+// if it is empty. Paging by the last ID, rather than by an offset, reaches
+// every event however many there are.
+func (db *EventDB) GetEventIDsByEventTypeID(mapping string, eventTypeID piazza.Ident, after piazza.Ident, size int) ([]piazza.Ident, error) {
+	ids := []piazza.Ident{}
+
+	exists, err := db.Esi.TypeExists(mapping)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return ids, nil
+	}
+
+	must := []interface{}{
+		map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventTypeID}},
+	}
+	if after != "" {
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{"eventId": map[string]interface{}{"gt": after}}})
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": must}},
+		"sort":  []interface{}{map[string]interface{}{"eventId": "asc"}},
+		"size":  size,
+	}
+	byts, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	searchResult, err := db.reader().SearchByJSON(mapping, string(byts))
+	if err != nil {
+		return nil, LoggedError("EventDB.GetEventIDsByEventTypeID failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, LoggedError("EventDB.GetEventIDsByEventTypeID failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var event Event
+			if err := json.Unmarshal(*hit.Source, &event); err != nil {
+				return nil, err
+			}
+			ids = append(ids, event.EventID)
 		}
 	}
-	if mapping == "" {
+	return ids, nil
+}
+
+// lookupEventTypeNameByEventID finds the EventType of an event in the
+// EventLookupDB. An event that isn't recorded there, as it was posted before
+// the EventLookupDB was kept or its EventType has a retention, is searched
+// for instead.
+func (db *EventDB) lookupEventTypeNameByEventID(id piazza.Ident, actor string) (string, error) {
+	mapping, found, err := db.service.eventLookupDB.GetName(id)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return mapping, nil
+	}
+
+	eventType, err := db.findEventType(id, actor)
+	if err != nil {
+		return "", err
+	}
+	if eventType == nil {
 		return "", LoggedError("EventDB.lookupEventTypeNameByEventID failed: [Item %s in index events does not exist]", id.String())
 	}
+	if eventType.Retention == nil {
+		_ = db.service.eventLookupDB.PostData(id, eventType.Name)
+	}
+
+	return eventType.Name, nil
+}
 
-	return mapping, nil
+// findEventType searches all of the events for one, and returns its
+// EventType, or nil if there is no such event.
+func (db *EventDB) findEventType(id piazza.Ident, actor string) (*EventType, error) {
+	query := fmt.Sprintf(`{"query":{"term":{"eventId":%q}}}`, id.String())
+	searchResult, err := db.reader().SearchByJSON("", query)
+	if err != nil {
+		return nil, LoggedError("EventDB.lookupEventTypeNameByEventID failed: %s", err)
+	}
+	if searchResult == nil || searchResult.NumHits() == 0 {
+		return nil, nil
+	}
+	var event Event
+	if err = json.Unmarshal(*searchResult.GetHit(0).Source, &event); err != nil {
+		return nil, err
+	}
+	eventType, found, err := db.service.eventTypeDB.GetOne(event.EventTypeID, actor)
+	if err != nil || !found {
+		return nil, err
+	}
+	return eventType, nil
 }
 
 // NameExists checks if an EventType name exists.
@@ -247,7 +455,11 @@ func (db *EventDB) NameExists(name string, actor string) (bool, error) {
 }
 
 func (db *EventDB) GetOne(mapping string, id piazza.Ident, actor string) (*Event, bool, error) {
-	getResult, err := db.Esi.GetByID(mapping, id.String())
+	esi, err := db.holding(mapping, "", id, actor)
+	if err != nil {
+		return nil, false, LoggedError("EventDB.GetOne failed: %s", err)
+	}
+	getResult, err := esi.GetByID(mapping, id.String())
 	if err != nil {
 		return nil, false, LoggedError("EventDB.GetOne failed: %s", err)
 	}
@@ -265,13 +477,22 @@ func (db *EventDB) GetOne(mapping string, id piazza.Ident, actor string) (*Event
 }
 
 func (db *EventDB) DeleteByID(mapping string, id piazza.Ident, actor string) (bool, error) {
-	deleteResult, err := db.Esi.DeleteByID(mapping, string(id))
+	esi, err := db.holding(mapping, "", id, actor)
+	if err != nil {
+		return false, LoggedError("EventDB.DeleteById failed: %s", err)
+	}
+	deleteResult, err := esi.DeleteByID(mapping, string(id))
 	if err != nil {
 		return deleteResult.Found, LoggedError("EventDB.DeleteById failed: %s", err)
 	}
 	if deleteResult == nil {
 		return false, LoggedError("EventDB.DeleteById failed: no deleteResult")
 	}
+	if deleteResult.Found {
+		if err = db.service.eventLookupDB.DeleteByID(id); err != nil {
+			return true, err
+		}
+	}
 
 	return deleteResult.Found, nil
 }
@@ -281,13 +502,34 @@ func (db *EventDB) AddMapping(name string, mapping map[string]interface{}, actor
 	if err != nil {
 		return LoggedError("EventDB.AddMapping failed: %s", err)
 	}
-	if err = db.Esi.SetMapping(name, jsn); err != nil {
+	// the partitions are given the mapping too, so that the type can be
+	// searched for through the alias
+	if err = db.reader().SetMapping(name, jsn); err != nil {
 		return LoggedError("EventDB.AddMapping SetMapping failed: %s", err)
 	}
 
 	return nil
 }
 
+// typeDeleter is an index that can drop a type. Elasticsearch 2 can't, so
+// there the mappings of deleted EventTypes are kept.
+type typeDeleter interface {
+	DeleteType(typ string) error
+}
+
+// DeleteMapping drops the EventType's mapping, where the index can, and says
+// if it did.
+func (db *EventDB) DeleteMapping(name string, actor string) (bool, error) {
+	deleter, ok := db.reader().(typeDeleter)
+	if !ok {
+		return false, nil
+	}
+	if err := deleter.DeleteType(name); err != nil {
+		return false, LoggedError("EventDB.DeleteMapping failed: %s", err)
+	}
+	return true, nil
+}
+
 func ConstructEventMappingSchema(name string, mapping map[string]interface{}) (piazza.JsonString, error) {
 	const template string = `{
 		"%s":{
@@ -378,3 +620,100 @@ func (db *EventDB) PercolateEventData(eventType string, data map[string]interfac
 
 	return &ids, nil
 }
+
+// AddPercolationQuery registers the query with the events index, under the
+// given id, so that events posted later are matched against it.
+func (db *EventDB) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	return db.Esi.AddPercolationQuery(id, query)
+}
+
+// DeletePercolationQuery removes a query added by AddPercolationQuery.
+func (db *EventDB) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	return db.Esi.DeletePercolationQuery(id)
+}
+
+// dryRunQueryID is the id of the query PercolateSamples registers.
+const dryRunQueryID = "dryrun"
+
+// PercolateSamples matches each of the documents, the data of events of the
+// type, against the query alone, and says which matched. The query is
+// registered in a scratch index with the type's mapping, dropped afterwards,
+// so the events posted meanwhile are never matched against it.
+func (db *EventDB) PercolateSamples(typ string, query piazza.JsonString, samples []map[string]interface{}) ([]bool, error) {
+	mapping, err := db.Esi.GetMapping(typ)
+	if err != nil {
+		return nil, LoggedError("EventDB.PercolateSamples failed: %s", err)
+	}
+	typeMapping, ok := mapping.(map[string]interface{})[typ]
+	if !ok {
+		return nil, LoggedError("EventDB.PercolateSamples failed: type %s has no mapping", typ)
+	}
+	cluster, err := db.scratchCluster()
+	if err != nil {
+		return nil, LoggedError("EventDB.PercolateSamples failed: %s", err)
+	}
+
+	name := db.reader().IndexName() + "-dryrun-" + strings.ToLower(db.service.newIdent().String())
+	defer func() {
+		if ok, _ := cluster.IndexExists(name); ok {
+			if err := cluster.DeleteIndex(name); err != nil {
+				db.service.syslogger.Warning("EventDB: scratch index %s was not dropped: %s", name, err)
+			}
+		}
+	}()
+	percolator, err := db.createScratch(cluster, name, typ, map[string]interface{}{typ: typeMapping})
+	if err != nil {
+		return nil, LoggedError("EventDB.PercolateSamples failed: %s", err)
+	}
+	if _, err = percolator.AddPercolationQuery(dryRunQueryID, query); err != nil {
+		return nil, LoggedError("EventDB.PercolateSamples addpercquery failed: %s", err)
+	}
+
+	matched := make([]bool, len(samples))
+	for i, sample := range samples {
+		resp, err := percolator.AddPercolationDocument(typ, map[string]interface{}{"data": sample})
+		if err != nil {
+			return nil, LoggedError("EventDB.PercolateSamples failed: %s", err)
+		}
+		matched[i] = len(resp.Matches) != 0
+	}
+	return matched, nil
+}
+
+// scratchCluster is the cluster the events index is in, where
+// PercolateSamples makes its scratch index.
+func (db *EventDB) scratchCluster() (PartitionCluster, error) {
+	if esi, ok := db.Esi.(*PercolatorIndex); ok {
+		return esi.Cluster, nil
+	}
+	if partitions := db.service.eventPartitions; partitions != nil {
+		return partitions.Cluster, nil
+	}
+	return nil, fmt.Errorf("the index %s is in no cluster", db.Esi.IndexName())
+}
+
+// createScratch makes the scratch index of PercolateSamples, an index of
+// the type on its own in Elasticsearch 2 or memory, or a percolator index
+// from Elasticsearch 5.
+func (db *EventDB) createScratch(cluster PartitionCluster, name string, typ string, mapping map[string]interface{}) (Percolator, error) {
+	if es, ok := cluster.(*esPartitionCluster); ok && usesPercolatorField(db.Esi.GetVersion()) {
+		percolator, err := newESPercolator(&es.esMigrationCluster, name)
+		if err != nil {
+			return nil, err
+		}
+		byts, err := json.Marshal(mapping)
+		if err != nil {
+			return nil, err
+		}
+		return percolator, percolator.SetMapping(typ, piazza.JsonString(byts))
+	}
+
+	byts, err := json.Marshal(map[string]interface{}{"mappings": mapping})
+	if err != nil {
+		return nil, err
+	}
+	if err = cluster.CreateIndex(name, byts); err != nil {
+		return nil, err
+	}
+	return cluster.OpenIndex(name)
+}
@@ -0,0 +1,139 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// defaultEventLookupsCached is how many lookups are kept in memory.
+const defaultEventLookupsCached = 10000
+
+// EventLookupDB maps the id of each event to the name of its EventType. The
+// most recently used lookups are also kept in memory.
+type EventLookupDB struct {
+	*ResourceDB
+	mapping string
+
+	cached int
+	names  map[piazza.Ident]string
+	order  []piazza.Ident
+	lock   sync.Mutex
+}
+
+func NewEventLookupDB(service *Service, esi elasticsearch.IIndex) (*EventLookupDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	eldb := EventLookupDB{
+		ResourceDB: rdb,
+		mapping:    EventLookupDBMapping,
+		cached:     defaultEventLookupsCached,
+		names:      map[piazza.Ident]string{},
+	}
+	return &eldb, nil
+}
+
+// cache remembers a lookup, forgetting the oldest if need be.
+func (db *EventLookupDB) cache(eventID piazza.Ident, name string) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.names[eventID]; !ok {
+		db.order = append(db.order, eventID)
+	}
+	db.names[eventID] = name
+	for len(db.order) > db.cached {
+		delete(db.names, db.order[0])
+		db.order = db.order[1:]
+	}
+}
+
+func (db *EventLookupDB) uncache(eventID piazza.Ident) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.names[eventID]; !ok {
+		return
+	}
+	delete(db.names, eventID)
+	for i, id := range db.order {
+		if id == eventID {
+			db.order = append(db.order[:i], db.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// PostData records the EventType of an event.
+func (db *EventLookupDB) PostData(eventID piazza.Ident, eventTypeName string) error {
+	lookup := &EventLookup{EventID: eventID, EventTypeName: eventTypeName}
+	if _, err := db.Esi.PutData(db.mapping, eventID.String(), lookup); err != nil {
+		return LoggedError("EventLookupDB.PostData failed: %s", err)
+	}
+	db.cache(eventID, eventTypeName)
+	return nil
+}
+
+// GetName returns the name of the EventType of an event, if it was recorded.
+func (db *EventLookupDB) GetName(eventID piazza.Ident) (string, bool, error) {
+	db.lock.Lock()
+	name, ok := db.names[eventID]
+	db.lock.Unlock()
+	if ok {
+		return name, true, nil
+	}
+
+	ok, err := db.Esi.ItemExists(db.mapping, eventID.String())
+	if err != nil {
+		return "", false, LoggedError("EventLookupDB.GetName failed: %s", err)
+	}
+	if !ok {
+		return "", false, nil
+	}
+	getResult, err := db.Esi.GetByID(db.mapping, eventID.String())
+	if err != nil {
+		return "", false, LoggedError("EventLookupDB.GetName failed: %s", err)
+	}
+	if getResult == nil || getResult.Source == nil {
+		return "", false, LoggedError("EventLookupDB.GetName failed: no getResult")
+	}
+	var lookup EventLookup
+	if err = json.Unmarshal(*getResult.Source, &lookup); err != nil {
+		return "", false, err
+	}
+	db.cache(eventID, lookup.EventTypeName)
+	return lookup.EventTypeName, true, nil
+}
+
+// DeleteByID forgets the EventType of an event; it is not an error if it
+// wasn't recorded.
+func (db *EventLookupDB) DeleteByID(eventID piazza.Ident) error {
+	db.uncache(eventID)
+	ok, err := db.Esi.ItemExists(db.mapping, eventID.String())
+	if err != nil {
+		return LoggedError("EventLookupDB.DeleteByID failed: %s", err)
+	}
+	if !ok {
+		return nil
+	}
+	if _, err = db.Esi.DeleteByID(db.mapping, eventID.String()); err != nil {
+		return LoggedError("EventLookupDB.DeleteByID failed: %s", err)
+	}
+	return nil
+}
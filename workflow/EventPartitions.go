@@ -0,0 +1,349 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The retention periods of an EventType.
+const (
+	RetentionDaily   = "daily"
+	RetentionMonthly = "monthly"
+)
+
+// retentionLayouts are the formats of the dates in the partition names.
+var retentionLayouts = map[string]string{
+	RetentionDaily:   "2006.01.02",
+	RetentionMonthly: "2006.01",
+}
+
+// ErrRetentionUnsupported is returned for a retention where the events aren't
+// partitioned, as where an index has one type the events of each EventType
+// are kept in an index of their own.
+var ErrRetentionUnsupported = errors.New("Retention is not supported where the events of each eventType are kept in an index of their own")
+
+// Validate checks the period is known and the count isn't negative.
+func (retention *EventRetention) Validate() error {
+	if _, ok := retentionLayouts[retention.Period]; !ok {
+		return fmt.Errorf("Retention period must be %s or %s, not %q", RetentionDaily, RetentionMonthly, retention.Period)
+	}
+	if retention.Keep < 0 {
+		return fmt.Errorf("Retention keep must not be negative, not %d", retention.Keep)
+	}
+	return nil
+}
+
+// ParseEventRetention reads a retention written as period:keep, such as
+// daily:30.
+func ParseEventRetention(s string) (*EventRetention, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Retention must be written as period:keep, not %q", s)
+	}
+	retention := &EventRetention{Period: parts[0]}
+	if _, err := fmt.Sscanf(parts[1], "%d", &retention.Keep); err != nil {
+		return nil, fmt.Errorf("Retention must be written as period:keep, not %q", s)
+	}
+	if err := retention.Validate(); err != nil {
+		return nil, err
+	}
+	return retention, nil
+}
+
+//---------------------------------------------------------------------------
+
+// PartitionCluster makes and drops the partitions of the events index.
+type PartitionCluster interface {
+	IndexExists(index string) (bool, error)
+	CreateIndex(index string, body json.RawMessage) error
+	AliasedIndices(alias string) ([]string, error)
+	DeleteIndex(index string) error
+	OpenIndex(index string) (elasticsearch.IIndex, error)
+}
+
+// EventPartitions keeps the events of EventTypes with a retention in an
+// index per period, named events-<eventTypeId>-<date>, which are all under
+// the alias the events are read through. Everything else, the events of the
+// other EventTypes, the mappings and the percolation queries, stays in the
+// base index, so the queries carry across the partitions as they come and
+// go.
+type EventPartitions struct {
+	Cluster PartitionCluster
+	// Base is the index under the alias that was there before the partitions.
+	Base elasticsearch.IIndex
+	// Reader is the alias.
+	Reader elasticsearch.IIndex
+	// Settings is the body a partition is made with, less the mappings it
+	// copies from the base and the alias.
+	Settings string
+
+	now  func() time.Time
+	lock sync.Mutex
+	open map[string]elasticsearch.IIndex
+}
+
+func NewEventPartitions(cluster PartitionCluster, base elasticsearch.IIndex, reader elasticsearch.IIndex, settings string) *EventPartitions {
+	return &EventPartitions{
+		Cluster:  cluster,
+		Base:     base,
+		Reader:   reader,
+		Settings: settings,
+		now:      time.Now,
+		open:     map[string]elasticsearch.IIndex{},
+	}
+}
+
+// NewElasticsearchPartitions keeps the partitions in the cluster behind the
+// base index.
+func NewElasticsearchPartitions(url string, base elasticsearch.IIndex, reader elasticsearch.IIndex, settings string) *EventPartitions {
+	cluster := &esPartitionCluster{esMigrationCluster: esMigrationCluster{esi: base}, url: url}
+	return NewEventPartitions(cluster, base, reader, settings)
+}
+
+// partitionPrefix is the start of the names of the partitions of an
+// EventType.
+func (partitions *EventPartitions) partitionPrefix(eventTypeID piazza.Ident) string {
+	return partitions.Reader.IndexName() + "-" + strings.ToLower(eventTypeID.String()) + "-"
+}
+
+// PartitionName is the name of the partition an event made at the time goes
+// in.
+func (partitions *EventPartitions) PartitionName(eventType *EventType, on time.Time) string {
+	layout := retentionLayouts[eventType.Retention.Period]
+	return partitions.partitionPrefix(eventType.EventTypeID) + on.UTC().Format(layout)
+}
+
+// Partitions returns the names of the partitions of the EventType, oldest
+// first.
+func (partitions *EventPartitions) Partitions(eventTypeID piazza.Ident) ([]string, error) {
+	indices, err := partitions.Cluster.AliasedIndices(partitions.Reader.IndexName())
+	if err != nil {
+		return nil, err
+	}
+	prefix := partitions.partitionPrefix(eventTypeID)
+	names := []string{}
+	for _, index := range indices {
+		if strings.HasPrefix(index, prefix) {
+			names = append(names, index)
+		}
+	}
+	return names, nil
+}
+
+// Index opens a partition.
+func (partitions *EventPartitions) Index(name string) (elasticsearch.IIndex, error) {
+	partitions.lock.Lock()
+	defer partitions.lock.Unlock()
+	if esi, ok := partitions.open[name]; ok {
+		return esi, nil
+	}
+	esi, err := partitions.Cluster.OpenIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	partitions.open[name] = esi
+	return esi, nil
+}
+
+// Writer returns the index an event of the EventType made at the time is
+// written to, making the partition for the period if it is the first, and
+// then dropping the partitions that have passed out of the retention.
+func (partitions *EventPartitions) Writer(eventType *EventType, on time.Time) (elasticsearch.IIndex, error) {
+	if eventType.Retention == nil {
+		return partitions.Base, nil
+	}
+
+	name := partitions.PartitionName(eventType, on)
+	partitions.lock.Lock()
+	esi, ok := partitions.open[name]
+	partitions.lock.Unlock()
+	if ok {
+		return esi, nil
+	}
+
+	created, err := partitions.create(name)
+	if err != nil {
+		return nil, err
+	}
+	if esi, err = partitions.Index(name); err != nil {
+		return nil, err
+	}
+	if created {
+		if _, err = partitions.Expire(eventType); err != nil {
+			log.Printf("EventPartitions: expiring the partitions of %s failed: %s", eventType.Name, err)
+		}
+	}
+	return esi, nil
+}
+
+// create makes the partition if it doesn't exist, and says if it did. It
+// is given all of the mappings of the base, as a search through the alias
+// checks its type is in every index.
+func (partitions *EventPartitions) create(name string) (bool, error) {
+	if ok, err := partitions.Cluster.IndexExists(name); err != nil || ok {
+		return false, err
+	}
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(partitions.Settings), &body); err != nil {
+		return false, err
+	}
+	mappings, _ := body["mappings"].(map[string]interface{})
+	if mappings == nil {
+		mappings = map[string]interface{}{}
+		body["mappings"] = mappings
+	}
+	types, err := partitions.Base.GetTypes()
+	if err != nil {
+		return false, err
+	}
+	for _, typ := range types {
+		// the percolation queries stay in the base
+		if strings.HasPrefix(typ, ".") {
+			continue
+		}
+		mapping, err := partitions.Base.GetMapping(typ)
+		if err != nil {
+			return false, err
+		}
+		if m, ok := mapping.(map[string]interface{})[typ]; ok {
+			mappings[typ] = m
+		}
+	}
+	body["aliases"] = map[string]interface{}{partitions.Reader.IndexName(): map[string]interface{}{}}
+	byts, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+
+	if err = partitions.Cluster.CreateIndex(name, byts); err != nil {
+		// another instance may have just made it
+		if ok, _ := partitions.Cluster.IndexExists(name); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Expire drops the partitions of the EventType that are older than its
+// retention keeps, and returns their names. Keep counts the current period,
+// so with a Keep of 1 only it is left.
+func (partitions *EventPartitions) Expire(eventType *EventType) ([]string, error) {
+	if eventType.Retention == nil || eventType.Retention.Keep == 0 {
+		return []string{}, nil
+	}
+	layout := retentionLayouts[eventType.Retention.Period]
+	now := partitions.now().UTC()
+	var cutoff time.Time
+	back := eventType.Retention.Keep - 1
+	switch eventType.Retention.Period {
+	case RetentionDaily:
+		cutoff = time.Date(now.Year(), now.Month(), now.Day()-back, 0, 0, 0, 0, time.UTC)
+	case RetentionMonthly:
+		cutoff = time.Date(now.Year(), now.Month()-time.Month(back), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	names, err := partitions.Partitions(eventType.EventTypeID)
+	if err != nil {
+		return nil, err
+	}
+	prefix := partitions.partitionPrefix(eventType.EventTypeID)
+	dropped := []string{}
+	for _, name := range names {
+		// a partition of another period is left for its own retention
+		on, err := time.Parse(layout, strings.TrimPrefix(name, prefix))
+		if err != nil || !on.Before(cutoff) {
+			continue
+		}
+		if err = partitions.Cluster.DeleteIndex(name); err != nil {
+			return dropped, err
+		}
+		partitions.lock.Lock()
+		delete(partitions.open, name)
+		partitions.lock.Unlock()
+		dropped = append(dropped, name)
+	}
+	return dropped, nil
+}
+
+// Drop deletes all of the partitions of the EventType, and returns their
+// names.
+func (partitions *EventPartitions) Drop(eventTypeID piazza.Ident) ([]string, error) {
+	names, err := partitions.Partitions(eventTypeID)
+	if err != nil {
+		return nil, err
+	}
+	dropped := []string{}
+	for _, name := range names {
+		if err = partitions.Cluster.DeleteIndex(name); err != nil {
+			return dropped, err
+		}
+		partitions.lock.Lock()
+		delete(partitions.open, name)
+		partitions.lock.Unlock()
+		dropped = append(dropped, name)
+	}
+	return dropped, nil
+}
+
+// Holding returns the index that holds the event: the base, or one of the
+// partitions of its EventType.
+func (partitions *EventPartitions) Holding(eventTypeID piazza.Ident, typ string, id piazza.Ident) (elasticsearch.IIndex, bool, error) {
+	if ok, err := partitions.Base.ItemExists(typ, id.String()); err != nil || ok {
+		return partitions.Base, ok, err
+	}
+	names, err := partitions.Partitions(eventTypeID)
+	if err != nil {
+		return nil, false, err
+	}
+	// the newest are the likeliest
+	for i := len(names) - 1; i >= 0; i-- {
+		esi, err := partitions.Index(names[i])
+		if err != nil {
+			return nil, false, err
+		}
+		if ok, err := esi.ItemExists(typ, id.String()); err != nil || ok {
+			return esi, ok, err
+		}
+	}
+	return partitions.Base, false, nil
+}
+
+//---------------------------------------------------------------------------
+
+// esPartitionCluster is the PartitionCluster of an Elasticsearch cluster.
+type esPartitionCluster struct {
+	esMigrationCluster
+	url string
+}
+
+func (cluster *esPartitionCluster) DeleteIndex(index string) error {
+	return cluster.acknowledged("DELETE", "/"+index, nil)
+}
+
+func (cluster *esPartitionCluster) OpenIndex(index string) (elasticsearch.IIndex, error) {
+	return elasticsearch.NewIndex2(cluster.url, index, "")
+}
@@ -35,6 +35,11 @@ func NewEventTypeDB(service *Service, esi elasticsearch.IIndex) (*EventTypeDB, e
 	return &etrdb, nil
 }
 
+// Mapping returns the type the EventTypes are kept under.
+func (db *EventTypeDB) Mapping() string {
+	return db.mapping
+}
+
 func (db *EventTypeDB) PostData(eventType *EventType) error {
 	vars, err := piazza.GetVarsFromStruct(eventType.Mapping)
 	if err != nil {
@@ -45,17 +50,36 @@ func (db *EventTypeDB) PostData(eventType *EventType) error {
 			return LoggedError("EventTypeDB.PostData failed: %v was not recognized as a valid mapping type", v)
 		}
 	}
-	indexResult, err := db.Esi.PostData(db.mapping, eventType.EventTypeID.String(), eventType)
+	stored := *eventType
+	stored.Version = 0
+	indexResult, err := db.Esi.PostData(db.mapping, eventType.EventTypeID.String(), &stored)
 	if err != nil {
 		return LoggedError("EventTypeDB.PostData failed: %s", err)
 	}
 	if !indexResult.Created {
 		return LoggedError("EventTypeDB.PostData failed: not created")
 	}
+	eventType.Version = int64(indexResult.Version)
 
 	return nil
 }
 
+// PutData replaces an EventType, if it is still at the version, or in any
+// case if the version is 0
+func (db *EventTypeDB) PutData(eventType *EventType, version int64) error {
+	stored := *eventType
+	stored.Version = 0
+	newVersion, err := db.putVersioned(db.mapping, eventType.EventTypeID, &stored, version)
+	if err == ErrVersionConflict {
+		return err
+	}
+	if err != nil {
+		return LoggedError("EventTypeDB.PutData failed: %s", err)
+	}
+	eventType.Version = newVersion
+	return nil
+}
+
 func (db *EventTypeDB) GetAll(format *piazza.JsonPagination, actor string) ([]EventType, int64, error) {
 	eventTypes := []EventType{}
 
@@ -121,21 +145,14 @@ func (db *EventTypeDB) GetEventTypesByDslQuery(dslString string, actor string) (
 }
 
 func (db *EventTypeDB) GetOne(id piazza.Ident, actor string) (*EventType, bool, error) {
-	getResult, err := db.Esi.GetByID(db.mapping, id.String())
-	if err != nil {
-		return nil, getResult.Found, LoggedError("EventTypeDB.GetOne failed: %s", err.Error())
-	}
-	if getResult == nil {
-		return nil, true, LoggedError("EventTypeDB.GetOne failed: no getResult")
-	}
-
-	src := getResult.Source
 	var eventType EventType
-	if err = json.Unmarshal(*src, &eventType); err != nil {
-		return nil, getResult.Found, err
+	found, version, err := db.getVersioned(db.mapping, id, &eventType)
+	if err != nil {
+		return nil, found, LoggedError("EventTypeDB.GetOne failed: %s", err.Error())
 	}
+	eventType.Version = version
 
-	return &eventType, getResult.Found, nil
+	return &eventType, found, nil
 }
 
 func (db *EventTypeDB) GetIDByName(format *piazza.JsonPagination, name string, actor string) (*piazza.Ident, bool, error) {
@@ -166,14 +183,16 @@ func (db *EventTypeDB) GetIDByName(format *piazza.JsonPagination, name string, a
 	return &eventType.EventTypeID, getResult.Found, nil
 }
 
-func (db *EventTypeDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
-	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
-	if err != nil {
-		return deleteResult.Found, LoggedError("EventTypeDB.DeleteById failed: %s", err)
+// DeleteByID deletes an EventType, if it is still at the version, or in any
+// case if the version is 0.
+func (db *EventTypeDB) DeleteByID(id piazza.Ident, version int64, actor string) (bool, error) {
+	found, err := db.deleteVersioned(db.mapping, id, version)
+	if err == ErrVersionConflict {
+		return false, err
 	}
-	if deleteResult == nil {
-		return false, LoggedError("EventTypeDB.DeleteById failed: no deleteResult")
+	if err != nil {
+		return found, LoggedError("EventTypeDB.DeleteById failed: %s", err)
 	}
 
-	return deleteResult.Found, nil
+	return found, nil
 }
@@ -0,0 +1,299 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Dependents are the resources of one kind that refer to an EventType. The
+// Events are only counted, as there may be more of them than can be listed.
+type Dependents struct {
+	Count int            `json:"count"`
+	IDs   []piazza.Ident `json:"ids"`
+}
+
+func (dependents *Dependents) add(id piazza.Ident) {
+	dependents.IDs = append(dependents.IDs, id)
+	dependents.Count++
+}
+
+// EventTypeDependencies lists what refers to an EventType: the Triggers on
+// it, or whose action posts an Event of it, its Events, its repeating
+// Events, and the Alerts of those Triggers. After a cascading delete, it
+// lists what was deleted, along with the partitions of its Events and
+// whether its mapping could be dropped.
+type EventTypeDependencies struct {
+	EventTypeID    piazza.Ident `json:"eventTypeId"`
+	Triggers       Dependents   `json:"triggers"`
+	Events         Dependents   `json:"events"`
+	Crons          Dependents   `json:"crons"`
+	Alerts         Dependents   `json:"alerts"`
+	Partitions     []string     `json:"partitions,omitempty"`
+	MappingDeleted bool         `json:"mappingDeleted"`
+}
+
+func newEventTypeDependencies(id piazza.Ident) *EventTypeDependencies {
+	return &EventTypeDependencies{
+		EventTypeID: id,
+		Triggers:    Dependents{IDs: []piazza.Ident{}},
+		Events:      Dependents{IDs: []piazza.Ident{}},
+		Crons:       Dependents{IDs: []piazza.Ident{}},
+		Alerts:      Dependents{IDs: []piazza.Ident{}},
+	}
+}
+
+//---------------------------------------------------------------------------
+
+// GetEventTypeDependencies lists what refers to the EventType.
+func (service *Service) GetEventTypeDependencies(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingEventTypeDependencies", id, "Service.GetEventTypeDependencies: User is getting the dependencies of eventType [%s]", id)
+	dependencies, err := service.eventTypeDependencies(eventType)
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingEventTypeDependenciesFailure", id, "Service.GetEventTypeDependencies: User failed to get the dependencies of eventType [%s]", id)
+		return service.statusInternalError(err)
+	}
+	service.syslogger.Audit("pz-workflow", "gotEventTypeDependencies", id, "Service.GetEventTypeDependencies: User successfully got the dependencies of eventType [%s]", id)
+
+	return service.statusOK(dependencies)
+}
+
+func (service *Service) eventTypeDependencies(eventType *EventType) (*EventTypeDependencies, error) {
+	id := eventType.EventTypeID
+	dependencies := newEventTypeDependencies(id)
+
+	const perPage = 100
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "triggerId", Order: piazza.SortOrderAscending}
+		triggers, _, err := service.triggerDB.GetAll(format, "pz-workflow")
+		if err != nil {
+			return nil, LoggedError("Service.eventTypeDependencies: Unable to get the triggers: %s", err)
+		}
+		for _, trigger := range triggers {
+			if trigger.EventTypeID == id || (trigger.Action != nil && trigger.Action.Event != nil && trigger.Action.Event.EventTypeID == id) {
+				dependencies.Triggers.add(trigger.TriggerID)
+			}
+		}
+		if len(triggers) < perPage {
+			break
+		}
+	}
+
+	for _, triggerID := range dependencies.Triggers.IDs {
+		alerts, err := service.alertsOfTrigger(triggerID)
+		if err != nil {
+			return nil, err
+		}
+		for _, alertID := range alerts {
+			dependencies.Alerts.add(alertID)
+		}
+	}
+
+	if ok, err := service.cronDB.Exists("pz-workflow"); err != nil {
+		return nil, LoggedError("Service.eventTypeDependencies: Unable to get the crons: %s", err)
+	} else if ok {
+		for page := 0; ; page++ {
+			format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "eventId", Order: piazza.SortOrderAscending}
+			jobs, _, err := service.cronDB.GetAll(format, "pz-workflow")
+			if err != nil {
+				return nil, LoggedError("Service.eventTypeDependencies: Unable to get the crons: %s", err)
+			}
+			for _, job := range jobs {
+				if job.EventTypeID == id {
+					dependencies.Crons.add(job.EventID)
+				}
+			}
+			if len(jobs) < perPage {
+				break
+			}
+		}
+	}
+
+	count, err := service.eventDB.CountEventsByEventTypeID(eventType.Name, id)
+	if err != nil {
+		return nil, LoggedError("Service.eventTypeDependencies: Unable to count the events: %s", err)
+	}
+	dependencies.Events.Count = int(count)
+
+	return dependencies, nil
+}
+
+// alertsOfTrigger returns the IDs of the Alerts of a Trigger, which may have
+// been deleted.
+func (service *Service) alertsOfTrigger(triggerID piazza.Ident) ([]piazza.Ident, error) {
+	ids := []piazza.Ident{}
+	const perPage = 100
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "alertId", Order: piazza.SortOrderAscending}
+		alerts, _, err := service.alertDB.GetAllByTrigger(format, triggerID, "pz-workflow")
+		if err != nil {
+			return nil, LoggedError("Service.alertsOfTrigger: Unable to get the alerts of trigger %s: %s", triggerID, err)
+		}
+		for _, alert := range alerts {
+			ids = append(ids, alert.AlertID)
+		}
+		if len(alerts) < perPage {
+			return ids, nil
+		}
+	}
+}
+
+// DeleteEventTypeCascade deletes the EventType along with everything that
+// refers to it. The repeating Events are stopped first, and then each
+// Trigger is deleted after its Alerts, so that nothing new is made while the
+// rest are deleted, and no Alert is left without a Trigger to find it by:
+// then the Events, the partitions of the Events, the mapping and last the
+// EventType. If a step fails, calling it again carries on where it left off.
+// If the version is not 0, nothing is deleted unless the EventType is still at
+// that version.
+func (service *Service) DeleteEventTypeCascade(id piazza.Ident, version int64) *piazza.JsonResponse {
+	defer service.handlePanic()
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventTypeCascade: failed to get eventType [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventTypeCascade: failed to get eventType [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	if IsSystemEvent(eventType.Name) {
+		return service.statusBadRequest(errors.New("Deleting system eventTypes is prohibited"))
+	}
+	if version != 0 && version != eventType.Version {
+		return service.statusPreconditionFailed(ErrVersionConflict)
+	}
+
+	dependencies, err := service.eventTypeDependencies(eventType)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "deletingEventTypeCascade", id, "Service.DeleteEventTypeCascade: User is deleting eventType [%s], with %d triggers, %d events, %d crons and %d alerts", id,
+		dependencies.Triggers.Count, dependencies.Events.Count, dependencies.Crons.Count, dependencies.Alerts.Count)
+
+	deleted, err := service.deleteEventTypeCascade(eventType, dependencies)
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "deletingEventTypeCascadeFailure", id, "Service.DeleteEventTypeCascade: User failed to delete eventType [%s]", id)
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "deletedEventTypeCascade", id, "Service.DeleteEventTypeCascade: User successfully deleted eventType [%s], with %d triggers, %d events, %d crons and %d alerts", id,
+		deleted.Triggers.Count, deleted.Events.Count, deleted.Crons.Count, deleted.Alerts.Count)
+
+	return service.statusOK(deleted)
+}
+
+func (service *Service) deleteEventTypeCascade(eventType *EventType, dependencies *EventTypeDependencies) (*EventTypeDependencies, error) {
+	id := eventType.EventTypeID
+	deleted := newEventTypeDependencies(id)
+
+	for _, cronID := range dependencies.Crons.IDs {
+		service.cronSchedules.remove(cronID)
+		ok, err := service.cronDB.DeleteByID(cronID, "pz-workflow")
+		if err != nil {
+			return nil, LoggedError("Service.DeleteEventTypeCascade: Unable to delete cron %s: %s", cronID, err)
+		}
+		if ok {
+			deleted.Crons.add(cronID)
+		}
+	}
+
+	for _, triggerID := range dependencies.Triggers.IDs {
+		if err := service.deleteAlertsOfTrigger(triggerID, deleted); err != nil {
+			return nil, err
+		}
+		ok, err := service.triggerDB.DeleteTrigger(triggerID, 0, "pz-workflow")
+		if err != nil {
+			return nil, LoggedError("Service.DeleteEventTypeCascade: Unable to delete trigger %s: %s", triggerID, err)
+		}
+		if ok {
+			deleted.Triggers.add(triggerID)
+		}
+		// and those it raised while its alerts were being deleted
+		if err = service.deleteAlertsOfTrigger(triggerID, deleted); err != nil {
+			return nil, err
+		}
+	}
+
+	// the events are found by the ID after the last one deleted, rather than
+	// by page, as Elasticsearch won't page past its max_result_window
+	const perPage = 100
+	after := piazza.Ident("")
+	for {
+		eventIDs, err := service.eventDB.GetEventIDsByEventTypeID(eventType.Name, id, after, perPage)
+		if err != nil {
+			return nil, LoggedError("Service.DeleteEventTypeCascade: Unable to get the events: %s", err)
+		}
+		for _, eventID := range eventIDs {
+			ok, err := service.eventDB.DeleteByID(eventType.Name, eventID, "pz-workflow")
+			if err != nil {
+				return nil, LoggedError("Service.DeleteEventTypeCascade: Unable to delete event %s: %s", eventID, err)
+			}
+			if ok {
+				deleted.Events.Count++
+			}
+			after = eventID
+		}
+		if len(eventIDs) < perPage {
+			break
+		}
+	}
+
+	if eventType.Retention != nil && service.eventPartitions != nil {
+		dropped, err := service.eventPartitions.Drop(id)
+		deleted.Partitions = dropped
+		if err != nil {
+			return nil, LoggedError("Service.DeleteEventTypeCascade: Unable to drop the partitions: %s", err)
+		}
+	}
+
+	ok, err := service.eventDB.DeleteMapping(eventType.Name, "pz-workflow")
+	if err != nil {
+		return nil, err
+	}
+	deleted.MappingDeleted = ok
+
+	if _, err = service.eventTypeDB.DeleteByID(id, 0, "pz-workflow"); err != nil {
+		return nil, LoggedError("Service.DeleteEventTypeCascade: Unable to delete the eventType: %s", err)
+	}
+
+	return deleted, nil
+}
+
+func (service *Service) deleteAlertsOfTrigger(triggerID piazza.Ident, deleted *EventTypeDependencies) error {
+	alertIDs, err := service.alertsOfTrigger(triggerID)
+	if err != nil {
+		return err
+	}
+	for _, alertID := range alertIDs {
+		// the AlertDB counts an alert that is already gone as an error
+		if ok, _ := service.alertDB.DeleteByID(alertID, 0, "pz-workflow"); ok {
+			deleted.Alerts.add(alertID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// FileIndex is a MemoryIndex kept on local disk, for running the service
+// without Elasticsearch. Each change is appended to a log file, and synced,
+// before it is made; opening the index replays the log and then rewrites it
+// as just the changes that make up the current contents. The whole index is
+// held in memory.
+type FileIndex struct {
+	*MemoryIndex
+	path string
+	file *os.File
+}
+
+// fileIndexSuffix is the extension of the log files in the data directory.
+const fileIndexSuffix = ".log"
+
+// NewFileIndex opens the index of the given name in the directory, making it
+// if need be.
+func NewFileIndex(dir string, name string) (*FileIndex, error) {
+	esi := &FileIndex{
+		MemoryIndex: NewMemoryIndex(name),
+		path:        filepath.Join(dir, name+fileIndexSuffix),
+	}
+	if err := esi.replay(); err != nil {
+		return nil, fmt.Errorf("FileIndex: %s can't be read: %s", esi.path, err)
+	}
+	if err := esi.compact(); err != nil {
+		return nil, fmt.Errorf("FileIndex: %s can't be rewritten: %s", esi.path, err)
+	}
+	esi.journal = esi.write
+	return esi, nil
+}
+
+// replay applies the records of the log. A last record cut short, as by a
+// crash while it was being written, is dropped: its change was never made.
+func (esi *FileIndex) replay() error {
+	file, err := os.Open(esi.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) != 0 {
+				log.Printf("FileIndex: %s: dropping incomplete record %d", esi.path, n)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := &memoryRecord{}
+		if err = json.Unmarshal(line, record); err != nil {
+			return fmt.Errorf("record %d: %s", n, err)
+		}
+		if err = esi.apply(record); err != nil {
+			return fmt.Errorf("record %d: %s", n, err)
+		}
+	}
+}
+
+// compact replaces the log with the records of the current contents, and
+// opens it for appending.
+func (esi *FileIndex) compact() error {
+	temp := esi.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range esi.records() {
+		byts, err := json.Marshal(record)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(byts, '\n'))
+	}
+	if err = writer.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(temp, esi.path); err != nil {
+		return err
+	}
+
+	esi.file, err = os.OpenFile(esi.path, os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+// write appends a record to the log; it is the journal of the MemoryIndex,
+// so it is called with the lock held.
+func (esi *FileIndex) write(record *memoryRecord) error {
+	if esi.file == nil {
+		return fmt.Errorf("FileIndex: %s is closed", esi.path)
+	}
+	byts, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	info, err := esi.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = esi.file.Write(append(byts, '\n')); err != nil {
+		// don't leave part of a record for the next one to follow
+		_ = esi.file.Truncate(info.Size())
+		return err
+	}
+	return esi.file.Sync()
+}
+
+// Close closes the log; the index can't be changed after.
+func (esi *FileIndex) Close() error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if esi.file == nil {
+		return nil
+	}
+	err := esi.file.Close()
+	esi.file = nil
+	return err
+}
@@ -0,0 +1,277 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Job templates fill in a trigger's job from the event that fired it. Any
+// string in the job may hold placeholders:
+//
+//   ${data.bbox.minX}      a value from the event data, by path
+//   ${data.name:-unknown}  the same, with a default for when it is missing
+//   ${eventId}             eventId, eventTypeId, createdBy or createdOn of the event
+//   $name                  the older form, for top-level data keys only
+//
+// A string that is just one placeholder is replaced by the value itself, so
+// numbers, booleans, arrays and objects keep their JSON types. Placeholders
+// inside a longer string are replaced by the value's text (JSON for arrays
+// and objects). A missing value with no default becomes null, or an empty
+// string inside a longer string; a $name that isn't in the data is left as is.
+
+var templatePattern = regexp.MustCompile(`\$\{([^}:]*)(:-([^}]*))?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// eventTemplateFields are the event fields, besides data, that a template
+// may use.
+var eventTemplateFields = []string{"eventId", "eventTypeId", "createdBy", "createdOn"}
+
+// newJobTemplateContext returns the values a job template is rendered with.
+// The data is the event's own data, not wrapped in the EventType name.
+func newJobTemplateContext(event *Event, data map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"data":        data,
+		"eventId":     event.EventID.String(),
+		"eventTypeId": event.EventTypeID.String(),
+		"createdBy":   event.CreatedBy,
+		"createdOn":   event.CreatedOn.String(),
+	}
+}
+
+// renderJobTemplate returns the job, with its placeholders filled in, as the
+// JSON string sent to the job manager.
+func renderJobTemplate(job JobRequest, context map[string]interface{}) (string, error) {
+	rendered, err := renderTemplate(job, context)
+	if err != nil {
+		return "", err
+	}
+	byts, err := json.Marshal(rendered)
+	if err != nil {
+		return "", err
+	}
+	return string(byts), nil
+}
+
+// renderTemplate fills in the placeholders of any JSON-able value.
+func renderTemplate(value interface{}, context map[string]interface{}) (interface{}, error) {
+	tree, err := templateTree(value)
+	if err != nil {
+		return nil, err
+	}
+	return renderTemplateNode(tree, context), nil
+}
+
+// templateTree turns the value into plain maps, slices and scalars, keeping
+// the exact text of numbers.
+func templateTree(value interface{}) (interface{}, error) {
+	byts, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	decoder := json.NewDecoder(bytes.NewReader(byts))
+	decoder.UseNumber()
+	if err = decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+func renderTemplateNode(node interface{}, context map[string]interface{}) interface{} {
+	switch t := node.(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, v := range t {
+			out[k] = renderTemplateNode(v, context)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, v := range t {
+			out[i] = renderTemplateNode(v, context)
+		}
+		return out
+	case string:
+		return renderTemplateString(t, context)
+	}
+	return node
+}
+
+func renderTemplateString(s string, context map[string]interface{}) interface{} {
+	matches := templatePattern.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) {
+		if value, ok := resolvePlaceholder(s, matches[0], context); ok {
+			return value
+		}
+		return s
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		buf.WriteString(s[last:m[0]])
+		last = m[1]
+		value, ok := resolvePlaceholder(s, m, context)
+		if !ok {
+			buf.WriteString(s[m[0]:m[1]])
+			continue
+		}
+		buf.WriteString(templateText(value))
+	}
+	buf.WriteString(s[last:])
+	return buf.String()
+}
+
+// resolvePlaceholder returns the value for one match of templatePattern. It
+// returns false only for a $name that isn't in the data.
+func resolvePlaceholder(s string, m []int, context map[string]interface{}) (interface{}, bool) {
+	if m[8] >= 0 {
+		data, _ := context["data"].(map[string]interface{})
+		value, ok := data[s[m[8]:m[9]]]
+		return value, ok
+	}
+	if value, ok := lookupTemplatePath(context, s[m[2]:m[3]]); ok {
+		return value, true
+	}
+	if m[4] >= 0 {
+		return parseTemplateDefault(s[m[6]:m[7]]), true
+	}
+	return nil, true
+}
+
+func lookupTemplatePath(context map[string]interface{}, path string) (interface{}, bool) {
+	var node interface{} = context
+	for _, part := range strings.Split(strings.TrimSpace(path), ".") {
+		switch t := node.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if node, ok = t[part]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			node = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, node != nil
+}
+
+// parseTemplateDefault reads a default as a JSON number, boolean or null if
+// it is one, or else as a plain string.
+func parseTemplateDefault(s string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(s), &value); err == nil {
+		switch value.(type) {
+		case float64, bool, nil:
+			return value
+		}
+	}
+	return s
+}
+
+func templateText(value interface{}) string {
+	switch t := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	}
+	byts, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(byts)
+}
+
+//------------------------------------------------------------------------------
+
+// validateTemplate checks that every ${...} placeholder in the value names
+// an event field, or a data field in the EventType mapping.
+func validateTemplate(value interface{}, eventTypeName string, mapping map[string]interface{}) error {
+	tree, err := templateTree(value)
+	if err != nil {
+		return err
+	}
+	for _, path := range templatePaths(tree) {
+		if contains(eventTemplateFields, path) {
+			continue
+		}
+		if !strings.HasPrefix(path, "data.") {
+			return fmt.Errorf("Job template field ${%s} must be one of %s or start with \"data.\"", path, strings.Join(eventTemplateFields, ", "))
+		}
+		if !mappingHasPath(mapping, strings.Split(strings.TrimPrefix(path, "data."), ".")) {
+			return fmt.Errorf("Job template field ${%s} is not in the mapping of eventType %s", path, eventTypeName)
+		}
+	}
+	return nil
+}
+
+func templatePaths(node interface{}) []string {
+	paths := []string{}
+	switch t := node.(type) {
+	case map[string]interface{}:
+		for _, v := range t {
+			paths = append(paths, templatePaths(v)...)
+		}
+	case []interface{}:
+		for _, v := range t {
+			paths = append(paths, templatePaths(v)...)
+		}
+	case string:
+		for _, m := range templatePattern.FindAllStringSubmatch(t, -1) {
+			if m[4] == "" {
+				paths = append(paths, strings.TrimSpace(m[1]))
+			}
+		}
+	}
+	return paths
+}
+
+// mappingHasPath walks an EventType mapping. A numeric path element indexes
+// into an array field, and any path below an object or array field that
+// isn't described by the mapping is rejected.
+func mappingHasPath(mapping map[string]interface{}, path []string) bool {
+	if len(path) == 0 || path[0] == "" {
+		return false
+	}
+	switch t := mapping[path[0]].(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			return true
+		}
+		return mappingHasPath(t, path[1:])
+	case string:
+		if len(path) == 1 {
+			return true
+		}
+		if _, err := strconv.Atoi(path[1]); err == nil && strings.HasPrefix(t, "[") && len(path) == 2 {
+			return true
+		}
+	}
+	return false
+}
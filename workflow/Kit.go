@@ -15,17 +15,12 @@
 package workflow
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"reflect"
-	"regexp"
-	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
@@ -35,18 +30,30 @@ import (
 //---------------------------------------------------------------------------
 
 type Kit struct {
-	Service       *Service
-	Server        *Server
-	LogWriter     pzsyslog.Writer
-	AuditWriter   pzsyslog.Writer
-	Sys           *piazza.SystemConfig
-	GenericServer *piazza.GenericServer
-	Url           string
-	done          chan error
-	mocking       bool
-	indices       *map[string]elasticsearch.IIndex
+	Service     *Service
+	Server      *Server
+	LogWriter   pzsyslog.Writer
+	AuditWriter pzsyslog.Writer
+	Sys         *piazza.SystemConfig
+	RouteServer *RouteServer
+	Url         string
+	done        chan error
+	mocking     bool
+	storage     string
+	indices     *map[string]elasticsearch.IIndex
+	partitions  *EventPartitions
+	cluster     *MemoryCluster
 }
 
+// The storage backends, chosen with PZ_WORKFLOW_STORAGE. The file backend
+// keeps the indices in PZ_WORKFLOW_DATA_DIR.
+const (
+	StorageElasticsearch = "elasticsearch"
+	StorageFile          = "file"
+)
+
+const defaultDataDir = "data"
+
 func NewKit(
 	sys *piazza.SystemConfig,
 	logWriter pzsyslog.Writer,
@@ -63,11 +70,36 @@ func NewKit(
 	kit.AuditWriter = auditWriter
 	kit.Sys = sys
 	kit.mocking = mocking
+	kit.storage = os.Getenv("PZ_WORKFLOW_STORAGE")
 
-	if kit.mocking {
+	switch {
+	case kit.mocking:
 		kit.indices = kit.makeMockIndices()
-	} else {
-		kit.indices = kit.makeIndices(sys)
+		kit.cluster = NewMemoryCluster()
+		if kit.partitions, err = kit.makeMemoryPartitions(); err != nil {
+			return nil, err
+		}
+	case kit.storage == StorageFile:
+		dir := os.Getenv("PZ_WORKFLOW_DATA_DIR")
+		if dir == "" {
+			dir = defaultDataDir
+		}
+		if kit.indices, err = kit.makeFileIndices(dir); err != nil {
+			return nil, err
+		}
+		kit.cluster = NewFileCluster(dir)
+		if err = kit.cluster.Load(keyEvents+"-", keyEvents); err != nil {
+			return nil, err
+		}
+		if kit.partitions, err = kit.makeMemoryPartitions(); err != nil {
+			return nil, err
+		}
+	case kit.storage == StorageElasticsearch, kit.storage == "":
+		if kit.indices, kit.partitions, err = kit.makeIndices(sys); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown storage: %s", kit.storage)
 	}
 
 	err = kit.Service.Init(sys, logWriter, auditWriter, kit.indices, pen)
@@ -75,11 +107,62 @@ func NewKit(
 		return nil, err
 	}
 
+	kit.Service.SetEventPartitions(kit.partitions)
+	if ingestRetention := os.Getenv("PZ_WORKFLOW_INGEST_RETENTION"); ingestRetention != "" {
+		retention, err := ParseEventRetention(ingestRetention)
+		if err != nil {
+			return nil, fmt.Errorf("PZ_WORKFLOW_INGEST_RETENTION: %s", err)
+		}
+		if err = kit.Service.SetEventRetention(ingestTypeName, retention); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without Elasticsearch, conditions are evaluated natively unless the
+	// percolation engine is asked for; the memory indices percolate with the
+	// same evaluator.
+	matchEngine := os.Getenv("PZ_WORKFLOW_MATCH_ENGINE")
+	if (kit.mocking || kit.storage == StorageFile) && matchEngine == "" {
+		matchEngine = MatchEngineNative
+	}
+	if matchEngine != "" {
+		if err = kit.Service.SetMatchEngine(matchEngine); err != nil {
+			return nil, err
+		}
+	}
+
+	if kit.Service.dispatcher.MaxAttempts, err = getEnvInt("PZ_WORKFLOW_DISPATCH_MAX_ATTEMPTS", defaultDispatchMaxAttempts); err != nil {
+		return nil, err
+	}
+	if kit.Service.publisher.Channels, err = getEnvInt("PZ_WORKFLOW_AMQP_CHANNELS", defaultPublisherChannels); err != nil {
+		return nil, err
+	}
+	workers, err := getEnvInt("PZ_WORKFLOW_TRIGGER_WORKERS", defaultTriggerWorkers)
+	if err != nil {
+		return nil, err
+	}
+	queueDepth, err := getEnvInt("PZ_WORKFLOW_TRIGGER_QUEUE", defaultTriggerQueueDepth)
+	if err != nil {
+		return nil, err
+	}
+	kit.Service.SetTriggerPool(workers, queueDepth)
+	leaseTTL, err := getEnvInt("PZ_WORKFLOW_LEASE_TTL", int(defaultLeaseTTL/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	kit.Service.cronElector.TTL = time.Duration(leaseTTL) * time.Second
+	trashDays, err := getEnvInt("PZ_WORKFLOW_TRASH_PURGE_DAYS", int(defaultTrashPurgeAfter/(24*time.Hour)))
+	if err != nil {
+		return nil, err
+	}
+	kit.Service.trashPurgeAfter = time.Duration(trashDays) * 24 * time.Hour
+
 	if !kit.mocking {
 		err = kit.Service.InitCron()
 		if err != nil {
 			log.Fatal(err)
 		}
+		kit.Service.dispatcher.Start()
 	}
 
 	kit.Server = &Server{}
@@ -88,20 +171,33 @@ func NewKit(
 		return nil, err
 	}
 
-	kit.GenericServer = &piazza.GenericServer{Sys: kit.Sys}
-	err = kit.GenericServer.Configure(kit.Server.Routes)
+	kit.RouteServer = &RouteServer{Sys: kit.Sys}
+	err = kit.RouteServer.Configure(kit.Server.Routes)
 	if err != nil {
 		return nil, err
 	}
 
-	kit.Url = piazza.DefaultProtocol + "://" + kit.GenericServer.Sys.BindTo
+	kit.Url = piazza.DefaultProtocol + "://" + kit.RouteServer.Sys.BindTo
 
 	return kit, nil
 }
 
+// getEnvInt reads a positive number from the environment.
+func getEnvInt(name string, defalt int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defalt, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number, not %s", name, value)
+	}
+	return n, nil
+}
+
 func (kit *Kit) Start() error {
 	var err error
-	kit.done, err = kit.GenericServer.Start()
+	kit.done, err = kit.RouteServer.Start()
 	return err
 }
 
@@ -110,11 +206,16 @@ func (kit *Kit) Wait() error {
 }
 
 func (kit *Kit) Stop() error {
-	err := kit.GenericServer.Stop()
+	err := kit.RouteServer.Stop()
 	if err != nil {
 		return err
 	}
 
+	kit.Service.cronElector.Stop()
+	kit.Service.triggerPool.Stop()
+	kit.Service.dispatcher.Stop()
+	kit.Service.publisher.Close()
+
 	if kit.mocking {
 		indices := *kit.indices
 
@@ -137,6 +238,35 @@ func (kit *Kit) Stop() error {
 		if err != nil {
 			return err
 		}
+
+		err = indices[keyCronRuns].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyDispatches].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyEventLookups].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyTrash].Delete()
+		if err != nil {
+			return err
+		}
+	} else if kit.storage == StorageFile {
+		for _, index := range *kit.indices {
+			if err = index.Close(); err != nil {
+				return err
+			}
+		}
+		if err = kit.cluster.Close(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -145,139 +275,130 @@ func (kit *Kit) Stop() error {
 func (kit *Kit) makeMockIndices() *map[string]elasticsearch.IIndex {
 
 	indices := &map[string]elasticsearch.IIndex{
-		keyEventTypes:        elasticsearch.NewMockIndex(keyEventTypes),
-		keyEvents:            elasticsearch.NewMockIndex(keyEvents),
-		keyTriggers:          elasticsearch.NewMockIndex(keyTriggers),
-		keyAlerts:            elasticsearch.NewMockIndex(keyAlerts),
-		keyCrons:             elasticsearch.NewMockIndex(keyCrons),
-		keyTestElasticsearch: elasticsearch.NewMockIndex(keyTestElasticsearch),
+		keyEventTypes:        NewMemoryIndex(keyEventTypes),
+		keyEvents:            NewMemoryIndex(keyEvents),
+		keyTriggers:          NewMemoryIndex(keyTriggers),
+		keyAlerts:            NewMemoryIndex(keyAlerts),
+		keyCrons:             NewMemoryIndex(keyCrons),
+		keyCronRuns:          NewMemoryIndex(keyCronRuns),
+		keyLeases:            NewMemoryIndex(keyLeases),
+		keyDispatches:        NewMemoryIndex(keyDispatches),
+		keyEventLookups:      NewMemoryIndex(keyEventLookups),
+		keyTrash:             NewMemoryIndex(keyTrash),
+		keyTestElasticsearch: NewMemoryIndex(keyTestElasticsearch),
 	}
 	(*indices)[keyEventTypes].SetMapping(EventTypeDBMapping, "{}")
 	(*indices)[keyEvents].SetMapping(EventDBMapping, "{}")
 	(*indices)[keyTriggers].SetMapping(TriggerDBMapping, "{}")
 	(*indices)[keyAlerts].SetMapping(AlertDBMapping, "{}")
 	(*indices)[keyCrons].SetMapping(CronDBMapping, "{}")
+	(*indices)[keyCronRuns].SetMapping(CronRunDBMapping, "{}")
+	(*indices)[keyLeases].SetMapping(LeaseMapping, "{}")
+	(*indices)[keyDispatches].SetMapping(DispatchDBMapping, "{}")
+	(*indices)[keyEventLookups].SetMapping(EventLookupDBMapping, "{}")
+	(*indices)[keyTrash].SetMapping(TrashDBMapping, "{}")
 	(*indices)[keyTestElasticsearch].SetMapping(TestElasticsearchMapping, "{}")
 	return indices
 }
 
-func (kit *Kit) makeIndices(sys *piazza.SystemConfig) *map[string]elasticsearch.IIndex {
-	var err error
-	var pwd, esURL string
-	{
-		pwd, err = os.Getwd()
-		if err != nil {
-			log.Fatalln(err)
-		}
-		esURL, err = sys.GetURL(piazza.PzElasticSearch)
-		if err != nil {
-			log.Fatalln(err)
-		}
+// makeMemoryPartitions keeps the partitions of the events in the kit's
+// MemoryCluster, alongside the events index.
+func (kit *Kit) makeMemoryPartitions() (*EventPartitions, error) {
+	base := (*kit.indices)[keyEvents]
+	if err := kit.cluster.Add(base, keyEvents); err != nil {
+		return nil, err
 	}
+	settings := fmt.Sprintf(`{"mappings":{%q:{}}}`, EventDBMapping)
+	return NewEventPartitions(kit.cluster, base, kit.cluster.Alias(keyEvents), settings), nil
+}
 
-	keyToPattern := map[string]string{
-		keyEventTypes:        "EventType",
-		keyEvents:            "Event",
-		keyTriggers:          "Trigger",
-		keyAlerts:            "Alert",
-		keyCrons:             "Cron",
-		keyTestElasticsearch: "TestES",
-	}
-	keyToScripts := map[string][]string{
-		keyEventTypes:        []string{},
-		keyEvents:            []string{},
-		keyTriggers:          []string{},
-		keyAlerts:            []string{},
-		keyCrons:             []string{},
-		keyTestElasticsearch: []string{},
-	}
+// makeFileIndices opens the indices kept in the directory, making any that
+// don't exist yet.
+func (kit *Kit) makeFileIndices(dir string) (*map[string]elasticsearch.IIndex, error) {
 	keyToType := map[string]string{
 		keyEventTypes:        EventTypeDBMapping,
 		keyEvents:            EventDBMapping,
 		keyTriggers:          TriggerDBMapping,
 		keyAlerts:            AlertDBMapping,
 		keyCrons:             CronDBMapping,
+		keyCronRuns:          CronRunDBMapping,
+		keyLeases:            LeaseMapping,
+		keyDispatches:        DispatchDBMapping,
+		keyEventLookups:      EventLookupDBMapping,
+		keyTrash:             TrashDBMapping,
 		keyTestElasticsearch: TestElasticsearchMapping,
 	}
-	indices := make(map[string]elasticsearch.IIndex)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
 
-	{
-		files, err := ioutil.ReadDir(pwd + "/db/")
+	indices := make(map[string]elasticsearch.IIndex)
+	for key, typ := range keyToType {
+		index, err := NewFileIndex(dir, key)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
-		for _, f := range files {
-			for alias, pattern := range keyToPattern {
-				re, err := regexp.Compile(fmt.Sprintf(`^[0-9]{3}-%s.sh$`, pattern))
-				if err != nil {
-					log.Fatalln(err)
-				}
-				if re.MatchString(f.Name()) {
-					keyToScripts[alias] = append(keyToScripts[alias], f.Name())
-				}
+		if ok, _ := index.TypeExists(typ); !ok {
+			if err = index.SetMapping(typ, "{}"); err != nil {
+				return nil, err
 			}
 		}
-		for _, scripts := range keyToScripts {
-			sort.Strings(scripts)
-		}
+		indices[key] = index
 	}
+	return &indices, nil
+}
 
-	type ScriptRes struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-		Mapping string `json:"mapping"`
+// makeIndices brings the indices up to date with the migrations, checks
+// their mappings, and opens them. The events are written to the index
+// itself, not the alias, which also takes in the partitions.
+func (kit *Kit) makeIndices(sys *piazza.SystemConfig) (*map[string]elasticsearch.IIndex, *EventPartitions, error) {
+	esURL, err := sys.GetURL(piazza.PzElasticSearch)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	format := func(dat []byte) []byte {
-		re := regexp.MustCompile(`\r?\n?\t`)
-		splitStr := `{"status":`
-		split := strings.SplitN(string(bytes.TrimPrefix([]byte(re.ReplaceAllString(string(dat), "")), []byte("\xef\xbb\xbf"))), splitStr, 2)
-		return []byte(splitStr + split[len(split)-1])
+	migrator, err := NewElasticsearchMigrator(esURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = migrator.Up(); err != nil {
+		return nil, nil, err
+	}
+	diffs, err := migrator.Verify()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(diffs) != 0 {
+		return nil, nil, fmt.Errorf("The indices don't match their schemas:\n  %s", strings.Join(diffs, "\n  "))
 	}
 
-	log.Println("==========")
-	for alias, scripts := range keyToScripts {
-		log.Println(alias)
-		for i, script := range scripts {
-			log.Println(" ", script)
-			outDat, err := exec.Command("bash", pwd+"/db/"+script, alias, esURL).Output()
-			if err != nil {
-				log.Fatalln(err)
-			}
-			resDat := format(outDat)
-			scriptRes := ScriptRes{}
-			if err = json.Unmarshal(resDat, &scriptRes); err != nil {
-				log.Fatalln(err, "\nOutput:", string(outDat))
-			}
-			if scriptRes.Status != "success" {
-				log.Fatalf("Script failed: [%s]\n", scriptRes.Message)
-			}
-			if indices[alias], err = elasticsearch.NewIndex(sys, alias, ""); err != nil {
-				log.Fatalln(err)
+	indices := make(map[string]elasticsearch.IIndex)
+	var partitions *EventPartitions
+	for _, schema := range migrator.Schemas {
+		if schema.Alias != keyEvents {
+			if indices[schema.Alias], err = elasticsearch.NewIndex(sys, schema.Alias, ""); err != nil {
+				return nil, nil, err
 			}
-			if scriptRes.Mapping != "" && i == len(scripts)-1 {
-				inter, err := piazza.StructStringToInterface(scriptRes.Mapping)
-				if err != nil {
-					log.Fatalln(err)
-				}
-				var scriptMap, esMap map[string]interface{}
-				var ok bool
-				if scriptMap, ok = inter.(map[string]interface{}); !ok {
-					log.Fatalf("Schema [%s] on alias [%s] in script is not type map[string]interface{}\n", keyToType[alias], alias)
-				}
-				if inter, err = indices[alias].GetMapping(keyToType[alias]); err != nil {
-					log.Fatalln(err)
-				}
-				if esMap, ok = inter.(map[string]interface{}); !ok {
-					log.Fatalf("Schema [%s] on alias [%s] on elasticsearch is not type map[string]interface{}\n", keyToType[alias], alias)
-				}
-				if !reflect.DeepEqual(scriptMap, esMap) {
-					log.Fatalf("Schema [%s] on alias [%s] on elasticsearch does not match the mapping provided\n", keyToType[alias], alias)
-				}
+			continue
+		}
+		reader, err := elasticsearch.NewIndex2(esURL, schema.Alias, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		// the events of each EventType are kept in an index of their own
+		// where an index has one type, which leaves nothing to partition
+		if usesPercolatorField(reader.GetVersion()) {
+			if indices[schema.Alias], err = NewElasticsearchPercolatorIndex(esURL, reader, schema.Body); err != nil {
+				return nil, nil, err
 			}
+			continue
 		}
+		base, err := elasticsearch.NewIndex2(esURL, schema.Index, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		indices[schema.Alias] = base
+		partitions = NewElasticsearchPartitions(esURL, base, reader, schema.Body)
 	}
-	log.Println("==========")
-
-	return &indices
+	return &indices, partitions, nil
 }
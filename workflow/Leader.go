@@ -0,0 +1,370 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const (
+	defaultLeaseTTL = 30 * time.Second
+	cronLeaseName   = "cron"
+)
+
+// LeaseMapping is the name of the Elasticsearch type leases are kept in, in
+// the leases index
+const LeaseMapping = "Lease"
+
+// A LeaseStore holds the leases that the replicas of the service compete
+// for. A lease is held by one holder until it expires.
+type LeaseStore interface {
+	// Acquire takes the lease for the holder if it is free, has expired, or
+	// is the holder's already, in which case it is renewed. It returns
+	// whether the holder now has the lease.
+	Acquire(name string, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease, if the holder has it.
+	Release(name string, holder string) error
+}
+
+// A Lease is a LeaseStore entry
+type Lease struct {
+	Holder  string           `json:"holder"`
+	Expires piazza.TimeStamp `json:"expires"`
+}
+
+//------------------------------------------------------------------------------
+
+// MemoryLeaseStore keeps leases in memory, so only works within one process.
+// It is meant for tests.
+type MemoryLeaseStore struct {
+	leases map[string]Lease
+	now    func() time.Time
+	lock   sync.Mutex
+}
+
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: map[string]Lease{}, now: time.Now}
+}
+
+func (store *MemoryLeaseStore) Acquire(name string, holder string, ttl time.Duration) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := store.now()
+	lease, ok := store.leases[name]
+	if ok && lease.Holder != holder && now.Before(time.Time(lease.Expires)) {
+		return false, nil
+	}
+	store.leases[name] = Lease{Holder: holder, Expires: piazza.TimeStamp(now.Add(ttl))}
+	return true, nil
+}
+
+func (store *MemoryLeaseStore) Release(name string, holder string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if lease, ok := store.leases[name]; ok && lease.Holder == holder {
+		delete(store.leases, name)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// ElasticsearchLeaseStore keeps leases as documents in an index. Each change
+// is made with the version of the document that was read, so that when two
+// replicas race for a lease only one of them gets it. Expiry times are
+// compared with the local clock, so the replicas' clocks must roughly agree.
+type ElasticsearchLeaseStore struct {
+	esi     elasticsearch.IIndex
+	mapping string
+}
+
+func NewElasticsearchLeaseStore(esi elasticsearch.IIndex) *ElasticsearchLeaseStore {
+	return &ElasticsearchLeaseStore{esi: esi, mapping: LeaseMapping}
+}
+
+// leaseDocument is what Elasticsearch returns for a get, put or delete; a
+// request that fails, such as a put with a stale version, has Status and Error
+// set instead.
+type leaseDocument struct {
+	Found   bool        `json:"found"`
+	Version int64       `json:"_version"`
+	Source  *Lease      `json:"_source"`
+	Status  int         `json:"status"`
+	Error   interface{} `json:"error"`
+}
+
+func (store *ElasticsearchLeaseStore) endpoint(name string) string {
+	return fmt.Sprintf("/%s/%s/%s", store.esi.IndexName(), store.mapping, url.QueryEscape(name))
+}
+
+func (store *ElasticsearchLeaseStore) get(name string) (*leaseDocument, error) {
+	doc := &leaseDocument{}
+	if err := store.esi.DirectAccess("GET", store.endpoint(name), nil, doc); err != nil {
+		return nil, LoggedError("ElasticsearchLeaseStore: lease %s could not be read: %s", name, err)
+	}
+	if doc.Error != nil {
+		return nil, LoggedError("ElasticsearchLeaseStore: lease %s could not be read: %v", name, doc.Error)
+	}
+	return doc, nil
+}
+
+func (store *ElasticsearchLeaseStore) Acquire(name string, holder string, ttl time.Duration) (bool, error) {
+	doc, err := store.get(name)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	endpoint := store.endpoint(name) + "?op_type=create"
+	if doc.Found && doc.Source != nil {
+		if doc.Source.Holder != holder && now.Before(time.Time(doc.Source.Expires)) {
+			return false, nil
+		}
+		endpoint = fmt.Sprintf("%s?version=%d", store.endpoint(name), doc.Version)
+	}
+
+	lease := &Lease{Holder: holder, Expires: piazza.TimeStamp(now.Add(ttl))}
+	result := &leaseDocument{}
+	if err = store.esi.DirectAccess("PUT", endpoint, lease, result); err != nil {
+		return false, LoggedError("ElasticsearchLeaseStore: lease %s could not be written: %s", name, err)
+	}
+	if result.Status == 409 {
+		// another replica got there first
+		return false, nil
+	}
+	if result.Error != nil {
+		return false, LoggedError("ElasticsearchLeaseStore: lease %s could not be written: %v", name, result.Error)
+	}
+	return true, nil
+}
+
+func (store *ElasticsearchLeaseStore) Release(name string, holder string) error {
+	doc, err := store.get(name)
+	if err != nil {
+		return err
+	}
+	if !doc.Found || doc.Source == nil || doc.Source.Holder != holder {
+		return nil
+	}
+
+	result := &leaseDocument{}
+	endpoint := fmt.Sprintf("%s?version=%d", store.endpoint(name), doc.Version)
+	if err = store.esi.DirectAccess("DELETE", endpoint, nil, result); err != nil {
+		return LoggedError("ElasticsearchLeaseStore: lease %s could not be released: %s", name, err)
+	}
+	if result.Error != nil && result.Status != 409 {
+		return LoggedError("ElasticsearchLeaseStore: lease %s could not be released: %v", name, result.Error)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// LeaderElector makes one replica of the service the leader, by having each
+// replica try for the same lease, and renew it while it holds it. Elected is
+// called when this replica becomes the leader, and Deposed when it stops
+// being the leader, which it does when it can't renew the lease before it
+// expires, or when it is stopped. If Elected fails, the lease is given up and
+// tried for again later.
+//
+// The lease is renewed on its own ticker, and the callbacks are run from
+// another goroutine, so that a slow callback doesn't let the lease lapse. A
+// callback that takes a while should check Holding as it goes, and stop once
+// the lease is lost.
+type LeaderElector struct {
+	Name   string
+	Holder string
+	TTL    time.Duration
+
+	Elected func() error
+	Deposed func()
+	// Leading is called on each renewal while this replica is the leader
+	Leading func()
+
+	store LeaseStore
+
+	lock sync.Mutex
+	// leader is set while this replica holds the lease, and elected once
+	// Elected has been called for it and Deposed hasn't been since
+	leader    bool
+	elected   bool
+	renewedAt time.Time
+
+	kick chan struct{}
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// NewLeaderElector returns a stopped elector for the named lease.
+func NewLeaderElector(store LeaseStore, name string, holder string) *LeaderElector {
+	return &LeaderElector{
+		Name:    name,
+		Holder:  holder,
+		TTL:     defaultLeaseTTL,
+		Elected: func() error { return nil },
+		Deposed: func() {},
+		Leading: func() {},
+		store:   store,
+	}
+}
+
+// Start tries for the lease now, and then every third of the TTL.
+func (elector *LeaderElector) Start() {
+	elector.stop = make(chan struct{})
+	elector.kick = make(chan struct{}, 1)
+	elector.done.Add(2)
+	go func() {
+		defer elector.done.Done()
+		ticker := time.NewTicker(elector.TTL / 3)
+		defer ticker.Stop()
+		for {
+			elector.renew()
+			select {
+			case elector.kick <- struct{}{}:
+			default:
+				// the callbacks are still running, and will be run again
+			}
+			select {
+			case <-elector.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	go func() {
+		defer elector.done.Done()
+		for {
+			select {
+			case <-elector.stop:
+				return
+			case <-elector.kick:
+				elector.follow()
+			}
+		}
+	}()
+}
+
+// Stop ends the elections and, if this replica is the leader, steps down and
+// gives up the lease, so that another replica can take over at once.
+func (elector *LeaderElector) Stop() {
+	if elector.stop != nil {
+		close(elector.stop)
+		elector.done.Wait()
+		elector.stop = nil
+	}
+
+	elector.lock.Lock()
+	leader, elected := elector.leader, elector.elected
+	elector.leader = false
+	elector.elected = false
+	elector.lock.Unlock()
+
+	if elected {
+		elector.Deposed()
+	}
+	if leader {
+		if err := elector.store.Release(elector.Name, elector.Holder); err != nil {
+			log.Printf("LeaderElector: %s could not release %s: %s", elector.Holder, elector.Name, err)
+		}
+	}
+}
+
+// IsLeader says whether this replica is the leader.
+func (elector *LeaderElector) IsLeader() bool {
+	elector.lock.Lock()
+	defer elector.lock.Unlock()
+	return elector.leader && elector.elected
+}
+
+// Holding says whether this replica holds the lease, and it hasn't run out
+// since it was last renewed.
+func (elector *LeaderElector) Holding() bool {
+	elector.lock.Lock()
+	defer elector.lock.Unlock()
+	return elector.leader && time.Since(elector.renewedAt) < elector.TTL
+}
+
+// Tick tries once to get or renew the lease, and then calls the callback that
+// follows from that.
+func (elector *LeaderElector) Tick() {
+	elector.renew()
+	elector.follow()
+}
+
+// renew tries once to get or renew the lease.
+func (elector *LeaderElector) renew() {
+	now := time.Now()
+	acquired, err := elector.store.Acquire(elector.Name, elector.Holder, elector.TTL)
+
+	elector.lock.Lock()
+	defer elector.lock.Unlock()
+	if err != nil {
+		// keep leading only while the lease can still be renewed before it
+		// runs out
+		if elector.leader && now.Add(elector.TTL/3).Sub(elector.renewedAt) >= elector.TTL {
+			log.Printf("LeaderElector: %s stepping down as leader of %s, lease could not be renewed: %s", elector.Holder, elector.Name, err)
+			elector.leader = false
+		}
+		return
+	}
+	if acquired {
+		elector.renewedAt = now
+	}
+	// if it wasn't acquired while this replica was the leader, the lease
+	// expired and another replica took it
+	elector.leader = acquired
+}
+
+// follow calls Elected, Leading or Deposed, as the state of the lease calls
+// for.
+func (elector *LeaderElector) follow() {
+	elector.lock.Lock()
+	leader, elected := elector.leader, elector.elected
+	elector.lock.Unlock()
+
+	switch {
+	case leader && elected:
+		elector.Leading()
+	case leader:
+		if err := elector.Elected(); err != nil {
+			log.Printf("LeaderElector: %s could not take over as leader of %s: %s", elector.Holder, elector.Name, err)
+			elector.lock.Lock()
+			elector.leader = false
+			elector.lock.Unlock()
+			_ = elector.store.Release(elector.Name, elector.Holder)
+			return
+		}
+		elector.lock.Lock()
+		elector.elected = true
+		leader = elector.leader
+		elector.lock.Unlock()
+		if !leader {
+			// the lease was lost while taking over
+			elector.follow()
+		}
+	case elected:
+		elector.lock.Lock()
+		elector.elected = false
+		elector.lock.Unlock()
+		elector.Deposed()
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const (
+	// MatchEnginePercolation matches events to triggers with Elasticsearch
+	// percolation queries
+	MatchEnginePercolation = "percolation"
+	// MatchEngineNative matches events to triggers by evaluating the trigger
+	// conditions in-process
+	MatchEngineNative = "native"
+)
+
+// MatchEngine finds the triggers whose conditions match an event's data.
+// Conditions are in the form the user gave them, with "data." paths, and
+// EventTypes are as stored, with the mapping wrapped in the EventType name.
+type MatchEngine interface {
+	// CheckCondition returns an error if the engine can't evaluate the condition
+	CheckCondition(condition map[string]interface{}) error
+	// MatchTriggers returns the ids of stored triggers that match the data
+	MatchTriggers(eventType *EventType, data map[string]interface{}, eventID piazza.Ident, actor string) ([]piazza.Ident, error)
+	// MatchSamples reports whether the condition matches each of the samples
+	MatchSamples(eventType *EventType, condition map[string]interface{}, samples []map[string]interface{}) ([]bool, error)
+}
+
+// NewMatchEngine returns the named engine.
+func NewMatchEngine(service *Service, name string) (MatchEngine, error) {
+	switch name {
+	case MatchEnginePercolation, "":
+		return &percolationMatchEngine{service: service}, nil
+	case MatchEngineNative:
+		return &nativeMatchEngine{service: service}, nil
+	}
+	return nil, fmt.Errorf("Unknown match engine: %s", name)
+}
+
+//------------------------------------------------------------------------------
+
+type percolationMatchEngine struct {
+	service *Service
+}
+
+// CheckCondition accepts anything; Elasticsearch checks the query when it is
+// registered.
+func (engine *percolationMatchEngine) CheckCondition(condition map[string]interface{}) error {
+	return nil
+}
+
+func (engine *percolationMatchEngine) MatchTriggers(eventType *EventType, data map[string]interface{}, eventID piazza.Ident, actor string) ([]piazza.Ident, error) {
+	ids, err := engine.service.eventDB.PercolateEventData(eventType.Name, engine.service.addUniqueParams(eventType.Name, data), eventID, actor)
+	if err != nil {
+		return nil, err
+	}
+	return *ids, nil
+}
+
+// MatchSamples percolates the samples against the condition on its own, in
+// a scratch index, so that nothing is registered with the events.
+func (engine *percolationMatchEngine) MatchSamples(eventType *EventType, condition map[string]interface{}, samples []map[string]interface{}) ([]bool, error) {
+	fixedQuery, ok := qualifyCondition(condition, eventType.Name)
+	if !ok {
+		return nil, fmt.Errorf("TriggerEB.PostData failed: failed to parse query")
+	}
+	body, err := json.Marshal(fixedQuery)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]map[string]interface{}, len(samples))
+	for i, sample := range samples {
+		wrapped[i] = engine.service.addUniqueParams(eventType.Name, sample)
+	}
+	return engine.service.eventDB.PercolateSamples(eventType.Name, piazza.JsonString(body), wrapped)
+}
+
+//------------------------------------------------------------------------------
+
+// nativeMatchEngine evaluates conditions in-process. Only the triggers for the
+// event's type are considered, which is also all that PostEvent will fire.
+type nativeMatchEngine struct {
+	service *Service
+}
+
+func (engine *nativeMatchEngine) CheckCondition(condition map[string]interface{}) error {
+	_, err := compileCondition(condition)
+	return err
+}
+
+func (engine *nativeMatchEngine) MatchTriggers(eventType *EventType, data map[string]interface{}, eventID piazza.Ident, actor string) ([]piazza.Ident, error) {
+	const perPage = 100
+	ids := []piazza.Ident{}
+	doc := newConditionDoc(data, engine.service.removeUniqueParams(eventType.Name, eventType.Mapping))
+
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "triggerId", Order: piazza.SortOrderAscending}
+		triggers, _, err := engine.service.triggerDB.GetTriggersByEventTypeID(format, eventType.EventTypeID, actor)
+		if err != nil {
+			return nil, err
+		}
+		for _, trigger := range triggers {
+			condition := decodeCondition(trigger.Condition).(map[string]interface{})
+			node, err := compileCondition(condition)
+			if err != nil {
+				engine.service.syslogger.Warning("MatchEngine: trigger %s condition can't be evaluated: %s", trigger.TriggerID, err)
+				continue
+			}
+			if node.matches(doc) {
+				ids = append(ids, trigger.TriggerID)
+			}
+		}
+		if len(triggers) < perPage {
+			break
+		}
+	}
+	return ids, nil
+}
+
+func (engine *nativeMatchEngine) MatchSamples(eventType *EventType, condition map[string]interface{}, samples []map[string]interface{}) ([]bool, error) {
+	node, err := compileCondition(condition)
+	if err != nil {
+		return nil, err
+	}
+	mapping := engine.service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	matched := make([]bool, len(samples))
+	for i, sample := range samples {
+		matched[i] = node.matches(newConditionDoc(sample, mapping))
+	}
+	return matched, nil
+}
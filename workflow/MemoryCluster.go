@@ -0,0 +1,470 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// MemoryCluster is a PartitionCluster of MemoryIndexes, or, given a
+// directory, of FileIndexes, with aliases over them.
+type MemoryCluster struct {
+	dir     string
+	lock    sync.Mutex
+	indices map[string]*memoryClusterIndex
+	aliases map[string]map[string]bool
+}
+
+type memoryClusterIndex struct {
+	memory *MemoryIndex
+	index  elasticsearch.IIndex
+}
+
+// NewMemoryCluster makes a cluster kept in memory.
+func NewMemoryCluster() *MemoryCluster {
+	return NewFileCluster("")
+}
+
+// NewFileCluster makes a cluster whose indices are kept in the directory.
+func NewFileCluster(dir string) *MemoryCluster {
+	return &MemoryCluster{
+		dir:     dir,
+		indices: map[string]*memoryClusterIndex{},
+		aliases: map[string]map[string]bool{},
+	}
+}
+
+// Add puts an index made elsewhere, a MemoryIndex or FileIndex, in the
+// cluster, under the aliases.
+func (cluster *MemoryCluster) Add(index elasticsearch.IIndex, aliases ...string) error {
+	var memory *MemoryIndex
+	switch esi := index.(type) {
+	case *MemoryIndex:
+		memory = esi
+	case *FileIndex:
+		memory = esi.MemoryIndex
+	default:
+		return fmt.Errorf("MemoryCluster: can't hold a %T", index)
+	}
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	cluster.indices[index.IndexName()] = &memoryClusterIndex{memory: memory, index: index}
+	for _, alias := range aliases {
+		cluster.addAlias(alias, index.IndexName())
+	}
+	return nil
+}
+
+// Load opens the indices in the directory whose names start with the
+// prefix, putting them under the alias.
+func (cluster *MemoryCluster) Load(prefix string, alias string) error {
+	if cluster.dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(cluster.dir, prefix+"*"+fileIndexSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), fileIndexSuffix)
+		index, err := NewFileIndex(cluster.dir, name)
+		if err != nil {
+			return err
+		}
+		if err = cluster.Add(index, alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Alias returns the index that reads the indices under the alias.
+func (cluster *MemoryCluster) Alias(alias string) *MemoryAlias {
+	return &MemoryAlias{name: alias, cluster: cluster}
+}
+
+// Close closes the indices.
+func (cluster *MemoryCluster) Close() error {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	for _, index := range cluster.indices {
+		if err := index.index.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cluster *MemoryCluster) addAlias(alias string, index string) {
+	if cluster.aliases[alias] == nil {
+		cluster.aliases[alias] = map[string]bool{}
+	}
+	cluster.aliases[alias][index] = true
+}
+
+// members returns the indices under the alias, in order of name.
+func (cluster *MemoryCluster) members(alias string) []*memoryClusterIndex {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	names := []string{}
+	for name := range cluster.aliases[alias] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	members := make([]*memoryClusterIndex, len(names))
+	for i, name := range names {
+		members[i] = cluster.indices[name]
+	}
+	return members
+}
+
+func (cluster *MemoryCluster) IndexExists(index string) (bool, error) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	_, ok := cluster.indices[index]
+	return ok, nil
+}
+
+// CreateIndex makes the index with the mappings and aliases of the body.
+func (cluster *MemoryCluster) CreateIndex(index string, body json.RawMessage) error {
+	var parsed struct {
+		Aliases map[string]interface{} `json:"aliases"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return err
+	}
+
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	if _, ok := cluster.indices[index]; ok {
+		return fmt.Errorf("MemoryCluster: index %s already exists", index)
+	}
+
+	entry := &memoryClusterIndex{}
+	if cluster.dir == "" {
+		entry.memory = NewMemoryIndex(index)
+		entry.index = entry.memory
+	} else {
+		esi, err := NewFileIndex(cluster.dir, index)
+		if err != nil {
+			return err
+		}
+		entry.memory, entry.index = esi.MemoryIndex, esi
+	}
+	if err := entry.index.Create(string(body)); err != nil {
+		return err
+	}
+
+	cluster.indices[index] = entry
+	for alias := range parsed.Aliases {
+		cluster.addAlias(alias, index)
+	}
+	return nil
+}
+
+func (cluster *MemoryCluster) AliasedIndices(alias string) ([]string, error) {
+	names := []string{}
+	for _, member := range cluster.members(alias) {
+		names = append(names, member.index.IndexName())
+	}
+	return names, nil
+}
+
+// DeleteIndex drops the index, and its file if it has one.
+func (cluster *MemoryCluster) DeleteIndex(index string) error {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	entry, ok := cluster.indices[index]
+	if !ok {
+		return fmt.Errorf("MemoryCluster: index %s does not exist", index)
+	}
+	if err := entry.index.Delete(); err != nil {
+		return err
+	}
+	if esi, ok := entry.index.(*FileIndex); ok {
+		if err := esi.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(esi.path); err != nil {
+			return err
+		}
+	}
+	delete(cluster.indices, index)
+	for _, members := range cluster.aliases {
+		delete(members, index)
+	}
+	return nil
+}
+
+func (cluster *MemoryCluster) OpenIndex(index string) (elasticsearch.IIndex, error) {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	entry, ok := cluster.indices[index]
+	if !ok {
+		return nil, fmt.Errorf("MemoryCluster: index %s does not exist", index)
+	}
+	return entry.index, nil
+}
+
+//---------------------------------------------------------------------------
+
+// MemoryAlias is an elasticsearch.IIndex over the indices of a MemoryCluster
+// under an alias. As with Elasticsearch, it searches them all together, but
+// a document can only be read or written through it, and a percolation query
+// added, while it is over a single index.
+type MemoryAlias struct {
+	name    string
+	cluster *MemoryCluster
+}
+
+func (esi *MemoryAlias) memories() []*MemoryIndex {
+	members := esi.cluster.members(esi.name)
+	memories := make([]*MemoryIndex, len(members))
+	for i, member := range members {
+		memories[i] = member.memory
+	}
+	return memories
+}
+
+// single returns the one index under the alias.
+func (esi *MemoryAlias) single() (elasticsearch.IIndex, error) {
+	members := esi.cluster.members(esi.name)
+	switch len(members) {
+	case 0:
+		return nil, fmt.Errorf("Index %s does not exist", esi.name)
+	case 1:
+		return members[0].index, nil
+	}
+	return nil, fmt.Errorf("Alias [%s] has more than one indices associated with it, can't execute a single index op", esi.name)
+}
+
+func (esi *MemoryAlias) GetVersion() string {
+	return "2.2.0"
+}
+
+func (esi *MemoryAlias) IndexName() string {
+	return esi.name
+}
+
+func (esi *MemoryAlias) IndexExists() (bool, error) {
+	return len(esi.cluster.members(esi.name)) != 0, nil
+}
+
+func (esi *MemoryAlias) TypeExists(typ string) (bool, error) {
+	for _, member := range esi.cluster.members(esi.name) {
+		if ok, err := member.index.TypeExists(typ); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (esi *MemoryAlias) ItemExists(typ string, id string) (bool, error) {
+	index, err := esi.single()
+	if err != nil {
+		return false, err
+	}
+	return index.ItemExists(typ, id)
+}
+
+// Create does nothing: the indices are made through the cluster.
+func (esi *MemoryAlias) Create(settings string) error {
+	return nil
+}
+
+func (esi *MemoryAlias) Close() error {
+	return nil
+}
+
+func (esi *MemoryAlias) Delete() error {
+	return fmt.Errorf("MemoryAlias: %s is an alias", esi.name)
+}
+
+func (esi *MemoryAlias) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	index, err := esi.single()
+	if err != nil {
+		return nil, err
+	}
+	return index.PostData(typ, id, obj)
+}
+
+func (esi *MemoryAlias) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	return esi.PostData(typ, id, obj)
+}
+
+func (esi *MemoryAlias) GetByID(typ string, id string) (*elasticsearch.GetResult, error) {
+	index, err := esi.single()
+	if err != nil {
+		return &elasticsearch.GetResult{Found: false}, err
+	}
+	return index.GetByID(typ, id)
+}
+
+func (esi *MemoryAlias) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	index, err := esi.single()
+	if err != nil {
+		return &elasticsearch.DeleteResponse{Found: false}, err
+	}
+	return index.DeleteByID(typ, id)
+}
+
+func (esi *MemoryAlias) FilterByMatchAll(typ string, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	return searchMemory(esi.memories(), typ, matchAllNode{}, newMemoryPage(format))
+}
+
+func (esi *MemoryAlias) GetAllElements(typ string) (*elasticsearch.SearchResult, error) {
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return nil, fmt.Errorf("MemoryAlias.GetAllElements: type %s in alias %s does not exist", typ, esi.name)
+	}
+	return searchMemory(esi.memories(), typ, matchAllNode{}, newMemoryPage(nil))
+}
+
+func (esi *MemoryAlias) FilterByTermQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("Can't filter on type \"\"")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return &elasticsearch.SearchResult{Found: false}, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return searchMemory(esi.memories(), typ, &termNode{field: name, values: []interface{}{value}}, newMemoryPage(format))
+}
+
+func (esi *MemoryAlias) FilterByMatchQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("Can't filter on type \"\"")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return searchMemory(esi.memories(), typ, &matchNode{field: name, query: value}, newMemoryPage(format))
+}
+
+func (esi *MemoryAlias) SearchByJSON(typ string, jsn string) (*elasticsearch.SearchResult, error) {
+	node, page, err := parseMemorySearch(jsn)
+	if err != nil {
+		return nil, err
+	}
+	return searchMemory(esi.memories(), typ, node, page)
+}
+
+// SetMapping sets the mapping on every index under the alias.
+func (esi *MemoryAlias) SetMapping(typ string, jsn piazza.JsonString) error {
+	for _, member := range esi.cluster.members(esi.name) {
+		if err := member.index.SetMapping(typ, jsn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteType drops the type from every index under the alias that has it.
+func (esi *MemoryAlias) DeleteType(typ string) error {
+	for _, member := range esi.cluster.members(esi.name) {
+		if ok, _ := member.memory.TypeExists(typ); !ok {
+			continue
+		}
+		if err := member.memory.DeleteType(typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (esi *MemoryAlias) GetTypes() ([]string, error) {
+	seen := map[string]bool{}
+	types := []string{}
+	for _, member := range esi.cluster.members(esi.name) {
+		memberTypes, err := member.index.GetTypes()
+		if err != nil {
+			return nil, err
+		}
+		for _, typ := range memberTypes {
+			if !seen[typ] {
+				seen[typ] = true
+				types = append(types, typ)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+func (esi *MemoryAlias) GetMapping(typ string) (interface{}, error) {
+	for _, member := range esi.cluster.members(esi.name) {
+		if ok, _ := member.index.TypeExists(typ); ok {
+			return member.index.GetMapping(typ)
+		}
+	}
+	return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+}
+
+func (esi *MemoryAlias) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	index, err := esi.single()
+	if err != nil {
+		return nil, err
+	}
+	return index.AddPercolationQuery(id, query)
+}
+
+func (esi *MemoryAlias) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	index, err := esi.single()
+	if err != nil {
+		return &elasticsearch.DeleteResponse{Found: false}, err
+	}
+	return index.DeletePercolationQuery(id)
+}
+
+// AddPercolationDocument percolates the document in each index that has the
+// type.
+func (esi *MemoryAlias) AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error) {
+	var resp *elasticsearch.PercolateResponse
+	for _, member := range esi.cluster.members(esi.name) {
+		if ok, _ := member.index.TypeExists(typ); !ok {
+			continue
+		}
+		memberResp, err := member.index.AddPercolationDocument(typ, doc)
+		if err != nil {
+			return nil, err
+		}
+		if resp == nil {
+			resp = memberResp
+			continue
+		}
+		resp.Total += memberResp.Total
+		resp.Matches = append(resp.Matches, memberResp.Matches...)
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return resp, nil
+}
+
+func (esi *MemoryAlias) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	index, err := esi.single()
+	if err != nil {
+		return err
+	}
+	return index.DirectAccess(verb, endpoint, input, output)
+}
@@ -0,0 +1,935 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// MemoryIndex is an elasticsearch.IIndex kept in memory, which the Kit uses
+// when mocking. Unlike elasticsearch.MockIndex it searches the way
+// Elasticsearch 2.x does: paging, sorting, term and match filters, and the
+// query DSL that conditions use (see Condition.go) in SearchByJSON. It also
+// percolates, and the document endpoints of DirectAccess honor versions.
+//
+// Fields are typed by the mappings given to Create and SetMapping. Unmapped
+// strings outside "data" are not analyzed, as the db scripts declare every
+// field of the service's own documents; unmapped fields inside "data" are
+// typed dynamically.
+type MemoryIndex struct {
+	name    string
+	exists  bool
+	types   map[string]*memoryType
+	queries map[string]*memoryQuery
+	lastID  int
+	lock    sync.Mutex
+
+	// journal, if set, is given each change before it is made; a FileIndex
+	// logs them
+	journal func(record *memoryRecord) error
+}
+
+type memoryType struct {
+	properties map[string]interface{}
+	docs       map[string]*memoryDoc
+}
+
+type memoryDoc struct {
+	id      string
+	typ     string
+	source  json.RawMessage
+	version int64
+}
+
+type memoryQuery struct {
+	source json.RawMessage
+	node   conditionNode
+}
+
+// memoryRecord is one change to a MemoryIndex. Every change is made by
+// applying a record, so that the changes can be logged and replayed.
+type memoryRecord struct {
+	Op       string          `json:"op"`
+	Type     string          `json:"type,omitempty"`
+	ID       string          `json:"id,omitempty"`
+	Source   json.RawMessage `json:"source,omitempty"`
+	Version  int64           `json:"version,omitempty"`
+	Sequence int             `json:"sequence,omitempty"`
+}
+
+const (
+	memoryOpCreate           = "create"
+	memoryOpDelete           = "delete"
+	memoryOpPut              = "put"
+	memoryOpRemove           = "remove"
+	memoryOpMapping          = "mapping"
+	memoryOpRemoveType       = "removeType"
+	memoryOpPercolator       = "percolator"
+	memoryOpRemovePercolator = "removePercolator"
+	memoryOpSequence         = "sequence"
+)
+
+// memorySearchDefaultSize is the number of hits Elasticsearch returns when a
+// search doesn't say.
+const memorySearchDefaultSize = 10
+
+func NewMemoryIndex(name string) *MemoryIndex {
+	return &MemoryIndex{
+		name:    name,
+		types:   map[string]*memoryType{},
+		queries: map[string]*memoryQuery{},
+	}
+}
+
+func (esi *MemoryIndex) GetVersion() string {
+	return "2.2.0"
+}
+
+func (esi *MemoryIndex) IndexName() string {
+	return esi.name
+}
+
+func (esi *MemoryIndex) IndexExists() (bool, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	return esi.exists, nil
+}
+
+func (esi *MemoryIndex) TypeExists(typ string) (bool, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	return esi.exists && esi.types[typ] != nil, nil
+}
+
+func (esi *MemoryIndex) ItemExists(typ string, id string) (bool, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	return esi.item(typ, id) != nil, nil
+}
+
+// Create makes the index, with the mappings of the settings if any. As with
+// Elasticsearch, creating an index that exists does nothing.
+func (esi *MemoryIndex) Create(settings string) error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if esi.exists {
+		return nil
+	}
+	record := &memoryRecord{Op: memoryOpCreate}
+	if settings != "" {
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(settings), &obj); err != nil {
+			return err
+		}
+		mappings, _ := obj["mappings"].(map[string]interface{})
+		for typ, mapping := range mappings {
+			if _, ok := mapping.(map[string]interface{}); !ok {
+				return fmt.Errorf("MemoryIndex: mapping for type %s must be an object", typ)
+			}
+		}
+		record.Source = json.RawMessage(settings)
+	}
+	return esi.change(record)
+}
+
+func (esi *MemoryIndex) Close() error {
+	return nil
+}
+
+func (esi *MemoryIndex) Delete() error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	return esi.change(&memoryRecord{Op: memoryOpDelete})
+}
+
+func (esi *MemoryIndex) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	byts, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if !esi.exists {
+		return nil, fmt.Errorf("Index %s does not exist", esi.name)
+	}
+	record := &memoryRecord{Op: memoryOpPut, Type: typ, ID: id, Source: byts, Version: esi.nextVersion(typ, id)}
+	if id == "" {
+		record.Sequence = esi.lastID + 1
+		record.ID = strconv.Itoa(record.Sequence)
+		record.Version = 1
+	}
+	if err = esi.change(record); err != nil {
+		return nil, err
+	}
+	return &elasticsearch.IndexResponse{Created: record.Version == 1, ID: record.ID, Index: esi.name, Type: typ, Version: int(record.Version)}, nil
+}
+
+func (esi *MemoryIndex) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	return esi.PostData(typ, id, obj)
+}
+
+func (esi *MemoryIndex) GetByID(typ string, id string) (*elasticsearch.GetResult, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	doc := esi.item(typ, id)
+	if doc == nil {
+		return &elasticsearch.GetResult{Found: false}, fmt.Errorf("Item %s in index %s and type %s does not exist", id, esi.name, typ)
+	}
+	source := append(json.RawMessage{}, doc.source...)
+	return &elasticsearch.GetResult{ID: id, Source: &source, Found: true}, nil
+}
+
+func (esi *MemoryIndex) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if esi.item(typ, id) == nil {
+		return &elasticsearch.DeleteResponse{Found: false}, fmt.Errorf("Item %s in index %s and type %s does not exist", id, esi.name, typ)
+	}
+	if err := esi.change(&memoryRecord{Op: memoryOpRemove, Type: typ, ID: id}); err != nil {
+		return nil, err
+	}
+	return &elasticsearch.DeleteResponse{Found: true, ID: id}, nil
+}
+
+func (esi *MemoryIndex) FilterByMatchAll(typ string, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	return esi.search(typ, matchAllNode{}, newMemoryPage(format))
+}
+
+func (esi *MemoryIndex) GetAllElements(typ string) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("MemoryIndex.GetAllElements: empty type")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return nil, fmt.Errorf("MemoryIndex.GetAllElements: type %s in index %s does not exist", typ, esi.name)
+	}
+	return esi.search(typ, matchAllNode{}, newMemoryPage(nil))
+}
+
+func (esi *MemoryIndex) FilterByTermQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("Can't filter on type \"\"")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return &elasticsearch.SearchResult{Found: false}, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return esi.search(typ, &termNode{field: name, values: []interface{}{value}}, newMemoryPage(format))
+}
+
+func (esi *MemoryIndex) FilterByMatchQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if typ == "" {
+		return nil, fmt.Errorf("Can't filter on type \"\"")
+	}
+	if ok, _ := esi.TypeExists(typ); !ok {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return esi.search(typ, &matchNode{field: name, query: value}, newMemoryPage(format))
+}
+
+// SearchByJSON runs a search body of query, from, size and sort. The query
+// may use any of the clauses a condition may.
+func (esi *MemoryIndex) SearchByJSON(typ string, jsn string) (*elasticsearch.SearchResult, error) {
+	node, page, err := parseMemorySearch(jsn)
+	if err != nil {
+		return nil, err
+	}
+	return esi.search(typ, node, page)
+}
+
+func parseMemorySearch(jsn string) (conditionNode, *memoryPage, error) {
+	body := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &body); err != nil {
+		return nil, nil, err
+	}
+
+	var node conditionNode = matchAllNode{}
+	page := newMemoryPage(nil)
+	for key, value := range body {
+		var err error
+		switch key {
+		case "query":
+			query, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("MemoryIndex: query must be an object")
+			}
+			node, err = compileClause(query)
+		case "from":
+			page.from, err = memoryPageNumber(key, value)
+		case "size":
+			page.size, err = memoryPageNumber(key, value)
+		case "sort":
+			page.sort, err = parseMemorySort(value)
+		default:
+			err = fmt.Errorf("MemoryIndex: search key [%s] is not supported", key)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return node, page, nil
+}
+
+// SetMapping adds the fields of the mapping to the type, making the type if
+// need be. Unlike with Elasticsearch the index needn't exist yet, so mappings
+// can be set up before Create.
+func (esi *MemoryIndex) SetMapping(typ string, jsn piazza.JsonString) error {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(jsn), &obj); err != nil {
+		return err
+	}
+	if inner, ok := obj[typ].(map[string]interface{}); ok && len(obj) == 1 {
+		obj = inner
+	}
+	byts, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	return esi.change(&memoryRecord{Op: memoryOpMapping, Type: typ, Source: byts})
+}
+
+func (esi *MemoryIndex) GetTypes() ([]string, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if !esi.exists {
+		return nil, fmt.Errorf("Index %s does not exist", esi.name)
+	}
+	types := []string{}
+	for typ := range esi.types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// DeleteType drops the type, with its mapping and documents, which
+// Elasticsearch 2 can't do.
+func (esi *MemoryIndex) DeleteType(typ string) error {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if esi.types[typ] == nil {
+		return fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	return esi.change(&memoryRecord{Op: memoryOpRemoveType, Type: typ})
+}
+
+// GetMapping returns the mapping of the type the way Elasticsearch does,
+// {"<type>": {"properties": {...}}}.
+func (esi *MemoryIndex) GetMapping(typ string) (interface{}, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	t := esi.types[typ]
+	if !esi.exists || t == nil {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	byts, err := json.Marshal(map[string]interface{}{typ: map[string]interface{}{"properties": t.properties}})
+	if err != nil {
+		return nil, err
+	}
+	var mapping interface{}
+	err = json.Unmarshal(byts, &mapping)
+	return mapping, err
+}
+
+func (esi *MemoryIndex) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	if _, err := compilePercolator(json.RawMessage(query)); err != nil {
+		return nil, err
+	}
+
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if !esi.exists {
+		return nil, fmt.Errorf("Index %s does not exist", esi.name)
+	}
+	_, existed := esi.queries[id]
+	if err := esi.change(&memoryRecord{Op: memoryOpPercolator, ID: id, Source: json.RawMessage(query)}); err != nil {
+		return nil, err
+	}
+	return &elasticsearch.IndexResponse{Created: !existed, ID: id, Index: esi.name, Type: ".percolator", Version: 1}, nil
+}
+
+func (esi *MemoryIndex) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if _, ok := esi.queries[id]; !ok {
+		return &elasticsearch.DeleteResponse{Found: false}, fmt.Errorf("Item %s in index %s and type .percolator does not exist", id, esi.name)
+	}
+	if err := esi.change(&memoryRecord{Op: memoryOpRemovePercolator, ID: id}); err != nil {
+		return nil, err
+	}
+	return &elasticsearch.DeleteResponse{Found: true, ID: id}, nil
+}
+
+// AddPercolationDocument returns the ids of the queries that match the
+// document, typed by the mapping of the type it would be indexed under.
+func (esi *MemoryIndex) AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error) {
+	byts, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	source := map[string]interface{}{}
+	if err = json.Unmarshal(byts, &source); err != nil {
+		return nil, err
+	}
+
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	t := esi.types[typ]
+	if !esi.exists || t == nil {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.name)
+	}
+	cdoc := &conditionDoc{source: source, types: t.fieldType}
+	ids := []string{}
+	for id, query := range esi.queries {
+		if query.node.matches(cdoc) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	resp := &elasticsearch.PercolateResponse{Total: int64(len(ids)), Matches: []*elasticsearch.PercolateResponseMatch{}}
+	for _, id := range ids {
+		resp.Matches = append(resp.Matches, &elasticsearch.PercolateResponseMatch{Id: id, Index: esi.name})
+	}
+	return resp, nil
+}
+
+// DirectAccess serves the document endpoints, /<index>/<type>/<id>, for GET,
+// PUT and DELETE, with the version and op_type=create parameters. Failures
+// are returned in the body, as Elasticsearch does, with status and error set.
+func (esi *MemoryIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != esi.name {
+		return fmt.Errorf("MemoryIndex: %s %s is not supported", verb, endpoint)
+	}
+	typ := parts[1]
+	id, err := url.QueryUnescape(parts[2])
+	if err != nil {
+		return err
+	}
+	params := u.Query()
+
+	var byts []byte
+	if input != nil {
+		if byts, err = json.Marshal(input); err != nil {
+			return err
+		}
+	}
+
+	esi.lock.Lock()
+	resp, err := esi.directAccess(verb, typ, id, params, byts)
+	esi.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if output == nil {
+		return nil
+	}
+	if byts, err = json.Marshal(resp); err != nil {
+		return err
+	}
+	return json.Unmarshal(byts, output)
+}
+
+func (esi *MemoryIndex) directAccess(verb string, typ string, id string, params url.Values, body []byte) (map[string]interface{}, error) {
+	resp := map[string]interface{}{"_index": esi.name, "_type": typ, "_id": id}
+	doc := esi.item(typ, id)
+
+	conflict := func(reason string) map[string]interface{} {
+		return map[string]interface{}{
+			"status": 409,
+			"error": map[string]interface{}{
+				"type":   "version_conflict_engine_exception",
+				"reason": fmt.Sprintf("[%s][%s]: version conflict, %s", typ, id, reason),
+			},
+		}
+	}
+	if v := params.Get("version"); v != "" && verb != "GET" {
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("MemoryIndex: version %s is not a number", v)
+		}
+		if doc == nil || doc.version != version {
+			return conflict(fmt.Sprintf("provided version [%d] is not the current one", version)), nil
+		}
+	}
+
+	switch verb {
+	case "GET":
+		resp["found"] = doc != nil
+		if doc != nil {
+			resp["_version"] = doc.version
+			resp["_source"] = doc.source
+		}
+	case "PUT", "POST":
+		if params.Get("op_type") == "create" && doc != nil {
+			return conflict("document already exists"), nil
+		}
+		if body == nil {
+			return nil, fmt.Errorf("MemoryIndex: %s of %s/%s has no body", verb, typ, id)
+		}
+		// as with indexing by the API, this makes the index if need be
+		record := &memoryRecord{Op: memoryOpPut, Type: typ, ID: id, Source: body, Version: esi.nextVersion(typ, id)}
+		if err := esi.change(record); err != nil {
+			return nil, err
+		}
+		resp["_version"] = record.Version
+		resp["created"] = record.Version == 1
+	case "DELETE":
+		resp["found"] = doc != nil
+		if doc != nil {
+			if err := esi.change(&memoryRecord{Op: memoryOpRemove, Type: typ, ID: id}); err != nil {
+				return nil, err
+			}
+			resp["_version"] = doc.version + 1
+		}
+	default:
+		return nil, fmt.Errorf("MemoryIndex: %s is not supported", verb)
+	}
+	return resp, nil
+}
+
+//------------------------------------------------------------------------------
+
+// item returns the document, or nil; the lock must be held.
+func (esi *MemoryIndex) item(typ string, id string) *memoryDoc {
+	t := esi.types[typ]
+	if !esi.exists || t == nil {
+		return nil
+	}
+	return t.docs[id]
+}
+
+// nextVersion returns the version the document will have once it is stored;
+// the lock must be held.
+func (esi *MemoryIndex) nextVersion(typ string, id string) int64 {
+	if doc := esi.item(typ, id); doc != nil {
+		return doc.version + 1
+	}
+	return 1
+}
+
+// change journals the record, if there is a journal, and applies it; the lock
+// must be held.
+func (esi *MemoryIndex) change(record *memoryRecord) error {
+	if esi.journal != nil {
+		if err := esi.journal(record); err != nil {
+			return err
+		}
+	}
+	return esi.apply(record)
+}
+
+// apply makes the change of the record, which has already been checked; the
+// lock must be held.
+func (esi *MemoryIndex) apply(record *memoryRecord) error {
+	if record.Sequence > esi.lastID {
+		// the last id generated for a document posted without one
+		esi.lastID = record.Sequence
+	}
+	switch record.Op {
+	case memoryOpCreate:
+		if len(record.Source) != 0 {
+			settings := struct {
+				Mappings map[string]map[string]interface{} `json:"mappings"`
+			}{}
+			if err := json.Unmarshal(record.Source, &settings); err != nil {
+				return err
+			}
+			for typ, mapping := range settings.Mappings {
+				esi.setMapping(typ, mapping)
+			}
+		}
+		esi.exists = true
+	case memoryOpDelete:
+		esi.exists = false
+		esi.types = map[string]*memoryType{}
+		esi.queries = map[string]*memoryQuery{}
+	case memoryOpPut:
+		esi.exists = true
+		t := esi.typeNamed(record.Type)
+		t.docs[record.ID] = &memoryDoc{id: record.ID, typ: record.Type, source: append(json.RawMessage{}, record.Source...), version: record.Version}
+	case memoryOpRemove:
+		if t := esi.types[record.Type]; t != nil {
+			delete(t.docs, record.ID)
+		}
+	case memoryOpMapping:
+		mapping := map[string]interface{}{}
+		if err := json.Unmarshal(record.Source, &mapping); err != nil {
+			return err
+		}
+		esi.setMapping(record.Type, mapping)
+	case memoryOpRemoveType:
+		delete(esi.types, record.Type)
+	case memoryOpPercolator:
+		query, err := compilePercolator(record.Source)
+		if err != nil {
+			return err
+		}
+		esi.queries[record.ID] = query
+	case memoryOpRemovePercolator:
+		delete(esi.queries, record.ID)
+	case memoryOpSequence:
+	default:
+		return fmt.Errorf("MemoryIndex: unknown change %s", record.Op)
+	}
+	return nil
+}
+
+// records returns the changes that make an empty index into this one.
+func (esi *MemoryIndex) records() []*memoryRecord {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	records := []*memoryRecord{}
+	if esi.exists {
+		records = append(records, &memoryRecord{Op: memoryOpCreate})
+	}
+	types := []string{}
+	for typ := range esi.types {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		t := esi.types[typ]
+		mapping, _ := json.Marshal(map[string]interface{}{"properties": t.properties})
+		records = append(records, &memoryRecord{Op: memoryOpMapping, Type: typ, Source: mapping})
+		ids := []string{}
+		for id := range t.docs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			doc := t.docs[id]
+			records = append(records, &memoryRecord{Op: memoryOpPut, Type: typ, ID: id, Source: doc.source, Version: doc.version})
+		}
+	}
+	ids := []string{}
+	for id := range esi.queries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		records = append(records, &memoryRecord{Op: memoryOpPercolator, ID: id, Source: esi.queries[id].source})
+	}
+	if esi.lastID > 0 {
+		records = append(records, &memoryRecord{Op: memoryOpSequence, Sequence: esi.lastID})
+	}
+	return records
+}
+
+func compilePercolator(source json.RawMessage) (*memoryQuery, error) {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(source, &obj); err != nil {
+		return nil, err
+	}
+	node, err := compileCondition(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryQuery{source: append(json.RawMessage{}, source...), node: node}, nil
+}
+
+func (esi *MemoryIndex) typeNamed(typ string) *memoryType {
+	t := esi.types[typ]
+	if t == nil {
+		t = &memoryType{properties: map[string]interface{}{}, docs: map[string]*memoryDoc{}}
+		esi.types[typ] = t
+	}
+	return t
+}
+
+// setMapping merges the properties of the mapping into the type; the lock
+// must be held.
+func (esi *MemoryIndex) setMapping(typ string, mapping map[string]interface{}) {
+	t := esi.typeNamed(typ)
+	if properties, ok := mapping["properties"].(map[string]interface{}); ok {
+		mergeMemoryProperties(t.properties, properties)
+	}
+}
+
+func mergeMemoryProperties(into map[string]interface{}, from map[string]interface{}) {
+	for name, field := range from {
+		existing, ok1 := into[name].(map[string]interface{})
+		incoming, ok2 := field.(map[string]interface{})
+		if ok1 && ok2 {
+			existingProps, ok1 := existing["properties"].(map[string]interface{})
+			incomingProps, ok2 := incoming["properties"].(map[string]interface{})
+			if ok1 && ok2 {
+				mergeMemoryProperties(existingProps, incomingProps)
+				continue
+			}
+		}
+		into[name] = field
+	}
+}
+
+// fieldType returns the type of a dotted path the way the condition
+// evaluator names them: a not_analyzed string is a "keyword".
+func (t *memoryType) fieldType(path string) string {
+	var field map[string]interface{}
+	properties := t.properties
+	for _, part := range strings.Split(path, ".") {
+		var ok bool
+		if field, ok = properties[part].(map[string]interface{}); !ok {
+			field = nil
+			break
+		}
+		properties, _ = field["properties"].(map[string]interface{})
+	}
+
+	if field == nil {
+		if strings.HasPrefix(path, "data.") {
+			return ""
+		}
+		return "keyword"
+	}
+	typ, _ := field["type"].(string)
+	switch {
+	case typ == "string" && field["index"] == "not_analyzed":
+		return "keyword"
+	case typ == "text":
+		return "string"
+	}
+	return typ
+}
+
+// search returns the documents of the type, or of every type if typ is "",
+// that the query matches, sorted and paged.
+func (esi *MemoryIndex) search(typ string, node conditionNode, page *memoryPage) (*elasticsearch.SearchResult, error) {
+	return searchMemory([]*MemoryIndex{esi}, typ, node, page)
+}
+
+// matching returns the documents of the type, or of every type if typ is "",
+// that the query matches.
+func (esi *MemoryIndex) matching(typ string, node conditionNode) ([]*memoryHit, error) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	hits := []*memoryHit{}
+	if !esi.exists {
+		return hits, nil
+	}
+	for name, t := range esi.types {
+		if typ != "" && name != typ {
+			continue
+		}
+		for _, doc := range t.docs {
+			source := map[string]interface{}{}
+			if err := json.Unmarshal(doc.source, &source); err != nil {
+				return nil, err
+			}
+			if node.matches(&conditionDoc{source: source, types: t.fieldType}) {
+				hits = append(hits, &memoryHit{index: esi.name, doc: doc, source: source, fieldType: t.fieldType})
+			}
+		}
+	}
+	return hits, nil
+}
+
+// searchMemory searches several indices at once, as a search of an alias
+// does, sorting and paging the hits of them all together.
+func searchMemory(indices []*MemoryIndex, typ string, node conditionNode, page *memoryPage) (*elasticsearch.SearchResult, error) {
+	hits := []*memoryHit{}
+	for _, esi := range indices {
+		matched, err := esi.matching(typ, node)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, matched...)
+	}
+
+	sort.Sort(memoryHitsBy{hits: hits, sort: page.sort})
+
+	total := int64(len(hits))
+	from := page.from
+	if from > len(hits) {
+		from = len(hits)
+	}
+	to := from + page.size
+	if to > len(hits) {
+		to = len(hits)
+	}
+
+	result := &elastic.SearchResult{Hits: &elastic.SearchHits{TotalHits: total, Hits: []*elastic.SearchHit{}}}
+	for _, hit := range hits[from:to] {
+		source := append(json.RawMessage{}, hit.doc.source...)
+		result.Hits.Hits = append(result.Hits.Hits, &elastic.SearchHit{Id: hit.doc.id, Type: hit.doc.typ, Index: hit.index, Source: &source})
+	}
+	return elasticsearch.NewSearchResult(result), nil
+}
+
+//------------------------------------------------------------------------------
+
+// memoryPage is the from, size and sort of a search.
+type memoryPage struct {
+	from int
+	size int
+	sort []memorySortKey
+}
+
+type memorySortKey struct {
+	field      string
+	descending bool
+}
+
+func newMemoryPage(format *piazza.JsonPagination) *memoryPage {
+	page := &memoryPage{size: memorySearchDefaultSize}
+	if format == nil {
+		return page
+	}
+	query := elasticsearch.NewQueryFormat(format)
+	page.from = query.From
+	page.size = query.Size
+	if query.Key != "" {
+		page.sort = []memorySortKey{{field: query.Key, descending: !query.Order}}
+	}
+	return page
+}
+
+func memoryPageNumber(name string, v interface{}) (int, error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != float64(int(f)) {
+		return 0, fmt.Errorf("MemoryIndex: %s must be a whole number, not %v", name, v)
+	}
+	return int(f), nil
+}
+
+// parseMemorySort reads a sort of one or a list of "field", {"field": "asc"}
+// or {"field": {"order": "desc"}}.
+func parseMemorySort(v interface{}) ([]memorySortKey, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	keys := []memorySortKey{}
+	for _, item := range list {
+		switch t := item.(type) {
+		case string:
+			keys = append(keys, memorySortKey{field: t, descending: t == "_score"})
+		case map[string]interface{}:
+			for field, order := range t {
+				if m, ok := order.(map[string]interface{}); ok {
+					order = m["order"]
+				}
+				switch strings.ToLower(fmt.Sprintf("%v", order)) {
+				case "asc":
+					keys = append(keys, memorySortKey{field: field})
+				case "desc":
+					keys = append(keys, memorySortKey{field: field, descending: true})
+				default:
+					return nil, fmt.Errorf("MemoryIndex: sort order of [%s] must be \"asc\" or \"desc\"", field)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("MemoryIndex: sort must be a field name or an object")
+		}
+	}
+	return keys, nil
+}
+
+type memoryHit struct {
+	index     string
+	doc       *memoryDoc
+	source    map[string]interface{}
+	fieldType func(path string) string
+}
+
+// memoryHitsBy sorts hits by the sort keys, with documents missing a field
+// last whatever the order, and then by id.
+type memoryHitsBy struct {
+	hits []*memoryHit
+	sort []memorySortKey
+}
+
+func (by memoryHitsBy) Len() int      { return len(by.hits) }
+func (by memoryHitsBy) Swap(i, j int) { by.hits[i], by.hits[j] = by.hits[j], by.hits[i] }
+func (by memoryHitsBy) Less(i, j int) bool {
+	a, b := by.hits[i], by.hits[j]
+	for _, key := range by.sort {
+		if key.field == "_score" {
+			// every hit scores the same
+			continue
+		}
+		va, oka := a.sortValue(key.field)
+		vb, okb := b.sortValue(key.field)
+		switch {
+		case !oka && !okb:
+			continue
+		case !oka:
+			return false
+		case !okb:
+			return true
+		}
+		c := compareSortValues(va, vb)
+		if c == 0 {
+			continue
+		}
+		if key.descending {
+			return c > 0
+		}
+		return c < 0
+	}
+	return a.doc.id < b.doc.id
+}
+
+// sortValue returns the first value of the field, as a number where the
+// field is numeric or a date.
+func (hit *memoryHit) sortValue(field string) (interface{}, bool) {
+	if field == "_id" || field == "_uid" {
+		return hit.doc.id, true
+	}
+	values := (&conditionDoc{source: hit.source}).values(field)
+	if len(values) == 0 {
+		return nil, false
+	}
+	v := values[0]
+	switch valueKind(hit.fieldType(field), v) {
+	case kindNumber:
+		if f, ok := toFloat(v); ok {
+			return f, true
+		}
+	case kindDate:
+		if ms, ok := toMillis(v); ok {
+			return float64(ms), true
+		}
+	}
+	return fmt.Sprintf("%v", v), true
+}
+
+func compareSortValues(a, b interface{}) int {
+	fa, ok1 := a.(float64)
+	fb, ok2 := b.(float64)
+	if ok1 && ok2 {
+		return compareFloat(fa, fb)
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
@@ -0,0 +1,577 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+// The first migrations make the indices as the db/ scripts did; on a cluster
+// the scripts were run against, they find them made and change nothing. The
+// ones after them add to those indices in place, so that the documents in
+// them, and the types and percolator queries of the events index, are kept.
+// To add a field to a type, add a schema of the same index that has it and a
+// putMapping migration; the events are given theirs with putDefaultMapping,
+// which adds them to each EventType's type too. An index that has to be made
+// again, to change what Elasticsearch can't change in place, would lose what
+// is in it unless its migration copies it over before moving the alias, so
+// that is only done with a migration that copies everything, percolator
+// queries included.
+
+var workflowMigrations = []Migration{
+	{1, "Create eventtypes004 as eventtypes", createIndex(eventTypes004)},
+	{2, "Create events005 as events", createIndex(events005)},
+	{3, "Create triggers004 as triggers", createIndex(triggers004)},
+	{4, "Create alerts004 as alerts", createIndex(alerts004)},
+	{5, "Create crons004 as crons", createIndex(crons004)},
+	{6, "Create testelasticsearch004 as testElasticsearch", createIndex(testElasticsearch004)},
+	{7, "Add the action to the Trigger mapping of triggers004", putMapping(triggers004Action, TriggerDBMapping)},
+	{8, "Add the action to the Alert mapping of alerts004", putMapping(alerts004Action, AlertDBMapping)},
+	{9, "Add the repeating event fields to the event types of events005", putDefaultMapping(events005Cron)},
+	{10, "Add the schedule, pause and runs to the Cron mapping of crons004", putMapping(crons004Schedule, CronDBMapping)},
+	{11, "Create cronruns001 as cronruns", createIndex(cronRuns001)},
+	{12, "Create dispatches001 as dispatches", createIndex(dispatches001)},
+	{13, "Add retention to the EventType mapping of eventtypes004", putMapping(eventTypes004Retention, EventTypeDBMapping)},
+	{14, "Create eventlookups001 as eventlookups", createIndex(eventLookups001)},
+	{15, "Create trash001 as trash", createIndex(trash001)},
+	{16, "Add status and annotation to the Alert mapping of alerts004", putMapping(alerts004Status, AlertDBMapping)},
+	{17, "Add the alert to the Dispatch mapping of dispatches001", putMapping(dispatches001Alert, DispatchDBMapping)},
+	{18, "Create leases001 as leases", createIndex(leases001)},
+}
+
+// workflowSchemas are the indices behind the aliases once all of the
+// migrations are applied.
+var workflowSchemas = []IndexSchema{
+	eventTypes004Retention,
+	events005Cron,
+	triggers004Action,
+	alerts004Status,
+	crons004Schedule,
+	leases001,
+	cronRuns001,
+	dispatches001Alert,
+	eventLookups001,
+	trash001,
+	testElasticsearch004,
+}
+
+var eventTypes004 = IndexSchema{
+	Alias: keyEventTypes,
+	Index: "eventtypes004",
+	Body: `{
+	"mappings": {
+		"EventType": {
+			"dynamic": "strict",
+			"properties": {
+				"eventTypeId": ` + migrationKeyword + `,
+				"name": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"createdBy": ` + migrationKeyword + `,
+				"mapping": {
+					"dynamic": "false",
+					"type": "object"
+				}
+			}
+		}
+	}
+}`,
+}
+
+var eventTypes004Retention = IndexSchema{
+	Alias: keyEventTypes,
+	Index: "eventtypes004",
+	Body: `{
+	"mappings": {
+		"EventType": {
+			"dynamic": "strict",
+			"properties": {
+				"eventTypeId": ` + migrationKeyword + `,
+				"name": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"createdBy": ` + migrationKeyword + `,
+				"mapping": {
+					"dynamic": "false",
+					"type": "object"
+				},
+				"retention": {
+					"properties": {
+						"period": ` + migrationKeyword + `,
+						"keep": {
+							"type": "integer"
+						}
+					}
+				}
+			}
+		}
+	}
+}`,
+}
+
+var events005 = IndexSchema{
+	Alias: keyEvents,
+	Index: "events005",
+	Body: `{
+	"settings": {
+		"index.mapping.coerce": false,
+		"index.version.created": 2010299
+	},
+	"mappings": {
+		"_default_": {
+			"dynamic": "strict",
+			"properties": {
+				"eventTypeId": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"data": {
+					"dynamic": "true",
+					"type": "object"
+				},
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"cronSchedule": ` + migrationKeyword + `
+			}
+		}
+	}
+}`,
+}
+
+var events005Cron = IndexSchema{
+	Alias: keyEvents,
+	Index: "events005",
+	Body: `{
+	"settings": {
+		"index.mapping.coerce": false,
+		"index.version.created": 2010299
+	},
+	"mappings": {
+		"_default_": {
+			"dynamic": "strict",
+			"properties": {
+				"eventTypeId": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"data": {
+					"dynamic": "true",
+					"type": "object"
+				},
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"cronSchedule": ` + migrationKeyword + `,
+				"missedRunPolicy": ` + migrationKeyword + `,
+				"timeZone": ` + migrationKeyword + `,
+				"startTime": ` + migrationDate + `,
+				"endTime": ` + migrationDate + `,
+				"maxRuns": {
+					"type": "integer"
+				}
+			}
+		}
+	}
+}`,
+}
+
+var triggers004 = IndexSchema{
+	Alias: keyTriggers,
+	Index: "triggers004",
+	Body: `{
+	"mappings": {
+		"Trigger": {
+			"dynamic": "strict",
+			"properties": {
+				"triggerId": ` + migrationKeyword + `,
+				"name": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"createdBy": ` + migrationKeyword + `,
+				"eventTypeId": ` + migrationKeyword + `,
+				"enabled": {
+					"type": "boolean"
+				},
+				"condition": {
+					"dynamic": "false",
+					"type": "object"
+				},
+				"job": {
+					"properties": {
+						"createdBy": ` + migrationKeyword + `,
+						"jobType": {
+							"dynamic": "false",
+							"type": "object"
+						}
+					}
+				},
+				"percolationId": ` + migrationKeyword + `
+			}
+		}
+	}
+}`,
+}
+
+var triggers004Action = IndexSchema{
+	Alias: keyTriggers,
+	Index: "triggers004",
+	Body: `{
+	"mappings": {
+		"Trigger": {
+			"dynamic": "strict",
+			"properties": {
+				"triggerId": ` + migrationKeyword + `,
+				"name": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"createdBy": ` + migrationKeyword + `,
+				"eventTypeId": ` + migrationKeyword + `,
+				"enabled": {
+					"type": "boolean"
+				},
+				"condition": {
+					"dynamic": "false",
+					"type": "object"
+				},
+				"job": {
+					"properties": {
+						"createdBy": ` + migrationKeyword + `,
+						"jobType": {
+							"dynamic": "false",
+							"type": "object"
+						}
+					}
+				},
+				"action": {
+					"dynamic": "false",
+					"type": "object",
+					"properties": {
+						"type": ` + migrationKeyword + `
+					}
+				},
+				"percolationId": ` + migrationKeyword + `
+			}
+		}
+	}
+}`,
+}
+
+var alerts004 = IndexSchema{
+	Alias: keyAlerts,
+	Index: "alerts004",
+	Body: `{
+	"mappings": {
+		"Alert": {
+			"dynamic": "strict",
+			"properties": {
+				"alertId": ` + migrationKeyword + `,
+				"triggerId": ` + migrationKeyword + `,
+				"jobId": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `
+			}
+		}
+	}
+}`,
+}
+
+var alerts004Action = IndexSchema{
+	Alias: keyAlerts,
+	Index: "alerts004",
+	Body: `{
+	"mappings": {
+		"Alert": {
+			"dynamic": "strict",
+			"properties": {
+				"alertId": ` + migrationKeyword + `,
+				"triggerId": ` + migrationKeyword + `,
+				"jobId": ` + migrationKeyword + `,
+				"action": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `
+			}
+		}
+	}
+}`,
+}
+
+var alerts004Status = IndexSchema{
+	Alias: keyAlerts,
+	Index: "alerts004",
+	Body: `{
+	"mappings": {
+		"Alert": {
+			"dynamic": "strict",
+			"properties": {
+				"alertId": ` + migrationKeyword + `,
+				"triggerId": ` + migrationKeyword + `,
+				"jobId": ` + migrationKeyword + `,
+				"action": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"status": ` + migrationKeyword + `,
+				"annotation": {
+					"type": "string"
+				}
+			}
+		}
+	}
+}`,
+}
+
+var crons004 = IndexSchema{
+	Alias: keyCrons,
+	Index: "crons004",
+	Body: `{
+	"settings": {
+		"index.mapping.coerce": false
+	},
+	"mappings": {
+		"Cron": {
+			"dynamic": "strict",
+			"properties": {
+				"eventTypeId": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"data": {
+					"dynamic": "false",
+					"type": "object"
+				},
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"cronSchedule": ` + migrationKeyword + `
+			}
+		}
+	}
+}`,
+}
+
+var crons004Schedule = IndexSchema{
+	Alias: keyCrons,
+	Index: "crons004",
+	Body: `{
+	"settings": {
+		"index.mapping.coerce": false
+	},
+	"mappings": {
+		"Cron": {
+			"dynamic": "strict",
+			"properties": {
+				"eventTypeId": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"data": {
+					"dynamic": "false",
+					"type": "object"
+				},
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"cronSchedule": ` + migrationKeyword + `,
+				"missedRunPolicy": ` + migrationKeyword + `,
+				"timeZone": ` + migrationKeyword + `,
+				"startTime": ` + migrationDate + `,
+				"endTime": ` + migrationDate + `,
+				"maxRuns": {
+					"type": "integer"
+				},
+				"paused": {
+					"type": "boolean"
+				},
+				"runs": {
+					"type": "integer"
+				},
+				"lastRun": ` + migrationDate + `
+			}
+		}
+	}
+}`,
+}
+
+var leases001 = IndexSchema{
+	Alias: keyLeases,
+	Index: "leases001",
+	Body: `{
+	"mappings": {
+		"Lease": {
+			"dynamic": "strict",
+			"properties": {
+				"holder": ` + migrationKeyword + `,
+				"expires": ` + migrationDate + `
+			}
+		}
+	}
+}`,
+}
+
+var cronRuns001 = IndexSchema{
+	Alias: keyCronRuns,
+	Index: "cronruns001",
+	Body: `{
+	"mappings": {
+		"CronRun": {
+			"dynamic": "strict",
+			"properties": {
+				"runId": ` + migrationKeyword + `,
+				"cronId": ` + migrationKeyword + `,
+				"scheduledFor": ` + migrationDate + `,
+				"firedOn": ` + migrationDate + `,
+				"eventId": ` + migrationKeyword + `,
+				"status": ` + migrationKeyword + `,
+				"statusCode": {
+					"type": "integer"
+				},
+				"message": {
+					"type": "string",
+					"index": "no"
+				},
+				"missed": {
+					"type": "integer"
+				}
+			}
+		}
+	}
+}`,
+}
+
+var dispatches001 = IndexSchema{
+	Alias: keyDispatches,
+	Index: "dispatches001",
+	Body: `{
+	"mappings": {
+		"Dispatch": {
+			"dynamic": "strict",
+			"properties": {
+				"dispatchId": ` + migrationKeyword + `,
+				"jobId": ` + migrationKeyword + `,
+				"triggerId": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"job": {
+					"type": "string",
+					"index": "no"
+				},
+				"status": ` + migrationKeyword + `,
+				"attempts": {
+					"type": "integer"
+				},
+				"lastError": {
+					"type": "string",
+					"index": "no"
+				},
+				"nextAttempt": ` + migrationDate + `,
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `
+			}
+		}
+	}
+}`,
+}
+
+var dispatches001Alert = IndexSchema{
+	Alias: keyDispatches,
+	Index: "dispatches001",
+	Body: `{
+	"mappings": {
+		"Dispatch": {
+			"dynamic": "strict",
+			"properties": {
+				"dispatchId": ` + migrationKeyword + `,
+				"jobId": ` + migrationKeyword + `,
+				"triggerId": ` + migrationKeyword + `,
+				"eventId": ` + migrationKeyword + `,
+				"job": {
+					"type": "string",
+					"index": "no"
+				},
+				"status": ` + migrationKeyword + `,
+				"attempts": {
+					"type": "integer"
+				},
+				"lastError": {
+					"type": "string",
+					"index": "no"
+				},
+				"nextAttempt": ` + migrationDate + `,
+				"createdBy": ` + migrationKeyword + `,
+				"createdOn": ` + migrationDate + `,
+				"alertId": ` + migrationKeyword + `,
+				"alertPending": {
+					"type": "boolean"
+				}
+			}
+		}
+	}
+}`,
+}
+
+var eventLookups001 = IndexSchema{
+	Alias: keyEventLookups,
+	Index: "eventlookups001",
+	Body: `{
+	"mappings": {
+		"EventLookup": {
+			"dynamic": "strict",
+			"properties": {
+				"eventId": ` + migrationKeyword + `,
+				"eventTypeName": {
+					"type": "string",
+					"index": "no"
+				}
+			}
+		}
+	}
+}`,
+}
+
+var trash001 = IndexSchema{
+	Alias: keyTrash,
+	Index: "trash001",
+	Body: `{
+	"mappings": {
+		"Trash": {
+			"dynamic": "strict",
+			"properties": {
+				"id": ` + migrationKeyword + `,
+				"kind": ` + migrationKeyword + `,
+				"name": ` + migrationKeyword + `,
+				"trashedBy": ` + migrationKeyword + `,
+				"trashedOn": ` + migrationDate + `,
+				"purgeOn": ` + migrationDate + `,
+				"trigger": {
+					"dynamic": "false",
+					"type": "object"
+				},
+				"eventType": {
+					"dynamic": "false",
+					"type": "object"
+				}
+			}
+		}
+	}
+}`,
+}
+
+var testElasticsearch004 = IndexSchema{
+	Alias: keyTestElasticsearch,
+	Index: "testelasticsearch004",
+	Body: `{
+	"mappings": {
+		"TestElasticsearch": {
+			"dynamic": "strict",
+			"properties": {
+				"id": {
+					"type": "string"
+				},
+				"data": {
+					"type": "string"
+				},
+				"tags": {
+					"type": "string"
+				},
+				"value": {
+					"type": "long"
+				}
+			}
+		}
+	}
+}`,
+}
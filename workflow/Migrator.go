@@ -0,0 +1,686 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// A Migration is one step in bringing the Elasticsearch indices up to date.
+// Migrations are applied in order of Version, each at most once, and are
+// never undone; a change to an index is made by adding a migration, never by
+// editing one that may have been applied.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(cluster MigrationCluster) error
+}
+
+// MigrationRecord is kept in the migrations index for each applied Migration.
+type MigrationRecord struct {
+	Version     int              `json:"version"`
+	Description string           `json:"description"`
+	AppliedOn   piazza.TimeStamp `json:"appliedOn"`
+}
+
+// MigrationStatus tells whether a Migration has been applied, and when.
+type MigrationStatus struct {
+	Version     int               `json:"version"`
+	Description string            `json:"description"`
+	Applied     bool              `json:"applied"`
+	AppliedOn   *piazza.TimeStamp `json:"appliedOn,omitempty"`
+}
+
+// MigrationCluster is what the migrations change: the indices of a cluster,
+// and the aliases the service reaches them by.
+type MigrationCluster interface {
+	IndexExists(index string) (bool, error)
+	CreateIndex(index string, body json.RawMessage) error
+	AliasedIndices(alias string) ([]string, error)
+	MoveAlias(alias string, from []string, to string) error
+	Types(index string) ([]string, error)
+	GetMapping(index string, typ string) (map[string]interface{}, error)
+	PutMapping(index string, typ string, mapping interface{}) error
+}
+
+// The migrations index is made outside of the migrations, as they are
+// recorded in it.
+const (
+	migrationIndex   = "workflowmigrations"
+	MigrationMapping = "Migration"
+)
+
+const migrationIndexSettings = `{
+	"mappings": {
+		"Migration": {
+			"dynamic": "strict",
+			"properties": {
+				"version": {
+					"type": "integer"
+				},
+				"description": {
+					"type": "string",
+					"index": "no"
+				},
+				"appliedOn": ` + migrationDate + `
+			}
+		}
+	}
+}`
+
+// Migrator applies the Migrations to the Cluster, recording them in Records,
+// and checks the indices against the Schemas the Migrations leave behind.
+type Migrator struct {
+	Cluster    MigrationCluster
+	Records    elasticsearch.IIndex
+	Migrations []Migration
+	Schemas    []IndexSchema
+}
+
+// NewMigrator makes a Migrator for the workflow's own migrations.
+func NewMigrator(cluster MigrationCluster, records elasticsearch.IIndex) *Migrator {
+	return &Migrator{
+		Cluster:    cluster,
+		Records:    records,
+		Migrations: workflowMigrations,
+		Schemas:    workflowSchemas,
+	}
+}
+
+// NewElasticsearchMigrator makes a Migrator for the cluster at the url,
+// making the migrations index if need be.
+func NewElasticsearchMigrator(url string) (*Migrator, error) {
+	version, err := ElasticsearchVersion(url)
+	if err != nil {
+		return nil, err
+	}
+	settings := migrationIndexSettings
+	if usesPercolatorField(version) {
+		if settings, err = modernizeBody(settings); err != nil {
+			return nil, err
+		}
+	}
+	records, err := elasticsearch.NewIndex2(url, migrationIndex, settings)
+	if err != nil {
+		return nil, err
+	}
+	migrator := NewMigrator(&esMigrationCluster{esi: records}, records)
+	if usesPercolatorField(version) {
+		if err = migrator.modernize(); err != nil {
+			return nil, err
+		}
+	}
+	return migrator, nil
+}
+
+// modernize makes the Migrator write, and check, the mappings in the syntax
+// of Elasticsearch 5 and later, where a string is a keyword or text.
+func (migrator *Migrator) modernize() error {
+	schemas := make([]IndexSchema, len(migrator.Schemas))
+	for i, schema := range migrator.Schemas {
+		body, err := modernizeBody(schema.Body)
+		if err != nil {
+			return fmt.Errorf("Schema of %s is not valid: %s", schema.Index, err)
+		}
+		schemas[i] = IndexSchema{Alias: schema.Alias, Index: schema.Index, Body: body}
+	}
+	migrator.Schemas = schemas
+	migrator.Cluster = &modernMigrationCluster{MigrationCluster: migrator.Cluster}
+	return nil
+}
+
+// sorted returns the Migrations in order of Version.
+func (migrator *Migrator) sorted() ([]Migration, error) {
+	migrations := make([]Migration, len(migrator.Migrations))
+	copy(migrations, migrator.Migrations)
+	sort.Sort(migrationsByVersion(migrations))
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("Migrator: there are two migrations numbered %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// applied returns the records of the applied migrations, by Version.
+func (migrator *Migrator) applied() (map[int]MigrationRecord, error) {
+	records := map[int]MigrationRecord{}
+
+	exists, err := migrator.Records.TypeExists(MigrationMapping)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return records, nil
+	}
+
+	const perPage = 100
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "version", Order: piazza.SortOrderAscending}
+		searchResult, err := migrator.Records.FilterByMatchAll(MigrationMapping, format)
+		if err != nil {
+			return nil, fmt.Errorf("Migrator: can't read the applied migrations: %s", err)
+		}
+		if searchResult == nil || searchResult.GetHits() == nil {
+			break
+		}
+		hits := *searchResult.GetHits()
+		for _, hit := range hits {
+			var record MigrationRecord
+			if err = json.Unmarshal(*hit.Source, &record); err != nil {
+				return nil, err
+			}
+			records[record.Version] = record
+		}
+		if len(hits) < perPage {
+			break
+		}
+	}
+	return records, nil
+}
+
+// Status tells which of the Migrations have been applied.
+func (migrator *Migrator) Status() ([]MigrationStatus, error) {
+	migrations, err := migrator.sorted()
+	if err != nil {
+		return nil, err
+	}
+	records, err := migrator.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i] = MigrationStatus{Version: migration.Version, Description: migration.Description}
+		if record, ok := records[migration.Version]; ok {
+			appliedOn := record.AppliedOn
+			statuses[i].Applied = true
+			statuses[i].AppliedOn = &appliedOn
+		}
+	}
+	return statuses, nil
+}
+
+// Up applies, in order, the Migrations that haven't been, and returns the
+// ones it applied. It stops at the first that fails; that one isn't
+// recorded, and so is tried again next time.
+func (migrator *Migrator) Up() ([]Migration, error) {
+	migrations, err := migrator.sorted()
+	if err != nil {
+		return nil, err
+	}
+	records, err := migrator.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, migration := range migrations {
+		if _, ok := records[migration.Version]; ok {
+			continue
+		}
+		log.Printf("Migrator: applying %d: %s", migration.Version, migration.Description)
+		if err = migration.Up(migrator.Cluster); err != nil {
+			return done, fmt.Errorf("Migrator: migration %d (%s) failed: %s", migration.Version, migration.Description, err)
+		}
+		record := &MigrationRecord{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedOn:   piazza.NewTimeStamp(),
+		}
+		if _, err = migrator.Records.PostData(MigrationMapping, strconv.Itoa(migration.Version), record); err != nil {
+			return done, fmt.Errorf("Migrator: migration %d was applied but can't be recorded: %s", migration.Version, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Verify compares the mappings of the indices behind the aliases with the
+// Schemas, and returns how they differ, one difference per line, as in
+// "crons/Cron.properties.runs.type: expected "integer", found "long"".
+func (migrator *Migrator) Verify() ([]string, error) {
+	diffs := []string{}
+	for _, schema := range migrator.Schemas {
+		expected, err := schema.mappings()
+		if err != nil {
+			return nil, err
+		}
+		types := make([]string, 0, len(expected))
+		for typ := range expected {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+
+		for _, typ := range types {
+			path := schema.Alias + "/" + typ
+			actual, err := migrator.Cluster.GetMapping(schema.Alias, typ)
+			if err != nil {
+				return nil, err
+			}
+			if actual == nil {
+				diffs = append(diffs, path+": missing")
+				continue
+			}
+			diffs = append(diffs, diffMapping(path, expected[typ], actual)...)
+		}
+	}
+	return diffs, nil
+}
+
+// diffMapping lists the differences between two parts of a mapping.
+func diffMapping(path string, expected interface{}, actual interface{}) []string {
+	expectedMap, ok1 := expected.(map[string]interface{})
+	actualMap, ok2 := actual.(map[string]interface{})
+	if !ok1 || !ok2 {
+		if reflect.DeepEqual(expected, actual) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: expected %s, found %s", path, mappingValue(expected), mappingValue(actual))}
+	}
+
+	keys := []string{}
+	for key := range expectedMap {
+		keys = append(keys, key)
+	}
+	for key := range actualMap {
+		if _, ok := expectedMap[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	diffs := []string{}
+	for _, key := range keys {
+		e, inExpected := expectedMap[key]
+		a, inActual := actualMap[key]
+		switch {
+		case !inActual:
+			diffs = append(diffs, fmt.Sprintf("%s.%s: missing", path, key))
+		case !inExpected:
+			diffs = append(diffs, fmt.Sprintf("%s.%s: not expected, found %s", path, key, mappingValue(a)))
+		default:
+			diffs = append(diffs, diffMapping(path+"."+key, e, a)...)
+		}
+	}
+	return diffs
+}
+
+func mappingValue(value interface{}) string {
+	byts, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(byts)
+}
+
+type migrationsByVersion []Migration
+
+func (m migrationsByVersion) Len() int           { return len(m) }
+func (m migrationsByVersion) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m migrationsByVersion) Less(i, j int) bool { return m[i].Version < m[j].Version }
+
+//---------------------------------------------------------------------------
+
+// IndexSchema is an index as the migrations make it: its name, the alias
+// the service reaches it by, and the body of the request that creates it,
+// which holds its settings and mappings.
+type IndexSchema struct {
+	Alias string
+	Index string
+	Body  string
+}
+
+// mappings returns the mapping of each type in the schema.
+func (schema *IndexSchema) mappings() (map[string]interface{}, error) {
+	var body struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(schema.Body), &body); err != nil {
+		return nil, fmt.Errorf("Schema of %s is not valid: %s", schema.Index, err)
+	}
+	return body.Mappings, nil
+}
+
+// createIndex returns the Up of a migration that makes the index of the
+// schema, unless it exists, and moves the alias to it from any other. On a
+// cluster where both were done by hand, it changes nothing.
+func createIndex(schema IndexSchema) func(cluster MigrationCluster) error {
+	return func(cluster MigrationCluster) error {
+		exists, err := cluster.IndexExists(schema.Index)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err = schema.mappings(); err != nil {
+				return err
+			}
+			if err = cluster.CreateIndex(schema.Index, json.RawMessage(schema.Body)); err != nil {
+				return err
+			}
+		}
+
+		indices, err := cluster.AliasedIndices(schema.Alias)
+		if err != nil {
+			return err
+		}
+		if len(indices) == 1 && indices[0] == schema.Index {
+			return nil
+		}
+		return cluster.MoveAlias(schema.Alias, indices, schema.Index)
+	}
+}
+
+// putMapping returns the Up of a migration that puts the mapping a type has
+// in the schema on the index behind its alias, which adds the fields that
+// are new to it.
+func putMapping(schema IndexSchema, typ string) func(cluster MigrationCluster) error {
+	return func(cluster MigrationCluster) error {
+		mappings, err := schema.mappings()
+		if err != nil {
+			return err
+		}
+		mapping, ok := mappings[typ]
+		if !ok {
+			return fmt.Errorf("Schema of %s has no type %s", schema.Index, typ)
+		}
+		return cluster.PutMapping(schema.Alias, typ, mapping)
+	}
+}
+
+// putDefaultMapping returns the Up of a migration that puts the _default_
+// mapping of the schema on the index behind its alias, and adds the fields
+// that are new to it to each type already in the index, as the _default_
+// mapping is only copied into a type when the type is made. The types of
+// Elasticsearch itself, such as .percolator, are left alone.
+func putDefaultMapping(schema IndexSchema) func(cluster MigrationCluster) error {
+	return func(cluster MigrationCluster) error {
+		if err := putMapping(schema, defaultMapping)(cluster); err != nil {
+			return err
+		}
+		mappings, err := schema.mappings()
+		if err != nil {
+			return err
+		}
+		properties, _ := mappings[defaultMapping].(map[string]interface{})["properties"].(map[string]interface{})
+
+		types, err := cluster.Types(schema.Alias)
+		if err != nil {
+			return err
+		}
+		for _, typ := range types {
+			if typ == defaultMapping || strings.HasPrefix(typ, ".") {
+				continue
+			}
+			mapping, err := cluster.GetMapping(schema.Alias, typ)
+			if err != nil {
+				return err
+			}
+			has, _ := mapping["properties"].(map[string]interface{})
+			added := map[string]interface{}{}
+			for name, property := range properties {
+				if _, ok := has[name]; !ok {
+					added[name] = property
+				}
+			}
+			if len(added) == 0 {
+				continue
+			}
+			if err = cluster.PutMapping(schema.Alias, typ, map[string]interface{}{"properties": added}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// defaultMapping is the type whose mapping Elasticsearch copies into each
+// type as it is made.
+const defaultMapping = "_default_"
+
+//---------------------------------------------------------------------------
+
+// esMigrationCluster is a MigrationCluster reached through the REST API of
+// Elasticsearch; any index of the cluster will do for esi.
+type esMigrationCluster struct {
+	esi elasticsearch.IIndex
+}
+
+// do makes a request, and returns the response and its status, which is
+// found in the body, as DirectAccess doesn't return it.
+func (cluster *esMigrationCluster) do(verb string, endpoint string, input interface{}) (map[string]interface{}, int, error) {
+	output := map[string]interface{}{}
+	if err := cluster.esi.DirectAccess(verb, endpoint, input, &output); err != nil {
+		return nil, 0, err
+	}
+	if status, ok := output["status"].(float64); ok && output["error"] != nil {
+		return output, int(status), nil
+	}
+	return output, http.StatusOK, nil
+}
+
+// acknowledged makes a request that changes the cluster.
+func (cluster *esMigrationCluster) acknowledged(verb string, endpoint string, input interface{}) error {
+	output, status, err := cluster.do(verb, endpoint, input)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK || output["acknowledged"] != true {
+		return fmt.Errorf("%s %s failed: %s", verb, endpoint, mappingValue(output))
+	}
+	return nil
+}
+
+func (cluster *esMigrationCluster) IndexExists(index string) (bool, error) {
+	output, status, err := cluster.do("GET", "/"+index+"/_settings", nil)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		// the name may be that of an alias, whose index is returned
+		_, ok := output[index]
+		return ok, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("GET /%s/_settings failed: %s", index, mappingValue(output))
+}
+
+func (cluster *esMigrationCluster) CreateIndex(index string, body json.RawMessage) error {
+	return cluster.acknowledged("PUT", "/"+index, body)
+}
+
+func (cluster *esMigrationCluster) AliasedIndices(alias string) ([]string, error) {
+	output, status, err := cluster.do("GET", "/_alias/"+alias, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return []string{}, nil
+	default:
+		return nil, fmt.Errorf("GET /_alias/%s failed: %s", alias, mappingValue(output))
+	}
+
+	indices := []string{}
+	for index := range output {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (cluster *esMigrationCluster) MoveAlias(alias string, from []string, to string) error {
+	actions := []map[string]interface{}{}
+	for _, index := range from {
+		if index != to {
+			actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": index, "alias": alias}})
+		}
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]string{"index": to, "alias": alias}})
+	return cluster.acknowledged("POST", "/_aliases", map[string]interface{}{"actions": actions})
+}
+
+// Types returns the types mapped in the indices behind the alias.
+func (cluster *esMigrationCluster) Types(index string) ([]string, error) {
+	output, status, err := cluster.do("GET", "/"+index+"/_mapping", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("GET /%s/_mapping failed: %s", index, mappingValue(output))
+	}
+
+	// the response is keyed by the name of each index behind the alias
+	seen := map[string]bool{}
+	types := []string{}
+	for _, indexMappings := range output {
+		mappings, _ := indexMappings.(map[string]interface{})["mappings"].(map[string]interface{})
+		for typ := range mappings {
+			if !seen[typ] {
+				seen[typ] = true
+				types = append(types, typ)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// GetMapping returns nil if the type isn't mapped.
+func (cluster *esMigrationCluster) GetMapping(index string, typ string) (map[string]interface{}, error) {
+	output, status, err := cluster.do("GET", "/"+index+"/_mapping/"+typ, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("GET /%s/_mapping/%s failed: %s", index, typ, mappingValue(output))
+	}
+
+	// the response is keyed by the name of the index behind the alias
+	for _, indexMappings := range output {
+		mappings, _ := indexMappings.(map[string]interface{})["mappings"].(map[string]interface{})
+		mapping, _ := mappings[typ].(map[string]interface{})
+		return mapping, nil
+	}
+	return nil, nil
+}
+
+func (cluster *esMigrationCluster) PutMapping(index string, typ string, mapping interface{}) error {
+	return cluster.acknowledged("PUT", "/"+index+"/_mapping/"+typ, mapping)
+}
+
+//---------------------------------------------------------------------------
+
+// modernMigrationCluster makes the indices and mappings of the migrations,
+// which are written for Elasticsearch 2, in the syntax of Elasticsearch 5
+// and later.
+type modernMigrationCluster struct {
+	MigrationCluster
+}
+
+func (cluster *modernMigrationCluster) CreateIndex(index string, body json.RawMessage) error {
+	modern, err := modernizeBody(string(body))
+	if err != nil {
+		return err
+	}
+	return cluster.MigrationCluster.CreateIndex(index, json.RawMessage(modern))
+}
+
+func (cluster *modernMigrationCluster) PutMapping(index string, typ string, mapping interface{}) error {
+	return cluster.MigrationCluster.PutMapping(index, typ, modernizeMapping(mapping))
+}
+
+// modernizeBody rewrites the body that creates an index for Elasticsearch 5
+// and later: its strings are made keywords or text, and the version it was
+// created by, which can no longer be set, is dropped.
+func modernizeBody(body string) (string, error) {
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return "", err
+	}
+	if settings, ok := parsed["settings"].(map[string]interface{}); ok {
+		delete(settings, "index.version.created")
+	}
+	byts, err := json.Marshal(modernizeMapping(parsed))
+	if err != nil {
+		return "", err
+	}
+	return string(byts), nil
+}
+
+// modernizeMapping rewrites a mapping for Elasticsearch 5 and later: a
+// string that isn't analyzed is a keyword, and one that is, text.
+func modernizeMapping(mapping interface{}) interface{} {
+	switch m := mapping.(type) {
+	case map[string]interface{}:
+		modern := map[string]interface{}{}
+		for key, value := range m {
+			modern[key] = modernizeMapping(value)
+		}
+		if modern["type"] != "string" {
+			return modern
+		}
+		switch modern["index"] {
+		case "not_analyzed":
+			modern["type"] = "keyword"
+			delete(modern, "index")
+		case "no":
+			modern["type"] = "keyword"
+			modern["index"] = false
+		default:
+			modern["type"] = "text"
+			delete(modern, "index")
+		}
+		return modern
+	case []interface{}:
+		modern := make([]interface{}, len(m))
+		for i, value := range m {
+			modern[i] = modernizeMapping(value)
+		}
+		return modern
+	}
+	return mapping
+}
+
+// migrationDate is the mapping of a timestamp, which may have any number of
+// fractional digits.
+const migrationDate = `{
+	"type": "date",
+	"format": "yyyy-MM-dd'T'HH:mm:ssZZ||yyyy-MM-dd'T'HH:mm:ss.SZZ||yyyy-MM-dd'T'HH:mm:ss.SSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'T'HH:mm:ss.SSSSSSSZZ"
+}`
+
+// migrationKeyword is the mapping of a string that is matched only whole.
+const migrationKeyword = `{
+	"type": "string",
+	"index": "not_analyzed"
+}`
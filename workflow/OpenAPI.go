@@ -0,0 +1,429 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The OpenAPI 3 document served at /openapi.json is made from the Server's
+// routes, each of which has an operation, described by openAPIRoutes. A
+// route whose path has a wildcard may serve several operations, each called
+// with a path of its own; POST /eventType/:id serves POST /eventType/query.
+
+const openAPIVersion = "3.0.0"
+
+// openAPIOperation describes an operation. Body and Data are values of the
+// types of the request body and of the data of the response; Raw is set if
+// the response isn't a piazza.JsonResponse. Verb is that of the route, and
+// Path that of the route unless it is given.
+type openAPIOperation struct {
+	Verb      string
+	Path      string
+	Summary   string
+	Tag       string
+	Query     []string
+	Body      interface{}
+	Data      interface{}
+	Status    int
+	Paginated bool
+	Versioned bool
+	Raw       bool
+}
+
+// openAPIParameters are the query parameters, by name.
+var openAPIParameters = map[string]map[string]interface{}{
+	"perPage":       {"type": "integer", "description": "Number of results on a page"},
+	"page":          {"type": "integer", "description": "Page of the results, counting from 0"},
+	"sortBy":        {"type": "string", "description": "Field to sort the results by"},
+	"order":         {"type": "string", "enum": []string{"asc", "desc"}, "description": "Order of the sort"},
+	"name":          {"type": "string", "description": "Name of the eventType"},
+	"eventTypeId":   {"type": "string", "description": "Id of the eventType of the events"},
+	"eventTypeName": {"type": "string", "description": "Name of the eventType of the events"},
+	"triggerId":     {"type": "string", "description": "Id of the trigger of the alerts"},
+	"inflate":       {"type": "boolean", "description": "Return the alerts with their trigger and event"},
+	"status":        {"type": "string", "description": "Status of the dispatches"},
+	"kind":          {"type": "string", "enum": []string{TrashKindTrigger, TrashKindEventType}, "description": "Kind of resource in the trash"},
+	"cascade":       {"type": "boolean", "description": "Delete what refers to the eventType along with it"},
+	"async":         {"type": "boolean", "description": "Fire the triggers after returning"},
+	"events":        {"type": "boolean", "description": "Include the events"},
+	"alerts":        {"type": "boolean", "description": "Include the alerts"},
+	"preserveIds":   {"type": "boolean", "description": "Restore the resources under their ids"},
+}
+
+// openAPIPagination are the query parameters of a paginated operation.
+var openAPIPagination = []string{"perPage", "page", "sortBy", "order"}
+
+// openAPIQuery is the body of a query: an Elasticsearch query.
+var openAPIQuery = map[string]interface{}{}
+
+// openAPIOneOf is the Data of an operation whose data is of one of the types.
+type openAPIOneOf []interface{}
+
+// openAPIAlerts are the alerts, which are AlertExts where they are inflated.
+var openAPIAlerts = openAPIOneOf{[]Alert{}, []AlertExt{}}
+
+// openAPIRoutes describes the operations of each route, by its verb and path.
+var openAPIRoutes = map[string][]openAPIOperation{
+	"GET /":             {{Summary: "Say hello", Tag: "Service", Data: ""}},
+	"GET /version":      {{Summary: "Get the version of the service", Tag: "Service", Data: piazza.Version{}}},
+	"GET /openapi.json": {{Summary: "Get this document", Tag: "Service", Raw: true}},
+
+	"GET /eventType":                  {{Summary: "Get the eventTypes", Tag: "EventType", Query: []string{"name"}, Data: []EventType{}, Paginated: true}},
+	"GET /eventType/:id":              {{Summary: "Get an eventType", Tag: "EventType", Data: EventType{}, Versioned: true}},
+	"GET /eventType/:id/dependencies": {{Summary: "List what refers to an eventType", Tag: "EventType", Data: EventTypeDependencies{}}},
+	"POST /eventType":                 {{Summary: "Create an eventType", Tag: "EventType", Body: EventType{}, Data: EventType{}, Status: http.StatusCreated}},
+	"PUT /eventType":                  {{Summary: "Add fields to the mapping of an eventType", Tag: "EventType", Body: EventType{}, Data: EventType{}, Versioned: true}},
+	"POST /eventType/:id":             {{Path: "/eventType/query", Summary: "Query the eventTypes", Tag: "EventType", Body: openAPIQuery, Data: []EventType{}, Paginated: true}},
+	"DELETE /eventType/:id":           {{Summary: "Delete an eventType to the trash, or, with cascade, delete it and what refers to it and return what was deleted", Tag: "EventType", Query: []string{"cascade"}, Versioned: true}},
+	"POST /eventType/:id/restore":     {{Summary: "Restore an eventType from the trash", Tag: "EventType", Data: EventType{}, Status: http.StatusCreated}},
+
+	"GET /event":             {{Summary: "Get the events", Tag: "Event", Query: []string{"eventTypeId", "eventTypeName"}, Data: []Event{}, Paginated: true}},
+	"GET /event/:id":         {{Summary: "Get an event", Tag: "Event", Data: Event{}}},
+	"GET /event/:id/results": {{Summary: "Get what the triggers did with a recent event", Tag: "Event", Data: EventResults{}}},
+	"POST /event":            {{Summary: "Post an event, or a repeating event if it has a cronSchedule; with async, the triggers fire after a 202 is returned", Tag: "Event", Query: []string{"async"}, Body: Event{}, Data: Event{}, Status: http.StatusCreated}},
+	"PUT /event":             {{Summary: "Correct the data of an event", Tag: "Event", Body: Event{}, Data: Event{}}},
+	"POST /event/query":      {{Summary: "Query the events", Tag: "Event", Query: []string{"eventTypeId", "eventTypeName"}, Body: openAPIQuery, Data: []Event{}, Paginated: true}},
+	"DELETE /event/:id":      {{Summary: "Delete an event", Tag: "Event"}},
+
+	"GET /cron":             {{Summary: "Get the repeating events", Tag: "Cron", Data: []CronJobInfo{}, Paginated: true}},
+	"GET /cron/:id":         {{Summary: "Get a repeating event", Tag: "Cron", Data: CronJobInfo{}, Versioned: true}},
+	"GET /cron/:id/events":  {{Summary: "Get the events a repeating event has posted", Tag: "Cron", Data: []Event{}, Paginated: true}},
+	"GET /cron/:id/runs":    {{Summary: "Get the runs of a repeating event", Tag: "Cron", Data: []CronRun{}, Paginated: true}},
+	"PUT /cron/:id":         {{Summary: "Change the schedule or data of a repeating event", Tag: "Cron", Body: CronUpdate{}, Data: CronJobInfo{}, Versioned: true}},
+	"POST /cron/:id/pause":  {{Summary: "Pause a repeating event", Tag: "Cron", Data: CronJobInfo{}}},
+	"POST /cron/:id/resume": {{Summary: "Resume a repeating event", Tag: "Cron", Data: CronJobInfo{}}},
+
+	"GET /trigger":     {{Summary: "Get the triggers", Tag: "Trigger", Data: []Trigger{}, Paginated: true}},
+	"GET /trigger/:id": {{Summary: "Get a trigger", Tag: "Trigger", Data: Trigger{}, Versioned: true}},
+	"POST /trigger":    {{Summary: "Create a trigger", Tag: "Trigger", Body: Trigger{}, Data: Trigger{}, Status: http.StatusCreated}},
+	"POST /trigger/:id": {
+		{Path: "/trigger/query", Summary: "Query the triggers", Tag: "Trigger", Body: openAPIQuery, Data: []Trigger{}, Paginated: true},
+		{Path: "/trigger/test", Summary: "Test a trigger against sample events", Tag: "Trigger", Body: TriggerTest{}, Data: []TriggerTestResult{}},
+	},
+	"PUT /trigger/:id":          {{Summary: "Change the fields of a trigger that are given", Tag: "Trigger", Body: map[string]interface{}{}, Data: Trigger{}, Versioned: true}},
+	"PATCH /trigger/:id":        {{Summary: "Change the fields of a trigger that are given", Tag: "Trigger", Body: map[string]interface{}{}, Data: Trigger{}, Versioned: true}},
+	"DELETE /trigger/:id":       {{Summary: "Delete a trigger to the trash", Tag: "Trigger", Versioned: true}},
+	"POST /trigger/:id/restore": {{Summary: "Restore a trigger from the trash", Tag: "Trigger", Data: Trigger{}, Status: http.StatusCreated}},
+
+	"GET /trash": {{Summary: "Get what is in the trash", Tag: "Trash", Query: []string{"kind"}, Data: []TrashItem{}, Paginated: true}},
+
+	"GET /alert":        {{Summary: "Get the alerts", Tag: "Alert", Query: []string{"triggerId", "inflate"}, Data: openAPIAlerts, Paginated: true}},
+	"GET /alert/:id":    {{Summary: "Get an alert", Tag: "Alert", Data: Alert{}, Versioned: true}},
+	"POST /alert":       {{Summary: "Create an alert", Tag: "Alert", Body: Alert{}, Data: Alert{}, Status: http.StatusCreated}},
+	"PUT /alert":        {{Summary: "Change the status or annotation of an alert", Tag: "Alert", Body: AlertUpdate{}, Data: Alert{}, Versioned: true}},
+	"POST /alert/query": {{Summary: "Query the alerts", Tag: "Alert", Query: []string{"inflate"}, Body: openAPIQuery, Data: openAPIAlerts, Paginated: true}},
+	"DELETE /alert/:id": {{Summary: "Delete an alert", Tag: "Alert", Versioned: true}},
+
+	"GET /admin/stats":                {{Summary: "Get the counts of what the service has done", Tag: "Admin", Data: Stats{}}},
+	"GET /admin/dispatch":             {{Summary: "Get the dispatches of jobs", Tag: "Admin", Query: []string{"status"}, Data: []Dispatch{}, Paginated: true}},
+	"GET /admin/dispatch/:id":         {{Summary: "Get a dispatch", Tag: "Admin", Data: Dispatch{}}},
+	"POST /admin/dispatch/:id/replay": {{Summary: "Dispatch a failed job again", Tag: "Admin", Data: Dispatch{}}},
+	"GET /admin/backup":               {{Summary: "Back up the workflow resources", Tag: "Admin", Query: []string{"events", "alerts"}, Data: Backup{}}},
+	"POST /admin/restore":             {{Summary: "Restore the workflow resources from a backup", Tag: "Admin", Query: []string{"preserveIds"}, Body: Backup{}, Data: RestoreReport{}}},
+
+	"GET /_test/elasticsearch/version":  {{Summary: "Get the version of Elasticsearch", Tag: "Test", Data: ""}},
+	"GET /_test/elasticsearch/data/:id": {{Summary: "Get a test document", Tag: "Test", Data: TestElasticsearchBody{}}},
+	"POST /_test/elasticsearch/data":    {{Summary: "Post a test document", Tag: "Test", Body: TestElasticsearchBody{}, Data: TestElasticsearchBody{}, Status: http.StatusCreated}},
+}
+
+// openAPIRouteOperations returns the operations of the routes. A route that
+// openAPIRoutes doesn't describe is given a bare operation.
+func openAPIRouteOperations(routes []piazza.RouteData) []openAPIOperation {
+	operations := []openAPIOperation{}
+	for _, route := range routes {
+		described, ok := openAPIRoutes[route.Verb+" "+route.Path]
+		if !ok {
+			described = []openAPIOperation{{}}
+		}
+		for _, op := range described {
+			op.Verb = route.Verb
+			if op.Path == "" {
+				op.Path = openAPIPath(route.Path)
+			}
+			operations = append(operations, op)
+		}
+	}
+	return operations
+}
+
+// openAPIPath writes the path of a route, such as /eventType/:id, as a path
+// of the document, /eventType/{id}.
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+//---------------------------------------------------------------------------
+
+// openAPISchemas makes the schemas of types, putting those of named structs
+// in the components and referring to them.
+type openAPISchemas struct {
+	components map[string]interface{}
+}
+
+var (
+	openAPITimeStamp = reflect.TypeOf(piazza.TimeStamp{})
+	openAPITime      = reflect.TypeOf(time.Time{})
+)
+
+func (schemas *openAPISchemas) of(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return schemas.of(t.Elem())
+	}
+	if t == openAPITimeStamp || t == openAPITime {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemas.of(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemas.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return schemas.object(t)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas.components[t.Name()]; !ok {
+			// it is put in first, as the type may refer to itself
+			schemas.components[t.Name()] = nil
+			schemas.components[t.Name()] = schemas.object(t)
+		}
+		return ref
+	}
+	// an interface may hold any value
+	return map[string]interface{}{}
+}
+
+// data makes the schema of the Data of an operation.
+func (schemas *openAPISchemas) data(data interface{}) map[string]interface{} {
+	oneOf, ok := data.(openAPIOneOf)
+	if !ok {
+		return schemas.of(reflect.TypeOf(data))
+	}
+	alternatives := []interface{}{}
+	for _, alternative := range oneOf {
+		alternatives = append(alternatives, schemas.of(reflect.TypeOf(alternative)))
+	}
+	return map[string]interface{}{"oneOf": alternatives}
+}
+
+// object makes the schema of a struct, as encoding/json writes it.
+func (schemas *openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	schemas.fields(t, properties, &required)
+	object := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		object["required"] = required
+	}
+	return object
+}
+
+func (schemas *openAPISchemas) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		if field.Anonymous && tag[0] == "" && field.Type.Kind() == reflect.Struct {
+			schemas.fields(field.Type, properties, required)
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemas.of(field.Type)
+		if field.Tag.Get("binding") == "required" {
+			*required = append(*required, name)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------
+
+// openAPIDocument makes the document from the operations.
+func openAPIDocument(operations []openAPIOperation) map[string]interface{} {
+	schemas := &openAPISchemas{components: map[string]interface{}{}}
+	envelope := schemas.of(reflect.TypeOf(piazza.JsonResponse{}))
+	// only a success has data
+	delete(schemas.components["JsonResponse"].(map[string]interface{}), "required")
+	errorResponse := map[string]interface{}{
+		"description": "The error, in the message",
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": envelope}},
+	}
+
+	paths := map[string]interface{}{}
+	for _, op := range operations {
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"operationId": strings.ToLower(op.Verb) + openAPIOperationName(op.Path),
+		}
+		if op.Tag != "" {
+			operation["tags"] = []string{op.Tag}
+		}
+
+		parameters := []interface{}{}
+		for _, segment := range strings.Split(op.Path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				parameters = append(parameters, map[string]interface{}{
+					"name": strings.Trim(segment, "{}"), "in": "path", "required": true,
+					"schema": map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		query := op.Query
+		if op.Paginated {
+			query = append(append([]string{}, query...), openAPIPagination...)
+		}
+		for _, name := range query {
+			param := openAPIParameters[name]
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "query", "description": param["description"],
+				"schema": openAPIParameterSchema(param),
+			})
+		}
+		if op.Versioned {
+			header := "If-Match"
+			description := "ETag the resource must still have"
+			if op.Verb == "GET" {
+				header = "If-None-Match"
+				description = "ETag of a copy the caller has"
+			}
+			parameters = append(parameters, map[string]interface{}{
+				"name": header, "in": "header", "description": description,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if len(parameters) != 0 {
+			operation["parameters"] = parameters
+		}
+
+		if op.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schemas.of(reflect.TypeOf(op.Body))}},
+			}
+		}
+
+		var schema map[string]interface{}
+		switch {
+		case op.Raw:
+			schema = map[string]interface{}{"type": "object"}
+		case op.Data == nil:
+			schema = envelope
+		default:
+			properties := map[string]interface{}{"data": schemas.data(op.Data)}
+			required := []string{"data"}
+			if op.Paginated {
+				properties["pagination"] = schemas.of(reflect.TypeOf(piazza.JsonPagination{}))
+				required = append(required, "pagination")
+			}
+			schema = map[string]interface{}{"allOf": []interface{}{
+				envelope,
+				map[string]interface{}{"type": "object", "properties": properties, "required": required},
+			}}
+		}
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+		}
+		responses := map[string]interface{}{strconv.Itoa(status): success, "default": errorResponse}
+		if op.Versioned && op.Verb != "DELETE" {
+			success["headers"] = map[string]interface{}{
+				"ETag": map[string]interface{}{"description": "Version of the resource", "schema": map[string]interface{}{"type": "string"}},
+			}
+		}
+		if op.Versioned && op.Verb == "GET" {
+			responses[strconv.Itoa(http.StatusNotModified)] = map[string]interface{}{"description": "The copy the caller has is current"}
+		}
+		operation["responses"] = responses
+
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Verb)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "pz-workflow",
+			"description": "Event types, events, triggers and alerts of the Piazza workflow service",
+			"version":     Version,
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas.components},
+	}
+}
+
+func openAPIParameterSchema(param map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{"type": param["type"]}
+	if enum, ok := param["enum"]; ok {
+		schema["enum"] = enum
+	}
+	return schema
+}
+
+// openAPIOperationName makes a name such as EventTypeIdRestore of a path.
+func openAPIOperationName(path string) string {
+	if path == "/" {
+		return "Root"
+	}
+	name := ""
+	for _, segment := range strings.FieldsFunc(path, func(r rune) bool { return strings.ContainsRune("/{}._", r) }) {
+		name += strings.ToUpper(segment[:1]) + segment[1:]
+	}
+	return name
+}
+
+//---------------------------------------------------------------------------
+
+func (server *Server) handleGetOpenAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, server.openAPI)
+}
@@ -0,0 +1,586 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// In Elasticsearch 2 the percolation queries are documents of the .percolator
+// type of the index they match the documents of, and each EventType is a type
+// of the events index. From Elasticsearch 5 a percolation query is a field
+// mapped as a percolator, matched by a percolate query, and from 6 an index
+// has a single type, so there the events index is a PercolatorIndex.
+
+// percolatorFieldVersion is the first major version of Elasticsearch whose
+// percolation queries are fields.
+const percolatorFieldVersion = 5
+
+// usesPercolatorField tells whether Elasticsearch at the version needs a
+// PercolatorIndex for the events.
+func usesPercolatorField(version string) bool {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	return err == nil && major >= percolatorFieldVersion
+}
+
+// ElasticsearchVersion asks the cluster at the url its version, the one
+// GET /_test/elasticsearch/version returns, without making an index.
+func ElasticsearchVersion(url string) (string, error) {
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	h := &piazza.Http{BaseUrl: url}
+	if _, err := h.Verb("GET", "/", nil, &info); err != nil {
+		return "", err
+	}
+	if info.Version.Number == "" {
+		return "", fmt.Errorf("Elasticsearch at %s did not give its version", url)
+	}
+	return info.Version.Number, nil
+}
+
+//---------------------------------------------------------------------------
+
+// Percolator holds the percolation queries of a PercolatorIndex. It is
+// given the mapping of each type, so that it knows the fields the queries
+// are on.
+type Percolator interface {
+	SetMapping(typ string, jsn piazza.JsonString) error
+	AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error)
+	DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error)
+	AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error)
+}
+
+// PercolatorIndex is an elasticsearch.IIndex whose types are each kept in an
+// index of their own, named <alias>-type-<hex of the type>, under the alias
+// they are searched through. Its percolation queries are kept by the
+// Percolator.
+type PercolatorIndex struct {
+	Cluster PartitionCluster
+	// Reader is the alias.
+	Reader  elasticsearch.IIndex
+	Queries Percolator
+	// Settings is the body the index of a type is made with, less its
+	// mapping and the alias; a _default_ mapping in it is merged into that of
+	// the type.
+	Settings string
+
+	lock sync.Mutex
+	open map[string]elasticsearch.IIndex
+}
+
+func NewPercolatorIndex(cluster PartitionCluster, reader elasticsearch.IIndex, queries Percolator, settings string) *PercolatorIndex {
+	return &PercolatorIndex{
+		Cluster:  cluster,
+		Reader:   reader,
+		Queries:  queries,
+		Settings: settings,
+		open:     map[string]elasticsearch.IIndex{},
+	}
+}
+
+// NewElasticsearchPercolatorIndex keeps the indices of the types in the
+// cluster behind the alias, and the percolation queries in the index named
+// <alias>-queries, which it makes if need be.
+func NewElasticsearchPercolatorIndex(url string, reader elasticsearch.IIndex, settings string) (*PercolatorIndex, error) {
+	cluster := &esPartitionCluster{esMigrationCluster: esMigrationCluster{esi: reader}, url: url}
+	queries, err := newESPercolator(&cluster.esMigrationCluster, reader.IndexName()+"-queries")
+	if err != nil {
+		return nil, err
+	}
+	return NewPercolatorIndex(cluster, reader, queries, settings), nil
+}
+
+func (esi *PercolatorIndex) typePrefix() string {
+	return esi.Reader.IndexName() + "-type-"
+}
+
+// TypeIndexName is the name of the index the type is kept in.
+func (esi *PercolatorIndex) TypeIndexName(typ string) string {
+	return esi.typePrefix() + hex.EncodeToString([]byte(typ))
+}
+
+// typeIndex opens the index of the type.
+func (esi *PercolatorIndex) typeIndex(typ string) (elasticsearch.IIndex, error) {
+	name := esi.TypeIndexName(typ)
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+	if index, ok := esi.open[name]; ok {
+		return index, nil
+	}
+	ok, err := esi.Cluster.IndexExists(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.IndexName())
+	}
+	index, err := esi.Cluster.OpenIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	esi.open[name] = index
+	return index, nil
+}
+
+// createTypeIndex makes the index of the type, with the mapping, unless
+// another instance just did. The Settings are in the syntax of the schemas.
+func (esi *PercolatorIndex) createTypeIndex(typ string, jsn piazza.JsonString) error {
+	settings, err := modernizeBody(esi.Settings)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{}
+	if err = json.Unmarshal([]byte(settings), &body); err != nil {
+		return err
+	}
+	given := map[string]interface{}{}
+	if err = json.Unmarshal([]byte(jsn), &given); err != nil {
+		return err
+	}
+	mappings, _ := body["mappings"].(map[string]interface{})
+	mapping, _ := given[typ].(map[string]interface{})
+	if mapping == nil {
+		return fmt.Errorf("The mapping of %s is not given", typ)
+	}
+	if defaults, ok := mappings["_default_"].(map[string]interface{}); ok {
+		mapping = mergeMapping(defaults, mapping)
+	}
+	body["mappings"] = map[string]interface{}{typ: mapping}
+	body["aliases"] = map[string]interface{}{esi.Reader.IndexName(): map[string]interface{}{}}
+	byts, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	name := esi.TypeIndexName(typ)
+	if err = esi.Cluster.CreateIndex(name, byts); err != nil {
+		if ok, _ := esi.Cluster.IndexExists(name); ok {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// mergeMapping returns the mapping with the properties and settings of the
+// defaults it doesn't have itself.
+func mergeMapping(defaults map[string]interface{}, mapping map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range mapping {
+		merged[key] = value
+	}
+	defaultProperties, _ := defaults["properties"].(map[string]interface{})
+	properties, _ := mapping["properties"].(map[string]interface{})
+	if defaultProperties != nil && properties != nil {
+		mergedProperties := map[string]interface{}{}
+		for key, value := range defaultProperties {
+			mergedProperties[key] = value
+		}
+		for key, value := range properties {
+			mergedProperties[key] = value
+		}
+		merged["properties"] = mergedProperties
+	}
+	return merged
+}
+
+func (esi *PercolatorIndex) GetVersion() string {
+	return esi.Reader.GetVersion()
+}
+
+func (esi *PercolatorIndex) IndexName() string {
+	return esi.Reader.IndexName()
+}
+
+func (esi *PercolatorIndex) IndexExists() (bool, error) {
+	return esi.Reader.IndexExists()
+}
+
+func (esi *PercolatorIndex) TypeExists(typ string) (bool, error) {
+	return esi.Cluster.IndexExists(esi.TypeIndexName(typ))
+}
+
+func (esi *PercolatorIndex) ItemExists(typ string, id string) (bool, error) {
+	ok, err := esi.TypeExists(typ)
+	if err != nil || !ok {
+		return false, err
+	}
+	index, err := esi.typeIndex(typ)
+	if err != nil {
+		return false, err
+	}
+	return index.ItemExists(typ, id)
+}
+
+// Create does nothing, as the index of each type is made with its mapping.
+func (esi *PercolatorIndex) Create(settings string) error {
+	return nil
+}
+
+func (esi *PercolatorIndex) Close() error {
+	return nil
+}
+
+// Delete drops the indices of all of the types.
+func (esi *PercolatorIndex) Delete() error {
+	types, err := esi.GetTypes()
+	if err != nil {
+		return err
+	}
+	for _, typ := range types {
+		if err = esi.DeleteType(typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (esi *PercolatorIndex) PostData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	index, err := esi.typeIndex(typ)
+	if err != nil {
+		return nil, err
+	}
+	return index.PostData(typ, id, obj)
+}
+
+func (esi *PercolatorIndex) PutData(typ string, id string, obj interface{}) (*elasticsearch.IndexResponse, error) {
+	index, err := esi.typeIndex(typ)
+	if err != nil {
+		return nil, err
+	}
+	return index.PutData(typ, id, obj)
+}
+
+func (esi *PercolatorIndex) GetByID(typ string, id string) (*elasticsearch.GetResult, error) {
+	index, err := esi.typeIndex(typ)
+	if err != nil {
+		return nil, err
+	}
+	return index.GetByID(typ, id)
+}
+
+func (esi *PercolatorIndex) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	index, err := esi.typeIndex(typ)
+	if err != nil {
+		return &elasticsearch.DeleteResponse{Found: false}, err
+	}
+	return index.DeleteByID(typ, id)
+}
+
+// FilterByMatchAll and the other searches go through the alias; with no
+// type, they search all of them.
+func (esi *PercolatorIndex) FilterByMatchAll(typ string, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if ok, err := esi.searchable(typ); !ok {
+		return emptySearchResult(), err
+	}
+	return esi.Reader.FilterByMatchAll(typ, format)
+}
+
+func (esi *PercolatorIndex) GetAllElements(typ string) (*elasticsearch.SearchResult, error) {
+	if ok, err := esi.searchable(typ); !ok {
+		return emptySearchResult(), err
+	}
+	return esi.Reader.GetAllElements(typ)
+}
+
+func (esi *PercolatorIndex) FilterByTermQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if ok, err := esi.searchable(typ); !ok {
+		return emptySearchResult(), err
+	}
+	return esi.Reader.FilterByTermQuery(typ, name, value, format)
+}
+
+func (esi *PercolatorIndex) FilterByMatchQuery(typ string, name string, value interface{}, format *piazza.JsonPagination) (*elasticsearch.SearchResult, error) {
+	if ok, err := esi.searchable(typ); !ok {
+		return emptySearchResult(), err
+	}
+	return esi.Reader.FilterByMatchQuery(typ, name, value, format)
+}
+
+func (esi *PercolatorIndex) SearchByJSON(typ string, jsn string) (*elasticsearch.SearchResult, error) {
+	if ok, err := esi.searchable(typ); !ok {
+		return emptySearchResult(), err
+	}
+	return esi.Reader.SearchByJSON(typ, jsn)
+}
+
+// searchable tells whether a search of the type, or of all of them, can
+// find anything, as the alias may be over no index at all.
+func (esi *PercolatorIndex) searchable(typ string) (bool, error) {
+	if typ != "" {
+		ok, err := esi.TypeExists(typ)
+		if err == nil && !ok {
+			err = fmt.Errorf("Type %s in index %s does not exist", typ, esi.IndexName())
+		}
+		return ok, err
+	}
+	indices, err := esi.Cluster.AliasedIndices(esi.IndexName())
+	return err == nil && len(indices) != 0, err
+}
+
+func emptySearchResult() *elasticsearch.SearchResult {
+	return elasticsearch.NewSearchResult(&elastic.SearchResult{Hits: &elastic.SearchHits{Hits: []*elastic.SearchHit{}}})
+}
+
+// SetMapping makes the index of the type, or adds to its mapping, and gives
+// the mapping to the Percolator.
+func (esi *PercolatorIndex) SetMapping(typ string, jsn piazza.JsonString) error {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(jsn), &parsed); err != nil {
+		return err
+	}
+	byts, err := json.Marshal(modernizeMapping(parsed))
+	if err != nil {
+		return err
+	}
+	jsn = piazza.JsonString(byts)
+
+	ok, err := esi.TypeExists(typ)
+	if err != nil {
+		return err
+	}
+	if ok {
+		index, err := esi.typeIndex(typ)
+		if err != nil {
+			return err
+		}
+		if err = index.SetMapping(typ, jsn); err != nil {
+			return err
+		}
+	} else if err = esi.createTypeIndex(typ, jsn); err != nil {
+		return err
+	}
+	return esi.Queries.SetMapping(typ, jsn)
+}
+
+// GetTypes returns the types whose indices are under the alias.
+func (esi *PercolatorIndex) GetTypes() ([]string, error) {
+	indices, err := esi.Cluster.AliasedIndices(esi.IndexName())
+	if err != nil {
+		return nil, err
+	}
+	types := []string{}
+	for _, index := range indices {
+		if !strings.HasPrefix(index, esi.typePrefix()) {
+			continue
+		}
+		typ, err := hex.DecodeString(strings.TrimPrefix(index, esi.typePrefix()))
+		if err != nil {
+			continue
+		}
+		types = append(types, string(typ))
+	}
+	return types, nil
+}
+
+func (esi *PercolatorIndex) GetMapping(typ string) (interface{}, error) {
+	index, err := esi.typeIndex(typ)
+	if err != nil {
+		return nil, err
+	}
+	return index.GetMapping(typ)
+}
+
+// DeleteType drops the index of the type. The Percolator keeps its mapping,
+// as Elasticsearch can't remove fields.
+func (esi *PercolatorIndex) DeleteType(typ string) error {
+	name := esi.TypeIndexName(typ)
+	if err := esi.Cluster.DeleteIndex(name); err != nil {
+		return err
+	}
+	esi.lock.Lock()
+	delete(esi.open, name)
+	esi.lock.Unlock()
+	return nil
+}
+
+func (esi *PercolatorIndex) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	return esi.Queries.AddPercolationQuery(id, query)
+}
+
+func (esi *PercolatorIndex) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	return esi.Queries.DeletePercolationQuery(id)
+}
+
+func (esi *PercolatorIndex) AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error) {
+	ok, err := esi.TypeExists(typ)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Type %s in index %s does not exist", typ, esi.IndexName())
+	}
+	return esi.Queries.AddPercolationDocument(typ, doc)
+}
+
+func (esi *PercolatorIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	return esi.Reader.DirectAccess(verb, endpoint, input, output)
+}
+
+//---------------------------------------------------------------------------
+
+// esPercolatorType is the type of the percolation queries in their index.
+const esPercolatorType = "queries"
+
+// esPercolateSize is the most queries a document is found to match; it is
+// the most hits Elasticsearch returns by default.
+const esPercolateSize = 10000
+
+// esPercolator keeps the percolation queries in an index of Elasticsearch 5
+// or later, in a field mapped as a percolator, along with the mappings of
+// the fields of the types' documents that they are on.
+type esPercolator struct {
+	cluster *esMigrationCluster
+	index   string
+}
+
+func newESPercolator(cluster *esMigrationCluster, index string) (*esPercolator, error) {
+	percolator := &esPercolator{cluster: cluster, index: index}
+	ok, err := cluster.IndexExists(index)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return percolator, nil
+	}
+	body := `{
+	"mappings": {
+		"` + esPercolatorType + `": {
+			"properties": {
+				"query": {
+					"type": "percolator"
+				}
+			}
+		}
+	}
+}`
+	if err = cluster.CreateIndex(index, json.RawMessage(body)); err != nil {
+		// another instance may have just made it
+		if ok, _ := cluster.IndexExists(index); !ok {
+			return nil, err
+		}
+	}
+	return percolator, nil
+}
+
+// SetMapping adds the properties of the type, all of which are under data,
+// to those the queries are on.
+func (percolator *esPercolator) SetMapping(typ string, jsn piazza.JsonString) error {
+	var mapping map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(jsn), &mapping); err != nil {
+		return err
+	}
+	properties, ok := mapping[typ]["properties"]
+	if !ok {
+		return fmt.Errorf("The mapping of %s has no properties", typ)
+	}
+	return percolator.cluster.PutMapping(percolator.index, esPercolatorType, map[string]interface{}{"properties": properties})
+}
+
+func (percolator *esPercolator) endpoint(id string) string {
+	return "/" + percolator.index + "/" + esPercolatorType + "/" + id + "?refresh=true"
+}
+
+// AddPercolationQuery adds the query, which, as a condition may be, can be
+// given bare or under "query", as in Elasticsearch 2.
+func (percolator *esPercolator) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(query), &doc); err != nil {
+		return nil, err
+	}
+	if _, ok := doc["query"]; !ok || len(doc) != 1 {
+		doc = map[string]interface{}{"query": doc}
+	}
+	output, status, err := percolator.cluster.do("PUT", percolator.endpoint(id), doc)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("Percolation query %s was not added: %s", id, mappingValue(output))
+	}
+	version, _ := output["_version"].(float64)
+	created := output["created"] == true || output["result"] == "created"
+	return &elasticsearch.IndexResponse{Created: created, ID: id, Index: percolator.index, Type: esPercolatorType, Version: int(version)}, nil
+}
+
+func (percolator *esPercolator) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	output, status, err := percolator.cluster.do("DELETE", percolator.endpoint(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("Percolation query %s was not deleted: %s", id, mappingValue(output))
+	}
+	if output["found"] != true && output["result"] != "deleted" {
+		return &elasticsearch.DeleteResponse{Found: false}, fmt.Errorf("Item %s in index %s and type %s does not exist", id, percolator.index, esPercolatorType)
+	}
+	return &elasticsearch.DeleteResponse{Found: true, ID: id}, nil
+}
+
+// esPercolateResponse is the part of the response to a percolate query that
+// is used; the total is a number before Elasticsearch 7.
+type esPercolateResponse struct {
+	Hits struct {
+		Hits []struct {
+			ID    string `json:"_id"`
+			Index string `json:"_index"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Status int         `json:"status"`
+	Error  interface{} `json:"error"`
+}
+
+// AddPercolationDocument returns the queries the document matches.
+func (percolator *esPercolator) AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error) {
+	query := map[string]interface{}{
+		"size":    esPercolateSize,
+		"_source": false,
+		"query": map[string]interface{}{
+			"percolate": map[string]interface{}{
+				"field":         "query",
+				"document_type": esPercolatorType,
+				"document":      doc,
+			},
+		},
+	}
+	var output esPercolateResponse
+	if err := percolator.cluster.esi.DirectAccess("POST", "/"+percolator.index+"/_search", query, &output); err != nil {
+		return nil, err
+	}
+	if output.Error != nil {
+		return nil, fmt.Errorf("Percolating a document of %s failed: %s", typ, mappingValue(output.Error))
+	}
+	resp := &elasticsearch.PercolateResponse{Total: int64(len(output.Hits.Hits)), Matches: []*elasticsearch.PercolateResponseMatch{}}
+	for _, hit := range output.Hits.Hits {
+		resp.Matches = append(resp.Matches, &elasticsearch.PercolateResponseMatch{Id: hit.ID, Index: hit.Index})
+	}
+	return resp, nil
+}
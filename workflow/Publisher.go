@@ -0,0 +1,374 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultPublisherChannels       = 8
+	defaultPublisherConfirmTimeout = 10 * time.Second
+	defaultPublisherReconnectDelay = time.Second
+	publisherMaxReconnectDelay     = 30 * time.Second
+)
+
+// Publisher sends messages to RabbitMQ over one shared connection. Channels
+// are pooled and put in confirm mode, so Publish returns only once the broker
+// has acked the message. The connection is dialed by the first Publish;
+// should that fail, or the connection close, the publisher reconnects in the
+// background, and until it has, Publish fails at once rather than wait on the
+// broker.
+type Publisher struct {
+	// Channels is the most idle channels kept open
+	Channels int
+	// ConfirmTimeout is how long Publish waits for the broker's ack
+	ConfirmTimeout time.Duration
+	// ReconnectDelay is how long the publisher waits before it first tries
+	// to reconnect; the wait doubles with each try
+	ReconnectDelay time.Duration
+
+	address func() (string, error)
+	dial    func(address string) (amqpConnection, error)
+
+	lock     sync.Mutex
+	conn     amqpConnection
+	dialing  bool
+	idle     []*publisherChannel
+	declared map[string]bool
+	closed   bool
+}
+
+type publisherChannel struct {
+	conn     amqpConnection
+	ch       amqpChannel
+	confirms chan amqp.Confirmation
+}
+
+// amqpConnection is the part of an amqp.Connection the Publisher uses.
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// amqpChannel is the part of an amqp.Channel the Publisher uses.
+type amqpChannel interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+type amqpBrokerConnection struct {
+	*amqp.Connection
+}
+
+func (conn amqpBrokerConnection) Channel() (amqpChannel, error) {
+	ch, err := conn.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func dialAMQP(address string) (amqpConnection, error) {
+	conn, err := amqp.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return amqpBrokerConnection{conn}, nil
+}
+
+// NewPublisher returns a publisher for the broker at the address. It doesn't
+// connect until the first message is published.
+func NewPublisher(address func() (string, error)) *Publisher {
+	return newPublisher(address, dialAMQP)
+}
+
+func newPublisher(address func() (string, error), dial func(address string) (amqpConnection, error)) *Publisher {
+	return &Publisher{
+		Channels:       defaultPublisherChannels,
+		ConfirmTimeout: defaultPublisherConfirmTimeout,
+		ReconnectDelay: defaultPublisherReconnectDelay,
+		address:        address,
+		dial:           dial,
+	}
+}
+
+// Publish sends the message to the exchange and waits for the broker to ack
+// it. If declareQueue is set, a durable queue named by the routing key is
+// declared first.
+func (publisher *Publisher) Publish(exchange string, routingKey string, declareQueue bool, message string) error {
+	pc, err := publisher.getChannel()
+	if err != nil {
+		return err
+	}
+
+	if declareQueue {
+		if err = publisher.declareQueue(pc, routingKey); err != nil {
+			publisher.discardChannel(pc)
+			return err
+		}
+	}
+
+	err = pc.ch.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         []byte(message),
+		})
+	if err != nil {
+		publisher.discardChannel(pc)
+		return LoggedError("rabbit-related failure (publish): %s", err.Error())
+	}
+
+	timer := time.NewTimer(publisher.ConfirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-pc.confirms:
+		if !ok {
+			publisher.discardChannel(pc)
+			return LoggedError("rabbit-related failure (confirm): channel closed before the broker acked")
+		}
+		publisher.putChannel(pc)
+		if !confirm.Ack {
+			return LoggedError("rabbit-related failure (confirm): the broker nacked the message")
+		}
+		return nil
+	case <-timer.C:
+		// a late confirm would be read as the next message's, so the
+		// channel can't be reused
+		publisher.discardChannel(pc)
+		return LoggedError("rabbit-related failure (confirm): no ack from the broker after %s", publisher.ConfirmTimeout)
+	}
+}
+
+// Close closes the connection and all the channels.
+func (publisher *Publisher) Close() {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	publisher.closed = true
+	publisher.resetLocked()
+}
+
+//------------------------------------------------------------------------------
+
+func (publisher *Publisher) getChannel() (*publisherChannel, error) {
+	conn, err := publisher.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []*publisherChannel{}
+	var pc *publisherChannel
+	publisher.lock.Lock()
+	for pc == nil && len(publisher.idle) > 0 {
+		next := publisher.idle[len(publisher.idle)-1]
+		publisher.idle = publisher.idle[:len(publisher.idle)-1]
+		if next.conn == conn {
+			pc = next
+		} else {
+			stale = append(stale, next)
+		}
+	}
+	publisher.lock.Unlock()
+	for _, next := range stale {
+		_ = next.ch.Close()
+	}
+	if pc != nil {
+		return pc, nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, LoggedError("rabbit-related failure (channel): %s", err.Error())
+	}
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, LoggedError("rabbit-related failure (confirm mode): %s", err.Error())
+	}
+	pc = &publisherChannel{
+		conn:     conn,
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+	}
+	return pc, nil
+}
+
+// connection returns the connection to the broker. If there is none, the
+// caller dials it, unless a dial is already under way, when it fails at once.
+func (publisher *Publisher) connection() (amqpConnection, error) {
+	publisher.lock.Lock()
+	switch {
+	case publisher.closed:
+		publisher.lock.Unlock()
+		return nil, errors.New("rabbit-related failure: publisher is closed")
+	case publisher.conn != nil:
+		conn := publisher.conn
+		publisher.lock.Unlock()
+		return conn, nil
+	case publisher.dialing:
+		publisher.lock.Unlock()
+		return nil, LoggedError("rabbit-related failure: not connected to the broker")
+	}
+	publisher.dialing = true
+	publisher.lock.Unlock()
+
+	conn, err := publisher.connect()
+	if err != nil {
+		go publisher.reconnect()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (publisher *Publisher) putChannel(pc *publisherChannel) {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	if publisher.closed || pc.conn != publisher.conn || len(publisher.idle) >= publisher.Channels {
+		_ = pc.ch.Close()
+		return
+	}
+	publisher.idle = append(publisher.idle, pc)
+}
+
+func (publisher *Publisher) discardChannel(pc *publisherChannel) {
+	_ = pc.ch.Close()
+}
+
+// declareQueue declares each queue once per connection.
+func (publisher *Publisher) declareQueue(pc *publisherChannel, name string) error {
+	publisher.lock.Lock()
+	declared := pc.conn == publisher.conn && publisher.declared[name]
+	publisher.lock.Unlock()
+	if declared {
+		return nil
+	}
+
+	_, err := pc.ch.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return LoggedError("rabbit-related failure (declare): %s", err.Error())
+	}
+
+	publisher.lock.Lock()
+	if pc.conn == publisher.conn {
+		publisher.declared[name] = true
+	}
+	publisher.lock.Unlock()
+	return nil
+}
+
+// connect dials the broker, outside the lock, for the caller that set
+// dialing. Once connected, dialing is cleared; if the dial fails, the caller
+// is still dialing.
+func (publisher *Publisher) connect() (amqpConnection, error) {
+	address, err := publisher.address()
+	if err != nil {
+		return nil, LoggedError("rabbit-related failure (address): %s", err.Error())
+	}
+	conn, err := publisher.dial(address)
+	if err != nil {
+		return nil, LoggedError("rabbit-related failure (dial): %s", err.Error())
+	}
+
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	publisher.dialing = false
+	if publisher.closed {
+		_ = conn.Close()
+		return nil, errors.New("rabbit-related failure: publisher is closed")
+	}
+	publisher.conn = conn
+	publisher.declared = map[string]bool{}
+
+	closes := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go publisher.watch(conn, closes)
+	return conn, nil
+}
+
+// reconnect dials the broker until it connects or the publisher is closed,
+// with the delay doubling after each try. It is run with dialing set, so
+// that meanwhile Publish fails at once.
+func (publisher *Publisher) reconnect() {
+	delay := publisher.ReconnectDelay
+	for {
+		time.Sleep(delay)
+		publisher.lock.Lock()
+		if publisher.closed {
+			publisher.dialing = false
+			publisher.lock.Unlock()
+			return
+		}
+		publisher.lock.Unlock()
+
+		if _, err := publisher.connect(); err == nil {
+			return
+		}
+		if delay *= 2; delay > publisherMaxReconnectDelay {
+			delay = publisherMaxReconnectDelay
+		}
+	}
+}
+
+// watch waits for the connection to close. If the broker closed it, the
+// publisher drops it and reconnects in the background.
+func (publisher *Publisher) watch(conn amqpConnection, closes chan *amqp.Error) {
+	amqpErr, ok := <-closes
+	if !ok || amqpErr == nil {
+		// closed by us
+		return
+	}
+	log.Printf("rabbit-related failure: connection closed: %s", amqpErr.Error())
+
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	if publisher.conn != conn {
+		return
+	}
+	publisher.resetLocked()
+	if !publisher.closed && !publisher.dialing {
+		publisher.dialing = true
+		go publisher.reconnect()
+	}
+}
+
+func (publisher *Publisher) resetLocked() {
+	for _, pc := range publisher.idle {
+		_ = pc.ch.Close()
+	}
+	publisher.idle = nil
+	if publisher.conn != nil {
+		_ = publisher.conn.Close()
+		publisher.conn = nil
+	}
+}
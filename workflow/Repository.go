@@ -0,0 +1,110 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// The Service reaches its resources only through these repositories, never
+// through the index underneath. The DB types keep them in an
+// elasticsearch.IIndex, which may be a real index or, when mocking, a
+// MemoryIndex.
+//
+// The EventTypes, Triggers, Alerts and cron jobs are versioned: GetOne fills
+// in the Version, writes set it, and the methods that take a version change
+// the resource only if it is still at that version, returning
+// ErrVersionConflict if it isn't. A version of 0 changes it regardless.
+
+// EventTypeRepository holds the EventTypes.
+type EventTypeRepository interface {
+	Mapping() string
+	PostData(eventType *EventType) error
+	PutData(eventType *EventType, version int64) error
+	GetAll(format *piazza.JsonPagination, actor string) ([]EventType, int64, error)
+	GetEventTypesByDslQuery(dslString string, actor string) ([]EventType, int64, error)
+	GetOne(id piazza.Ident, actor string) (*EventType, bool, error)
+	GetIDByName(format *piazza.JsonPagination, name string, actor string) (*piazza.Ident, bool, error)
+	DeleteByID(id piazza.Ident, version int64, actor string) (bool, error)
+}
+
+// EventRepository holds the Events, one type per EventType, and the
+// percolation queries of the Triggers.
+type EventRepository interface {
+	IndexName() string
+	PostData(event *Event, typ string) error
+	PutData(event *Event, typ string) error
+	GetAll(mapping string, format *piazza.JsonPagination, actor string) ([]Event, int64, error)
+	GetEventsByDslQuery(mapping string, jsnString string, actor string) ([]Event, int64, error)
+	GetEventsByEventTypeID(format *piazza.JsonPagination, mapping string, eventTypeID piazza.Ident, actor string) ([]Event, int64, error)
+	GetEventsByCreator(format *piazza.JsonPagination, mapping string, createdBy string, actor string) ([]Event, int64, error)
+	CountEventsByEventTypeID(mapping string, eventTypeID piazza.Ident) (int64, error)
+	GetEventIDsByEventTypeID(mapping string, eventTypeID piazza.Ident, after piazza.Ident, size int) ([]piazza.Ident, error)
+	lookupEventTypeNameByEventID(id piazza.Ident, actor string) (string, error)
+	NameExists(name string, actor string) (bool, error)
+	GetOne(mapping string, id piazza.Ident, actor string) (*Event, bool, error)
+	DeleteByID(mapping string, id piazza.Ident, actor string) (bool, error)
+	AddMapping(name string, mapping map[string]interface{}, actor string) error
+	DeleteMapping(name string, actor string) (bool, error)
+	PercolateEventData(eventType string, data map[string]interface{}, id piazza.Ident, actor string) (*[]piazza.Ident, error)
+	AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error)
+	DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error)
+	PercolateSamples(typ string, query piazza.JsonString, samples []map[string]interface{}) ([]bool, error)
+}
+
+// TriggerRepository holds the Triggers.
+type TriggerRepository interface {
+	Mapping() string
+	PostData(trigger *Trigger) error
+	PutTrigger(trigger *Trigger, previousCondition map[string]interface{}, version int64, actor string) error
+	GetAll(format *piazza.JsonPagination, actor string) ([]Trigger, int64, error)
+	GetTriggersByDslQuery(dslString string, actor string) ([]Trigger, int64, error)
+	GetOne(id piazza.Ident, actor string) (*Trigger, bool, error)
+	GetTriggersByEventTypeID(format *piazza.JsonPagination, id piazza.Ident, actor string) ([]Trigger, int64, error)
+	DeleteTrigger(id piazza.Ident, version int64, actor string) (bool, error)
+}
+
+// AlertRepository holds the Alerts.
+type AlertRepository interface {
+	Mapping() string
+	PostData(alert *Alert) error
+	PutData(alert *Alert, version int64) error
+	GetAll(format *piazza.JsonPagination, actor string) ([]Alert, int64, error)
+	GetAlertsByDslQuery(dslString string, actor string) ([]Alert, int64, error)
+	GetAllByTrigger(format *piazza.JsonPagination, triggerID piazza.Ident, actor string) ([]Alert, int64, error)
+	GetOne(id piazza.Ident, actor string) (*Alert, bool, error)
+	DeleteByID(id piazza.Ident, version int64, actor string) (bool, error)
+}
+
+// CronRepository holds the cron jobs behind the repeating Events.
+type CronRepository interface {
+	Mapping() string
+	PostData(job *CronJob) error
+	PutData(job *CronJob, version int64) error
+	GetAll(format *piazza.JsonPagination, actor string) ([]CronJob, int64, error)
+	GetOne(id piazza.Ident, actor string) (*CronJob, bool, error)
+	Exists(actor string) (bool, error)
+	itemExists(id piazza.Ident, actor string) (bool, error)
+	DeleteByID(id piazza.Ident, actor string) (bool, error)
+}
+
+var (
+	_ EventTypeRepository = (*EventTypeDB)(nil)
+	_ EventRepository     = (*EventDB)(nil)
+	_ TriggerRepository   = (*TriggerDB)(nil)
+	_ AlertRepository     = (*AlertDB)(nil)
+	_ CronRepository      = (*CronDB)(nil)
+)
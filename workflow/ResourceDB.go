@@ -14,7 +14,16 @@
 
 package workflow
 
-import "github.com/venicegeo/pz-gocommon/elasticsearch"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
 
 type ResourceDB struct {
 	service *Service
@@ -33,3 +42,88 @@ func NewResourceDB(service *Service, esi elasticsearch.IIndex) (*ResourceDB, err
 
 	return db, nil
 }
+
+// IndexName returns the name of the index the resources are kept in.
+func (db *ResourceDB) IndexName() string {
+	return db.Esi.IndexName()
+}
+
+// ErrVersionConflict is returned when a resource is written or deleted on
+// condition that it is still at a version, and it has since been changed.
+var ErrVersionConflict = errors.New("the resource has been changed since the version given")
+
+// versionedDocument is what Elasticsearch returns for a get, put or delete of
+// a resource; a request that fails, such as a put with a stale version, has
+// Status and Error set instead.
+type versionedDocument struct {
+	Found   bool             `json:"found"`
+	Version int64            `json:"_version"`
+	Source  *json.RawMessage `json:"_source"`
+	Status  int              `json:"status"`
+	Error   interface{}      `json:"error"`
+}
+
+// endpoint returns the document endpoint of a resource, conditional on the
+// version if it isn't 0.
+func (db *ResourceDB) endpoint(typ string, id piazza.Ident, version int64) string {
+	endpoint := fmt.Sprintf("/%s/%s/%s", db.Esi.IndexName(), typ, url.QueryEscape(id.String()))
+	if version != 0 {
+		endpoint = fmt.Sprintf("%s?version=%d", endpoint, version)
+	}
+	return endpoint
+}
+
+// getVersioned reads a resource into obj, returning its version. Unlike
+// GetByID, it returns the version, which the search results don't have.
+func (db *ResourceDB) getVersioned(typ string, id piazza.Ident, obj interface{}) (bool, int64, error) {
+	doc := &versionedDocument{}
+	if err := db.Esi.DirectAccess("GET", db.endpoint(typ, id, 0), nil, doc); err != nil {
+		return false, 0, err
+	}
+	if doc.Status == http.StatusNotFound || (doc.Error == nil && (!doc.Found || doc.Source == nil)) {
+		return false, 0, fmt.Errorf("Item %s in index %s and type %s does not exist", id, db.Esi.IndexName(), typ)
+	}
+	if doc.Error != nil {
+		return false, 0, fmt.Errorf("%v", doc.Error)
+	}
+	if err := json.Unmarshal(*doc.Source, obj); err != nil {
+		return true, 0, err
+	}
+	return true, doc.Version, nil
+}
+
+// putVersioned writes a resource, if it is still at the version, or in any
+// case if the version is 0, and returns its new version.
+func (db *ResourceDB) putVersioned(typ string, id piazza.Ident, obj interface{}, version int64) (int64, error) {
+	doc := &versionedDocument{}
+	if err := db.Esi.DirectAccess("PUT", db.endpoint(typ, id, version), obj, doc); err != nil {
+		return 0, err
+	}
+	if doc.Status == http.StatusConflict {
+		return 0, ErrVersionConflict
+	}
+	if doc.Error != nil {
+		return 0, fmt.Errorf("%v", doc.Error)
+	}
+	return doc.Version, nil
+}
+
+// deleteVersioned deletes a resource, if it is still at the version, or in
+// any case if the version is 0. As with DeleteByID, a resource that isn't
+// there is an error.
+func (db *ResourceDB) deleteVersioned(typ string, id piazza.Ident, version int64) (bool, error) {
+	doc := &versionedDocument{}
+	if err := db.Esi.DirectAccess("DELETE", db.endpoint(typ, id, version), nil, doc); err != nil {
+		return false, err
+	}
+	if doc.Status == http.StatusConflict {
+		return false, ErrVersionConflict
+	}
+	if doc.Status == http.StatusNotFound || (doc.Error == nil && !doc.Found) {
+		return false, fmt.Errorf("Item %s in index %s and type %s does not exist", id, db.Esi.IndexName(), typ)
+	}
+	if doc.Error != nil {
+		return false, fmt.Errorf("%v", doc.Error)
+	}
+	return true, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"net/http"
+
+	"github.com/braintree/manners"
+	"github.com/gin-gonic/gin"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// RouteServer serves the routes of the Server. It is piazza's GenericServer,
+// which can't route PATCH, with any verb gin has.
+type RouteServer struct {
+	Sys    *piazza.SystemConfig
+	router http.Handler
+	obj    *manners.GracefulServer
+}
+
+// Configure registers the routes with the server.
+func (server *RouteServer) Configure(routes []piazza.RouteData) error {
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+	for _, route := range routes {
+		router.Handle(route.Verb, route.Path, route.Handler)
+	}
+	server.router = router
+
+	return nil
+}
+
+// Start serves the routes, once the server is Configured, and returns once
+// it answers. The channel gets the error it stopped with.
+func (server *RouteServer) Start() (chan error, error) {
+	sys := server.Sys
+	if sys.BindTo == "" {
+		sys.BindTo = ":http"
+	}
+
+	server.obj = manners.NewWithServer(&http.Server{
+		Addr:    sys.BindTo,
+		Handler: server.router,
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- server.obj.ListenAndServe()
+	}()
+
+	if err := piazza.WaitForService(sys.Name, piazza.DefaultProtocol+"://"+sys.BindTo); err != nil {
+		return nil, err
+	}
+	sys.AddService(sys.Name, sys.BindTo)
+
+	return done, nil
+}
+
+// Stop shuts the server down, letting the requests it is serving finish.
+func (server *RouteServer) Stop() error {
+	server.obj.Close()
+	return nil
+}
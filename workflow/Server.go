@@ -15,6 +15,7 @@
 package workflow
 
 import (
+	"fmt"
 	"net/http"
 
 	"bytes"
@@ -31,6 +32,7 @@ type Server struct {
 	Routes  []piazza.RouteData
 	service *Service
 	origin  string
+	openAPI map[string]interface{}
 }
 
 const Version = "1.0.0"
@@ -44,33 +46,57 @@ func (server *Server) Init(service *Service) error {
 	server.Routes = []piazza.RouteData{
 		{Verb: "GET", Path: "/", Handler: server.handleGetRoot},
 		{Verb: "GET", Path: "/version", Handler: server.handleGetVersion},
+		{Verb: "GET", Path: "/openapi.json", Handler: server.handleGetOpenAPI},
 
 		{Verb: "GET", Path: "/eventType", Handler: server.handleGetAllEventTypes},
 		{Verb: "GET", Path: "/eventType/:id", Handler: server.handleGetEventType},
+		{Verb: "GET", Path: "/eventType/:id/dependencies", Handler: server.handleGetEventTypeDependencies},
 		{Verb: "POST", Path: "/eventType", Handler: server.handlePostEventType},
-		{Verb: "POST", Path: "/eventType/query", Handler: server.handleEventTypeQuery},
+		{Verb: "POST", Path: "/eventType/:id", Handler: server.handlePostEventTypeID},
+		{Verb: "PUT", Path: "/eventType", Handler: server.handlePutEventType},
 		{Verb: "DELETE", Path: "/eventType/:id", Handler: server.handleDeleteEventType},
+		{Verb: "POST", Path: "/eventType/:id/restore", Handler: server.handleRestoreEventType},
 
 		{Verb: "GET", Path: "/event/:id", Handler: server.handleGetEvent},
+		{Verb: "GET", Path: "/event/:id/results", Handler: server.handleGetEventResults},
 		{Verb: "GET", Path: "/event", Handler: server.handleGetAllEvents},
 		{Verb: "POST", Path: "/event", Handler: server.handlePostEvent},
 		{Verb: "POST", Path: "/event/query", Handler: server.handleEventQuery},
+		{Verb: "PUT", Path: "/event", Handler: server.handlePutEvent},
 		{Verb: "DELETE", Path: "/event/:id", Handler: server.handleDeleteEvent},
 
+		{Verb: "GET", Path: "/cron", Handler: server.handleGetAllCronJobs},
+		{Verb: "GET", Path: "/cron/:id", Handler: server.handleGetCronJob},
+		{Verb: "GET", Path: "/cron/:id/events", Handler: server.handleGetCronJobEvents},
+		{Verb: "GET", Path: "/cron/:id/runs", Handler: server.handleGetCronJobRuns},
+		{Verb: "PUT", Path: "/cron/:id", Handler: server.handlePutCronJob},
+		{Verb: "POST", Path: "/cron/:id/pause", Handler: server.handlePauseCronJob},
+		{Verb: "POST", Path: "/cron/:id/resume", Handler: server.handleResumeCronJob},
+
 		{Verb: "GET", Path: "/trigger/:id", Handler: server.handleGetTrigger},
 		{Verb: "GET", Path: "/trigger", Handler: server.handleGetAllTriggers},
 		{Verb: "POST", Path: "/trigger", Handler: server.handlePostTrigger},
-		{Verb: "POST", Path: "/trigger/query", Handler: server.handleTriggerQuery},
+		{Verb: "POST", Path: "/trigger/:id", Handler: server.handlePostTriggerID},
 		{Verb: "PUT", Path: "/trigger/:id", Handler: server.handlePutTrigger},
+		{Verb: "PATCH", Path: "/trigger/:id", Handler: server.handlePutTrigger},
 		{Verb: "DELETE", Path: "/trigger/:id", Handler: server.handleDeleteTrigger},
+		{Verb: "POST", Path: "/trigger/:id/restore", Handler: server.handleRestoreTrigger},
+
+		{Verb: "GET", Path: "/trash", Handler: server.handleGetAllTrash},
 
 		{Verb: "GET", Path: "/alert/:id", Handler: server.handleGetAlert},
 		{Verb: "GET", Path: "/alert", Handler: server.handleGetAllAlerts},
 		{Verb: "POST", Path: "/alert", Handler: server.handlePostAlert},
 		{Verb: "POST", Path: "/alert/query", Handler: server.handleAlertQuery},
+		{Verb: "PUT", Path: "/alert", Handler: server.handlePutAlert},
 		{Verb: "DELETE", Path: "/alert/:id", Handler: server.handleDeleteAlert},
 
 		{Verb: "GET", Path: "/admin/stats", Handler: server.handleGetStats},
+		{Verb: "GET", Path: "/admin/dispatch", Handler: server.handleGetAllDispatches},
+		{Verb: "GET", Path: "/admin/dispatch/:id", Handler: server.handleGetDispatch},
+		{Verb: "POST", Path: "/admin/dispatch/:id/replay", Handler: server.handleReplayDispatch},
+		{Verb: "GET", Path: "/admin/backup", Handler: server.handleExportBackup},
+		{Verb: "POST", Path: "/admin/restore", Handler: server.handleImportBackup},
 
 		{Verb: "GET", Path: "/_test/elasticsearch/version", Handler: server.handleTestElasticsearchVersion},
 		{Verb: "GET", Path: "/_test/elasticsearch/data/:id", Handler: server.handleTestElasticsearchGetOne},
@@ -78,6 +104,7 @@ func (server *Server) Init(service *Service) error {
 	}
 
 	server.origin = service.origin
+	server.openAPI = openAPIDocument(openAPIRouteOperations(server.Routes))
 
 	return nil
 }
@@ -96,17 +123,65 @@ func (server *Server) handleGetVersion(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) notFound(c *gin.Context) {
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf("No route for %s %s", c.Request.Method, c.Request.URL.Path),
+		Origin:     server.origin,
+	}
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleGetStats(c *gin.Context) {
 	resp := server.service.GetStats()
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetAllDispatches(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAllDispatches(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetDispatch(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetDispatch(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleReplayDispatch(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.ReplayDispatch(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleExportBackup(c *gin.Context) {
+	resp := server.service.ExportBackup(c.Query("events") == "true", c.Query("alerts") == "true")
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleImportBackup(c *gin.Context) {
+	backup := &Backup{}
+	err := c.BindJSON(backup)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.ImportBackup(backup, c.Query("preserveIds") == "true")
+	piazza.GinReturnJson(c, resp)
+}
+
 //---------------------------------------------------------------------------
 
 func (server *Server) handleGetEventType(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.GetEventType(id, "pz-workflow")
-	piazza.GinReturnJson(c, resp)
+	server.returnVersioned(c, resp)
 }
 
 func (server *Server) handleGetAllEventTypes(c *gin.Context) {
@@ -150,9 +225,62 @@ func (server *Server) handleEventTypeQuery(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePutEventType(c *gin.Context) {
+	version, ok := server.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+	eventType := &EventType{}
+	err := c.BindJSON(eventType)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutEventType(eventType, version)
+	server.returnVersioned(c, resp)
+}
+
 func (server *Server) handleDeleteEventType(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteEventType(id)
+	version, ok := server.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+	var resp *piazza.JsonResponse
+	if c.Query("cascade") == "true" {
+		resp = server.service.DeleteEventTypeCascade(id, version)
+	} else {
+		resp = server.service.DeleteEventType(id, version)
+	}
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetEventTypeDependencies(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetEventTypeDependencies(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+// handlePostEventTypeID serves POST /eventType/query. The router can't have
+// it beside the wildcard of POST /eventType/:id/restore, so it takes the
+// wildcard.
+func (server *Server) handlePostEventTypeID(c *gin.Context) {
+	switch c.Param("id") {
+	case "query":
+		server.handleEventTypeQuery(c)
+	default:
+		server.notFound(c)
+	}
+}
+
+func (server *Server) handleRestoreEventType(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.RestoreEventType(id)
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -186,12 +314,20 @@ func (server *Server) handlePostEvent(c *gin.Context) {
 	var resp *piazza.JsonResponse
 	if event.CronSchedule != "" {
 		resp = server.service.PostRepeatingEvent(event)
+	} else if c.Query("async") == "true" {
+		resp = server.service.PostEventAsync(event)
 	} else {
 		resp = server.service.PostEvent(event)
 	}
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetEventResults(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetEventResults(id)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleEventQuery(c *gin.Context) {
 	buf := new(bytes.Buffer)
 	_, err := buf.ReadFrom(c.Request.Body)
@@ -211,6 +347,22 @@ func (server *Server) handleEventQuery(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePutEvent(c *gin.Context) {
+	event := &Event{}
+	err := c.BindJSON(event)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutEvent(event)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleDeleteEvent(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.DeleteEvent(id)
@@ -219,10 +371,71 @@ func (server *Server) handleDeleteEvent(c *gin.Context) {
 
 //---------------------------------------------------------------------------
 
+func (server *Server) handleGetAllCronJobs(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAllCronJobs(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetCronJob(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetCronJob(id)
+	server.returnVersioned(c, resp)
+}
+
+func (server *Server) handleGetCronJobEvents(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetCronJobEvents(id, params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetCronJobRuns(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetCronJobRuns(id, params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutCronJob(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	version, ok := server.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+	update := &CronUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutCronJob(id, update, version)
+	server.returnVersioned(c, resp)
+}
+
+func (server *Server) handlePauseCronJob(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.PauseCronJob(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleResumeCronJob(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.ResumeCronJob(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------------
+
 func (server *Server) handleGetTrigger(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.GetTrigger(id)
-	piazza.GinReturnJson(c, resp)
+	server.returnVersioned(c, resp)
 }
 
 func (server *Server) handleGetAllTriggers(c *gin.Context) {
@@ -266,10 +479,30 @@ func (server *Server) handleTriggerQuery(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleTestTrigger(c *gin.Context) {
+	test := &TriggerTest{}
+	err := c.BindJSON(test)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.TestTrigger(test)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handlePutTrigger(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	update := &TriggerUpdate{}
-	err := c.BindJSON(update)
+	version, ok := server.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+	update := map[string]interface{}{}
+	err := c.BindJSON(&update)
 	if err != nil {
 		resp := &piazza.JsonResponse{
 			StatusCode: http.StatusBadRequest,
@@ -279,13 +512,44 @@ func (server *Server) handlePutTrigger(c *gin.Context) {
 		piazza.GinReturnJson(c, resp)
 		return
 	}
-	resp := server.service.PutTrigger(id, update)
-	piazza.GinReturnJson(c, resp)
+	resp := server.service.PutTrigger(id, update, version)
+	server.returnVersioned(c, resp)
 }
 
 func (server *Server) handleDeleteTrigger(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteTrigger(id)
+	version, ok := server.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+	resp := server.service.DeleteTrigger(id, version)
+	piazza.GinReturnJson(c, resp)
+}
+
+// handlePostTriggerID serves POST /trigger/query and /trigger/test, for the
+// same reason as handlePostEventTypeID.
+func (server *Server) handlePostTriggerID(c *gin.Context) {
+	switch c.Param("id") {
+	case "query":
+		server.handleTriggerQuery(c)
+	case "test":
+		server.handleTestTrigger(c)
+	default:
+		server.notFound(c)
+	}
+}
+
+func (server *Server) handleRestoreTrigger(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.RestoreTrigger(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------------
+
+func (server *Server) handleGetAllTrash(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAllTrash(params)
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -294,7 +558,7 @@ func (server *Server) handleDeleteTrigger(c *gin.Context) {
 func (server *Server) handleGetAlert(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.GetAlert(id)
-	piazza.GinReturnJson(c, resp)
+	server.returnVersioned(c, resp)
 }
 
 func (server *Server) handleGetAllAlerts(c *gin.Context) {
@@ -338,9 +602,33 @@ func (server *Server) handlePostAlert(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePutAlert(c *gin.Context) {
+	version, ok := server.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+	update := &AlertUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutAlert(update, version)
+	server.returnVersioned(c, resp)
+}
+
 func (server *Server) handleDeleteAlert(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteAlert(id)
+	version, ok := server.ifMatchVersion(c)
+	if !ok {
+		return
+	}
+	resp := server.service.DeleteAlert(id, version)
 	piazza.GinReturnJson(c, resp)
 }
 
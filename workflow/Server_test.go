@@ -16,10 +16,15 @@ package workflow
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -30,8 +35,9 @@ import (
 
 type ServerTester struct {
 	suite.Suite
-	sys    *piazza.SystemConfig
-	client *Client
+	sys     *piazza.SystemConfig
+	client  *Client
+	service *Service
 }
 
 func assertNoData(t *testing.T, client *Client) {
@@ -89,7 +95,22 @@ func TestRunSuite(t *testing.T) {
 	mappingTester := &MappingTester{}
 	suite.Run(t, mappingTester)
 
-	serverTester := &ServerTester{client: client, sys: sys}
+	conditionTester := &ConditionTester{}
+	suite.Run(t, conditionTester)
+
+	fileIndexTester := &FileIndexTester{}
+	suite.Run(t, fileIndexTester)
+
+	migratorTester := &MigratorTester{}
+	suite.Run(t, migratorTester)
+
+	percolatorTester := &PercolatorTester{}
+	suite.Run(t, percolatorTester)
+
+	publisherTester := &PublisherTester{}
+	suite.Run(t, publisherTester)
+
+	serverTester := &ServerTester{client: client, sys: sys, service: kit.Service}
 	suite.Run(t, serverTester)
 
 	clientTester := &ClientTester{client: client, sys: sys}
@@ -356,6 +377,43 @@ func (suite *ServerTester) Test03Trigger() {
 
 	err = client.PutTrigger(id, &TriggerUpdate{})
 	assert.NoError(err)
+	trigger, err = client.GetTrigger(id)
+	assert.NoError(err)
+	assert.False(trigger.Enabled)
+	assert.EqualValues("MY TRIGGER TITLE", trigger.Name)
+
+	trigger.Name = "MY NEW TRIGGER TITLE"
+	trigger.Enabled = true
+	trigger.Condition = map[string]interface{}{
+		"match": map[string]interface{}{
+			"data.num": 17,
+		},
+	}
+	respTrigger, err = client.UpdateTrigger(id, trigger)
+	assert.NoError(err)
+	assert.EqualValues(string(id), string(respTrigger.TriggerID))
+	trigger, err = client.GetTrigger(id)
+	assert.NoError(err)
+	assert.EqualValues(string(id), string(trigger.TriggerID))
+	assert.EqualValues("MY NEW TRIGGER TITLE", trigger.Name)
+	assert.True(trigger.Enabled)
+	assert.EqualValues(17, trigger.Condition["match"].(map[string]interface{})["data.num"])
+
+	// a PATCH changes just the fields it is given
+	code, _, _, err := piazza.HTTP("PATCH", client.url+"/trigger/"+id.String(),
+		piazza.NewHeaderBuilder().AddJsonContentType().GetHeader(), strings.NewReader(`{"enabled": false}`))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, code)
+	trigger, err = client.GetTrigger(id)
+	assert.NoError(err)
+	assert.False(trigger.Enabled)
+	assert.EqualValues("MY NEW TRIGGER TITLE", trigger.Name)
+
+	trigger.EventTypeID = "nosuchtype"
+	_, err = client.UpdateTrigger(id, trigger)
+	assert.Error(err)
+	_, err = client.UpdateTrigger("nosuchtrigger", trigger)
+	assert.Error(err)
 
 	//log.Printf("Delete trigger by id: %s", id)
 	err = client.DeleteTrigger(id)
@@ -897,14 +955,2063 @@ func (suite *ServerTester) Test09Elasticsearch() {
 	assert.Equal(17, data.Value)
 }
 
-func printJSON(msg string, input interface{}) {
-	if input != nil {
-		results, err := json.Marshal(input)
-		if err != nil {
-			log.Fatal(err)
+func (suite *ServerTester) Test10TriggerTest() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{
+		"match": map[string]interface{}{
+			"data.num": 31,
+		},
+	}
+	trigger.Job.JobType.Data["num"] = "$num"
+	test := &TriggerTest{
+		Trigger: *trigger,
+		Samples: []map[string]interface{}{{"num": 17}, {"num": 31}},
+	}
+	results, err := client.TestTrigger(test)
+	assert.NoError(err)
+	assert.Len(*results, 2)
+	for i, result := range *results {
+		assert.Equal(i, result.Sample)
+	}
+	assert.False((*results)[0].Matched)
+	assert.Empty((*results)[0].Job)
+	assert.True((*results)[1].Matched)
+	assert.Contains((*results)[1].Job, `"num":31`)
+
+	test.Trigger.Condition = map[string]interface{}{
+		"fuzzy": map[string]interface{}{
+			"data.num": 31,
+		},
+	}
+	_, err = client.TestTrigger(test)
+	assert.Error(err)
+	test.Trigger.Condition = trigger.Condition
+
+	numTriggers, err := client.GetNumTriggers()
+	assert.NoError(err)
+	assert.Zero(numTriggers)
+
+	test.Trigger.EventTypeID = "nosuchtype"
+	_, err = client.TestTrigger(test)
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test18JobTemplate() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType := &EventType{
+		Name: makeTestEventTypeName(),
+		Mapping: map[string]interface{}{
+			"id":   elasticsearch.MappingElementTypeString,
+			"idx":  elasticsearch.MappingElementTypeInteger,
+			"tags": elasticsearch.MappingElementTypeStringA,
+			"bbox": map[string]interface{}{
+				"minX": elasticsearch.MappingElementTypeDouble,
+				"maxX": elasticsearch.MappingElementTypeDouble,
+			},
+		},
+	}
+	eventType, err := client.PostEventType(eventType)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match_all": map[string]interface{}{}}
+	trigger.Job.JobType.Data["minX"] = "${data.bbox.minX}"
+	trigger.Job.JobType.Data["bbox"] = "${data.bbox}"
+	trigger.Job.JobType.Data["name"] = "$id-$idx \"${data.tags.1}\""
+	trigger.Job.JobType.Data["maxX"] = "${data.bbox.maxX:-180}"
+	trigger.Job.JobType.Data["first"] = "${data.tags.0:-none}"
+	trigger.Job.JobType.Data["event"] = "${eventTypeId}"
+
+	results, err := client.TestTrigger(&TriggerTest{
+		Trigger: *trigger,
+		Samples: []map[string]interface{}{{
+			"id":   "a",
+			"idx":  7,
+			"tags": []interface{}{"x", "y"},
+			"bbox": map[string]interface{}{"minX": -10.5},
+		}},
+	})
+	assert.NoError(err)
+	assert.Len(*results, 1)
+
+	var job JobRequest
+	assert.NoError(json.Unmarshal([]byte((*results)[0].Job), &job))
+	data := job.JobType.Data
+	assert.EqualValues(-10.5, data["minX"])
+	assert.EqualValues(map[string]interface{}{"minX": -10.5}, data["bbox"])
+	assert.EqualValues(`a-7 "y"`, data["name"])
+	assert.EqualValues(180, data["maxX"])
+	assert.EqualValues("x", data["first"])
+	assert.EqualValues(eventType.EventTypeID, data["event"])
+	assert.EqualValues("ddd5134", data["serviceId"])
+
+	trigger.Job.JobType.Data["bad"] = "${data.bbox.minY}"
+	_, err = client.PostTrigger(trigger)
+	assert.Error(err)
+	trigger.Job.JobType.Data["bad"] = "${nosuchfield}"
+	_, err = client.PostTrigger(trigger)
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test19Actions() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	var webhookBodies []map[string]interface{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+		webhookBodies = append(webhookBodies, body)
+	}))
+	defer webhook.Close()
+
+	first, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(first.EventTypeID)
+		assert.NoError(err)
+	}()
+	second, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(second.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	// dry runs of each kind of action
+	trigger := makeTestTrigger([]piazza.Ident{first.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match_all": map[string]interface{}{}}
+	samples := []map[string]interface{}{{"num": 17}}
+
+	trigger.Action = &TriggerAction{
+		Type:    ActionTypeWebhook,
+		Webhook: &WebhookAction{URL: webhook.URL, Body: map[string]interface{}{"n": "${data.num}"}},
+	}
+	results, err := client.TestTrigger(&TriggerTest{Trigger: *trigger, Samples: samples})
+	assert.NoError(err)
+	assert.Equal(ActionTypeWebhook, (*results)[0].Action)
+	assert.JSONEq(`{"n":17}`, (*results)[0].Output)
+	assert.Empty((*results)[0].Job)
+
+	trigger.Action = &TriggerAction{Type: ActionTypeAMQP, AMQP: &AMQPAction{Exchange: "Piazza", RoutingKey: "x"}}
+	results, err = client.TestTrigger(&TriggerTest{Trigger: *trigger, Samples: samples})
+	assert.NoError(err)
+	assert.Equal(ActionTypeAMQP, (*results)[0].Action)
+	assert.Contains((*results)[0].Output, `"data":{"num":17}`)
+
+	trigger.Action = &TriggerAction{
+		Type:  ActionTypeEvent,
+		Event: &EventAction{EventTypeID: second.EventTypeID, Data: map[string]interface{}{"num": "${data.num}"}},
+	}
+	results, err = client.TestTrigger(&TriggerTest{Trigger: *trigger, Samples: samples})
+	assert.NoError(err)
+	assert.Equal(ActionTypeEvent, (*results)[0].Action)
+	assert.Contains((*results)[0].Output, `"data":{"num":17}`)
+
+	// bad actions are refused
+	bad := []*TriggerAction{
+		{Type: "nosuchaction"},
+		{Type: ActionTypeWebhook},
+		{Type: ActionTypeWebhook, Webhook: &WebhookAction{URL: "ftp://example.com"}},
+		{Type: ActionTypeWebhook, Webhook: &WebhookAction{URL: webhook.URL, Method: "GET"}},
+		{Type: ActionTypeWebhook, Webhook: &WebhookAction{URL: webhook.URL, Body: "${data.nosuchfield}"}},
+		{Type: ActionTypeAMQP, AMQP: &AMQPAction{}},
+		{Type: ActionTypeEvent, Event: &EventAction{EventTypeID: "nosuchtype"}},
+	}
+	for i, action := range bad {
+		trigger.Action = action
+		_, err = client.PostTrigger(trigger)
+		assert.Error(err, "action %d", i)
+	}
+
+	// an event action fires the triggers of the event it posts
+	trigger.Action = &TriggerAction{
+		Type:  ActionTypeEvent,
+		Event: &EventAction{EventTypeID: second.EventTypeID, Data: map[string]interface{}{"num": "${data.num}"}},
+	}
+	firstTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteTrigger(firstTrigger.TriggerID)
+		assert.NoError(err)
+	}()
+
+	trigger = makeTestTrigger([]piazza.Ident{second.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	trigger.Job = JobRequest{}
+	trigger.Action = &TriggerAction{Type: ActionTypeWebhook, Webhook: &WebhookAction{URL: webhook.URL}}
+	secondTrigger, err := client.PostTrigger(trigger)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteTrigger(secondTrigger.TriggerID)
+		assert.NoError(err)
+	}()
+
+	event, err := client.PostEvent(makeTestEvent(first.EventTypeID))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEvent(event.EventID)
+		assert.NoError(err)
+	}()
+
+	if assert.Len(webhookBodies, 1) {
+		assert.EqualValues(secondTrigger.TriggerID, webhookBodies[0]["triggerId"])
+		assert.EqualValues(second.EventTypeID, webhookBodies[0]["eventTypeId"])
+		assert.EqualValues(map[string]interface{}{"num": 17.0}, webhookBodies[0]["data"])
+		chained, err := client.GetAllEventsByEventType(second.EventTypeID)
+		assert.NoError(err)
+		for _, e := range *chained {
+			assert.NoError(client.DeleteEvent(e.EventID))
 		}
-		log.Printf("\t%s: %s\n", msg, string(results))
-	} else {
-		log.Printf("\t%s: null\n", msg)
 	}
+
+	for _, triggerID := range []piazza.Ident{firstTrigger.TriggerID, secondTrigger.TriggerID} {
+		alerts, err := client.GetAlertByTrigger(triggerID)
+		assert.NoError(err)
+		if assert.Len(*alerts, 1) {
+			assert.NotEqual(ActionTypeJob, (*alerts)[0].Action)
+			assert.NoError(client.DeleteAlert((*alerts)[0].AlertID))
+		}
+	}
+}
+
+func (suite *ServerTester) Test21Dispatch() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	dispatcher := suite.service.dispatcher
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	// stand in for the broker, which starts out down
+	brokerUp := false
+	sent := []string{}
+	send := dispatcher.send
+	maxAttempts, baseDelay, claimFor := dispatcher.MaxAttempts, dispatcher.BaseDelay, dispatcher.ClaimFor
+	dispatcher.send = func(dispatch *Dispatch) error {
+		if !brokerUp {
+			return errors.New("connection refused")
+		}
+		sent = append(sent, dispatch.Job)
+		return nil
+	}
+	// and for the alerts, which are down when the job is first sent
+	alertsUp := false
+	record := dispatcher.record
+	dispatcher.record = func(alert *Alert) error {
+		if !alertsUp {
+			return errors.New("alerts are down")
+		}
+		return record(alert)
+	}
+	dispatcher.MaxAttempts, dispatcher.BaseDelay, dispatcher.ClaimFor = 2, 0, 0
+	defer func() {
+		dispatcher.send, dispatcher.record = send, record
+		dispatcher.MaxAttempts, dispatcher.BaseDelay, dispatcher.ClaimFor = maxAttempts, baseDelay, claimFor
+	}()
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match_all": map[string]interface{}{}}
+	trigger, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteTrigger(trigger.TriggerID)
+		assert.NoError(err)
+	}()
+
+	// the event is accepted even though its job can't be sent yet
+	event, err := client.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEvent(event.EventID)
+		assert.NoError(err)
+	}()
+
+	// there is no alert until the broker has acked the job
+	alerts, err := client.GetAlertByTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	assert.Len(*alerts, 0)
+
+	dispatches, err := client.GetAllDispatches(DispatchPending, 100, 0)
+	assert.NoError(err)
+	if !assert.Len(*dispatches, 1) {
+		return
+	}
+	dispatch := (*dispatches)[0]
+	defer func() {
+		_, err = suite.service.dispatchDB.DeleteByID(dispatch.DispatchID, "test")
+		assert.NoError(err)
+	}()
+	assert.Equal(event.EventID, dispatch.EventID)
+	assert.Equal(1, dispatch.Attempts)
+	assert.Equal("connection refused", dispatch.LastError)
+
+	// the second failure dead-letters it
+	tried, err := dispatcher.RetryDue()
+	assert.NoError(err)
+	assert.Equal(1, tried)
+	dispatches, err = client.GetAllDispatches(DispatchDead, 100, 0)
+	assert.NoError(err)
+	assert.Len(*dispatches, 1)
+	tried, err = dispatcher.RetryDue()
+	assert.NoError(err)
+	assert.Zero(tried)
+
+	stale, err := client.GetDispatch(dispatch.DispatchID)
+	assert.NoError(err)
+	assert.NotZero(stale.Version)
+
+	brokerUp = true
+	replayed, err := client.ReplayDispatch(dispatch.DispatchID)
+	assert.NoError(err)
+	assert.Equal(DispatchSent, replayed.Status)
+	assert.Equal(1, replayed.Attempts)
+	assert.Empty(replayed.LastError)
+	assert.True(replayed.AlertPending)
+	assert.Equal([]string{dispatch.Job}, sent)
+
+	// another replica that read the dispatch before it was sent can't claim
+	// it, so the job isn't sent twice
+	stale.Status, stale.NextAttempt = DispatchPending, piazza.NewTimeStamp()
+	other := NewDispatcher(suite.service)
+	other.send = dispatcher.send
+	assert.False(other.attempt(stale))
+	assert.Equal([]string{dispatch.Job}, sent)
+
+	// the alert that wasn't recorded is, once it can be, without the job
+	// being sent again
+	alerts, err = client.GetAlertByTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	assert.Len(*alerts, 0)
+	alertsUp = true
+	tried, err = dispatcher.RetryDue()
+	assert.NoError(err)
+	assert.Equal(1, tried)
+	assert.Equal([]string{dispatch.Job}, sent)
+	tried, err = dispatcher.RetryDue()
+	assert.NoError(err)
+	assert.Zero(tried)
+
+	alerts, err = client.GetAlertByTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	if assert.Len(*alerts, 1) {
+		assert.Equal(dispatch.JobID, (*alerts)[0].JobID)
+		assert.Equal(event.EventID, (*alerts)[0].EventID)
+		assert.Equal(ActionTypeJob, (*alerts)[0].Action)
+		assert.NoError(client.DeleteAlert((*alerts)[0].AlertID))
+	}
+
+	got, err := client.GetDispatch(dispatch.DispatchID)
+	assert.NoError(err)
+	assert.Equal(DispatchSent, got.Status)
+	assert.False(got.AlertPending)
+	assert.NotEmpty(got.AlertID)
+
+	_, err = client.ReplayDispatch(dispatch.DispatchID)
+	assert.Error(err)
+	_, err = client.ReplayDispatch("nosuchdispatch")
+	assert.Error(err)
+	_, err = client.GetAllDispatches("lost", 100, 0)
+	assert.Error(err)
+
+	assert.Equal(5*time.Second, (&Dispatcher{BaseDelay: 5 * time.Second, MaxDelay: time.Minute}).backoff(1))
+	assert.Equal(40*time.Second, (&Dispatcher{BaseDelay: 5 * time.Second, MaxDelay: time.Minute}).backoff(4))
+	assert.Equal(time.Minute, (&Dispatcher{BaseDelay: 5 * time.Second, MaxDelay: time.Minute}).backoff(9))
+}
+
+func (suite *ServerTester) Test22TriggerPool() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	// the webhook holds each call until it is let go
+	calls := make(chan bool, 10)
+	letGo := make(chan bool, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- true
+		<-letGo
+	}))
+	defer webhook.Close()
+
+	pool := service.triggerPool
+	service.SetTriggerPool(1, 1)
+	defer func() {
+		service.SetTriggerPool(pool.Workers, pool.QueueDepth)
+	}()
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 17}}
+	trigger.Job = JobRequest{}
+	trigger.Action = &TriggerAction{Type: ActionTypeWebhook, Webhook: &WebhookAction{URL: webhook.URL}}
+	trigger, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteTrigger(trigger.TriggerID)
+		assert.NoError(err)
+	}()
+
+	event, err := client.PostEventAsync(makeTestEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEvent(event.EventID)
+		assert.NoError(err)
+	}()
+	<-calls
+
+	results, err := client.GetEventResults(event.EventID)
+	assert.NoError(err)
+	assert.Equal(EventResultsRunning, results.Status)
+	assert.Empty(results.Triggers)
+
+	// the pool is full, so a second event that fires the trigger is refused
+	resp := client.h.PzPost("/event", makeTestEvent(eventType.EventTypeID))
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	// but one that fires nothing is fine
+	other := makeTestEvent(eventType.EventTypeID)
+	other.Data["num"] = 18
+	other, err = client.PostEvent(other)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEvent(other.EventID)
+		assert.NoError(err)
+	}()
+
+	letGo <- true
+	for i := 0; i < 100 && results.Status != EventResultsDone; i++ {
+		time.Sleep(10 * time.Millisecond)
+		results, err = client.GetEventResults(event.EventID)
+		assert.NoError(err)
+	}
+	assert.Equal(EventResultsDone, results.Status)
+	if assert.Len(results.Triggers, 1) {
+		assert.Equal(trigger.TriggerID, results.Triggers[0].TriggerID)
+		assert.Equal(ActionTypeWebhook, results.Triggers[0].Action)
+		assert.Equal(http.StatusOK, results.Triggers[0].StatusCode)
+	}
+
+	alerts, err := client.GetAlertByTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	if assert.Len(*alerts, 1) {
+		assert.NoError(client.DeleteAlert((*alerts)[0].AlertID))
+	}
+
+	_, err = client.GetEventResults("nosuchevent")
+	assert.Error(err)
+
+	// a stopped pool refuses everything
+	service.triggerPool.Stop()
+	resp = client.h.PzPost("/event", makeTestEvent(eventType.EventTypeID))
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func (suite *ServerTester) Test23Cron() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	seed, err := client.PostEvent(makeTestCronEvent(eventType.EventTypeID))
+	assert.NoError(err)
+
+	jobs, err := client.GetAllCronJobs(100, 0)
+	assert.NoError(err)
+	found := false
+	for _, job := range *jobs {
+		if job.EventID == seed.EventID {
+			found = true
+			assert.False(job.Paused)
+			assert.NotNil(job.NextRun)
+			assert.EqualValues(17, job.Data["num"])
+		}
+	}
+	assert.True(found)
+
+	job, err := client.PauseCronJob(seed.EventID)
+	assert.NoError(err)
+	assert.True(job.Paused)
+	assert.Nil(job.NextRun)
+	job, err = client.GetCronJob(seed.EventID)
+	assert.NoError(err)
+	assert.True(job.Paused)
+
+	job, err = client.ResumeCronJob(seed.EventID)
+	assert.NoError(err)
+	assert.False(job.Paused)
+	assert.NotNil(job.NextRun)
+
+	job, err = client.PutCronJob(seed.EventID, &CronUpdate{CronSchedule: "0 0 * * * *", Data: map[string]interface{}{"num": 18}})
+	assert.NoError(err)
+	assert.Equal("0 0 * * * *", job.CronSchedule)
+	assert.EqualValues(18, job.Data["num"])
+	if assert.NotNil(job.NextRun) {
+		assert.Equal(0, time.Time(*job.NextRun).Minute())
+	}
+	event, err := client.GetEvent(seed.EventID)
+	assert.NoError(err)
+	assert.EqualValues(18, event.Data["num"])
+
+	_, err = client.PutCronJob(seed.EventID, &CronUpdate{CronSchedule: "not a schedule"})
+	assert.Error(err)
+	_, err = client.PutCronJob(seed.EventID, &CronUpdate{Data: map[string]interface{}{"num": 18, "nosuchfield": 1}})
+	assert.Error(err)
+
+	// the cron isn't started when mocking, so fire the current entry by hand
+	fired := 0
+	key := service.cronSchedules.entries[seed.EventID].key
+	for _, entry := range service.cron.Entries() {
+		if entry.Job.(cronEvent).key == key {
+			entry.Job.Run()
+			fired++
+		}
+	}
+	assert.Equal(1, fired)
+
+	events, err := client.GetCronJobEvents(seed.EventID, 100, 0)
+	assert.NoError(err)
+	if assert.Len(*events, 1) {
+		assert.Equal(seed.EventID.String(), (*events)[0].CreatedBy)
+		assert.EqualValues(18, (*events)[0].Data["num"])
+		assert.NoError(client.DeleteEvent((*events)[0].EventID))
+	}
+
+	_, err = client.GetCronJob("nosuchcron")
+	assert.Error(err)
+	_, err = client.PauseCronJob("nosuchcron")
+	assert.Error(err)
+
+	err = client.DeleteEvent(seed.EventID)
+	assert.NoError(err)
+	_, err = client.GetCronJob(seed.EventID)
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test24LeaderElection() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	now := time.Now()
+	store := NewMemoryLeaseStore()
+	store.now = func() time.Time { return now }
+
+	elected := map[string]int{}
+	deposed := map[string]int{}
+	newElector := func(holder string) *LeaderElector {
+		elector := NewLeaderElector(store, "test", holder)
+		elector.Elected = func() error {
+			elected[holder]++
+			return nil
+		}
+		elector.Deposed = func() { deposed[holder]++ }
+		return elector
+	}
+	a := newElector("a")
+	b := newElector("b")
+
+	a.Tick()
+	b.Tick()
+	assert.True(a.IsLeader())
+	assert.False(b.IsLeader())
+
+	// a renews its lease, so b can't take over
+	now = now.Add(a.TTL / 2)
+	a.Tick()
+	now = now.Add(a.TTL / 2)
+	b.Tick()
+	assert.True(a.IsLeader())
+	assert.False(b.IsLeader())
+
+	// once the lease expires, b takes over, and a finds out it was deposed
+	now = now.Add(a.TTL)
+	b.Tick()
+	a.Tick()
+	assert.False(a.IsLeader())
+	assert.True(b.IsLeader())
+	assert.Equal(map[string]int{"a": 1, "b": 1}, elected)
+	assert.Equal(map[string]int{"a": 1}, deposed)
+
+	// a leader that stops gives up the lease at once
+	b.Stop()
+	a.Tick()
+	assert.True(a.IsLeader())
+	assert.Equal(2, deposed["b"]+deposed["a"])
+	a.Stop()
+	assert.False(a.IsLeader())
+
+	// the lease is renewed while a slow Elected runs
+	slow := NewLeaderElector(NewMemoryLeaseStore(), "test", "slow")
+	slow.TTL = 30 * time.Millisecond
+	takeOver := make(chan struct{})
+	slow.Elected = func() error {
+		<-takeOver
+		return nil
+	}
+	slow.Start()
+	time.Sleep(3 * slow.TTL)
+	assert.True(slow.Holding())
+	assert.False(slow.IsLeader())
+	close(takeOver)
+	assert.True(eventually(slow.IsLeader))
+	slow.Stop()
+	assert.False(slow.Holding())
+
+	// the cron runs only while the replica is the leader
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	replica := service.newCronElector(store, "replica")
+	assert.False(service.cronSchedules.isRunning())
+	replica.Tick()
+	assert.True(replica.IsLeader())
+	assert.True(service.cronSchedules.isRunning())
+
+	// the leader picks up a job another replica added
+	job := &CronJob{Event: *makeTestCronEvent(eventType.EventTypeID)}
+	job.EventID = "cron-from-another-replica"
+	job.Data = service.addUniqueParams(eventType.Name, job.Data)
+	assert.NoError(service.cronDB.PostData(job))
+	replica.Tick()
+	info, err := client.GetCronJob(job.EventID)
+	assert.NoError(err)
+	assert.NotNil(info.NextRun)
+
+	// and drops it once it is gone
+	_, err = service.cronDB.DeleteByID(job.EventID, "pz-workflow")
+	assert.NoError(err)
+	replica.Tick()
+	assert.Nil(service.cronSchedules.next(job.EventID))
+
+	replica.Stop()
+	assert.False(service.cronSchedules.isRunning())
+}
+
+func (suite *ServerTester) Test25CronRuns() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	bad := makeTestCronEvent(eventType.EventTypeID)
+	bad.MissedRunPolicy = "sometimes"
+	_, err = client.PostEvent(bad)
+	assert.Error(err)
+
+	seedEvent := makeTestCronEvent(eventType.EventTypeID)
+	seedEvent.CronSchedule = "0 * * * * *"
+	seedEvent.MissedRunPolicy = CronMissedRunFireAll
+	seed, err := client.PostEvent(seedEvent)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEvent(seed.EventID)
+		assert.NoError(err)
+	}()
+	key := service.cronSchedules.entries[seed.EventID].key
+
+	// the service was down for three and a half minutes, so missed four runs
+	now := time.Now().Truncate(time.Minute)
+	holding := func() bool { return true }
+	catchUp := func() {
+		job, found, err := service.cronDB.GetOne(seed.EventID, "pz-workflow")
+		assert.True(found)
+		assert.NoError(err)
+		down := piazza.TimeStamp(now.Add(-210 * time.Second))
+		job.LastRun = &down
+		assert.NoError(service.cronDB.PutData(job, 0))
+		service.catchUpCronJob(job, eventType.Name, now, holding)
+	}
+	runsWith := func(status string, missed int) []CronRun {
+		runs, err := client.GetCronJobRuns(seed.EventID, 100, 0)
+		assert.NoError(err)
+		found := []CronRun{}
+		for _, run := range *runs {
+			if run.Status == status && run.Missed == missed {
+				found = append(found, run)
+			}
+		}
+		return found
+	}
+
+	catchUp()
+	fired := runsWith(CronRunFired, 1)
+	if assert.Len(fired, 4) {
+		scheduled := map[time.Time]bool{}
+		for _, run := range fired {
+			scheduled[time.Time(run.ScheduledFor).UTC()] = true
+			assert.NotEmpty(run.EventID)
+			assert.NotNil(run.FiredOn)
+		}
+		for i := 0; i < 4; i++ {
+			assert.True(scheduled[now.Add(time.Duration(-i)*time.Minute).UTC()])
+		}
+	}
+	job, err := client.GetCronJob(seed.EventID)
+	assert.NoError(err)
+	if assert.NotNil(job.LastRun) {
+		assert.True(now.Equal(time.Time(*job.LastRun)))
+	}
+
+	// a replica that loses the lease stops firing the runs it missed
+	held := 2
+	holding = func() bool {
+		held--
+		return held >= 0
+	}
+	catchUp()
+	assert.Len(runsWith(CronRunFired, 1), 6)
+	holding = func() bool { return true }
+
+	// recording runs isn't a change to the schedule
+	assert.NoError(service.syncCron(nil))
+	assert.Equal(key, service.cronSchedules.entries[seed.EventID].key)
+
+	_, err = client.PutCronJob(seed.EventID, &CronUpdate{MissedRunPolicy: "sometimes"})
+	assert.Error(err)
+	_, err = client.PutCronJob(seed.EventID, &CronUpdate{MissedRunPolicy: CronMissedRunFireOnce})
+	assert.NoError(err)
+	catchUp()
+	assert.Len(runsWith(CronRunFired, 4), 1)
+
+	_, err = client.PutCronJob(seed.EventID, &CronUpdate{MissedRunPolicy: CronMissedRunSkip})
+	assert.NoError(err)
+	catchUp()
+	skipped := runsWith(CronRunSkipped, 4)
+	if assert.Len(skipped, 1) {
+		assert.Empty(skipped[0].EventID.String())
+		assert.True(now.Equal(time.Time(skipped[0].ScheduledFor)))
+	}
+
+	// a run that fails is recorded too
+	dbJob, _, err := service.cronDB.GetOne(seed.EventID, "pz-workflow")
+	assert.NoError(err)
+	run := service.fireCronJob(cronEvent{Event: &dbJob.Event, eventTypeName: "nosuchtype", service: service}, now, 0)
+	assert.Equal(CronRunFailed, run.Status)
+	assert.Equal(http.StatusBadRequest, run.StatusCode)
+	assert.NotEmpty(run.Message)
+	assert.Len(runsWith(CronRunFailed, 0), 1)
+
+	events, err := client.GetCronJobEvents(seed.EventID, 100, 0)
+	assert.NoError(err)
+	assert.Len(*events, 7)
+	for _, event := range *events {
+		assert.NoError(client.DeleteEvent(event.EventID))
+	}
+}
+
+func (suite *ServerTester) Test26CronBounds() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	now := time.Now().Truncate(time.Minute)
+	stamp := func(t time.Time) *piazza.TimeStamp {
+		ts := piazza.TimeStamp(t)
+		return &ts
+	}
+	postSeed := func(change func(*Event)) *Event {
+		event := makeTestCronEvent(eventType.EventTypeID)
+		change(event)
+		seed, err := client.PostEvent(event)
+		if err != nil {
+			return nil
+		}
+		return seed
+	}
+	deleteSeed := func(seed *Event) {
+		events, err := client.GetCronJobEvents(seed.EventID, 100, 0)
+		assert.NoError(err)
+		for _, event := range *events {
+			assert.NoError(client.DeleteEvent(event.EventID))
+		}
+		assert.NoError(client.DeleteEvent(seed.EventID))
+	}
+
+	// schedules that can't run
+	assert.Nil(postSeed(func(e *Event) { e.TimeZone = "Nowhere/Atlantis" }))
+	assert.Nil(postSeed(func(e *Event) { e.EndTime = stamp(now.Add(-time.Hour)) }))
+	assert.Nil(postSeed(func(e *Event) {
+		e.StartTime = stamp(now.Add(2 * time.Hour))
+		e.EndTime = stamp(now.Add(time.Hour))
+	}))
+	assert.Nil(postSeed(func(e *Event) { e.MaxRuns = -1 }))
+
+	// a schedule in a time zone, that starts later
+	ny, err := time.LoadLocation("America/New_York")
+	assert.NoError(err)
+	start := now.Add(48*time.Hour + 30*time.Minute)
+	seed := postSeed(func(e *Event) {
+		e.CronSchedule = "0 0 9 * * *"
+		e.TimeZone = "America/New_York"
+		e.StartTime = stamp(start)
+	})
+	if assert.NotNil(seed) {
+		job, err := client.GetCronJob(seed.EventID)
+		assert.NoError(err)
+		assert.Nil(job.RemainingRuns)
+		if assert.NotNil(job.NextRun) {
+			next := time.Time(*job.NextRun).In(ny)
+			assert.Equal(9, next.Hour())
+			assert.Equal(0, next.Minute())
+			assert.False(next.Before(start))
+			assert.True(next.Before(start.Add(24 * time.Hour)))
+		}
+		deleteSeed(seed)
+	}
+
+	// a schedule that runs twice
+	seed = postSeed(func(e *Event) {
+		e.CronSchedule = "* * * * * *"
+		e.MaxRuns = 2
+	})
+	if assert.NotNil(seed) {
+		job, err := client.GetCronJob(seed.EventID)
+		assert.NoError(err)
+		if assert.NotNil(job.RemainingRuns) {
+			assert.Equal(2, *job.RemainingRuns)
+		}
+
+		run := func() {
+			key := service.cronSchedules.entries[seed.EventID].key
+			for _, entry := range service.cron.Entries() {
+				if c, ok := entry.Job.(cronEvent); ok && c.key == key {
+					entry.Job.Run()
+				}
+			}
+		}
+		run()
+		job, err = client.GetCronJob(seed.EventID)
+		assert.NoError(err)
+		assert.Equal(1, job.Runs)
+		if assert.NotNil(job.RemainingRuns) {
+			assert.Equal(1, *job.RemainingRuns)
+		}
+		_, err = client.PutCronJob(seed.EventID, &CronUpdate{MaxRuns: 1})
+		assert.Error(err)
+
+		run()
+		_, err = client.GetCronJob(seed.EventID)
+		assert.Error(err)
+		_, ok := service.cronSchedules.entries[seed.EventID]
+		assert.False(ok)
+		// its history is kept
+		runs, err := client.GetCronJobRuns(seed.EventID, 100, 0)
+		assert.NoError(err)
+		assert.Len(*runs, 2)
+		events, err := client.GetCronJobEvents(seed.EventID, 100, 0)
+		assert.NoError(err)
+		assert.Len(*events, 2)
+		deleteSeed(seed)
+	}
+
+	// a schedule whose end passed while the service was down fires the runs
+	// it missed before then, and retires
+	seed = postSeed(func(e *Event) {
+		e.CronSchedule = "0 * * * * *"
+		e.MissedRunPolicy = CronMissedRunFireAll
+		e.EndTime = stamp(now.Add(time.Hour))
+	})
+	if assert.NotNil(seed) {
+		job, _, err := service.cronDB.GetOne(seed.EventID, "pz-workflow")
+		assert.NoError(err)
+		job.LastRun = stamp(now.Add(-210 * time.Second))
+		job.EndTime = stamp(now.Add(-30 * time.Second))
+		assert.NoError(service.cronDB.PutData(job, 0))
+
+		assert.NoError(service.syncCron(func() bool { return true }))
+		_, err = client.GetCronJob(seed.EventID)
+		assert.Error(err)
+		_, ok := service.cronSchedules.entries[seed.EventID]
+		assert.False(ok)
+
+		events, err := client.GetCronJobEvents(seed.EventID, 100, 0)
+		assert.NoError(err)
+		assert.Len(*events, 3)
+		deleteSeed(seed)
+	}
+}
+
+func (suite *ServerTester) Test27CronTemplate() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(&EventType{
+		Name: makeTestEventTypeName(),
+		Mapping: map[string]interface{}{
+			"num":    elasticsearch.MappingElementTypeInteger,
+			"since":  elasticsearch.MappingElementTypeDate,
+			"until":  elasticsearch.MappingElementTypeDate,
+			"window": elasticsearch.MappingElementTypeDate,
+			"label":  elasticsearch.MappingElementTypeString,
+		},
+	})
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	template := map[string]interface{}{
+		"num":    "${run}",
+		"since":  "${previousRun}",
+		"until":  "${scheduledFor}",
+		"window": "${last.1h}",
+		"label":  "run ${run} of ${cronId}",
+	}
+	makeSeed := func(change func(map[string]interface{})) *Event {
+		data := map[string]interface{}{}
+		for k, v := range template {
+			data[k] = v
+		}
+		change(data)
+		return &Event{
+			EventTypeID:     eventType.EventTypeID,
+			Data:            data,
+			CronSchedule:    "0 * * * * *",
+			MissedRunPolicy: CronMissedRunFireAll,
+		}
+	}
+
+	// placeholders that runs don't fill in
+	_, err = client.PostEvent(makeSeed(func(data map[string]interface{}) { data["label"] = "${nosuch}" }))
+	assert.Error(err)
+	_, err = client.PostEvent(makeSeed(func(data map[string]interface{}) { data["window"] = "${last.1.5h}" }))
+	assert.Error(err)
+	_, err = client.PostEvent(makeSeed(func(data map[string]interface{}) { data["window"] = "${last.-1h}" }))
+	assert.Error(err)
+
+	seed, err := client.PostEvent(makeSeed(func(data map[string]interface{}) {}))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEvent(seed.EventID)
+		assert.NoError(err)
+	}()
+	assert.Equal("${run}", seed.Data["num"])
+
+	// the CronDB keeps the placeholders, the seed event has them filled in
+	job, err := client.GetCronJob(seed.EventID)
+	assert.NoError(err)
+	assert.Equal("${last.1h}", job.Data["window"])
+	seedEvent, err := client.GetEvent(seed.EventID)
+	assert.NoError(err)
+	assert.EqualValues(1, seedEvent.Data["num"])
+	assert.Equal("run 1 of "+seed.EventID.String(), seedEvent.Data["label"])
+
+	_, err = client.PutCronJob(seed.EventID, &CronUpdate{Data: map[string]interface{}{"num": "${nosuch}"}})
+	assert.Error(err)
+
+	// three runs missed since the last one
+	now := time.Now().Truncate(time.Minute)
+	dbJob, _, err := service.cronDB.GetOne(seed.EventID, "pz-workflow")
+	assert.NoError(err)
+	last := piazza.TimeStamp(now.Add(-150 * time.Second))
+	dbJob.LastRun = &last
+	assert.NoError(service.cronDB.PutData(dbJob, 0))
+	service.catchUpCronJob(dbJob, eventType.Name, now, func() bool { return true })
+
+	events, err := client.GetCronJobEvents(seed.EventID, 100, 0)
+	assert.NoError(err)
+	byRun := map[int]Event{}
+	for _, event := range *events {
+		num, ok := event.Data["num"].(float64)
+		assert.True(ok)
+		byRun[int(num)] = event
+	}
+	if assert.Len(byRun, 3) {
+		previous := time.Time(last)
+		for run := 1; run <= 3; run++ {
+			scheduled := now.Add(time.Duration(run-3) * time.Minute)
+			data := byRun[run].Data
+			assert.Equal(piazza.TimeStamp(previous).String(), data["since"])
+			assert.Equal(piazza.TimeStamp(scheduled).String(), data["until"])
+			assert.Equal(piazza.TimeStamp(scheduled.Add(-time.Hour)).String(), data["window"])
+			assert.Equal("run "+strconv.Itoa(run)+" of "+seed.EventID.String(), data["label"])
+			previous = scheduled
+		}
+	}
+	for _, event := range *events {
+		assert.NoError(client.DeleteEvent(event.EventID))
+	}
+}
+
+func printJSON(msg string, input interface{}) {
+	if input != nil {
+		results, err := json.Marshal(input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("\t%s: %s\n", msg, string(results))
+	} else {
+		log.Printf("\t%s: null\n", msg)
+	}
+}
+
+func (suite *ServerTester) Test28RepositoryQueries() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventTypeName := makeTestEventTypeName()
+	eventType, err := client.PostEventType(&EventType{
+		Name: eventTypeName,
+		Mapping: map[string]interface{}{
+			"num":   elasticsearch.MappingElementTypeInteger,
+			"label": elasticsearch.MappingElementTypeString,
+		},
+	})
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	labels := []string{"Alpha one", "beta two", "alpha three"}
+	for i, label := range labels {
+		event := makeTestEvent(eventType.EventTypeID)
+		event.Data = map[string]interface{}{"num": i + 1, "label": label}
+		event, err = client.PostEvent(event)
+		assert.NoError(err)
+		defer func(id piazza.Ident) {
+			err = client.DeleteEvent(id)
+			assert.NoError(err)
+		}(event.EventID)
+	}
+
+	num := "data." + eventTypeName + ".num"
+	nums := func(events *[]Event) []interface{} {
+		out := []interface{}{}
+		for _, event := range *events {
+			out = append(out, event.Data[eventTypeName].(map[string]interface{})["num"])
+		}
+		return out
+	}
+
+	events, err := client.QueryEvents(map[string]interface{}{
+		"query": map[string]interface{}{"range": map[string]interface{}{num: map[string]interface{}{"gte": 2}}},
+		"sort":  []interface{}{map[string]interface{}{num: "asc"}},
+	})
+	assert.NoError(err)
+	assert.Equal([]interface{}{2.0, 3.0}, nums(events))
+
+	// label is analyzed, so a match on one word finds both alphas
+	events, err = client.QueryEvents(map[string]interface{}{
+		"query": map[string]interface{}{"match": map[string]interface{}{"data." + eventTypeName + ".label": "ALPHA"}},
+		"sort":  []interface{}{map[string]interface{}{num: map[string]interface{}{"order": "desc"}}},
+	})
+	assert.NoError(err)
+	assert.Equal([]interface{}{3.0, 1.0}, nums(events))
+
+	// eventTypeId is not analyzed, and paging applies after sorting
+	events, err = client.QueryEvents(map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventType.EventTypeID.String()}},
+		"sort":  []interface{}{map[string]interface{}{num: "desc"}},
+		"size":  2,
+	})
+	assert.NoError(err)
+	assert.Equal([]interface{}{3.0, 2.0}, nums(events))
+
+	_, err = client.QueryEvents(map[string]interface{}{
+		"query": map[string]interface{}{"fuzzy": map[string]interface{}{num: 2}},
+	})
+	assert.Error(err)
+
+	trigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventType.EventTypeID}))
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteTrigger(trigger.TriggerID)
+		assert.NoError(err)
+	}()
+
+	triggers, err := client.QueryTriggers(map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventType.EventTypeID.String()}},
+	})
+	assert.NoError(err)
+	assert.Len(*triggers, 1)
+	triggers, err = client.QueryTriggers(map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventTypeId": "no-such-id"}},
+	})
+	assert.NoError(err)
+	assert.Len(*triggers, 0)
+
+	for i := 0; i < 3; i++ {
+		alert, err := client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: piazza.Ident("event" + strconv.Itoa(i))})
+		assert.NoError(err)
+		defer func(id piazza.Ident) {
+			err = client.DeleteAlert(id)
+			assert.NoError(err)
+		}(alert.AlertID)
+	}
+	alerts, err := client.QueryAlerts(map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{
+			"filter":   []interface{}{map[string]interface{}{"term": map[string]interface{}{"triggerId": trigger.TriggerID.String()}}},
+			"must_not": []interface{}{map[string]interface{}{"term": map[string]interface{}{"eventId": "event1"}}},
+		}},
+	})
+	assert.NoError(err)
+	assert.Len(*alerts, 2)
+
+	// the memory index percolates too
+	assert.NoError(service.SetMatchEngine(MatchEnginePercolation))
+	defer func() {
+		assert.NoError(service.SetMatchEngine(MatchEngineNative))
+	}()
+	matched, err := service.matchEngine.MatchSamples(eventType, map[string]interface{}{
+		"range": map[string]interface{}{"data.num": map[string]interface{}{"gt": 1}},
+	}, []map[string]interface{}{{"num": 1, "label": "a"}, {"num": 2, "label": "b"}})
+	assert.NoError(err)
+	assert.Equal([]bool{false, true}, matched)
+	// in a scratch index, which is gone
+	cluster := service.eventPartitions.Cluster.(*MemoryCluster)
+	cluster.lock.Lock()
+	for name := range cluster.indices {
+		assert.NotContains(name, "dryrun")
+	}
+	cluster.lock.Unlock()
+}
+
+func (suite *ServerTester) Test29EventPartitions() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+	partitions := service.eventPartitions
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	_, err := client.PostEventType(&EventType{
+		Name:      makeTestEventTypeName(),
+		Mapping:   map[string]interface{}{"num": elasticsearch.MappingElementTypeInteger},
+		Retention: &EventRetention{Period: "weekly", Keep: 2},
+	})
+	assert.Error(err)
+
+	// without partitions, as on Elasticsearch 5 and later, a retention can't
+	// be applied, so isn't taken
+	service.SetEventPartitions(nil)
+	_, err = client.PostEventType(&EventType{
+		Name:      makeTestEventTypeName(),
+		Mapping:   map[string]interface{}{"num": elasticsearch.MappingElementTypeInteger},
+		Retention: &EventRetention{Period: RetentionDaily, Keep: 2},
+	})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "400")
+		assert.Contains(err.Error(), "not supported")
+	}
+	assert.Equal(ErrRetentionUnsupported, service.SetEventRetention(ingestTypeName, &EventRetention{Period: RetentionDaily}))
+	service.SetEventPartitions(partitions)
+
+	eventTypeName := makeTestEventTypeName()
+	eventType, err := client.PostEventType(&EventType{
+		Name:      eventTypeName,
+		Mapping:   map[string]interface{}{"num": elasticsearch.MappingElementTypeInteger},
+		Retention: &EventRetention{Period: RetentionDaily, Keep: 2},
+	})
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+	assert.Equal(RetentionDaily, eventType.Retention.Period)
+
+	// an event each day, the third of which drops the first day's partition
+	ids := []piazza.Ident{}
+	for day := 1; day <= 3; day++ {
+		on := time.Date(2016, 10, day, 12, 0, 0, 0, time.UTC)
+		partitions.now = func() time.Time { return on }
+		event := &Event{
+			EventID:     service.newIdent(),
+			EventTypeID: eventType.EventTypeID,
+			Data:        service.addUniqueParams(eventTypeName, map[string]interface{}{"num": day}),
+			CreatedOn:   piazza.TimeStamp(on),
+		}
+		assert.NoError(service.eventDB.PostData(event, eventTypeName))
+		ids = append(ids, event.EventID)
+	}
+	partitions.now = time.Now
+
+	prefix := "events-" + eventType.EventTypeID.String() + "-"
+	names, err := partitions.Partitions(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Equal([]string{prefix + "2016.10.02", prefix + "2016.10.03"}, names)
+
+	events, err := client.GetAllEventsByEventType(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Len(*events, 2)
+	_, err = client.GetEvent(ids[0])
+	assert.Error(err)
+	event, err := client.GetEvent(ids[2])
+	assert.NoError(err)
+	assert.Equal(3.0, event.Data["num"])
+
+	// today's event is kept, and the older partitions dropped, as it is
+	// more than two days on
+	posted, err := client.PostEvent(&Event{EventTypeID: eventType.EventTypeID, Data: map[string]interface{}{"num": 31}})
+	assert.NoError(err)
+	names, err = partitions.Partitions(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Equal([]string{partitions.PartitionName(eventType, time.Now())}, names)
+	_, err = client.GetEvent(ids[2])
+	assert.Error(err)
+	event, err = client.GetEvent(posted.EventID)
+	assert.NoError(err)
+
+	// the triggers percolate in the base index, across the partitions
+
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 31}}
+	trigger, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteTrigger(trigger.TriggerID)
+		assert.NoError(err)
+	}()
+	matches, err := service.eventDB.PercolateEventData(eventTypeName, service.addUniqueParams(eventTypeName, map[string]interface{}{"num": 31}), posted.EventID, "test")
+	assert.NoError(err)
+	assert.Equal([]piazza.Ident{trigger.TriggerID}, *matches)
+
+	assert.NoError(client.DeleteEvent(posted.EventID))
+}
+
+func (suite *ServerTester) Test33EventLookup() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	lookups := suite.service.eventLookupDB
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventTypeName := makeTestEventTypeName()
+	eventType, err := client.PostEventType(&EventType{
+		Name:    eventTypeName,
+		Mapping: map[string]interface{}{"num": elasticsearch.MappingElementTypeInteger},
+	})
+	assert.NoError(err)
+	defer func() {
+		err = client.DeleteEventType(eventType.EventTypeID)
+		assert.NoError(err)
+	}()
+
+	event, err := client.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	name, found, err := lookups.GetName(event.EventID)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(eventTypeName, name)
+
+	// the lookup is kept in the index as well as in memory
+	lookups.lock.Lock()
+	lookups.names, lookups.order = map[piazza.Ident]string{}, nil
+	lookups.lock.Unlock()
+	name, found, err = lookups.GetName(event.EventID)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(eventTypeName, name)
+
+	// an event without a lookup is found by searching, and recorded
+	assert.NoError(lookups.DeleteByID(event.EventID))
+	_, found, err = lookups.GetName(event.EventID)
+	assert.NoError(err)
+	assert.False(found)
+	got, err := client.GetEvent(event.EventID)
+	assert.NoError(err)
+	assert.Equal(event.EventID, got.EventID)
+	_, found, err = lookups.GetName(event.EventID)
+	assert.NoError(err)
+	assert.True(found)
+
+	assert.NoError(client.DeleteEvent(event.EventID))
+	_, found, err = lookups.GetName(event.EventID)
+	assert.NoError(err)
+	assert.False(found)
+	_, err = client.GetEvent(event.EventID)
+	assert.Error(err)
+
+	// only the most recent lookups are kept in memory
+	lookups.cached = 2
+	defer func() {
+		lookups.cached = defaultEventLookupsCached
+	}()
+	for _, id := range []piazza.Ident{"lookup1", "lookup2", "lookup3"} {
+		assert.NoError(lookups.PostData(id, eventTypeName))
+		defer func(id piazza.Ident) {
+			assert.NoError(lookups.DeleteByID(id))
+		}(id)
+	}
+	lookups.lock.Lock()
+	assert.Equal([]piazza.Ident{"lookup2", "lookup3"}, lookups.order)
+	assert.Len(lookups.names, 2)
+	lookups.lock.Unlock()
+	name, found, err = lookups.GetName("lookup1")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(eventTypeName, name)
+}
+
+func (suite *ServerTester) Test34Backup() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventTypeName := makeTestEventTypeName()
+	eventType, err := client.PostEventType(makeTestEventType(eventTypeName))
+	assert.NoError(err)
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 31}}
+	trigger, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+	event, err := client.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	seed, err := client.PostEvent(makeTestCronEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	alert, err := client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: event.EventID})
+	assert.NoError(err)
+
+	// removes what was made, or restored, under the IDs
+	remove := func(eventTypeID, triggerID, eventID, cronID, alertID piazza.Ident) {
+		assert.NoError(client.DeleteAlert(alertID))
+		assert.NoError(client.DeleteTrigger(triggerID))
+		assert.NoError(client.DeleteEvent(eventID))
+		assert.NoError(client.DeleteEvent(cronID))
+		assert.NoError(client.DeleteEventType(eventTypeID))
+	}
+
+	backup, err := client.Backup(true, true)
+	assert.NoError(err)
+	assert.Equal(BackupVersion, backup.Version)
+
+	// just what this test made, and the system event types
+	archive := &Backup{Version: backup.Version, CreatedOn: backup.CreatedOn}
+	for _, et := range backup.EventTypes {
+		if et.EventTypeID == eventType.EventTypeID || IsSystemEvent(et.Name) {
+			archive.EventTypes = append(archive.EventTypes, et)
+		}
+	}
+	for _, x := range backup.Triggers {
+		if x.TriggerID == trigger.TriggerID {
+			archive.Triggers = append(archive.Triggers, x)
+		}
+	}
+	for _, x := range backup.Crons {
+		if x.EventID == seed.EventID {
+			archive.Crons = append(archive.Crons, x)
+		}
+	}
+	for _, x := range backup.Events {
+		if x.EventID == event.EventID || x.EventID == seed.EventID {
+			archive.Events = append(archive.Events, x)
+		}
+	}
+	for _, x := range backup.Alerts {
+		if x.AlertID == alert.AlertID {
+			archive.Alerts = append(archive.Alerts, x)
+		}
+	}
+	assert.Len(archive.EventTypes, 3)
+	assert.Len(archive.Triggers, 1)
+	assert.Len(archive.Crons, 1)
+	assert.Len(archive.Events, 2)
+	assert.Len(archive.Alerts, 1)
+
+	// the archive holds them as they were posted
+	for _, et := range archive.EventTypes {
+		if et.EventTypeID == eventType.EventTypeID {
+			assert.EqualValues(map[string]interface{}{"num": "integer"}, et.Mapping)
+		}
+	}
+	assert.EqualValues(map[string]interface{}{"match": map[string]interface{}{"data.num": 31.0}}, archive.Triggers[0].Condition)
+	assert.EqualValues(map[string]interface{}{"num": 17.0}, archive.Crons[0].Data)
+	assert.EqualValues(map[string]interface{}{"num": 17.0}, archive.Events[0].Data)
+
+	remove(eventType.EventTypeID, trigger.TriggerID, event.EventID, seed.EventID, alert.AlertID)
+
+	// restored under new IDs, with the references remapped
+	report, err := client.Restore(archive, false)
+	assert.NoError(err)
+	assert.Empty(report.Errors)
+	assert.Equal(1, report.EventTypes)
+	assert.Equal(1, report.Triggers)
+	assert.Equal(1, report.Crons)
+	assert.Equal(1, report.Events)
+	assert.Equal(1, report.Alerts)
+	// the system event types were already there under the same IDs
+	assert.Len(report.IDs, 5)
+	newEventTypeID := report.IDs[eventType.EventTypeID]
+	newTriggerID := report.IDs[trigger.TriggerID]
+	newEventID := report.IDs[event.EventID]
+	newCronID := report.IDs[seed.EventID]
+	newAlertID := report.IDs[alert.AlertID]
+	assert.NotEqual(eventType.EventTypeID, newEventTypeID)
+
+	gotEventType, err := client.GetEventType(newEventTypeID)
+	assert.NoError(err)
+	assert.Equal(eventTypeName, gotEventType.Name)
+	gotTrigger, err := client.GetTrigger(newTriggerID)
+	assert.NoError(err)
+	assert.Equal(newEventTypeID, gotTrigger.EventTypeID)
+	assert.EqualValues(archive.Triggers[0].Condition, gotTrigger.Condition)
+	matches, err := suite.service.eventDB.PercolateEventData(eventTypeName,
+		suite.service.addUniqueParams(eventTypeName, map[string]interface{}{"num": 31}), "", "pz-workflow")
+	assert.NoError(err)
+	assert.Contains(*matches, newTriggerID)
+	job, err := client.GetCronJob(newCronID)
+	assert.NoError(err)
+	assert.Equal(newEventTypeID, job.EventTypeID)
+	assert.EqualValues(map[string]interface{}{"num": 17.0}, job.Data)
+	gotEvent, err := client.GetEvent(newEventID)
+	assert.NoError(err)
+	assert.Equal(newEventTypeID, gotEvent.EventTypeID)
+	gotAlert, err := client.GetAlert(newAlertID)
+	assert.NoError(err)
+	assert.Equal(newTriggerID, gotAlert.TriggerID)
+	assert.Equal(newEventID, gotAlert.EventID)
+
+	remove(newEventTypeID, newTriggerID, newEventID, newCronID, newAlertID)
+
+	// restored under the same IDs
+	report, err = client.Restore(archive, true)
+	assert.NoError(err)
+	assert.Empty(report.Errors)
+	assert.Empty(report.IDs)
+	assert.Equal(1, report.Triggers)
+	gotTrigger, err = client.GetTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	assert.Equal(eventType.EventTypeID, gotTrigger.EventTypeID)
+
+	// what is already there is left alone
+	report, err = client.Restore(archive, true)
+	assert.NoError(err)
+	assert.Equal(0, report.EventTypes)
+	assert.Equal(0, report.Triggers)
+	assert.Equal(0, report.Crons)
+	assert.Len(report.Errors, 4)
+
+	remove(eventType.EventTypeID, trigger.TriggerID, event.EventID, seed.EventID, alert.AlertID)
+
+	_, err = client.Restore(&Backup{Version: BackupVersion + 1}, false)
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test35EventTypeCascade() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventTypeName := makeTestEventTypeName()
+	eventType, err := client.PostEventType(makeTestEventType(eventTypeName))
+	assert.NoError(err)
+	other, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	defer func() {
+		assert.NoError(client.DeleteEventType(other.EventTypeID))
+	}()
+
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 31}}
+	trigger, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+	// a trigger of another event type that posts events of this one
+	poster := makeTestTrigger([]piazza.Ident{other.EventTypeID})
+	poster.Action = &TriggerAction{
+		Type:  ActionTypeEvent,
+		Event: &EventAction{EventTypeID: eventType.EventTypeID, Data: map[string]interface{}{"num": "${data.num}"}},
+	}
+	poster, err = client.PostTrigger(poster)
+	assert.NoError(err)
+	event, err := client.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	seed, err := client.PostEvent(makeTestCronEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	alert, err := client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: event.EventID})
+	assert.NoError(err)
+
+	dependencies, err := client.GetEventTypeDependencies(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Equal(eventType.EventTypeID, dependencies.EventTypeID)
+	assert.Equal(2, dependencies.Triggers.Count)
+	assert.Contains(dependencies.Triggers.IDs, trigger.TriggerID)
+	assert.Contains(dependencies.Triggers.IDs, poster.TriggerID)
+	assert.Equal(2, dependencies.Events.Count)
+	assert.Empty(dependencies.Events.IDs)
+	// the events are paged by the last ID, so that there may be any number
+	first, err := suite.service.eventDB.GetEventIDsByEventTypeID(eventTypeName, eventType.EventTypeID, "", 1)
+	assert.NoError(err)
+	assert.Len(first, 1)
+	second, err := suite.service.eventDB.GetEventIDsByEventTypeID(eventTypeName, eventType.EventTypeID, first[0], 1)
+	assert.NoError(err)
+	assert.Len(second, 1)
+	assert.Contains(append(first, second...), event.EventID)
+	assert.Contains(append(first, second...), seed.EventID)
+	rest, err := suite.service.eventDB.GetEventIDsByEventTypeID(eventTypeName, eventType.EventTypeID, second[0], 1)
+	assert.NoError(err)
+	assert.Empty(rest)
+	assert.Equal([]piazza.Ident{seed.EventID}, dependencies.Crons.IDs)
+	assert.Equal([]piazza.Ident{alert.AlertID}, dependencies.Alerts.IDs)
+	assert.False(dependencies.MappingDeleted)
+
+	// without cascade it is still refused
+	assert.Error(client.DeleteEventType(eventType.EventTypeID))
+	_, err = client.GetEventTypeDependencies("nosuchtype")
+	assert.Error(err)
+
+	deleted, err := client.DeleteEventTypeCascade(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Equal(2, deleted.Triggers.Count)
+	assert.Equal(2, deleted.Events.Count)
+	assert.Equal(1, deleted.Crons.Count)
+	assert.Equal(1, deleted.Alerts.Count)
+	assert.True(deleted.MappingDeleted)
+
+	_, err = client.GetEventType(eventType.EventTypeID)
+	assert.Error(err)
+	_, err = client.GetTrigger(poster.TriggerID)
+	assert.Error(err)
+	_, err = client.GetEvent(event.EventID)
+	assert.Error(err)
+	_, err = client.GetCronJob(seed.EventID)
+	assert.Error(err)
+	_, err = client.GetAlert(alert.AlertID)
+	assert.Error(err)
+	assert.NotContains(suite.service.cronSchedules.ids(), seed.EventID)
+
+	// with the mapping gone, the name can be used again
+	again, err := client.PostEventType(makeTestEventType(eventTypeName))
+	assert.NoError(err)
+	deleted, err = client.DeleteEventTypeCascade(again.EventTypeID)
+	assert.NoError(err)
+	assert.Equal(0, deleted.Events.Count)
+
+	// the system event types stay
+	ingestID, _, err := suite.service.eventTypeDB.GetIDByName(nil, ingestTypeName, "pz-workflow")
+	assert.NoError(err)
+	_, err = client.DeleteEventTypeCascade(*ingestID)
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test36Versions() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	get := func(path string, ifNoneMatch string) (int, string) {
+		headers := piazza.NewHeaderBuilder()
+		if ifNoneMatch != "" {
+			headers.AddHeader("If-None-Match", ifNoneMatch)
+		}
+		code, _, header, err := piazza.HTTP("GET", client.url+path, headers.GetHeader(), nil)
+		assert.NoError(err)
+		return code, header.Get("ETag")
+	}
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	assert.Equal(int64(1), eventType.Version)
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 36}}
+	trigger, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+	event, err := client.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	alert, err := client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: event.EventID})
+	assert.NoError(err)
+	seed, err := client.PostEvent(makeTestCronEvent(eventType.EventTypeID))
+	assert.NoError(err)
+
+	// each is sent with its version as its ETag, and not sent again while it
+	// is unchanged
+	for _, path := range []string{
+		"/eventType/" + eventType.EventTypeID.String(),
+		"/trigger/" + trigger.TriggerID.String(),
+		"/alert/" + alert.AlertID.String(),
+		"/cron/" + seed.EventID.String(),
+	} {
+		code, etag := get(path, "")
+		assert.Equal(http.StatusOK, code, path)
+		assert.Equal(`"1"`, etag, path)
+		code, _ = get(path, etag)
+		assert.Equal(http.StatusNotModified, code, path)
+		code, _ = get(path, `"7", W/"1"`)
+		assert.Equal(http.StatusNotModified, code, path)
+		code, _ = get(path, `"2"`)
+		assert.Equal(http.StatusOK, code, path)
+	}
+
+	// the second of two updates made from the same version fails
+	got, err := client.GetTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	assert.Equal(int64(1), got.Version)
+	version := got.Version
+	got.Enabled = false
+	updated, err := client.UpdateTriggerIfMatch(trigger.TriggerID, got, version)
+	assert.NoError(err)
+	assert.Equal(int64(2), updated.Version)
+	assert.False(updated.Enabled)
+	got.Enabled = true
+	_, err = client.UpdateTriggerIfMatch(trigger.TriggerID, got, version)
+	assert.Error(err)
+	assert.Contains(err.Error(), "412")
+	got, err = client.GetTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	assert.False(got.Enabled)
+	_, etag := get("/trigger/"+trigger.TriggerID.String(), "")
+	assert.Equal(`"2"`, etag)
+
+	job, err := client.PutCronJobIfMatch(seed.EventID, &CronUpdate{CronSchedule: "0 0 * * * *"}, 1)
+	assert.NoError(err)
+	assert.Equal(int64(2), job.Version)
+	_, err = client.PutCronJobIfMatch(seed.EventID, &CronUpdate{CronSchedule: "0 0 0 * * *"}, 1)
+	assert.Error(err)
+	assert.Contains(err.Error(), "412")
+
+	// a stale or malformed If-Match deletes nothing
+	err = client.DeleteAlertIfMatch(alert.AlertID, 2)
+	assert.Contains(err.Error(), "412")
+	code, _, _, err := piazza.HTTP("DELETE", client.url+"/alert/"+alert.AlertID.String(),
+		piazza.NewHeaderBuilder().AddHeader("If-Match", "W/\"1\"").GetHeader(), nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.NoError(client.DeleteAlertIfMatch(alert.AlertID, 1))
+
+	assert.Contains(client.DeleteTriggerIfMatch(trigger.TriggerID, 1).Error(), "412")
+	assert.NoError(client.DeleteTriggerIfMatch(trigger.TriggerID, 2))
+
+	deleted, err := client.DeleteEventTypeCascade(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Equal(2, deleted.Events.Count)
+	assert.Equal(1, deleted.Crons.Count)
+
+	unused, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	assert.Contains(client.DeleteEventTypeIfMatch(unused.EventTypeID, 2).Error(), "412")
+	assert.NoError(client.DeleteEventTypeIfMatch(unused.EventTypeID, unused.Version))
+}
+
+func (suite *ServerTester) Test37Trash() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+	service := suite.service
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	inTrash := func(kind string, id piazza.Ident) *TrashItem {
+		items, err := client.GetTrash(kind, 100, 0)
+		assert.NoError(err)
+		for _, item := range *items {
+			if item.ID == id {
+				return &item
+			}
+		}
+		return nil
+	}
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	trigger := makeTestTrigger([]piazza.Ident{eventType.EventTypeID})
+	trigger.Condition = map[string]interface{}{"match": map[string]interface{}{"data.num": 37}}
+	trigger, err = client.PostTrigger(trigger)
+	assert.NoError(err)
+	alert, err := client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: service.newIdent()})
+	assert.NoError(err)
+
+	// a deleted trigger goes to the trash, and its alert still shows it
+	assert.NoError(client.DeleteTrigger(trigger.TriggerID))
+	_, err = client.GetTrigger(trigger.TriggerID)
+	assert.Error(err)
+	item := inTrash(TrashKindTrigger, trigger.TriggerID)
+	assert.NotNil(item)
+	if item != nil {
+		assert.Equal(TrashKindTrigger, item.Kind)
+		assert.Equal(trigger.Name, item.Name)
+		assert.Equal(trigger.Condition, item.Trigger.Condition)
+		assert.True(time.Time(item.PurgeOn).After(time.Now().Add(24 * time.Hour)))
+	}
+	assert.Nil(inTrash(TrashKindEventType, trigger.TriggerID))
+	alertExt, err := service.inflateAlert(*alert)
+	assert.NoError(err)
+	assert.Equal(trigger.Name, alertExt.Trigger.Name)
+
+	_, err = client.GetTrash("bogus", 10, 0)
+	assert.Error(err)
+
+	// restoring it registers its query again, under the same ID
+	restored, err := client.RestoreTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	assert.Equal(trigger.TriggerID, restored.TriggerID)
+	got, err := client.GetTrigger(trigger.TriggerID)
+	assert.NoError(err)
+	assert.Equal(trigger.Condition, got.Condition)
+	assert.Nil(inTrash("", trigger.TriggerID))
+	_, err = client.RestoreTrigger(trigger.TriggerID)
+	assert.Error(err)
+	_, err = client.RestoreEventType(trigger.TriggerID)
+	assert.Error(err)
+
+	// an eventType keeps its name while it is in the trash
+	assert.NoError(client.DeleteTrigger(trigger.TriggerID))
+	assert.NoError(client.DeleteEventType(eventType.EventTypeID))
+	assert.NotNil(inTrash(TrashKindEventType, eventType.EventTypeID))
+	_, err = client.PostEventType(makeTestEventType(eventType.Name))
+	assert.Error(err)
+	_, err = client.RestoreTrigger(trigger.TriggerID)
+	assert.Error(err)
+	restoredType, err := client.RestoreEventType(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Equal(eventType.Name, restoredType.Name)
+	assert.Equal(eventType.Mapping, restoredType.Mapping)
+	_, err = client.RestoreTrigger(trigger.TriggerID)
+	assert.NoError(err)
+
+	// past the purge period it is gone for good
+	defer func(purgeAfter time.Duration) { service.trashPurgeAfter = purgeAfter }(service.trashPurgeAfter)
+	service.trashPurgeAfter = -time.Second
+	assert.NoError(client.DeleteAlert(alert.AlertID))
+	assert.NoError(client.DeleteTrigger(trigger.TriggerID))
+	assert.NoError(client.DeleteEventType(eventType.EventTypeID))
+	// listing the trash doesn't purge it; the leader of the cron does
+	assert.NotNil(inTrash("", trigger.TriggerID))
+	purged, err := service.purgeTrash()
+	assert.NoError(err)
+	assert.Equal(2, purged)
+	assert.Nil(inTrash("", trigger.TriggerID))
+	_, err = client.RestoreTrigger(trigger.TriggerID)
+	assert.Error(err)
+	_, err = client.RestoreEventType(eventType.EventTypeID)
+	assert.Error(err)
+
+	// and the eventType's name is free again
+	reused, err := client.PostEventType(makeTestEventType(eventType.Name))
+	if assert.NoError(err) {
+		assert.NoError(client.DeleteEventType(reused.EventTypeID))
+		purged, err = service.purgeTrash()
+		assert.NoError(err)
+		assert.Equal(1, purged)
+	}
+}
+
+// servingRoute returns the route that serves a call of the path: of those
+// that match, the one with the most static segments, as the router prefers
+// a static segment to a wildcard.
+func servingRoute(routes []piazza.RouteData, verb string, path string) int {
+	segments := strings.Split(path, "/")
+	best, bestStatic := -1, -1
+	for i, route := range routes {
+		routeSegments := strings.Split(route.Path, "/")
+		if route.Verb != verb || len(routeSegments) != len(segments) {
+			continue
+		}
+		static := 0
+		for j, segment := range routeSegments {
+			if strings.HasPrefix(segment, ":") {
+				continue
+			}
+			if segment != segments[j] {
+				static = -1
+				break
+			}
+			static++
+		}
+		if static > bestStatic {
+			best, bestStatic = i, static
+		}
+	}
+	return best
+}
+
+// refs lists the $refs in a part of a document.
+func refs(node interface{}) []string {
+	found := []string{}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, value := range n {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				found = append(found, ref)
+			}
+			found = append(found, refs(value)...)
+		}
+	case []interface{}:
+		for _, value := range n {
+			found = append(found, refs(value)...)
+		}
+	}
+	return found
+}
+
+func (suite *ServerTester) Test38OpenAPI() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	resp, err := http.Get(suite.client.url + "/openapi.json")
+	assert.NoError(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&doc))
+	assert.Equal("3.0.0", doc.OpenAPI)
+	for _, name := range []string{"EventType", "Event", "Trigger", "Alert", "AlertExt", "Stats", "JsonResponse", "JsonPagination"} {
+		assert.Contains(doc.Components.Schemas, name)
+	}
+	for _, ref := range refs(map[string]interface{}{"paths": doc.Paths, "schemas": doc.Components.Schemas}) {
+		assert.Contains(doc.Components.Schemas, strings.TrimPrefix(ref, "#/components/schemas/"), "%s does not resolve", ref)
+	}
+	eventType := doc.Components.Schemas["EventType"].(map[string]interface{})
+	assert.Equal([]interface{}{"name", "mapping"}, eventType["required"])
+	getAll := doc.Paths["/eventType"]["get"]
+	assert.Contains(getAll["responses"], "200")
+	assert.Len(getAll["parameters"], 5)
+
+	// each route serves an operation of the document, and each operation is
+	// served by a route
+	server := &Server{}
+	assert.NoError(server.Init(suite.service))
+	served := map[int]bool{}
+	for path, item := range doc.Paths {
+		for verb := range item {
+			route := servingRoute(server.Routes, strings.ToUpper(verb), path)
+			if assert.NotEqual(-1, route, "no route serves %s %s", verb, path) {
+				served[route] = true
+			}
+		}
+	}
+	for i, route := range server.Routes {
+		assert.True(served[i], "route %s %s has no operation in the OpenAPI document", route.Verb, route.Path)
+	}
+
+	// and each route, and only a route, is described
+	routes := map[string]bool{}
+	for _, route := range server.Routes {
+		routes[route.Verb+" "+route.Path] = true
+		assert.Contains(openAPIRoutes, route.Verb+" "+route.Path)
+	}
+	for key := range openAPIRoutes {
+		assert.True(routes[key], "%s is described but isn't a route", key)
+	}
+	assert.Equal("/eventType/{id}/restore", openAPIPath("/eventType/:id/restore"))
+	assert.Contains(doc.Paths, "/trigger/test")
+	assert.NotContains(doc.Paths["/trigger/{id}"], "post")
+}
+
+func (suite *ServerTester) Test39PutResources() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	event, err := client.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	seed, err := client.PostEvent(makeTestCronEvent(eventType.EventTypeID))
+	assert.NoError(err)
+	alert, err := client.PostAlert(&Alert{TriggerID: "trigger", EventID: event.EventID})
+	assert.NoError(err)
+
+	// fields can be added to the mapping, but not dropped or changed
+	update := *eventType
+	update.Mapping = map[string]interface{}{
+		"num":   elasticsearch.MappingElementTypeInteger,
+		"label": elasticsearch.MappingElementTypeString,
+	}
+	updated, err := client.PutEventTypeIfMatch(&update, eventType.Version)
+	assert.NoError(err)
+	assert.Equal(int64(2), updated.Version)
+	assert.Contains(updated.Mapping, "label")
+	got, err := client.GetEventType(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Contains(got.Mapping, "label")
+	_, err = client.PutEventTypeIfMatch(&update, eventType.Version)
+	assert.Contains(err.Error(), "412")
+	updated, err = client.PutEventType(&update)
+	assert.NoError(err)
+	assert.Equal(int64(2), updated.Version)
+	update.Mapping = map[string]interface{}{"label": elasticsearch.MappingElementTypeString}
+	_, err = client.PutEventType(&update)
+	assert.Error(err)
+	update.Mapping = map[string]interface{}{
+		"num":   elasticsearch.MappingElementTypeString,
+		"label": elasticsearch.MappingElementTypeString,
+	}
+	_, err = client.PutEventType(&update)
+	assert.Error(err)
+	renamed := *got
+	renamed.Name = makeTestEventTypeName()
+	_, err = client.PutEventType(&renamed)
+	assert.Error(err)
+
+	// new events must have the added field
+	_, err = client.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.Error(err)
+	labelled := makeTestEvent(eventType.EventTypeID)
+	labelled.Data["label"] = "labelled"
+	_, err = client.PostEvent(labelled)
+	assert.NoError(err)
+
+	// an event's data is checked again as it is corrected
+	corrected := *event
+	corrected.Data = map[string]interface{}{"num": 18, "label": "corrected"}
+	putEvent, err := client.PutEvent(&corrected)
+	assert.NoError(err)
+	assert.EqualValues(18, putEvent.Data["num"])
+	gotEvent, err := client.GetEvent(event.EventID)
+	assert.NoError(err)
+	assert.EqualValues(18, gotEvent.Data["num"])
+	assert.Equal("corrected", gotEvent.Data["label"])
+	corrected.Data = map[string]interface{}{"num": 19}
+	_, err = client.PutEvent(&corrected)
+	assert.Error(err)
+	corrected.Data = map[string]interface{}{"num": 19, "label": "moved"}
+	corrected.EventTypeID = "nosuchtype"
+	_, err = client.PutEvent(&corrected)
+	assert.Error(err)
+	seed.Data = map[string]interface{}{"num": 19, "label": "seed"}
+	_, err = client.PutEvent(seed)
+	assert.Error(err)
+
+	// an alert's status and annotation can be changed, and nothing else
+	annotation := func(s string) *string { return &s }
+	putAlert, err := client.PutAlertIfMatch(&AlertUpdate{AlertID: alert.AlertID, Status: AlertStatusAcknowledged, Annotation: annotation("looking")}, alert.Version)
+	assert.NoError(err)
+	assert.Equal(int64(2), putAlert.Version)
+	assert.Equal(AlertStatusAcknowledged, putAlert.Status)
+	assert.Equal(alert.JobID, putAlert.JobID)
+	putAlert, err = client.PutAlert(&AlertUpdate{AlertID: alert.AlertID, Annotation: annotation("fixed")})
+	assert.NoError(err)
+	gotAlert, err := client.GetAlert(alert.AlertID)
+	assert.NoError(err)
+	assert.Equal(AlertStatusAcknowledged, gotAlert.Status)
+	assert.Equal("fixed", gotAlert.Annotation)
+	// an absent annotation is kept, and an empty one clears it
+	_, err = client.PutAlert(&AlertUpdate{AlertID: alert.AlertID, Status: AlertStatusResolved})
+	assert.NoError(err)
+	gotAlert, err = client.GetAlert(alert.AlertID)
+	assert.NoError(err)
+	assert.Equal("fixed", gotAlert.Annotation)
+	_, err = client.PutAlert(&AlertUpdate{AlertID: alert.AlertID, Annotation: annotation("")})
+	assert.NoError(err)
+	gotAlert, err = client.GetAlert(alert.AlertID)
+	assert.NoError(err)
+	assert.Equal("", gotAlert.Annotation)
+	assert.Equal(AlertStatusResolved, gotAlert.Status)
+	_, err = client.PutAlert(&AlertUpdate{AlertID: alert.AlertID, Status: "ignored"})
+	assert.Error(err)
+	_, err = client.PutAlertIfMatch(&AlertUpdate{AlertID: alert.AlertID, Status: AlertStatusResolved}, alert.Version)
+	assert.Contains(err.Error(), "412")
+	_, err = client.PutAlert(&AlertUpdate{AlertID: "nosuchalert", Status: AlertStatusResolved})
+	assert.Error(err)
+
+	assert.NoError(client.DeleteAlert(alert.AlertID))
+	_, err = client.DeleteEventTypeCascade(eventType.EventTypeID)
+	assert.NoError(err)
 }
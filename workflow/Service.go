@@ -25,8 +25,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/streadway/amqp"
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
 	pzsyslog "github.com/venicegeo/pz-gocommon/syslog"
@@ -43,14 +43,23 @@ const keyEvents = "events"
 const keyTriggers = "triggers"
 const keyAlerts = "alerts"
 const keyCrons = "crons"
+const keyCronRuns = "cronruns"
+const keyLeases = "leases"
+const keyDispatches = "dispatches"
+const keyEventLookups = "eventlookups"
+const keyTrash = "trash"
 const keyTestElasticsearch = "testElasticsearch"
 
 type Service struct {
-	eventTypeDB         *EventTypeDB
-	eventDB             *EventDB
-	triggerDB           *TriggerDB
-	alertDB             *AlertDB
-	cronDB              *CronDB
+	eventTypeDB         EventTypeRepository
+	eventDB             EventRepository
+	triggerDB           TriggerRepository
+	alertDB             AlertRepository
+	cronDB              CronRepository
+	cronRunDB           *CronRunDB
+	dispatchDB          *DispatchDB
+	eventLookupDB       *EventLookupDB
+	trashDB             *TrashDB
 	testElasticsearchDB *TestElasticsearchDB
 
 	stats Stats
@@ -60,7 +69,21 @@ type Service struct {
 
 	sys *piazza.SystemConfig
 
-	cron *cron.Cron
+	cron          *cron.Cron
+	cronSchedules *cronSchedules
+	cronElector   *LeaderElector
+
+	matchEngine MatchEngine
+
+	eventPartitions *EventPartitions
+
+	// trashPurgeAfter is how long deleted triggers and eventTypes are kept
+	trashPurgeAfter time.Duration
+
+	dispatcher   *Dispatcher
+	publisher    *Publisher
+	triggerPool  *TriggerPool
+	eventResults *eventResultStore
 
 	origin string
 }
@@ -81,6 +104,11 @@ func (service *Service) Init(
 	triggersIndex := (*indices)[keyTriggers]
 	alertsIndex := (*indices)[keyAlerts]
 	cronIndex := (*indices)[keyCrons]
+	cronRunsIndex := (*indices)[keyCronRuns]
+	leasesIndex := (*indices)[keyLeases]
+	dispatchesIndex := (*indices)[keyDispatches]
+	eventLookupsIndex := (*indices)[keyEventLookups]
+	trashIndex := (*indices)[keyTrash]
 	testElasticsearchIndex := (*indices)[keyTestElasticsearch]
 
 	var err error
@@ -112,13 +140,47 @@ func (service *Service) Init(
 		return err
 	}
 
+	if service.cronRunDB, err = NewCronRunDB(service, cronRunsIndex); err != nil {
+		return err
+	}
+
+	if service.dispatchDB, err = NewDispatchDB(service, dispatchesIndex); err != nil {
+		return err
+	}
+
+	if service.eventLookupDB, err = NewEventLookupDB(service, eventLookupsIndex); err != nil {
+		return err
+	}
+
+	if service.trashDB, err = NewTrashDB(service, trashIndex); err != nil {
+		return err
+	}
+	service.trashPurgeAfter = defaultTrashPurgeAfter
+
 	if service.testElasticsearchDB, err = NewTestElasticsearchDB(service, testElasticsearchIndex); err != nil {
 		return err
 	}
 
 	service.cron = cron.New()
+	service.cronSchedules = newCronSchedules(service.cron)
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	service.cronElector = service.newCronElector(NewElasticsearchLeaseStore(leasesIndex), hostname+"/"+service.newIdent().String())
 	service.origin = string(sys.Name)
 
+	if service.matchEngine, err = NewMatchEngine(service, MatchEnginePercolation); err != nil {
+		return err
+	}
+
+	service.dispatcher = NewDispatcher(service)
+	service.triggerPool = NewTriggerPool(defaultTriggerWorkers, defaultTriggerQueueDepth)
+	service.eventResults = newEventResultStore(defaultEventResultsKept)
+	service.publisher = NewPublisher(func() (string, error) {
+		return sys.GetAddress(piazza.PzRabbitMQ)
+	})
+
 	// allow the database time to settle
 	//time.Sleep(time.Second * 5)
 	pollingFn := elasticsearch.GetData(func() (bool, error) {
@@ -191,6 +253,64 @@ func (service *Service) Init(
 	return nil
 }
 
+// SetMatchEngine chooses how events are matched to triggers, either
+// MatchEnginePercolation or MatchEngineNative.
+func (service *Service) SetMatchEngine(name string) error {
+	engine, err := NewMatchEngine(service, name)
+	if err != nil {
+		return err
+	}
+	service.matchEngine = engine
+	return nil
+}
+
+// SetTriggerPool replaces the pool the triggers fired by events run on.
+func (service *Service) SetTriggerPool(workers int, queueDepth int) {
+	old := service.triggerPool
+	service.triggerPool = NewTriggerPool(workers, queueDepth)
+	if old != nil {
+		old.Stop()
+	}
+}
+
+// SetEventPartitions has the events of EventTypes with a retention kept in
+// the partitions.
+func (service *Service) SetEventPartitions(partitions *EventPartitions) {
+	service.eventPartitions = partitions
+}
+
+// checkRetention checks that the retention is valid, and that the events
+// are partitioned, so that it can be applied.
+func (service *Service) checkRetention(retention *EventRetention) error {
+	if service.eventPartitions == nil {
+		return ErrRetentionUnsupported
+	}
+	return retention.Validate()
+}
+
+// SetEventRetention changes the retention of the named EventType, which
+// takes effect as its next partition is made.
+func (service *Service) SetEventRetention(name string, retention *EventRetention) error {
+	if retention != nil {
+		if err := service.checkRetention(retention); err != nil {
+			return err
+		}
+	}
+	id, found, err := service.eventTypeDB.GetIDByName(nil, name, "pz-workflow")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("EventType %s does not exist", name)
+	}
+	eventType, _, err := service.eventTypeDB.GetOne(*id, "pz-workflow")
+	if err != nil {
+		return err
+	}
+	eventType.Retention = retention
+	return service.eventTypeDB.PutData(eventType, 0)
+}
+
 func (service *Service) newIdent() piazza.Ident {
 	return piazza.Ident(piazza.NewUuid().String())
 }
@@ -205,58 +325,22 @@ func (service *Service) handlePanic() {
 
 func (service *Service) sendToRabbitMQ(jobInstance string, jobID piazza.Ident, actor string) error {
 	service.syslogger.Audit(actor, "creatingJob", "rabbitmq", "User [%s] is sending job [%s] to rabbitmq", actor, jobID)
-	rabbitAddress, err := service.sys.GetAddress(piazza.PzRabbitMQ)
-	if err != nil {
-		service.syslogger.Audit(actor, "creatingJobFailure", "rabbitmq", "User [%s] sending job [%s] to rabbitmq failed (1)", actor, jobID)
-		return LoggedError("rabbit-related failure (1): %s", err.Error())
-	}
-	conn, err := amqp.Dial(rabbitAddress)
-	if err != nil {
-		service.syslogger.Audit(actor, "creatingJobFailure", "rabbitmq", "User [%s] sending job [%s] to rabbitmq failed (2)", actor, jobID)
-		return LoggedError("rabbit-related failure (2): %s", err.Error())
-	}
-	defer conn.Close()
-	ch, err := conn.Channel()
-	if err != nil {
-		service.syslogger.Audit(actor, "creatingJobFailure", "rabbitmq", "User [%s] sending job [%s] to rabbitmq failed (3)", actor, jobID)
-		return LoggedError("rabbit-related failure (3): %s", err.Error())
-	}
-	defer ch.Close()
-
-	ex := "Piazza"
 	topic := fmt.Sprintf("Request-Job-%s", service.sys.Space)
-	message := jobInstance
-
-	q, err := ch.QueueDeclare(
-		topic, // name
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		service.syslogger.Audit(actor, "creatingJobFailure", "rabbitmq", "User [%s] sending job [%s] to rabbitmq failed (4)", actor, jobID)
-		return LoggedError("rabbit-related failure (4): %s", err.Error())
-	}
-
-	err = ch.Publish(
-		ex,     // exchange
-		q.Name, // routing key
-		false,  // mandatory
-		false,  // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        []byte(message),
-		})
-	if err != nil {
-		service.syslogger.Audit(actor, "creatingJobFailure", "rabbitmq", "User [%s] sending job [%s] to rabbitmq failed (5)", actor, jobID)
-		return LoggedError("rabbit-related failure (5): %s", err.Error())
+	if err := service.publishToRabbitMQ("Piazza", topic, true, jobInstance, actor); err != nil {
+		service.syslogger.Audit(actor, "creatingJobFailure", "rabbitmq", "User [%s] sending job [%s] to rabbitmq failed", actor, jobID)
+		return err
 	}
-
 	return nil
 }
 
+// publishToRabbitMQ sends a message to an exchange, and returns once the
+// broker has acked it. If declareQueue is set, a durable queue named by the
+// routing key is declared first.
+func (service *Service) publishToRabbitMQ(exchange string, routingKey string, declareQueue bool, message string, actor string) error {
+	service.syslogger.Audit(actor, "publishingMessage", "rabbitmq", "User [%s] is publishing to rabbitmq exchange [%s] with key [%s]", actor, exchange, routingKey)
+	return service.publisher.Publish(exchange, routingKey, declareQueue, message)
+}
+
 //---------------------------------------------------------------------
 
 func (service *Service) statusOK(obj interface{}) *piazza.JsonResponse {
@@ -285,6 +369,14 @@ func (service *Service) statusCreated(obj interface{}) *piazza.JsonResponse {
 	return resp
 }
 
+func (service *Service) statusAccepted(obj interface{}) *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{StatusCode: http.StatusAccepted, Data: obj}
+	if err := resp.SetType(); err != nil {
+		return service.statusInternalError(err)
+	}
+	return resp
+}
+
 func (service *Service) statusBadRequest(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusBadRequest,
@@ -317,8 +409,41 @@ func (service *Service) statusNotFound(err error) *piazza.JsonResponse {
 	}
 }
 
+// statusPreconditionFailed is returned when a conditional request finds the
+// resource has changed since the version it gave
+func (service *Service) statusPreconditionFailed(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusPreconditionFailed,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+func (service *Service) statusTooManyRequests(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+func (service *Service) statusServiceUnavailable(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
 //------------------------------------------------------------------------------
 
+// updateStats changes the stats while holding the service lock.
+func (service *Service) updateStats(update func(stats *Stats)) {
+	service.Lock()
+	defer service.Unlock()
+	update(&service.stats)
+}
+
 // GetStats TODO
 func (service *Service) GetStats() *piazza.JsonResponse {
 	defer service.handlePanic()
@@ -330,6 +455,76 @@ func (service *Service) GetStats() *piazza.JsonResponse {
 
 //------------------------------------------------------------------------------
 
+// GetAllDispatches lists the jobs in the outbox; the status parameter picks
+// out the pending, sent or dead-lettered ones.
+func (service *Service) GetAllDispatches(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	status, err := params.GetAsString("status", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	switch status {
+	case "", DispatchPending, DispatchSent, DispatchDead:
+	default:
+		return service.statusBadRequest(fmt.Errorf("Unknown dispatch status: %s", status))
+	}
+
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingAllDispatches", service.dispatchDB.mapping, "Service.GetAllDispatches: User is getting all dispatches")
+	dispatches, totalHits, err := service.dispatchDB.GetAll(format, status, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingAllDispatchesFailure", service.dispatchDB.mapping, "Service.GetAllDispatches: User failed to get all dispatches")
+		return service.statusInternalError(err)
+	}
+	service.syslogger.Audit("pz-workflow", "gotAllDispatches", service.dispatchDB.mapping, "Service.GetAllDispatches: User successfully got all dispatches")
+
+	resp := service.statusOK(dispatches)
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
+
+// GetDispatch TODO
+func (service *Service) GetDispatch(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	dispatch, found, err := service.dispatchDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	return service.statusOK(dispatch)
+}
+
+// ReplayDispatch tries a dead-lettered job again, with a fresh count of
+// attempts. If this attempt fails too, the retry loop carries on with it.
+func (service *Service) ReplayDispatch(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	dispatch, found, err := service.dispatchDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "replayingDispatch", id, "Service.ReplayDispatch: User is replaying dispatch [%s] of job [%s]", id, dispatch.JobID)
+	if err = service.dispatcher.Replay(dispatch); err != nil {
+		service.syslogger.Audit("pz-workflow", "replayingDispatchFailure", id, "Service.ReplayDispatch: User failed to replay dispatch [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	service.syslogger.Audit("pz-workflow", "replayedDispatch", id, "Service.ReplayDispatch: User replayed dispatch [%s], which is now %s", id, dispatch.Status)
+
+	return service.statusOK(dispatch)
+}
+
+//------------------------------------------------------------------------------
+
 // GetEventType TODO
 func (service *Service) GetEventType(id piazza.Ident, actor string) *piazza.JsonResponse {
 	defer service.handlePanic()
@@ -364,7 +559,7 @@ func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "gettingAllEventTypes", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User is getting all eventTypes")
+	service.syslogger.Audit("pz-workflow", "gettingAllEventTypes", service.eventTypeDB.Mapping(), "Service.GetAllEventTypes: User is getting all eventTypes")
 
 	if nameParam != "" {
 		nameParamValue := nameParam
@@ -375,12 +570,12 @@ func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza
 		var eventtype *EventType
 		if foundName && eventtypeid != nil {
 			if err != nil {
-				service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+				service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.Mapping(), "Service.GetAllEventTypes: User failed to get all eventTypes")
 				return service.statusBadRequest(err)
 			}
 			eventtype, foundType, err = service.eventTypeDB.GetOne(*eventtypeid, "pz-workflow")
 			if err != nil {
-				service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+				service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.Mapping(), "Service.GetAllEventTypes: User failed to get all eventTypes")
 				return service.statusInternalError(err)
 			}
 		}
@@ -392,12 +587,12 @@ func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza
 	} else {
 		eventtypes, totalHits, err = service.eventTypeDB.GetAll(format, "pz-workflow")
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+			service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.Mapping(), "Service.GetAllEventTypes: User failed to get all eventTypes")
 			return service.statusInternalError(err)
 		}
 	}
 	if eventtypes == nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User failed to get all eventTypes")
+		service.syslogger.Audit("pz-workflow", "gettingAllEventTypesFailure", service.eventTypeDB.Mapping(), "Service.GetAllEventTypes: User failed to get all eventTypes")
 		return service.statusInternalError(errors.New("getalleventtypes returned nil"))
 	}
 	for i := 0; i < len(eventtypes); i++ {
@@ -405,7 +600,7 @@ func (service *Service) GetAllEventTypes(params *piazza.HttpQueryParams) *piazza
 	}
 	resp := service.statusOK(eventtypes)
 
-	service.syslogger.Audit("pz-workflow", "gotAllEventTypes", service.eventTypeDB.mapping, "Service.GetAllEventTypes: User successfully got all eventTypes")
+	service.syslogger.Audit("pz-workflow", "gotAllEventTypes", service.eventTypeDB.Mapping(), "Service.GetAllEventTypes: User successfully got all eventTypes")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -426,15 +621,15 @@ func (service *Service) QueryEventTypes(dslString string, params *piazza.HttpQue
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queryingEventTypes", service.eventTypeDB.mapping, "Service.QueryEventTypes: User is querying eventTypes")
+	service.syslogger.Audit("pz-workflow", "queryingEventTypes", service.eventTypeDB.Mapping(), "Service.QueryEventTypes: User is querying eventTypes")
 
 	eventtypes, totalHits, err = service.eventTypeDB.GetEventTypesByDslQuery(dslString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingEventTypesFailure", service.eventTypeDB.mapping, "Service.QueryEventTypes: User failed to query eventTypes")
+		service.syslogger.Audit("pz-workflow", "queryingEventTypesFailure", service.eventTypeDB.Mapping(), "Service.QueryEventTypes: User failed to query eventTypes")
 		return service.statusBadRequest(err)
 	}
 	if eventtypes == nil {
-		service.syslogger.Audit("pz-workflow", "queryingEventTypesFailure", service.eventTypeDB.mapping, "Service.QueryEventTypes: User failed to query eventTypes")
+		service.syslogger.Audit("pz-workflow", "queryingEventTypesFailure", service.eventTypeDB.Mapping(), "Service.QueryEventTypes: User failed to query eventTypes")
 		return service.statusInternalError(errors.New("queryeventtypes returned nil"))
 	}
 	for i := 0; i < len(eventtypes); i++ {
@@ -442,7 +637,7 @@ func (service *Service) QueryEventTypes(dslString string, params *piazza.HttpQue
 	}
 	resp := service.statusOK(eventtypes)
 
-	service.syslogger.Audit("pz-workflow", "queriedEventTypes", service.eventTypeDB.mapping, "Service.QueryEventTypes: User successfully queried eventTypes")
+	service.syslogger.Audit("pz-workflow", "queriedEventTypes", service.eventTypeDB.Mapping(), "Service.QueryEventTypes: User successfully queried eventTypes")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -461,6 +656,15 @@ func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse
 	if found {
 		return service.statusBadRequest(LoggedError("EventType Name already exists"))
 	}
+	eventType.EventTypeID = service.newIdent()
+	eventType.CreatedOn = piazza.NewTimeStamp()
+	return service.createEventType(eventType)
+}
+
+// createEventType checks and stores an EventType that has been given its ID,
+// and adds its mapping to the EventDB. The mapping may already be there, as
+// the mappings of deleted EventTypes are kept.
+func (service *Service) createEventType(eventType *EventType) *piazza.JsonResponse {
 	id1, found, err := service.eventTypeDB.GetIDByName(nil, eventType.Name, eventType.CreatedBy)
 	if err != nil {
 		return service.statusInternalError(err)
@@ -470,8 +674,11 @@ func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse
 			LoggedError("EventType Name already exists under EventTypeId %s", id1))
 	}
 
-	eventType.EventTypeID = service.newIdent()
-	eventType.CreatedOn = piazza.NewTimeStamp()
+	if eventType.Retention != nil {
+		if err = service.checkRetention(eventType.Retention); err != nil {
+			return service.statusBadRequest(LoggedError("EventTypeDB.PostData failed: %s", err))
+		}
+	}
 
 	vars, err := piazza.GetVarsFromStruct(eventType.Mapping)
 	if err != nil {
@@ -499,17 +706,115 @@ func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse
 
 	if err = service.eventDB.AddMapping(eventType.Name, eventType.Mapping, eventType.CreatedBy); err != nil {
 		service.syslogger.Audit(eventType.CreatedBy, "creatingEventTypeFailure", eventType.EventTypeID, "Service.PostEventType: User [%s] failed to create eventType [%s]", eventType.CreatedBy, eventType.EventTypeID)
-		_, _ = service.eventTypeDB.DeleteByID(eventType.EventTypeID, eventType.CreatedBy)
+		_, _ = service.eventTypeDB.DeleteByID(eventType.EventTypeID, 0, eventType.CreatedBy)
 		return service.statusInternalError(err)
 	}
 
 	service.syslogger.Audit(eventType.CreatedBy, "createdEventType", eventType.EventTypeID, "Service.PostEventType: User [%s] successfully created eventType [%s]", eventType.CreatedBy, eventType.EventTypeID)
 
-	service.stats.IncrEventTypes()
+	service.updateStats((*Stats).IncrEventTypes)
 
+	response.Version = eventType.Version
 	return service.statusCreated(&response)
 }
 
+// PutEventType adds fields to the mapping of an EventType. The fields it has
+// can't be dropped or changed, as its events have them; its other fields are
+// kept as they are. If the version is not 0, it is changed only if it is
+// still at that version; either way it is written at the version it was read
+// at, so a change made meanwhile is refused rather than overwritten.
+func (service *Service) PutEventType(eventType *EventType, version int64) *piazza.JsonResponse {
+	defer service.handlePanic()
+	id := eventType.EventTypeID
+	current, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if version != 0 && version != current.Version {
+		return service.statusPreconditionFailed(ErrVersionConflict)
+	}
+	if eventType.Name != current.Name {
+		return service.statusBadRequest(LoggedError("Service.PutEventType failed: eventType %s can't be renamed", id))
+	}
+
+	vars, err := piazza.GetVarsFromStruct(eventType.Mapping)
+	if err != nil {
+		return service.statusBadRequest(LoggedError("Service.PutEventType failed: %s", err))
+	}
+	for k, v := range vars {
+		if strings.Contains(k, "~") {
+			return service.statusBadRequest(LoggedError("Service.PutEventType failed: Variable names cannot contain '%s~': [%s]", eventType.Name, k))
+		}
+		if !elasticsearch.IsValidMappingType(v) {
+			return service.statusBadRequest(LoggedError("Service.PutEventType failed: %v was not recognized as a valid mapping type", v))
+		}
+	}
+	mapping := service.removeUniqueParams(current.Name, current.Mapping)
+	added, err := mappingAdditions(mapping, eventType.Mapping, "")
+	if err != nil {
+		return service.statusBadRequest(LoggedError("Service.PutEventType failed: %s", err))
+	}
+	if added == 0 {
+		current.Mapping = mapping
+		return service.statusOK(current)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatingEventType", id, "Service.PutEventType: User is adding %d fields to eventType [%s]", added, id)
+
+	// the events index is given the fields first, as a field there that the
+	// EventType doesn't have does no harm
+	current.Mapping = service.addUniqueParams(current.Name, eventType.Mapping)
+	if err = service.eventDB.AddMapping(current.Name, current.Mapping, "pz-workflow"); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingEventTypeFailure", id, "Service.PutEventType: User failed to update eventType [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	if err = service.eventTypeDB.PutData(current, current.Version); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingEventTypeFailure", id, "Service.PutEventType: User failed to update eventType [%s]", id)
+		if err == ErrVersionConflict {
+			return service.statusPreconditionFailed(err)
+		}
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatedEventType", id, "Service.PutEventType: User successfully updated eventType [%s]", id)
+
+	current.Mapping = eventType.Mapping
+	return service.statusOK(current)
+}
+
+// mappingAdditions returns how many fields the proposed mapping adds to the
+// current one; it may not drop or change any of them.
+func mappingAdditions(current map[string]interface{}, proposed map[string]interface{}, path string) (int, error) {
+	added := 0
+	for name, was := range current {
+		is, ok := proposed[name]
+		if !ok {
+			return 0, fmt.Errorf("the mapping may not drop %s%s", path, name)
+		}
+		wasFields, wasObject := was.(map[string]interface{})
+		isFields, isObject := is.(map[string]interface{})
+		switch {
+		case wasObject && isObject:
+			n, err := mappingAdditions(wasFields, isFields, path+name+".")
+			if err != nil {
+				return 0, err
+			}
+			added += n
+		case wasObject || isObject || fmt.Sprint(was) != fmt.Sprint(is):
+			return 0, fmt.Errorf("the mapping may not change %s%s", path, name)
+		}
+	}
+	for name := range proposed {
+		if _, ok := current[name]; !ok {
+			added++
+		}
+	}
+	return added, nil
+}
+
 // IsSystemEvent returns true if the event was generated within Piazza.
 //
 // TODO: Instead, check if createdBy=system
@@ -517,8 +822,11 @@ func IsSystemEvent(name string) bool {
 	return name == ingestTypeName || name == executeTypeName
 }
 
-// DeleteEventType TODO
-func (service *Service) DeleteEventType(id piazza.Ident) *piazza.JsonResponse {
+// DeleteEventType moves an EventType that is not in use to the trash. Its
+// mapping is kept in the EventDB, so the name can't be used again until it is
+// restored, or purged from an index that can drop the mapping. If the version
+// is not 0, it is deleted only if it is still at that version.
+func (service *Service) DeleteEventType(id piazza.Ident, version int64) *piazza.JsonResponse {
 	defer service.handlePanic()
 	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
 	if !found {
@@ -534,6 +842,9 @@ func (service *Service) DeleteEventType(id piazza.Ident) *piazza.JsonResponse {
 		if eventType != nil && IsSystemEvent(eventType.Name) {
 			return service.statusBadRequest(errors.New("Deleting system eventTypes is prohibited"))
 		}
+		if version != 0 && version != eventType.Version {
+			return service.statusPreconditionFailed(ErrVersionConflict)
+		}
 
 		var triggers []Trigger
 		var hits int64
@@ -555,7 +866,23 @@ func (service *Service) DeleteEventType(id piazza.Ident) *piazza.JsonResponse {
 
 	service.syslogger.Audit("pz-workflow", "deletingEventType", id, "Service.DeleteEventType: User is deleting eventType [%s]", id)
 
-	ok, err := service.eventTypeDB.DeleteByID(id, "pz-workflow")
+	item := service.newTrashItem(id, TrashKindEventType, eventType.Name)
+	trashed := *eventType
+	trashed.Mapping = service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	item.EventType = &trashed
+	if err = service.trashDB.PostData(item); err != nil {
+		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
+		return service.statusInternalError(err)
+	}
+
+	ok, err := service.eventTypeDB.DeleteByID(id, version, "pz-workflow")
+	if err != nil || !ok {
+		_, _ = service.trashDB.DeleteByID(id, "pz-workflow")
+	}
+	if err == ErrVersionConflict {
+		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
+		return service.statusPreconditionFailed(err)
+	}
 	if !ok {
 		service.syslogger.Audit("pz-workflow", "deletingEventTypeFailure", id, "Service.DeleteEventType: User failed to delete eventType [%s]", id)
 		return service.statusNotFound(err)
@@ -638,24 +965,24 @@ func (service *Service) GetAllEvents(params *piazza.HttpQueryParams) *piazza.Jso
 		query = ""
 	}
 
-	service.syslogger.Audit("pz-workflow", "gettingAllEvents", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User is getting all events")
+	service.syslogger.Audit("pz-workflow", "gettingAllEvents", service.eventDB.IndexName(), "Service.GetAllEvents: User is getting all events")
 
 	events, totalHits, err := service.eventDB.GetAll(query, format, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User failed to get all events")
+		service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.IndexName(), "Service.GetAllEvents: User failed to get all events")
 		return service.statusInternalError(err)
 	}
 	for i := 0; i < len(events); i++ {
 		eventType, found, err := service.eventTypeDB.GetOne(events[i].EventTypeID, "pz-workflow")
 		if !found || err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User failed to get all events")
+			service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.IndexName(), "Service.GetAllEvents: User failed to get all events")
 			return service.statusInternalError(err)
 		}
 		events[i].Data = service.removeUniqueParams(eventType.Name, events[i].Data)
 	}
 	resp := service.statusOK(events)
 
-	service.syslogger.Audit("pz-workflow", "gotAllEvents", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User successfully got all events")
+	service.syslogger.Audit("pz-workflow", "gotAllEvents", service.eventDB.IndexName(), "Service.GetAllEvents: User successfully got all events")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -679,7 +1006,10 @@ func (service *Service) PostRepeatingEvent(event *Event) *piazza.JsonResponse {
 	}
 
 	//log.Println("Posted Repeating Event")
-	if _, err = cron.Parse(event.CronSchedule); err != nil {
+	if err = validateCronJob(&CronJob{Event: *event}, time.Now()); err != nil {
+		return service.statusBadRequest(err)
+	}
+	if err = validateCronTemplate(event.Data); err != nil {
 		return service.statusBadRequest(err)
 	}
 
@@ -688,172 +1018,519 @@ func (service *Service) PostRepeatingEvent(event *Event) *piazza.JsonResponse {
 
 	response := *event
 
-	event.Data = service.addUniqueParams(eventType.Name, event.Data)
-
-	service.syslogger.Audit(event.CreatedBy, "creatingCronEvent", event.EventID, "Service.PostRepeatingEvent: User [%s] is creating cron event [%s]", event.CreatedBy, event.EventID)
-
-	if err = service.cron.AddJob(event.CronSchedule, cronEvent{event, eventType.Name, service}); err != nil {
-		service.syslogger.Audit(event.CreatedBy, "creatingCronEventFailure", event.EventID, "Service.PostRepeatingEvent: User [%s] failed to create cron event [%s]", event.CreatedBy, event.EventID)
-		return service.statusInternalError(err)
+	job := &CronJob{Event: *event}
+	job.Data = service.addUniqueParams(eventType.Name, event.Data)
+	// the seed event keeps its data with the placeholders filled in, so that
+	// it matches the EventType mapping; the CronDB keeps the placeholders
+	seedData, err := service.renderCronSeedData(job, eventType.Name)
+	if err != nil {
+		return service.statusBadRequest(err)
 	}
+	event.Data = seedData
 
-	if err = service.cronDB.PostData(event); err != nil {
-		service.syslogger.Audit(event.CreatedBy, "creatingCronEventFailure", event.EventID, "Service.PostRepeatingEvent: User [%s] failed to create cron event [%s]", event.CreatedBy, event.EventID)
-		return service.statusInternalError(err)
-	}
+	service.syslogger.Audit(event.CreatedBy, "creatingCronEvent", event.EventID, "Service.PostRepeatingEvent: User [%s] is creating cron event [%s]", event.CreatedBy, event.EventID)
 
-	if err = service.eventDB.PostData(event, eventType.Name); err != nil {
+	if err = service.storeCronJob(job, event, eventType.Name); err != nil {
 		service.syslogger.Audit(event.CreatedBy, "creatingCronEventFailure", event.EventID, "Service.PostRepeatingEvent: User [%s] failed to create cron event [%s]", event.CreatedBy, event.EventID)
-		// If we fail, need to also remove from cronDB
-		// We don't check for errors here because if we've reached this point,
-		// the eventID will be in the cronDB
-		_, _ = service.cronDB.DeleteByID(event.EventID, event.CreatedBy)
-		service.cron.Remove(event.EventID.String())
 		return service.statusInternalError(err)
 	}
 
 	service.syslogger.Audit(event.CreatedBy, "createdCronEvent", event.EventID, "Service.PostRepeatingEvent: User [%s] successfully created cron event [%s] on schedule [%s]", event.CreatedBy, event.EventID, event.CronSchedule)
 
-	service.stats.IncrEvents()
+	service.updateStats((*Stats).IncrEvents)
 
 	return service.statusCreated(&response)
 }
 
-// PostEvent TODO
-func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
-	defer service.handlePanic()
-	eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, event.CreatedBy)
-	if err != nil || !found {
-		return service.statusBadRequest(err)
+// storeCronJob schedules the job, unless it is paused, and stores it and its
+// seed event, undoing what it did if either can't be stored.
+func (service *Service) storeCronJob(job *CronJob, seed *Event, eventTypeName string) error {
+	if !job.Paused {
+		if err := service.cronSchedules.add(job, eventTypeName, service); err != nil {
+			return err
+		}
 	}
 
-	event.EventID = service.newIdent()
-	event.CreatedOn = piazza.NewTimeStamp()
-
-	response := *event
-
-	event.Data = service.addUniqueParams(eventType.Name, event.Data)
-
-	service.syslogger.Audit(event.CreatedBy, "creatingEvent", event.EventID, "Service.PostEvent: User [%s] is creating event [%s]", event.CreatedBy, event.EventID)
-
-	if err = service.eventDB.PostData(event, eventType.Name); err != nil {
-		service.syslogger.Audit(event.CreatedBy, "creatingEventFailure", event.EventID, "Service.PostEvent: User [%s] failed to create event [%s]", event.CreatedBy, event.EventID)
-		return service.statusBadRequest(err)
+	if err := service.cronDB.PostData(job); err != nil {
+		service.cronSchedules.remove(job.EventID)
+		return err
 	}
 
-	service.syslogger.Audit(event.CreatedBy, "createdEvent", event.EventID, "Service.PostEvent: User [%s] successfully created event [%s]", event.CreatedBy, event.EventID)
-
-	{
-		// Find triggers associated with event
-		triggerIDs, err1 := service.eventDB.PercolateEventData(eventType.Name, event.Data, event.EventID, event.CreatedBy)
-		if err1 != nil {
-			return service.statusBadRequest(err1)
-		}
-
-		// For each trigger,  apply the event data and submit job
-		var waitGroup sync.WaitGroup
-
-		results := make(map[piazza.Ident]*piazza.JsonResponse)
-
-		for _, triggerID := range *triggerIDs {
-			waitGroup.Add(1)
-			go func(triggerID piazza.Ident) {
-				defer waitGroup.Done()
-
-				trigger, found, err2 := service.triggerDB.GetOne(triggerID, event.CreatedBy)
-				if err2 != nil {
-					results[triggerID] = service.statusBadRequest(err2)
-					return
-				}
-				if !found {
-					// Don't fail for this, just log something and continue to the next trigger id
-					service.syslogger.Warning("Percolation error: Trigger %s does not exist", string(triggerID))
-					return
-				}
-				if !trigger.Enabled {
-					//results[triggerID] = statusOK(triggerID)
-					return
-				}
-
-				// Not the best way to do this, but should disallow Triggers from firing if they
-				// don't have the same Eventtype as the Event
-				// Would rather have this done via the percolation itself ...
-				if eventType.EventTypeID != trigger.EventTypeID {
-					return
-				}
-
-				// jobID gets sent through Kafka as the key
-				job := trigger.Job
-				jobID := service.newIdent()
-
-				jobInstance, err4 := json.Marshal(job)
-				if err4 != nil {
-					results[triggerID] = service.statusInternalError(err4)
-					return
-				}
-				jobString := string(jobInstance)
-
-				idamURL, err5 := service.sys.GetURL(piazza.PzIdam)
-				service.syslogger.Info("Requesting pz-idam url: %s", idamURL)
-				if err5 == nil { //Mocking
-					service.syslogger.Audit("pz-workflow", "createJobRequestAccess", "pz-idam", "User [%s] POSTed event [%s] requesting access to trigger [%s] created by [%s]", event.CreatedBy, event.EventID, trigger.TriggerID, trigger.CreatedBy)
-					auth, err6 := piazza.RequestAuthZAccess(idamURL, eventType.CreatedBy)
-					service.syslogger.Info("Pz-idam authoriazation for user [%s]: %t", eventType.CreatedBy, auth)
-					if err6 != nil {
-						results[triggerID] = service.statusInternalError(err6)
-						service.syslogger.Audit("pz-workflow", "createJobRequestAccessFailure", "pz-idam", "Event [%s] firing trigger [%s] could not get access to create job", event.EventID, trigger.TriggerID)
-						return
-					} else if !auth {
-						results[triggerID] = service.statusForbidden(errors.New("Access to create job denied"))
-						service.syslogger.Audit("pz-workflow", "createJobRequestAccessDenied", "pz-idam", "Event [%s] firing trigger [%s] was denied access to create job", event.EventID, trigger.TriggerID)
-						return
-					}
-				}
-
-				service.syslogger.Audit("pz-workflow", "createJobRequestAccessGranted", "pz-idam", "Event [%s] firing trigger [%s] was granted access to create job", event.EventID, trigger.TriggerID)
-				service.syslogger.Info("job [%s] submission by event [%s] using trigger [%s]: %s\n", jobID, event.EventID, triggerID, jobString)
-
-				// Not very robust,  need to find a better way
-				for key, value := range event.Data[eventType.Name].(map[string]interface{}) {
-					jobString = strings.Replace(jobString, "$"+key, fmt.Sprintf("%v", value), -1)
-				}
-
-				//log.Printf("JOB ID: %s", jobID)
-				//log.Printf("JOB STRING: %s", jobString)
-
-				err7 := service.sendToRabbitMQ(jobString, jobID, trigger.CreatedBy)
-				if err7 != nil {
-					results[triggerID] = service.statusInternalError(err7)
-					return
-				}
-
-				service.stats.IncrTriggerJobs()
-
-				alert := Alert{EventID: event.EventID, TriggerID: triggerID, JobID: jobID, CreatedBy: trigger.CreatedBy}
-				if resp := service.PostAlert(&alert); resp.IsError() {
-					// resp will be a statusInternalError or statusBadRequest
-					results[triggerID] = resp
-					return
-				}
-
-			}(triggerID)
-		}
-
-		waitGroup.Wait()
+	if err := service.eventDB.PostData(seed, eventTypeName); err != nil {
+		// If we fail, need to also remove from cronDB
+		// We don't check for errors here because if we've reached this point,
+		// the eventID will be in the cronDB
+		_, _ = service.cronDB.DeleteByID(job.EventID, job.CreatedBy)
+		service.cronSchedules.remove(job.EventID)
+		return err
+	}
+	return nil
+}
 
-		for _, v := range results {
-			if v != nil {
-				return v
-			}
-		}
+// renderCronSeedData returns the job's data, with its placeholders filled in
+// as of now, as the seed event is kept in the EventDB.
+func (service *Service) renderCronSeedData(job *CronJob, eventTypeName string) (map[string]interface{}, error) {
+	now := time.Now()
+	data, err := renderCronData(service.removeUniqueParams(eventTypeName, job.Data), newCronTemplateRun(job, now, now))
+	if err != nil {
+		return nil, err
 	}
+	return service.addUniqueParams(eventTypeName, data), nil
+}
 
-	service.stats.IncrEvents()
+// cronJobInfo adds to the job when it will next fire and how many more times
+// it may, and takes the EventType name off its data
+func (service *Service) cronJobInfo(job *CronJob, eventTypeName string) *CronJobInfo {
+	info := &CronJobInfo{CronJob: *job, NextRun: service.cronSchedules.next(job.EventID), RemainingRuns: job.remainingRuns()}
+	info.Data = service.removeUniqueParams(eventTypeName, job.Data)
+	return info
+}
 
-	return service.statusCreated(&response)
+func (service *Service) getCronJob(id piazza.Ident) (*CronJob, *EventType, *piazza.JsonResponse) {
+	job, found, err := service.cronDB.GetOne(id, "pz-workflow")
+	if !found {
+		return nil, nil, service.statusNotFound(err)
+	}
+	if err != nil {
+		return nil, nil, service.statusBadRequest(err)
+	}
+	eventType, found, err := service.eventTypeDB.GetOne(job.EventTypeID, "pz-workflow")
+	if !found || err != nil {
+		return nil, nil, service.statusInternalError(fmt.Errorf("Unable to retrieve event type %s of cron event %s: %v", job.EventTypeID, id, err))
+	}
+	return job, eventType, nil
 }
 
-func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+// GetAllCronJobs lists the repeating events, with the time each will next fire.
+func (service *Service) GetAllCronJobs(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingAllCronJobs", service.cronDB.Mapping(), "Service.GetAllCronJobs: User is getting all cron events")
+	jobs, totalHits, err := service.cronDB.GetAll(format, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingAllCronJobsFailure", service.cronDB.Mapping(), "Service.GetAllCronJobs: User failed to get all cron events")
+		return service.statusInternalError(err)
+	}
+
+	infos := []CronJobInfo{}
+	names := map[piazza.Ident]string{}
+	for i := range jobs {
+		name, ok := names[jobs[i].EventTypeID]
+		if !ok {
+			eventType, found, err := service.eventTypeDB.GetOne(jobs[i].EventTypeID, "pz-workflow")
+			if !found || err != nil {
+				service.syslogger.Audit("pz-workflow", "gettingAllCronJobsFailure", service.cronDB.Mapping(), "Service.GetAllCronJobs: User failed to get all cron events")
+				return service.statusInternalError(fmt.Errorf("Unable to retrieve event type %s of cron event %s: %v", jobs[i].EventTypeID, jobs[i].EventID, err))
+			}
+			name = eventType.Name
+			names[jobs[i].EventTypeID] = name
+		}
+		infos = append(infos, *service.cronJobInfo(&jobs[i], name))
+	}
+	service.syslogger.Audit("pz-workflow", "gotAllCronJobs", service.cronDB.Mapping(), "Service.GetAllCronJobs: User successfully got all cron events")
+
+	resp := service.statusOK(infos)
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
+
+// GetCronJob returns one repeating event, with the time it will next fire.
+func (service *Service) GetCronJob(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	job, eventType, resp := service.getCronJob(id)
+	if resp != nil {
+		return resp
+	}
+	return service.statusOK(service.cronJobInfo(job, eventType.Name))
+}
+
+// PutCronJob changes the schedule or the seed data of a repeating event. The
+// seed event is updated too, and a scheduled event is rescheduled at once. If
+// the version is not 0, it is changed only if it is still at that version.
+// It is written at the version it was read at, so that a run recorded, or a
+// pause made, meanwhile is refused rather than overwritten.
+func (service *Service) PutCronJob(id piazza.Ident, update *CronUpdate, version int64) *piazza.JsonResponse {
+	defer service.handlePanic()
+	job, eventType, resp := service.getCronJob(id)
+	if resp != nil {
+		return resp
+	}
+	if version != 0 && version != job.Version {
+		return service.statusPreconditionFailed(ErrVersionConflict)
+	}
+	previous := *job
+
+	rescheduled := false
+	if update.CronSchedule != "" && update.CronSchedule != job.CronSchedule {
+		job.CronSchedule = update.CronSchedule
+		rescheduled = true
+	}
+	if update.TimeZone != "" && update.TimeZone != job.TimeZone {
+		job.TimeZone = update.TimeZone
+		rescheduled = true
+	}
+	if rescheduled {
+		// runs due on the new schedule before now weren't missed
+		now := piazza.NewTimeStamp()
+		job.LastRun = &now
+	}
+	if update.StartTime != nil {
+		job.StartTime = update.StartTime
+	}
+	if update.EndTime != nil {
+		job.EndTime = update.EndTime
+	}
+	if update.MaxRuns != 0 {
+		job.MaxRuns = update.MaxRuns
+	}
+	if update.MissedRunPolicy != "" {
+		job.MissedRunPolicy = update.MissedRunPolicy
+	}
+	if err := validateCronJob(job, time.Now()); err != nil {
+		return service.statusBadRequest(err)
+	}
+	if update.Data != nil {
+		if err := validateCronTemplate(update.Data); err != nil {
+			return service.statusBadRequest(err)
+		}
+		job.Data = service.addUniqueParams(eventType.Name, update.Data)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatingCronEvent", id, "Service.PutCronJob: User is updating cron event [%s]", id)
+	event := job.Event
+	seedData, err := service.renderCronSeedData(job, eventType.Name)
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingCronEventFailure", id, "Service.PutCronJob: User failed to update cron event [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	event.Data = seedData
+	if err := service.cronDB.PutData(job, job.Version); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingCronEventFailure", id, "Service.PutCronJob: User failed to update cron event [%s]", id)
+		if err == ErrVersionConflict {
+			return service.statusPreconditionFailed(err)
+		}
+		return service.statusInternalError(err)
+	}
+	if err := service.eventDB.PutData(&event, eventType.Name); err != nil {
+		// the job is put back as it was, so that it still matches its seed
+		_ = service.cronDB.PutData(&previous, job.Version)
+		service.syslogger.Audit("pz-workflow", "updatingCronEventFailure", id, "Service.PutCronJob: User failed to update cron event [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	if !job.Paused {
+		if err := service.cronSchedules.add(job, eventType.Name, service); err != nil {
+			service.syslogger.Audit("pz-workflow", "updatingCronEventFailure", id, "Service.PutCronJob: User failed to update cron event [%s]", id)
+			return service.statusInternalError(err)
+		}
+	}
+	service.syslogger.Audit("pz-workflow", "updatedCronEvent", id, "Service.PutCronJob: User successfully updated cron event [%s] to schedule [%s]", id, job.CronSchedule)
+
+	return service.statusOK(service.cronJobInfo(job, eventType.Name))
+}
+
+// PauseCronJob stops a repeating event from firing, without deleting it.
+func (service *Service) PauseCronJob(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	return service.setCronJobPaused(id, true)
+}
+
+// ResumeCronJob starts a paused repeating event firing again.
+func (service *Service) ResumeCronJob(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	return service.setCronJobPaused(id, false)
+}
+
+func (service *Service) setCronJobPaused(id piazza.Ident, paused bool) *piazza.JsonResponse {
+	job, eventType, resp := service.getCronJob(id)
+	if resp != nil {
+		return resp
+	}
+
+	verb, done := "resuming", "resumed"
+	if paused {
+		verb, done = "pausing", "paused"
+	}
+	if job.Paused == paused {
+		return service.statusOK(service.cronJobInfo(job, eventType.Name))
+	}
+
+	service.syslogger.Audit("pz-workflow", verb+"CronEvent", id, "Service.setCronJobPaused: User is %s cron event [%s]", verb, id)
+	// the job is written back at the version it was read at, so that a run
+	// recorded meanwhile isn't undone; it is read again and paused then
+	for tries := 1; ; tries++ {
+		job.Paused = paused
+		if !paused {
+			// runs due while it was paused weren't missed
+			now := piazza.NewTimeStamp()
+			job.LastRun = &now
+		}
+		err := service.cronDB.PutData(job, job.Version)
+		if err == ErrVersionConflict && tries < maxCronJobWriteTries {
+			if job, eventType, resp = service.getCronJob(id); resp != nil {
+				return resp
+			}
+			continue
+		}
+		if err != nil {
+			service.syslogger.Audit("pz-workflow", verb+"CronEventFailure", id, "Service.setCronJobPaused: User failed %s cron event [%s]", verb, id)
+			return service.statusInternalError(err)
+		}
+		break
+	}
+	if paused {
+		service.cronSchedules.remove(id)
+	} else if err := service.cronSchedules.add(job, eventType.Name, service); err != nil {
+		service.syslogger.Audit("pz-workflow", verb+"CronEventFailure", id, "Service.setCronJobPaused: User failed %s cron event [%s]", verb, id)
+		return service.statusInternalError(err)
+	}
+	service.syslogger.Audit("pz-workflow", done+"CronEvent", id, "Service.setCronJobPaused: User successfully %s cron event [%s]", done, id)
+
+	return service.statusOK(service.cronJobInfo(job, eventType.Name))
+}
+
+// GetCronJobRuns lists the runs of a repeating event: the events it fired,
+// the runs that failed, and the missed runs that were skipped. The runs of an
+// event that has retired are kept, along with its seed event.
+func (service *Service) GetCronJobRuns(id piazza.Ident, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow"); mapping == "" {
+		return service.statusNotFound(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingCronRuns", id, "Service.GetCronJobRuns: User is getting the runs of cron event [%s]", id)
+	runs, totalHits, err := service.cronRunDB.GetAllByCron(format, id, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingCronRunsFailure", id, "Service.GetCronJobRuns: User failed to get the runs of cron event [%s]", id)
+		return service.statusInternalError(err)
+	}
+	service.syslogger.Audit("pz-workflow", "gotCronRuns", id, "Service.GetCronJobRuns: User successfully got the runs of cron event [%s]", id)
+
+	resp := service.statusOK(runs)
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
+
+// GetCronJobEvents lists the events a repeating event has fired, which are
+// those created by its seed event, whether or not it has retired.
+func (service *Service) GetCronJobEvents(id piazza.Ident, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
+	if mapping == "" {
+		return service.statusNotFound(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingCronEvents", id, "Service.GetCronJobEvents: User is getting the events of cron event [%s]", id)
+	events, totalHits, err := service.eventDB.GetEventsByCreator(format, mapping, id.String(), "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingCronEventsFailure", id, "Service.GetCronJobEvents: User failed to get the events of cron event [%s]", id)
+		return service.statusInternalError(err)
+	}
+	for i := range events {
+		events[i].Data = service.removeUniqueParams(mapping, events[i].Data)
+	}
+	service.syslogger.Audit("pz-workflow", "gotCronEvents", id, "Service.GetCronJobEvents: User successfully got the events of cron event [%s]", id)
+
+	resp := service.statusOK(events)
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
+
+// PostEvent stores the event and runs the triggers it fires, returning once
+// they have all run.
+func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
+	defer service.handlePanic()
+	return service.postEvent(event, 0, false)
+}
+
+// PostEventAsync stores the event and returns at once, with a 202; what its
+// triggers did can be fetched later with GetEventResults.
+func (service *Service) PostEventAsync(event *Event) *piazza.JsonResponse {
+	defer service.handlePanic()
+	return service.postEvent(event, 0, true)
+}
+
+// postEvent posts the event and runs the actions of the triggers it fires.
+// The depth is the number of event actions that led to this event.
+func (service *Service) postEvent(event *Event, depth int, async bool) *piazza.JsonResponse {
+	eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, event.CreatedBy)
+	if err != nil || !found {
+		return service.statusBadRequest(err)
+	}
+
+	event.EventID = service.newIdent()
+	event.CreatedOn = piazza.NewTimeStamp()
+
+	response := *event
+
+	// Find triggers associated with event
+	triggerIDs, err := service.matchEngine.MatchTriggers(eventType, response.Data, event.EventID, event.CreatedBy)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	// An event posted by an event action is already running on one of the
+	// pool's workers, so its triggers are run in place; waiting on the pool
+	// from inside it could deadlock.
+	pooled := depth == 0
+	if pooled {
+		if err = service.triggerPool.Reserve(len(triggerIDs)); err == errTriggerPoolFull {
+			return service.statusTooManyRequests(err)
+		} else if err != nil {
+			return service.statusServiceUnavailable(err)
+		}
+	}
+
+	event.Data = service.addUniqueParams(eventType.Name, event.Data)
+
+	service.syslogger.Audit(event.CreatedBy, "creatingEvent", event.EventID, "Service.PostEvent: User [%s] is creating event [%s]", event.CreatedBy, event.EventID)
+
+	if err = service.eventDB.PostData(event, eventType.Name); err != nil {
+		service.syslogger.Audit(event.CreatedBy, "creatingEventFailure", event.EventID, "Service.PostEvent: User [%s] failed to create event [%s]", event.CreatedBy, event.EventID)
+		if pooled {
+			service.triggerPool.Release(len(triggerIDs))
+		}
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit(event.CreatedBy, "createdEvent", event.EventID, "Service.PostEvent: User [%s] successfully created event [%s]", event.CreatedBy, event.EventID)
+
+	service.updateStats((*Stats).IncrEvents)
+
+	// For each trigger, apply the event data and run its action
+	run := service.eventResults.start(event.EventID, len(triggerIDs))
+	for i, triggerID := range triggerIDs {
+		i, triggerID := i, triggerID
+		task := func() {
+			run.set(i, service.fireTrigger(triggerID, event, eventType, response.Data, depth))
+		}
+		if pooled {
+			service.triggerPool.Run(task)
+		} else {
+			task()
+		}
+	}
+
+	if async {
+		return service.statusAccepted(&response)
+	}
+
+	run.wait()
+	if failed := run.failure(); failed != nil {
+		return &piazza.JsonResponse{
+			StatusCode: failed.StatusCode,
+			Message:    failed.Message,
+			Origin:     service.origin,
+		}
+	}
+
+	return service.statusCreated(&response)
+}
+
+// fireTrigger runs the action of one trigger an event matched. It returns
+// nil if the trigger was skipped.
+func (service *Service) fireTrigger(triggerID piazza.Ident, event *Event, eventType *EventType, data map[string]interface{}, depth int) *TriggerResult {
+	failure := func(action string, resp *piazza.JsonResponse) *TriggerResult {
+		return &TriggerResult{TriggerID: triggerID, Action: action, StatusCode: resp.StatusCode, Message: resp.Message}
+	}
+
+	trigger, found, err := service.triggerDB.GetOne(triggerID, event.CreatedBy)
+	if err != nil {
+		return failure("", service.statusBadRequest(err))
+	}
+	if !found {
+		// Don't fail for this, just log something and continue to the next trigger id
+		service.syslogger.Warning("Percolation error: Trigger %s does not exist", string(triggerID))
+		return nil
+	}
+	if !trigger.Enabled {
+		return nil
+	}
+
+	// Not the best way to do this, but should disallow Triggers from firing if they
+	// don't have the same Eventtype as the Event
+	// Would rather have this done via the percolation itself ...
+	if eventType.EventTypeID != trigger.EventTypeID {
+		return nil
+	}
+
+	action := trigger.ActionType()
+	kind, err := getActionKind(action)
+	if err != nil {
+		return failure(action, service.statusInternalError(err))
+	}
+
+	if action == ActionTypeJob {
+		idamURL, err := service.sys.GetURL(piazza.PzIdam)
+		service.syslogger.Info("Requesting pz-idam url: %s", idamURL)
+		if err == nil { //Mocking
+			service.syslogger.Audit("pz-workflow", "createJobRequestAccess", "pz-idam", "User [%s] POSTed event [%s] requesting access to trigger [%s] created by [%s]", event.CreatedBy, event.EventID, trigger.TriggerID, trigger.CreatedBy)
+			auth, err := piazza.RequestAuthZAccess(idamURL, eventType.CreatedBy)
+			service.syslogger.Info("Pz-idam authoriazation for user [%s]: %t", eventType.CreatedBy, auth)
+			if err != nil {
+				service.syslogger.Audit("pz-workflow", "createJobRequestAccessFailure", "pz-idam", "Event [%s] firing trigger [%s] could not get access to create job", event.EventID, trigger.TriggerID)
+				return failure(action, service.statusInternalError(err))
+			} else if !auth {
+				service.syslogger.Audit("pz-workflow", "createJobRequestAccessDenied", "pz-idam", "Event [%s] firing trigger [%s] was denied access to create job", event.EventID, trigger.TriggerID)
+				return failure(action, service.statusForbidden(errors.New("Access to create job denied")))
+			}
+		}
+		service.syslogger.Audit("pz-workflow", "createJobRequestAccessGranted", "pz-idam", "Event [%s] firing trigger [%s] was granted access to create job", event.EventID, trigger.TriggerID)
+	}
+
+	ctx := &ActionContext{
+		Service:   service,
+		Trigger:   trigger,
+		Event:     event,
+		EventType: eventType,
+		Data:      data,
+		Depth:     depth,
+	}
+	jobID, err := kind.Run(ctx)
+	if err != nil {
+		return failure(action, service.statusInternalError(err))
+	}
+	result := &TriggerResult{TriggerID: triggerID, Action: action, JobID: jobID, StatusCode: http.StatusOK}
+
+	// The alert for a job is recorded by the dispatcher, once the broker has
+	// acked the job
+	if action == ActionTypeJob {
+		return result
+	}
+
+	alert := Alert{EventID: event.EventID, TriggerID: triggerID, JobID: jobID, Action: action, CreatedBy: trigger.CreatedBy}
+	if resp := service.PostAlert(&alert); resp.IsError() {
+		// resp will be a statusInternalError or statusBadRequest
+		return failure(action, resp)
+	}
+	return result
+}
+
+// GetEventResults returns what the triggers fired by a recent event did.
+func (service *Service) GetEventResults(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	results, found := service.eventResults.get(id)
+	if !found {
+		return service.statusNotFound(fmt.Errorf("No trigger results for event %s; only recent events have them", id))
+	}
+	return service.statusOK(results)
+}
+
+func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
 	defer service.handlePanic()
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
@@ -895,16 +1572,16 @@ func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryP
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queryingEvents", service.eventDB.Esi.IndexName(), "Service.QueryEvents: User is querying events")
+	service.syslogger.Audit("pz-workflow", "queryingEvents", service.eventDB.IndexName(), "Service.QueryEvents: User is querying events")
 
 	events, totalHits, err := service.eventDB.GetEventsByDslQuery(query, jsonString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingEventsFailure", service.eventDB.Esi.IndexName(), "Service.QueryEvents: User failed to query events")
+		service.syslogger.Audit("pz-workflow", "queryingEventsFailure", service.eventDB.IndexName(), "Service.QueryEvents: User failed to query events")
 		return service.statusBadRequest(err)
 	}
 	resp := service.statusOK(events)
 
-	service.syslogger.Audit("pz-workflow", "queriedEvents", service.eventDB.Esi.IndexName(), "Service.QueryEvents: User successfully queried events")
+	service.syslogger.Audit("pz-workflow", "queriedEvents", service.eventDB.IndexName(), "Service.QueryEvents: User successfully queried events")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -912,6 +1589,51 @@ func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryP
 	return resp
 }
 
+// PutEvent corrects the data of an Event, which is checked against its
+// EventType again; the Triggers aren't fired again. The events Piazza posts,
+// and the seeds of repeating events, whose data is that of their cron job,
+// can't be changed.
+func (service *Service) PutEvent(event *Event) *piazza.JsonResponse {
+	defer service.handlePanic()
+	id := event.EventID
+	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
+	if mapping == "" {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if IsSystemEvent(mapping) {
+		return service.statusForbidden(LoggedError("Service.PutEvent failed: event %s of %s was posted by Piazza", id, mapping))
+	}
+	current, found, err := service.eventDB.GetOne(mapping, id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if event.EventTypeID != current.EventTypeID {
+		return service.statusBadRequest(LoggedError("Service.PutEvent failed: event %s can't be moved to another eventType", id))
+	}
+	if current.CronSchedule != "" {
+		return service.statusBadRequest(LoggedError("Service.PutEvent failed: event %s is a repeating event, which is changed with PUT /cron/%s", id, id))
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatingEvent", id, "Service.PutEvent: User is updating event [%s]", id)
+
+	current.Data = service.addUniqueParams(mapping, event.Data)
+	if err = service.eventDB.PutData(current, mapping); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingEventFailure", id, "Service.PutEvent: User failed to update event [%s]", id)
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatedEvent", id, "Service.PutEvent: User successfully updated event [%s]", id)
+
+	current.Data = event.Data
+	return service.statusOK(current)
+}
+
 func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
 	defer service.handlePanic()
 	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
@@ -956,7 +1678,7 @@ func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
 			return service.statusBadRequest(err)
 		}
 		service.syslogger.Audit("pz-workflow", "deletedCronEvent", id, "Service.DeleteEvent: User successfully deleted cron event [%s]", id)
-		service.cron.Remove(id.String())
+		service.cronSchedules.remove(id)
 	}
 
 	return service.statusOK(nil)
@@ -994,14 +1716,14 @@ func (service *Service) GetAllTriggers(params *piazza.HttpQueryParams) *piazza.J
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "gettingAllTriggers", service.triggerDB.mapping, "Service.GetAllTriggers: User is getting all triggers")
+	service.syslogger.Audit("pz-workflow", "gettingAllTriggers", service.triggerDB.Mapping(), "Service.GetAllTriggers: User is getting all triggers")
 
 	triggers, totalHits, err := service.triggerDB.GetAll(format, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllTriggersFailure", service.triggerDB.mapping, "Service.GetAllTriggers: User failed to get all triggers")
+		service.syslogger.Audit("pz-workflow", "gettingAllTriggersFailure", service.triggerDB.Mapping(), "Service.GetAllTriggers: User failed to get all triggers")
 		return service.statusInternalError(err)
 	} else if triggers == nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllTriggersFailure", service.triggerDB.mapping, "Service.GetAllTriggers: User failed to get all triggers")
+		service.syslogger.Audit("pz-workflow", "gettingAllTriggersFailure", service.triggerDB.Mapping(), "Service.GetAllTriggers: User failed to get all triggers")
 		return service.statusInternalError(errors.New("GetAllTriggers returned nil"))
 	}
 	for i := 0; i < len(triggers); i++ {
@@ -1014,7 +1736,7 @@ func (service *Service) GetAllTriggers(params *piazza.HttpQueryParams) *piazza.J
 	}
 	resp := service.statusOK(triggers)
 
-	service.syslogger.Audit("pz-workflow", "gotAllTriggers", service.triggerDB.mapping, "Service.GetAllTriggers: User successfully got all triggers")
+	service.syslogger.Audit("pz-workflow", "gotAllTriggers", service.triggerDB.Mapping(), "Service.GetAllTriggers: User successfully got all triggers")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1029,32 +1751,32 @@ func (service *Service) QueryTriggers(dslString string, params *piazza.HttpQuery
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queryingTriggers", service.triggerDB.mapping, "Service.QueryTriggers: User is querying triggers")
+	service.syslogger.Audit("pz-workflow", "queryingTriggers", service.triggerDB.Mapping(), "Service.QueryTriggers: User is querying triggers")
 
 	dslString, err = format.SyncPagination(dslString)
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: syncPagination failed")
+		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.Mapping(), "Service.QueryTriggers: syncPagination failed")
 		return service.statusBadRequest(err)
 	}
 	triggers, totalHits, err := service.triggerDB.GetTriggersByDslQuery(dslString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: User failed to query triggers")
+		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.Mapping(), "Service.QueryTriggers: User failed to query triggers")
 		return service.statusBadRequest(err)
 	} else if triggers == nil {
-		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: User failed to query triggers")
+		service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.Mapping(), "Service.QueryTriggers: User failed to query triggers")
 		return service.statusInternalError(errors.New("QueryTriggers returned nil"))
 	}
 	for i := 0; i < len(triggers); i++ {
 		eventType, found, err := service.eventTypeDB.GetOne(triggers[i].EventTypeID, "pz-workflow")
 		if err != nil || !found {
-			service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.mapping, "Service.QueryTriggers: User failed to query triggers")
+			service.syslogger.Audit("pz-workflow", "queryingTriggersFailure", service.triggerDB.Mapping(), "Service.QueryTriggers: User failed to query triggers")
 			return service.statusBadRequest(err)
 		}
 		triggers[i].Condition = service.removeUniqueParams(eventType.Name, triggers[i].Condition)
 	}
 	resp := service.statusOK(triggers)
 
-	service.syslogger.Audit("pz-workflow", "queriedTriggers", service.triggerDB.mapping, "Service.QueryTriggers: User successfully queried triggers")
+	service.syslogger.Audit("pz-workflow", "queriedTriggers", service.triggerDB.Mapping(), "Service.QueryTriggers: User successfully queried triggers")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1064,28 +1786,17 @@ func (service *Service) QueryTriggers(dslString string, params *piazza.HttpQuery
 
 func (service *Service) PostTrigger(trigger *Trigger) *piazza.JsonResponse {
 	defer service.handlePanic()
-	var err error
 	trigger.TriggerID = service.newIdent()
 	trigger.CreatedOn = piazza.NewTimeStamp()
+	return service.createTrigger(trigger)
+}
 
-	var eventType *EventType
-	{ //check eventtype id
-		if trigger.EventTypeID == "" {
-			return service.statusBadRequest(fmt.Errorf("TriggerDB.PostData failed: no eventTypeId was specified"))
-		}
-		var et *EventType
-		var found bool
-		et, found, err = service.eventTypeDB.GetOne(trigger.EventTypeID, trigger.CreatedBy)
-		if !found || err != nil {
-			return service.statusBadRequest(fmt.Errorf("TriggerDB.PostData failed: eventType %s could not be found", trigger.EventTypeID))
-		}
-		eventType = et
-	}
-	fixedQuery, ok := handleUniqueParams(trigger.Condition, eventType.Name, func(eventTypeName string, key string) string {
-		return strings.Replace(key, "data.", "data."+eventTypeName+".", 1)
-	}).(map[string]interface{})
-	if !ok {
-		return service.statusBadRequest(fmt.Errorf("TriggerEB.PostData failed: failed to parse query"))
+// createTrigger checks and stores a Trigger that has been given its ID, which
+// registers its percolation query.
+func (service *Service) createTrigger(trigger *Trigger) *piazza.JsonResponse {
+	fixedQuery, err := service.prepareTrigger(trigger)
+	if err != nil {
+		return service.statusBadRequest(err)
 	}
 	response := *trigger
 	trigger.Condition = fixedQuery
@@ -1099,38 +1810,209 @@ func (service *Service) PostTrigger(trigger *Trigger) *piazza.JsonResponse {
 
 	service.syslogger.Audit(trigger.CreatedBy, "createdTrigger", trigger.TriggerID, "Service.PostTrigger: User [%s] successfully created trigger [%s]", trigger.CreatedBy, trigger.TriggerID)
 
-	service.stats.IncrTriggers()
+	service.updateStats((*Stats).IncrTriggers)
 
+	response.Version = trigger.Version
 	return service.statusCreated(&response)
 }
 
-func (service *Service) PutTrigger(id piazza.Ident, update *TriggerUpdate) *piazza.JsonResponse {
+// TestTrigger does a dry run of a candidate trigger against some sample event
+// data. No trigger, event, alert or job is created.
+func (service *Service) TestTrigger(test *TriggerTest) *piazza.JsonResponse {
 	defer service.handlePanic()
-	trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
+	trigger := test.Trigger
+
+	if _, err := service.prepareTrigger(&trigger); err != nil {
+		return service.statusBadRequest(err)
+	}
+	eventType, _, err := service.eventTypeDB.GetOne(trigger.EventTypeID, "pz-workflow")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	matched, err := service.matchEngine.MatchSamples(eventType, trigger.Condition, test.Samples)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	kind, err := getActionKind(trigger.ActionType())
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	results := make([]TriggerTestResult, len(test.Samples))
+	for i, sample := range test.Samples {
+		results[i].Sample = i
+		if !matched[i] {
+			continue
+		}
+		event := &Event{EventTypeID: eventType.EventTypeID, CreatedBy: trigger.CreatedBy, CreatedOn: piazza.NewTimeStamp()}
+		ctx := &ActionContext{Service: service, Trigger: &trigger, Event: event, EventType: eventType, Data: sample}
+		results[i].Matched = true
+		results[i].Action = trigger.ActionType()
+		output, err := kind.Render(ctx)
+		if err != nil {
+			return service.statusInternalError(err)
+		}
+		if results[i].Action == ActionTypeJob {
+			results[i].Job = output
+		} else {
+			results[i].Output = output
+		}
+	}
+
+	return service.statusOK(results)
+}
+
+// prepareTrigger checks the trigger's eventTypeId, condition and action,
+// and returns its condition in the stored form, where "data."
+// paths are prefixed with the EventType name.
+func (service *Service) prepareTrigger(trigger *Trigger) (map[string]interface{}, error) {
+	if trigger.EventTypeID == "" {
+		return nil, fmt.Errorf("TriggerDB.PostData failed: no eventTypeId was specified")
+	}
+	eventType, found, err := service.eventTypeDB.GetOne(trigger.EventTypeID, trigger.CreatedBy)
+	if !found || err != nil {
+		return nil, fmt.Errorf("TriggerDB.PostData failed: eventType %s could not be found", trigger.EventTypeID)
+	}
+	if err = service.matchEngine.CheckCondition(trigger.Condition); err != nil {
+		return nil, err
+	}
+	if err = service.validateAction(trigger, eventType); err != nil {
+		return nil, err
+	}
+	fixedQuery, ok := qualifyCondition(trigger.Condition, eventType.Name)
+	if !ok {
+		return nil, fmt.Errorf("TriggerEB.PostData failed: failed to parse query")
+	}
+	return fixedQuery, nil
+}
+
+func qualifyCondition(condition map[string]interface{}, eventTypeName string) (map[string]interface{}, bool) {
+	fixedQuery, ok := handleUniqueParams(condition, eventTypeName, func(eventTypeName string, key string) string {
+		return strings.Replace(key, "data.", "data."+eventTypeName+".", 1)
+	}).(map[string]interface{})
+	return fixedQuery, ok
+}
+
+// PutTrigger updates a trigger in place. Fields absent from the request keep
+// their current values, so a body of just {"enabled": false} still works. The
+// triggerId, createdBy and createdOn fields can't be changed. If the version
+// is not 0, the trigger is updated only if it is still at that version; a
+// change made since it was read is refused, not overwritten.
+func (service *Service) PutTrigger(id piazza.Ident, fields map[string]interface{}, version int64) *piazza.JsonResponse {
+	defer service.handlePanic()
+	current, found, err := service.triggerDB.GetOne(id, "pz-workflow")
 	if !found {
 		return service.statusNotFound(err)
 	}
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
+	if version != 0 && version != current.Version {
+		return service.statusPreconditionFailed(ErrVersionConflict)
+	}
+
+	trigger, err := mergeTrigger(current, fields)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if trigger.Name == "" {
+		return service.statusBadRequest(errors.New("Service.PutTrigger failed: name may not be empty"))
+	}
+
+	fixedQuery, err := service.prepareTrigger(trigger)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	previousQuery := current.Condition
+	if eventType, found, err := service.eventTypeDB.GetOne(current.EventTypeID, "pz-workflow"); found && err == nil {
+		if q, ok := qualifyCondition(current.Condition, eventType.Name); ok {
+			previousQuery = q
+		}
+	}
+	response := *trigger
+	trigger.Condition = fixedQuery
 
 	service.syslogger.Audit("pz-workflow", "updatingTrigger", id, "Service.PutTrigger: User is updating trigger [%s]", id)
 
-	if _, err = service.triggerDB.PutTrigger(trigger, update, "pz-workflow"); err != nil {
+	if err = service.triggerDB.PutTrigger(trigger, previousQuery, current.Version, "pz-workflow"); err != nil {
 		service.syslogger.Audit("pz-workflow", "updatingTriggerFailure", id, "Service.PutTrigger: User failed to update trigger [%s]", id)
+		if err == ErrVersionConflict {
+			return service.statusPreconditionFailed(err)
+		}
 		return service.statusBadRequest(err)
 	}
 
-	service.syslogger.Audit("pz-workflow", "updatedTrigger", id, "Service.PutTrigger: User successfully updated trigger [%s] with enabled=[%v]", id, update.Enabled)
+	service.syslogger.Audit("pz-workflow", "updatedTrigger", id, "Service.PutTrigger: User successfully updated trigger [%s] with enabled=[%v]", id, trigger.Enabled)
 
-	return service.statusPutOK("Updated trigger")
+	response.PercolationID = trigger.PercolationID
+	response.Version = trigger.Version
+	return service.statusOK(&response)
 }
 
-func (service *Service) DeleteTrigger(id piazza.Ident) *piazza.JsonResponse {
+// mergeTrigger overlays the given JSON fields onto a copy of the trigger.
+func mergeTrigger(current *Trigger, fields map[string]interface{}) (*Trigger, error) {
+	byts, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	merged := map[string]interface{}{}
+	if err = json.Unmarshal(byts, &merged); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	if byts, err = json.Marshal(merged); err != nil {
+		return nil, err
+	}
+	trigger := &Trigger{}
+	if err = json.Unmarshal(byts, trigger); err != nil {
+		return nil, err
+	}
+	trigger.TriggerID = current.TriggerID
+	trigger.CreatedBy = current.CreatedBy
+	trigger.CreatedOn = current.CreatedOn
+	trigger.PercolationID = current.PercolationID
+	trigger.Version = current.Version
+	return trigger, nil
+}
+
+// DeleteTrigger moves a trigger to the trash, which unregisters its
+// percolation query. If the version is not 0, it is deleted only if it is
+// still at that version.
+func (service *Service) DeleteTrigger(id piazza.Ident, version int64) *piazza.JsonResponse {
 	defer service.handlePanic()
 	service.syslogger.Audit("pz-workflow", "deletingTrigger", id, "Service.DeleteTrigger: User is deleting trigger [%s]", id)
 
-	ok, err := service.triggerDB.DeleteTrigger(id, "pz-workflow")
+	trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit("pz-workflow", "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	if version != 0 && version != trigger.Version {
+		return service.statusPreconditionFailed(ErrVersionConflict)
+	}
+
+	item := service.newTrashItem(id, TrashKindTrigger, trigger.Name)
+	item.Trigger = trigger
+	if err = service.trashDB.PostData(item); err != nil {
+		service.syslogger.Audit("pz-workflow", "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
+		return service.statusInternalError(err)
+	}
+
+	ok, err := service.triggerDB.DeleteTrigger(id, version, "pz-workflow")
+	if err != nil || !ok {
+		_, _ = service.trashDB.DeleteByID(id, "pz-workflow")
+	}
+	if err == ErrVersionConflict {
+		service.syslogger.Audit("pz-workflow", "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
+		return service.statusPreconditionFailed(err)
+	}
 	if !ok {
 		service.syslogger.Audit("pz-workflow", "deletingTriggerFailure", id, "Service.DeleteTrigger: User failed to delete trigger [%s]", id)
 		return service.statusNotFound(err)
@@ -1179,28 +2061,28 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 	var alerts []Alert
 	var totalHits int64
 
-	service.syslogger.Audit("pz-workflow", "gettingAllAlerts", service.alertDB.mapping, "Service.GetAllAlerts: User is getting all alerts")
+	service.syslogger.Audit("pz-workflow", "gettingAllAlerts", service.alertDB.Mapping(), "Service.GetAllAlerts: User is getting all alerts")
 
 	if triggerID != "" && piazza.ValidUuid(triggerID.String()) {
 		alerts, totalHits, err = service.alertDB.GetAllByTrigger(format, triggerID, "pz-workflow")
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.Mapping(), "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(err)
 		} else if alerts == nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.Mapping(), "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(errors.New("GetAllAlerts returned nil"))
 		}
 	} else if triggerID == "" {
 		alerts, totalHits, err = service.alertDB.GetAll(format, "pz-workflow")
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.Mapping(), "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(err)
 		} else if alerts == nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.Mapping(), "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(errors.New("GetAllAlerts returned nil"))
 		}
 	} else {
-		service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+		service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.Mapping(), "Service.GetAllAlerts: User failed to get all alerts")
 		return service.statusBadRequest(errors.New("Malformed triggerId query parameter"))
 	}
 
@@ -1210,7 +2092,7 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 	if inflate {
 		alertExts, err := service.inflateAlerts(alerts)
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.Mapping(), "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(err)
 		}
 		resp = service.statusOK(*alertExts)
@@ -1218,7 +2100,7 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 		resp = service.statusOK(alerts)
 	}
 
-	service.syslogger.Audit("pz-workflow", "gotAllAlerts", service.alertDB.mapping, "Service.GetAllAlerts: User successfully got all alerts")
+	service.syslogger.Audit("pz-workflow", "gotAllAlerts", service.alertDB.Mapping(), "Service.GetAllAlerts: User successfully got all alerts")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1236,19 +2118,19 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 	var alerts []Alert
 	var totalHits int64
 
-	service.syslogger.Audit("pz-workflow", "queryingAlerts", service.alertDB.mapping, "Service.QueryAlerts: User is querying alerts")
+	service.syslogger.Audit("pz-workflow", "queryingAlerts", service.alertDB.Mapping(), "Service.QueryAlerts: User is querying alerts")
 
 	dslString, err = format.SyncPagination(dslString)
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: syncPagination failed")
+		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.Mapping(), "Service.QueryAlerts: syncPagination failed")
 		return service.statusBadRequest(err)
 	}
 	alerts, totalHits, err = service.alertDB.GetAlertsByDslQuery(dslString, "pz-workflow")
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: User failed to query alerts")
+		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.Mapping(), "Service.QueryAlerts: User failed to query alerts")
 		return service.statusBadRequest(err)
 	} else if alerts == nil {
-		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: User failed to query alerts")
+		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.Mapping(), "Service.QueryAlerts: User failed to query alerts")
 		return service.statusInternalError(errors.New("QueryAlerts returned nil"))
 	}
 
@@ -1258,7 +2140,7 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 	if inflate {
 		alertExts, err := service.inflateAlerts(alerts)
 		if err != nil {
-			service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: User failed to query alerts")
+			service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.Mapping(), "Service.QueryAlerts: User failed to query alerts")
 			return service.statusInternalError(err)
 		}
 		resp = service.statusOK(*alertExts)
@@ -1266,7 +2148,7 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 		resp = service.statusOK(alerts)
 	}
 
-	service.syslogger.Audit("pz-workflow", "queriedAlerts", service.alertDB.mapping, "Service.QueryAlerts: User successfully queried alerts")
+	service.syslogger.Audit("pz-workflow", "queriedAlerts", service.alertDB.Mapping(), "Service.QueryAlerts: User successfully queried alerts")
 
 	format.Count = int(totalHits)
 	resp.Pagination = format
@@ -1302,6 +2184,10 @@ func (service *Service) inflateAlert(alert Alert) (*AlertExt, error) {
 	trigger, found, err := service.triggerDB.GetOne(alert.TriggerID, "pz-workflow")
 	if err != nil || !found {
 		trigger = &Trigger{TriggerID: alert.TriggerID}
+		// the trigger may be in the trash
+		if item, found, err := service.trashDB.GetOne(alert.TriggerID, "pz-workflow"); err == nil && found && item.Trigger != nil {
+			trigger = item.Trigger
+		}
 	}
 
 	mapping, err := service.eventDB.lookupEventTypeNameByEventID(alert.EventID, alert.CreatedBy)
@@ -1314,12 +2200,15 @@ func (service *Service) inflateAlert(alert Alert) (*AlertExt, error) {
 		event = &Event{EventID: alert.EventID}
 	}
 	alertExt := &AlertExt{
-		AlertID:   alert.AlertID,
-		Trigger:   *trigger,
-		Event:     *event,
-		JobID:     alert.JobID,
-		CreatedBy: alert.CreatedBy,
-		CreatedOn: alert.CreatedOn,
+		AlertID:    alert.AlertID,
+		Trigger:    *trigger,
+		Event:      *event,
+		JobID:      alert.JobID,
+		Action:     alert.Action,
+		CreatedBy:  alert.CreatedBy,
+		CreatedOn:  alert.CreatedOn,
+		Status:     alert.Status,
+		Annotation: alert.Annotation,
 	}
 	return alertExt, nil
 }
@@ -1339,17 +2228,66 @@ func (service *Service) PostAlert(alert *Alert) *piazza.JsonResponse {
 
 	service.syslogger.Audit(alert.CreatedBy, "createdAlert", alert.AlertID, "Service.PostAlert: User [%s] successfully created alert [%s]", alert.CreatedBy, alert.AlertID)
 
-	service.stats.IncrAlerts()
+	service.updateStats((*Stats).IncrAlerts)
 
 	return service.statusCreated(alert)
 }
 
-// DeleteAlert TODO
-func (service *Service) DeleteAlert(id piazza.Ident) *piazza.JsonResponse {
+// PutAlert changes the status or the annotation of an Alert; an absent field
+// is left as it is, an empty annotation clears it, and its other fields can't
+// be changed. If the version is not 0, it is changed only if it is still at
+// that version; a change made since it was read is refused, not overwritten.
+func (service *Service) PutAlert(update *AlertUpdate, version int64) *piazza.JsonResponse {
+	defer service.handlePanic()
+	id := update.AlertID
+	switch update.Status {
+	case "", AlertStatusNew, AlertStatusAcknowledged, AlertStatusResolved:
+	default:
+		return service.statusBadRequest(LoggedError("Service.PutAlert failed: unknown status %s", update.Status))
+	}
+	current, found, err := service.alertDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if version != 0 && version != current.Version {
+		return service.statusPreconditionFailed(ErrVersionConflict)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatingAlert", id, "Service.PutAlert: User is updating alert [%s]", id)
+
+	if update.Status != "" {
+		current.Status = update.Status
+	}
+	if update.Annotation != nil {
+		current.Annotation = *update.Annotation
+	}
+	if err = service.alertDB.PutData(current, current.Version); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingAlertFailure", id, "Service.PutAlert: User failed to update alert [%s]", id)
+		if err == ErrVersionConflict {
+			return service.statusPreconditionFailed(err)
+		}
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatedAlert", id, "Service.PutAlert: User successfully updated alert [%s] with status=[%s]", id, current.Status)
+
+	return service.statusOK(current)
+}
+
+// DeleteAlert deletes an alert. If the version is not 0, it is deleted only if
+// it is still at that version.
+func (service *Service) DeleteAlert(id piazza.Ident, version int64) *piazza.JsonResponse {
 	defer service.handlePanic()
 	service.syslogger.Audit("pz-workflow", "deletingAlert", id, "Service.DeleteAlert: User is deleteing alert [%s]", id)
 
-	ok, err := service.alertDB.DeleteByID(id, "pz-workflow")
+	ok, err := service.alertDB.DeleteByID(id, version, "pz-workflow")
+	if err == ErrVersionConflict {
+		service.syslogger.Audit("pz-workflow", "deletingAlertFailure", id, "Service.DeleteAlert: User failed to delete alert [%s]", id)
+		return service.statusPreconditionFailed(err)
+	}
 	if !ok {
 		service.syslogger.Audit("pz-workflow", "deletingAlertFailure", id, "Service.DeleteAlert: User failed to delete alert [%s]", id)
 		return service.statusNotFound(err)
@@ -1378,59 +2316,15 @@ func (service *Service) removeUniqueParams(uniqueKey string, inputObj map[string
 
 //---------------------------------------------------------------------
 
-// InitCron TODO
+// InitCron starts the elections for which replica runs the cron. Every
+// replica schedules the repeating events it is given, so that it can tell
+// when they will fire, but only the leader's cron runs.
 func (service *Service) InitCron() error {
 	defer service.handlePanic()
-	ok, err := service.cronDB.Exists("pz-workflow")
-	if err != nil {
-		return err
-	}
-	if ok {
-		events, err := service.cronDB.GetAll("pz-workflow")
-		if err != nil {
-			return LoggedError("WorkflowService.InitCron: Unable to get all from CronDB")
-		}
-
-		for _, e := range *events {
-			eventType, found, err := service.eventTypeDB.GetOne(e.EventTypeID, "pz-workflow")
-			if !found || err != nil {
-				return LoggedError("WorkflowService.InitCron: Unable to retrieve event type for cron event %#v", e)
-			}
-			if err = service.cron.AddJob(e.CronSchedule, cronEvent{&e, eventType.Name, service}); err != nil {
-				return LoggedError("WorkflowService.InitCron: Unable to register cron event %#v", e)
-			}
-		}
-	}
-
-	service.cron.Start()
-
+	service.cronElector.Start()
 	return nil
 }
 
-type cronEvent struct {
-	*Event
-	eventTypeName string
-	service       *Service
-}
-
-func (c cronEvent) Run() {
-	uniqueMap := c.Data[c.eventTypeName]
-	if uniqueMap == nil {
-		uniqueMap = make(map[string]interface{})
-	}
-	ev := &Event{
-		EventTypeID: c.EventTypeID,
-		Data:        uniqueMap.(map[string]interface{}),
-		CreatedOn:   piazza.NewTimeStamp(),
-		CreatedBy:   c.EventID.String(),
-	}
-	c.service.PostEvent(ev)
-}
-
-func (c cronEvent) Key() string {
-	return c.EventID.String()
-}
-
 //---------------------------------------------------------------------
 
 func (service *Service) TestElasticsearchVersion() *piazza.JsonResponse {
@@ -0,0 +1,195 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// A deleted Trigger or EventType goes into the trash, from which it can be
+// restored under the same ID until it is purged. A trashed Trigger has no
+// percolation query, so it doesn't fire; restoring it registers the query
+// again.
+
+// defaultTrashPurgeAfter is how long a resource stays in the trash.
+const defaultTrashPurgeAfter = 30 * 24 * time.Hour
+
+func (service *Service) newTrashItem(id piazza.Ident, kind string, name string) *TrashItem {
+	now := time.Now()
+	return &TrashItem{
+		ID:        id,
+		Kind:      kind,
+		Name:      name,
+		TrashedBy: "pz-workflow",
+		TrashedOn: piazza.TimeStamp(now),
+		PurgeOn:   piazza.TimeStamp(now.Add(service.trashPurgeAfter)),
+	}
+}
+
+// GetAllTrash lists what is in the trash; the kind parameter picks out the
+// triggers or the eventTypes. Purging is left to the leader of the cron, so
+// what is due to be purged is listed until it is.
+func (service *Service) GetAllTrash(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	kind, err := params.GetAsString("kind", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	switch kind {
+	case "", TrashKindTrigger, TrashKindEventType:
+	default:
+		return service.statusBadRequest(fmt.Errorf("Unknown trash kind: %s", kind))
+	}
+
+	sortBy, err := params.GetAsString("sortBy", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if sortBy == "" {
+		format.SortBy = "trashedOn"
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingAllTrash", service.trashDB.mapping, "Service.GetAllTrash: User is getting the trash")
+	items, totalHits, err := service.trashDB.GetAll(format, kind, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingAllTrashFailure", service.trashDB.mapping, "Service.GetAllTrash: User failed to get the trash")
+		return service.statusInternalError(err)
+	}
+	service.syslogger.Audit("pz-workflow", "gotAllTrash", service.trashDB.mapping, "Service.GetAllTrash: User successfully got the trash")
+
+	resp := service.statusOK(items)
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
+
+// getTrashItem returns the resource of the kind in the trash, or the
+// response to give if it isn't there.
+func (service *Service) getTrashItem(id piazza.Ident, kind string) (*TrashItem, *piazza.JsonResponse) {
+	item, found, err := service.trashDB.GetOne(id, "pz-workflow")
+	if err != nil {
+		return nil, service.statusInternalError(err)
+	}
+	if !found || item.Kind != kind {
+		return nil, service.statusNotFound(fmt.Errorf("No %s %s is in the trash", kind, id))
+	}
+	return item, nil
+}
+
+// RestoreTrigger takes a trigger out of the trash and registers its
+// percolation query again. Its eventType must still exist.
+func (service *Service) RestoreTrigger(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	item, resp := service.getTrashItem(id, TrashKindTrigger)
+	if resp != nil {
+		return resp
+	}
+	if _, found, _ := service.triggerDB.GetOne(id, "pz-workflow"); found {
+		return service.statusBadRequest(LoggedError("Trigger %s already exists", id))
+	}
+
+	service.syslogger.Audit("pz-workflow", "restoringTrigger", id, "Service.RestoreTrigger: User is restoring trigger [%s]", id)
+
+	trigger := item.Trigger
+	trigger.Version = 0
+	resp = service.createTrigger(trigger)
+	if resp.StatusCode != http.StatusCreated {
+		service.syslogger.Audit("pz-workflow", "restoringTriggerFailure", id, "Service.RestoreTrigger: User failed to restore trigger [%s]", id)
+		return resp
+	}
+	if _, err := service.trashDB.DeleteByID(id, "pz-workflow"); err != nil {
+		service.syslogger.Warning("Trash: unable to take trigger %s out of the trash: %s", id, err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "restoredTrigger", id, "Service.RestoreTrigger: User successfully restored trigger [%s]", id)
+
+	return resp
+}
+
+// RestoreEventType takes an eventType out of the trash. Its name must not
+// have been taken since it was deleted.
+func (service *Service) RestoreEventType(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	item, resp := service.getTrashItem(id, TrashKindEventType)
+	if resp != nil {
+		return resp
+	}
+	if _, found, _ := service.eventTypeDB.GetOne(id, "pz-workflow"); found {
+		return service.statusBadRequest(LoggedError("EventType %s already exists", id))
+	}
+
+	service.syslogger.Audit("pz-workflow", "restoringEventType", id, "Service.RestoreEventType: User is restoring eventType [%s]", id)
+
+	eventType := item.EventType
+	eventType.Version = 0
+	resp = service.createEventType(eventType)
+	if resp.StatusCode != http.StatusCreated {
+		service.syslogger.Audit("pz-workflow", "restoringEventTypeFailure", id, "Service.RestoreEventType: User failed to restore eventType [%s]", id)
+		return resp
+	}
+	if _, err := service.trashDB.DeleteByID(id, "pz-workflow"); err != nil {
+		service.syslogger.Warning("Trash: unable to take eventType %s out of the trash: %s", id, err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "restoredEventType", id, "Service.RestoreEventType: User successfully restored eventType [%s]", id)
+
+	return resp
+}
+
+// purgeTrash deletes what has been in the trash for longer than the purge
+// period, and returns how many were deleted. The mapping of a purged EventType
+// is dropped, where the index can, so that its name can be used again.
+func (service *Service) purgeTrash() (int, error) {
+	const perPage = 100
+	now := time.Now()
+	due := []TrashItem{}
+
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{PerPage: perPage, Page: page, SortBy: "id", Order: piazza.SortOrderAscending}
+		items, _, err := service.trashDB.GetAll(format, "", "pz-workflow")
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range items {
+			if !time.Time(item.PurgeOn).After(now) {
+				due = append(due, item)
+			}
+		}
+		if len(items) < perPage {
+			break
+		}
+	}
+
+	for _, item := range due {
+		if item.Kind == TrashKindEventType {
+			if _, err := service.eventDB.DeleteMapping(item.Name, "pz-workflow"); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := service.trashDB.DeleteByID(item.ID, "pz-workflow"); err != nil {
+			return 0, err
+		}
+		service.syslogger.Audit("pz-workflow", "purgedTrash", item.ID, "Service.purgeTrash: [%s] was purged from the trash", item.ID)
+	}
+	return len(due), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// TrashDB holds the deleted Triggers and EventTypes. The resources are kept
+// whole but not indexed; a trigger's condition is kept with its dots
+// replaced, as in the TriggerDB.
+type TrashDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewTrashDB(service *Service, esi elasticsearch.IIndex) (*TrashDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	trdb := TrashDB{ResourceDB: rdb, mapping: TrashDBMapping}
+	return &trdb, nil
+}
+
+// PostData puts a resource in the trash, replacing it if it is already there.
+func (db *TrashDB) PostData(item *TrashItem) error {
+	stored := *item
+	if item.Trigger != nil {
+		trigger := *item.Trigger
+		if trigger.Condition != nil {
+			trigger.Condition = encodeCondition(trigger.Condition).(map[string]interface{})
+		}
+		trigger.Version = 0
+		stored.Trigger = &trigger
+	}
+	if item.EventType != nil {
+		eventType := *item.EventType
+		eventType.Version = 0
+		stored.EventType = &eventType
+	}
+	if _, err := db.Esi.PutData(db.mapping, item.ID.String(), &stored); err != nil {
+		return LoggedError("TrashDB.PostData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *TrashDB) decode(src *json.RawMessage) (*TrashItem, error) {
+	var item TrashItem
+	if err := json.Unmarshal(*src, &item); err != nil {
+		return nil, err
+	}
+	if item.Trigger != nil && item.Trigger.Condition != nil {
+		item.Trigger.Condition = handleDotTilde(item.Trigger.Condition, func(in string) string {
+			return strings.Replace(in, "~", ".", -1)
+		}).(map[string]interface{})
+	}
+	return &item, nil
+}
+
+// GetAll returns a page of what is in the trash, of one kind or of all kinds.
+func (db *TrashDB) GetAll(format *piazza.JsonPagination, kind string, actor string) ([]TrashItem, int64, error) {
+	items := []TrashItem{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return items, 0, err
+	}
+	if !exists {
+		return items, 0, nil
+	}
+
+	var searchResult *elasticsearch.SearchResult
+	if kind == "" {
+		searchResult, err = db.Esi.FilterByMatchAll(db.mapping, format)
+	} else {
+		searchResult, err = db.Esi.FilterByTermQuery(db.mapping, "kind", kind, format)
+	}
+	if err != nil {
+		return nil, 0, LoggedError("TrashDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("TrashDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			item, err := db.decode(hit.Source)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, *item)
+		}
+	}
+
+	return items, searchResult.TotalHits(), nil
+}
+
+// GetOne returns a resource in the trash, if it is there.
+func (db *TrashDB) GetOne(id piazza.Ident, actor string) (*TrashItem, bool, error) {
+	ok, err := db.Esi.ItemExists(db.mapping, id.String())
+	if err != nil {
+		return nil, false, LoggedError("TrashDB.GetOne failed: %s", err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, LoggedError("TrashDB.GetOne failed: %s", err)
+	}
+	if getResult == nil || getResult.Source == nil {
+		return nil, false, LoggedError("TrashDB.GetOne failed: no getResult")
+	}
+	item, err := db.decode(getResult.Source)
+	if err != nil {
+		return nil, true, err
+	}
+	return item, true, nil
+}
+
+// DeleteByID takes a resource out of the trash.
+func (db *TrashDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, id.String())
+	if err != nil {
+		return false, LoggedError("TrashDB.DeleteByID failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, LoggedError("TrashDB.DeleteByID failed: no deleteResult")
+	}
+	return deleteResult.Found, nil
+}
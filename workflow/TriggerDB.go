@@ -39,34 +39,14 @@ func NewTriggerDB(service *Service, esi elasticsearch.IIndex) (*TriggerDB, error
 	return &ardb, nil
 }
 
+// Mapping returns the type the Triggers are kept under.
+func (db *TriggerDB) Mapping() string {
+	return db.mapping
+}
+
 func (db *TriggerDB) PostData(trigger *Trigger) error {
-	{ //CHECK SERVICE EXISTS
-		serviceID := trigger.Job.JobType.Data["serviceId"]
-		strServiceID, ok := serviceID.(string)
-		if !ok {
-			return LoggedError("TriggerDB.PostData failed: serviceId field not of type string")
-		}
-		if domain := os.Getenv("DOMAIN"); domain != "" {
-			serviceControllerURL := "https://pz-servicecontroller." + domain
-			// TODO:
-			// if err is nil, we have a servicecontroller to talk to
-			// if err is not nil, we'll assume we are mocking (which means
-			// we have no servicecontroller client to mock)
-			response, err := http.Get(fmt.Sprintf("%s/service/%s", serviceControllerURL, strServiceID))
-			if err != nil {
-				return LoggedError("TriggerDB.PostData failed to make request to ServiceController: %s", err)
-			}
-			// On error, this should close on it's own
-			defer func() {
-				err = response.Body.Close()
-				if err != nil {
-					panic(err) // TODO: defer doesn't handle errs well
-				}
-			}()
-			if response.StatusCode != 200 {
-				return LoggedError("TriggerDB.PostData failed: serviceID %s does not exist", strServiceID)
-			}
-		}
+	if err := db.verifyServiceExists(trigger); err != nil {
+		return err
 	}
 
 	//log.Printf("Query: %v", wrapper)
@@ -76,7 +56,7 @@ func (db *TriggerDB) PostData(trigger *Trigger) error {
 	}
 
 	//log.Printf("Posting percolation query: %s", body)
-	indexResult, err := db.service.eventDB.Esi.AddPercolationQuery(trigger.TriggerID.String(), piazza.JsonString(body))
+	indexResult, err := db.service.eventDB.AddPercolationQuery(trigger.TriggerID.String(), piazza.JsonString(body))
 	if err != nil {
 		var errMessage string
 		if strings.Contains(err.Error(), "elastic: Error 500 (Internal Server Error): failed to parse query") {
@@ -98,41 +78,102 @@ func (db *TriggerDB) PostData(trigger *Trigger) error {
 	trigger.PercolationID = piazza.Ident(indexResult.ID)
 
 	trigger.Condition = encodeCondition(trigger.Condition).(map[string]interface{})
+	trigger.Version = 0
 
 	indexResult2, err := db.Esi.PostData(db.mapping, trigger.TriggerID.String(), trigger)
 	if err != nil {
-		_, _ = db.service.eventDB.Esi.DeletePercolationQuery(trigger.TriggerID.String())
+		_, _ = db.service.eventDB.DeletePercolationQuery(trigger.TriggerID.String())
 		return LoggedError("TriggerDB.PostData failed: %s", err)
 	}
 	if !indexResult2.Created {
-		_, _ = db.service.eventDB.Esi.DeletePercolationQuery(trigger.TriggerID.String())
+		_, _ = db.service.eventDB.DeletePercolationQuery(trigger.TriggerID.String())
 		return LoggedError("TriggerDB.PostData failed: not created")
 	}
+	trigger.Version = int64(indexResult2.Version)
 
 	return nil
 }
 
-func (db *TriggerDB) PutTrigger(trigger *Trigger, update *TriggerUpdate, actor string) (*Trigger, error) {
-	trigger.Enabled = update.Enabled
-	strTrigger, err := piazza.StructInterfaceToString(*trigger)
+// verifyServiceExists checks that the serviceId named by the trigger's job is
+// known to the ServiceController. Triggers with other actions have no job.
+func (db *TriggerDB) verifyServiceExists(trigger *Trigger) error {
+	if trigger.ActionType() != ActionTypeJob {
+		return nil
+	}
+	serviceID := trigger.Job.JobType.Data["serviceId"]
+	strServiceID, ok := serviceID.(string)
+	if !ok {
+		return LoggedError("TriggerDB.verifyServiceExists failed: serviceId field not of type string")
+	}
+	if domain := os.Getenv("DOMAIN"); domain != "" {
+		serviceControllerURL := "https://pz-servicecontroller." + domain
+		// TODO:
+		// if err is nil, we have a servicecontroller to talk to
+		// if err is not nil, we'll assume we are mocking (which means
+		// we have no servicecontroller client to mock)
+		response, err := http.Get(fmt.Sprintf("%s/service/%s", serviceControllerURL, strServiceID))
+		if err != nil {
+			return LoggedError("TriggerDB.verifyServiceExists failed to make request to ServiceController: %s", err)
+		}
+		// On error, this should close on it's own
+		defer func() {
+			err = response.Body.Close()
+			if err != nil {
+				panic(err) // TODO: defer doesn't handle errs well
+			}
+		}()
+		if response.StatusCode != 200 {
+			return LoggedError("TriggerDB.verifyServiceExists failed: serviceID %s does not exist", strServiceID)
+		}
+	}
+	return nil
+}
+
+// PutTrigger replaces a stored trigger, if it is still at the version, or in
+// any case if the version is 0. The percolation query registered under the
+// trigger's id is overwritten in place, so the TriggerID (and with it the
+// alert history) is kept. If the trigger document can't be written, the
+// previous query is put back.
+func (db *TriggerDB) PutTrigger(trigger *Trigger, previousCondition map[string]interface{}, version int64, actor string) error {
+	if err := db.verifyServiceExists(trigger); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(trigger.Condition)
+	if err != nil {
+		return err
+	}
+	previousBody, err := json.Marshal(previousCondition)
 	if err != nil {
-		return trigger, LoggedError("TriggerDB.PutData failed: %s", err)
+		return err
 	}
-	intTrigger, err := piazza.StructStringToInterface(strTrigger)
+
+	indexResult, err := db.service.eventDB.AddPercolationQuery(trigger.TriggerID.String(), piazza.JsonString(body))
 	if err != nil {
-		return trigger, LoggedError("TriggerDB.PutData failed: %s", err)
+		if strings.Contains(err.Error(), "elastic: Error 500 (Internal Server Error): failed to parse query") {
+			return LoggedError("TriggerDB.PutTrigger addpercquery failed: elastic failed to parse query. Common causes: [Variables do not start with 'data.' or are not found at your specified path, invalid perc query structure].")
+		}
+		return LoggedError("TriggerDB.PutTrigger addpercquery failed [unknown cause]: %s ", err)
 	}
-	mapTrigger, ok := intTrigger.(map[string]interface{})
-	if !ok {
-		return trigger, LoggedError("TriggerDB.PutData failed: bad trigger")
+	if indexResult == nil {
+		return LoggedError("TriggerDB.PutTrigger addpercquery failed: no indexResult")
 	}
-	fixedTrigger := handleDotTilde(mapTrigger, func(in string) string { return strings.Replace(in, ".", "~", -1) })
+	trigger.PercolationID = piazza.Ident(indexResult.ID)
 
-	_, err = db.Esi.PutData(db.mapping, trigger.TriggerID.String(), fixedTrigger)
+	stored := *trigger
+	stored.Condition = encodeCondition(trigger.Condition).(map[string]interface{})
+	stored.Version = 0
+
+	newVersion, err := db.putVersioned(db.mapping, trigger.TriggerID, &stored, version)
 	if err != nil {
-		return trigger, LoggedError("TriggerDB.PutData failed: %s", err)
+		_, _ = db.service.eventDB.AddPercolationQuery(trigger.TriggerID.String(), piazza.JsonString(previousBody))
+		if err == ErrVersionConflict {
+			return err
+		}
+		return LoggedError("TriggerDB.PutTrigger failed: %s", err)
 	}
-	return trigger, nil
+	trigger.Version = newVersion
+	return nil
 }
 
 func (db *TriggerDB) GetAll(format *piazza.JsonPagination, actor string) ([]Trigger, int64, error) {
@@ -204,23 +245,16 @@ func (db *TriggerDB) GetTriggersByDslQuery(dslString string, actor string) ([]Tr
 }
 
 func (db *TriggerDB) GetOne(id piazza.Ident, actor string) (*Trigger, bool, error) {
-	getResult, err := db.Esi.GetByID(db.mapping, id.String())
-	if err != nil {
-		return nil, false, LoggedError("TriggerDB.GetOne failed: %s", err)
-	}
-	if getResult == nil {
-		return nil, false, LoggedError("TriggerDB.GetOne failed: no getResult")
-	}
-
-	src := getResult.Source
 	var trigger Trigger
-	if err = json.Unmarshal(*src, &trigger); err != nil {
-		return nil, getResult.Found, LoggedError("TriggerDB.GetOne failed: %s", err)
+	found, version, err := db.getVersioned(db.mapping, id, &trigger)
+	if err != nil {
+		return nil, found, LoggedError("TriggerDB.GetOne failed: %s", err)
 	}
 
 	trigger.Condition = decodeCondition(trigger.Condition).(map[string]interface{})
+	trigger.Version = version
 
-	return &trigger, getResult.Found, nil
+	return &trigger, found, nil
 }
 
 func (db *TriggerDB) GetTriggersByEventTypeID(format *piazza.JsonPagination, id piazza.Ident, actor string) ([]Trigger, int64, error) {
@@ -234,7 +268,7 @@ func (db *TriggerDB) GetTriggersByEventTypeID(format *piazza.JsonPagination, id
 		return triggers, 0, nil
 	}
 
-	searchResult, err := db.Esi.FilterByTermQuery(db.mapping, "eventTypeId", id, format)
+	searchResult, err := db.Esi.FilterByTermQuery(db.mapping, "eventTypeId", id.String(), format)
 	if err != nil {
 		return nil, 0, LoggedError("TriggerDB.GetTriggersByEventTypeId failed: %s", err)
 	}
@@ -254,7 +288,9 @@ func (db *TriggerDB) GetTriggersByEventTypeID(format *piazza.JsonPagination, id
 	return triggers, searchResult.TotalHits(), nil
 }
 
-func (db *TriggerDB) DeleteTrigger(id piazza.Ident, actor string) (bool, error) {
+// DeleteTrigger deletes a trigger and its percolation query, if it is still
+// at the version, or in any case if the version is 0.
+func (db *TriggerDB) DeleteTrigger(id piazza.Ident, version int64, actor string) (bool, error) {
 	trigger, found, err := db.GetOne(id, actor)
 	if err != nil {
 		return found, err
@@ -262,19 +298,18 @@ func (db *TriggerDB) DeleteTrigger(id piazza.Ident, actor string) (bool, error)
 	if trigger == nil {
 		return false, nil
 	}
-
-	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
-	if err != nil {
-		return deleteResult.Found, LoggedError("TriggerDB.DeleteById failed: %s", err)
-	}
-	if deleteResult == nil {
-		return false, LoggedError("TriggerDB.DeleteById failed: no deleteResult")
+	if version != 0 && version != trigger.Version {
+		return false, ErrVersionConflict
 	}
-	if !deleteResult.Found {
-		return false, nil
+
+	if _, err = db.deleteVersioned(db.mapping, id, version); err != nil {
+		if err == ErrVersionConflict {
+			return false, err
+		}
+		return false, LoggedError("TriggerDB.DeleteById failed: %s", err)
 	}
 
-	deleteResult2, err := db.service.eventDB.Esi.DeletePercolationQuery(string(trigger.PercolationID))
+	deleteResult2, err := db.service.eventDB.DeletePercolationQuery(string(trigger.PercolationID))
 	if err != nil {
 		return deleteResult2.Found, LoggedError("TriggerDB.DeleteById percquery failed: %s", err)
 	}
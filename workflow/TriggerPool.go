@@ -0,0 +1,213 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"sync"
+
+	piazza "github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+const (
+	defaultTriggerWorkers    = 16
+	defaultTriggerQueueDepth = 256
+	defaultEventResultsKept  = 1000
+)
+
+// The errors TriggerPool.Reserve returns
+var (
+	errTriggerPoolFull    = errors.New("Too many triggers are waiting to run, try again later")
+	errTriggerPoolStopped = errors.New("Triggers can't be run, the service is shutting down")
+)
+
+// TriggerPool runs the triggers fired by events on a fixed number of
+// workers. At most QueueDepth triggers may be waiting or running at once;
+// an event whose triggers don't fit is refused, rather than queued.
+type TriggerPool struct {
+	Workers    int
+	QueueDepth int
+
+	tasks chan func()
+
+	lock     sync.Mutex
+	reserved int
+	stopped  bool
+	workers  sync.WaitGroup
+}
+
+// NewTriggerPool starts the workers.
+func NewTriggerPool(workers int, queueDepth int) *TriggerPool {
+	pool := &TriggerPool{
+		Workers:    workers,
+		QueueDepth: queueDepth,
+		tasks:      make(chan func(), queueDepth),
+	}
+	for i := 0; i < workers; i++ {
+		pool.workers.Add(1)
+		go pool.work()
+	}
+	return pool
+}
+
+// Reserve makes room for n tasks, all or none. Each reserved task must be
+// given to Run.
+func (pool *TriggerPool) Reserve(n int) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if pool.stopped {
+		return errTriggerPoolStopped
+	}
+	if pool.reserved+n > pool.QueueDepth {
+		return errTriggerPoolFull
+	}
+	pool.reserved += n
+	return nil
+}
+
+// Release gives back room reserved for tasks that won't be run.
+func (pool *TriggerPool) Release(n int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	pool.reserved -= n
+}
+
+// Run queues a task that room was reserved for. It doesn't block, since the
+// reservation guarantees the queue has room; once the pool has stopped, the
+// task is run straight away instead.
+func (pool *TriggerPool) Run(task func()) {
+	pool.lock.Lock()
+	if pool.stopped {
+		pool.lock.Unlock()
+		task()
+		pool.Release(1)
+		return
+	}
+	pool.tasks <- task
+	pool.lock.Unlock()
+}
+
+// Stop refuses new tasks and waits for the queued ones to finish.
+func (pool *TriggerPool) Stop() {
+	pool.lock.Lock()
+	if pool.stopped {
+		pool.lock.Unlock()
+		return
+	}
+	pool.stopped = true
+	close(pool.tasks)
+	pool.lock.Unlock()
+
+	pool.workers.Wait()
+}
+
+func (pool *TriggerPool) work() {
+	defer pool.workers.Done()
+	for task := range pool.tasks {
+		task()
+		pool.Release(1)
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// eventRun collects the results of the triggers one event fired. Each
+// trigger writes only its own slot; a nil slot is a trigger that was skipped
+// or hasn't run yet.
+type eventRun struct {
+	eventID   piazza.Ident
+	slots     []*TriggerResult
+	remaining int
+	lock      sync.Mutex
+	pending   sync.WaitGroup
+}
+
+func (run *eventRun) set(i int, result *TriggerResult) {
+	run.lock.Lock()
+	run.slots[i] = result
+	run.remaining--
+	run.lock.Unlock()
+	run.pending.Done()
+}
+
+func (run *eventRun) wait() {
+	run.pending.Wait()
+}
+
+// failure returns the first trigger that failed, if any.
+func (run *eventRun) failure() *TriggerResult {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	for _, result := range run.slots {
+		if result != nil && result.StatusCode >= 400 {
+			return result
+		}
+	}
+	return nil
+}
+
+func (run *eventRun) snapshot() *EventResults {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	results := &EventResults{EventID: run.eventID, Status: EventResultsDone, Triggers: []TriggerResult{}}
+	if run.remaining > 0 {
+		results.Status = EventResultsRunning
+	}
+	for _, result := range run.slots {
+		if result != nil {
+			results.Triggers = append(results.Triggers, *result)
+		}
+	}
+	return results
+}
+
+// eventResultStore keeps the trigger results of the most recent events.
+type eventResultStore struct {
+	kept  int
+	runs  map[piazza.Ident]*eventRun
+	order []piazza.Ident
+	lock  sync.Mutex
+}
+
+func newEventResultStore(kept int) *eventResultStore {
+	return &eventResultStore{kept: kept, runs: map[piazza.Ident]*eventRun{}}
+}
+
+// start records a new event that fired the given number of triggers,
+// forgetting the oldest one if need be.
+func (store *eventResultStore) start(eventID piazza.Ident, triggers int) *eventRun {
+	run := &eventRun{eventID: eventID, slots: make([]*TriggerResult, triggers), remaining: triggers}
+	run.pending.Add(triggers)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.runs[eventID] = run
+	store.order = append(store.order, eventID)
+	for len(store.order) > store.kept {
+		delete(store.runs, store.order[0])
+		store.order = store.order[1:]
+	}
+	return run
+}
+
+func (store *eventResultStore) get(eventID piazza.Ident) (*EventResults, bool) {
+	store.lock.Lock()
+	run, ok := store.runs[eventID]
+	store.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return run.snapshot(), true
+}
@@ -45,12 +45,51 @@ type Trigger struct {
 	Name          string                 `json:"name" binding:"required"`
 	EventTypeID   piazza.Ident           `json:"eventTypeId" binding:"required"`
 	Condition     map[string]interface{} `json:"condition" binding:"required"`
-	Job           JobRequest             `json:"job" binding:"required"`
+	Job           JobRequest             `json:"job" binding:"-"`
+	Action        *TriggerAction         `json:"action,omitempty"`
 	PercolationID piazza.Ident           `json:"percolationId"`
 	CreatedBy     string                 `json:"createdBy"`
 	CreatedOn     piazza.TimeStamp       `json:"createdOn"`
 	Enabled       bool                   `json:"enabled"`
+	// Version is the version of the stored trigger; it isn't stored itself
+	Version int64 `json:"version,omitempty"`
 }
+
+// TriggerAction is what a trigger does when it fires, other than submit its
+// Job. Type selects one of the kinds below, or one added with
+// RegisterActionKind; the fields for other kinds are ignored.
+type TriggerAction struct {
+	Type    string         `json:"type"`
+	Webhook *WebhookAction `json:"webhook,omitempty"`
+	AMQP    *AMQPAction    `json:"amqp,omitempty"`
+	Event   *EventAction   `json:"event,omitempty"`
+}
+
+// WebhookAction sends the Body, a job template, to the URL. With no Body, a
+// JSON object with the triggerId, eventId, eventTypeId and event data is sent.
+type WebhookAction struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    interface{}       `json:"body,omitempty"`
+}
+
+// AMQPAction publishes the Body, as for WebhookAction, to an exchange
+type AMQPAction struct {
+	Exchange   string      `json:"exchange"`
+	RoutingKey string      `json:"routingKey"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// EventAction posts an event of another EventType, with Data filled in from
+// the firing event the same way a job template is
+type EventAction struct {
+	EventTypeID piazza.Ident           `json:"eventTypeId"`
+	Data        map[string]interface{} `json:"data"`
+}
+
+// TriggerUpdate is the short form of a trigger update, which only toggles
+// Enabled. PUT /trigger/:id also accepts any of the Trigger fields.
 type TriggerUpdate struct {
 	Enabled bool `json:"enabled"`
 }
@@ -58,6 +97,24 @@ type TriggerUpdate struct {
 // TriggerList is a list of triggers
 type TriggerList []Trigger
 
+// TriggerTest is the body of a trigger dry run: a candidate trigger and some
+// sample event data payloads to try it against
+type TriggerTest struct {
+	Trigger Trigger                  `json:"trigger"`
+	Samples []map[string]interface{} `json:"samples" binding:"required"`
+}
+
+// TriggerTestResult says whether the candidate trigger matched one sample,
+// and if so, the job string that would have been submitted, or for other
+// action types, the output of the action
+type TriggerTestResult struct {
+	Sample  int    `json:"sample"`
+	Matched bool   `json:"matched"`
+	Action  string `json:"action,omitempty"`
+	Job     string `json:"job,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
 //-EVENT------------------------------------------------------------------------
 
 const EventDBMapping string = "_default_"
@@ -71,6 +128,16 @@ type Event struct {
 	CreatedBy    string                 `json:"createdBy"`
 	CreatedOn    piazza.TimeStamp       `json:"createdOn"`
 	CronSchedule string                 `json:"cronSchedule"`
+	// MissedRunPolicy says what a repeating event does about the runs it
+	// missed while the service was down
+	MissedRunPolicy string `json:"missedRunPolicy,omitempty"`
+	// TimeZone is the IANA time zone the CronSchedule is in, by default the
+	// server's; the event repeats from StartTime until EndTime, at most
+	// MaxRuns times, if any are set
+	TimeZone  string            `json:"timeZone,omitempty"`
+	StartTime *piazza.TimeStamp `json:"startTime,omitempty"`
+	EndTime   *piazza.TimeStamp `json:"endTime,omitempty"`
+	MaxRuns   int               `json:"maxRuns,omitempty"`
 }
 
 // EventList is a list of events
@@ -88,39 +155,228 @@ type EventType struct {
 	Mapping     map[string]interface{} `json:"mapping" binding:"required"`
 	CreatedBy   string                 `json:"createdBy"`
 	CreatedOn   piazza.TimeStamp       `json:"createdOn"`
+	Retention   *EventRetention        `json:"retention,omitempty"`
+	// Version is the version of the stored eventType; it isn't stored itself
+	Version int64 `json:"version,omitempty"`
+}
+
+// EventRetention keeps the events of an EventType in an index per day or
+// month, dropping all but the newest Keep of them; a Keep of 0 drops none
+type EventRetention struct {
+	Period string `json:"period"`
+	Keep   int    `json:"keep"`
 }
 
 // EventTypeList is a list of EventTypes
 type EventTypeList []EventType
 
+// TriggerResult is what one trigger did when an event fired it
+type TriggerResult struct {
+	TriggerID  piazza.Ident `json:"triggerId"`
+	Action     string       `json:"action,omitempty"`
+	JobID      piazza.Ident `json:"jobId,omitempty"`
+	StatusCode int          `json:"statusCode"`
+	Message    string       `json:"message,omitempty"`
+}
+
+// The states of an EventResults
+const (
+	EventResultsRunning = "running"
+	EventResultsDone    = "done"
+)
+
+// EventResults holds what the triggers fired by an event did. Triggers that
+// were skipped, or haven't run yet, aren't listed.
+type EventResults struct {
+	EventID  piazza.Ident    `json:"eventId"`
+	Status   string          `json:"status"`
+	Triggers []TriggerResult `json:"triggers"`
+}
+
 //-ALERT------------------------------------------------------------------------
 
 // AlertDBMapping is the name of the Elasticsearch type to which Alerts are added
 const AlertDBMapping string = "Alert"
 
+// The statuses of an Alert as it is handled; an Alert with no status is new
+const (
+	AlertStatusNew          = "new"
+	AlertStatusAcknowledged = "acknowledged"
+	AlertStatusResolved     = "resolved"
+)
+
 // Alert is a notification, automatically created when a Trigger happens
 type Alert struct {
 	AlertID   piazza.Ident     `json:"alertId"`
 	TriggerID piazza.Ident     `json:"triggerId"`
 	EventID   piazza.Ident     `json:"eventId"`
 	JobID     piazza.Ident     `json:"jobId"`
+	Action    string           `json:"action,omitempty"`
 	CreatedBy string           `json:"createdBy"`
 	CreatedOn piazza.TimeStamp `json:"createdOn"`
+	// Status and Annotation are set by whoever handles the alert
+	Status     string `json:"status,omitempty"`
+	Annotation string `json:"annotation,omitempty"`
+	// Version is the version of the stored alert; it isn't stored itself
+	Version int64 `json:"version,omitempty"`
+}
+
+// AlertUpdate changes the status or the annotation of an Alert; an absent
+// field is left as it is, and an empty annotation clears it
+type AlertUpdate struct {
+	AlertID    piazza.Ident `json:"alertId"`
+	Status     string       `json:"status,omitempty"`
+	Annotation *string      `json:"annotation,omitempty"`
 }
 
 type AlertExt struct {
-	AlertID   piazza.Ident     `json:"alertId"`
-	Trigger   Trigger          `json:"trigger" binding:"required"`
-	Event     Event            `json:"event" binding:"required"`
-	JobID     piazza.Ident     `json:"jobId"`
-	CreatedBy string           `json:"createdBy"`
-	CreatedOn piazza.TimeStamp `json:"createdOn"`
+	AlertID    piazza.Ident     `json:"alertId"`
+	Trigger    Trigger          `json:"trigger" binding:"required"`
+	Event      Event            `json:"event" binding:"required"`
+	JobID      piazza.Ident     `json:"jobId"`
+	Action     string           `json:"action,omitempty"`
+	CreatedBy  string           `json:"createdBy"`
+	CreatedOn  piazza.TimeStamp `json:"createdOn"`
+	Status     string           `json:"status,omitempty"`
+	Annotation string           `json:"annotation,omitempty"`
+}
+
+//-EVENTLOOKUP------------------------------------------------------------------
+
+const EventLookupDBMapping string = "EventLookup"
+
+// An EventLookup records the EventType of an event, whose type must be known
+// to get it, so that it can be found by its id alone
+type EventLookup struct {
+	EventID       piazza.Ident `json:"eventId"`
+	EventTypeName string       `json:"eventTypeName"`
+}
+
+//-TRASH------------------------------------------------------------------------
+
+const TrashDBMapping string = "Trash"
+
+// The kinds of resource that are put in the trash when deleted
+const (
+	TrashKindTrigger   = "trigger"
+	TrashKindEventType = "eventType"
+)
+
+// A TrashItem is a deleted Trigger or EventType, kept as it was when it was
+// deleted so that it can be restored, until it is purged
+type TrashItem struct {
+	ID        piazza.Ident     `json:"id"`
+	Kind      string           `json:"kind"`
+	Name      string           `json:"name"`
+	TrashedBy string           `json:"trashedBy"`
+	TrashedOn piazza.TimeStamp `json:"trashedOn"`
+	PurgeOn   piazza.TimeStamp `json:"purgeOn"`
+	Trigger   *Trigger         `json:"trigger,omitempty"`
+	EventType *EventType       `json:"eventType,omitempty"`
+}
+
+//-DISPATCH---------------------------------------------------------------------
+
+const DispatchDBMapping string = "Dispatch"
+
+// The states of a Dispatch
+const (
+	DispatchPending = "pending"
+	DispatchSent    = "sent"
+	DispatchDead    = "dead"
+)
+
+// A Dispatch is a job a trigger has submitted. It is kept in the outbox until
+// the job has been sent to the job manager, and is retried with backoff until
+// it is sent or has failed too many times, when it is dead-lettered. Once it
+// is sent, AlertPending is set until its Alert is recorded as AlertID.
+type Dispatch struct {
+	DispatchID   piazza.Ident     `json:"dispatchId"`
+	JobID        piazza.Ident     `json:"jobId"`
+	TriggerID    piazza.Ident     `json:"triggerId"`
+	EventID      piazza.Ident     `json:"eventId"`
+	Job          string           `json:"job"`
+	Status       string           `json:"status"`
+	Attempts     int              `json:"attempts"`
+	LastError    string           `json:"lastError,omitempty"`
+	NextAttempt  piazza.TimeStamp `json:"nextAttempt"`
+	CreatedBy    string           `json:"createdBy"`
+	CreatedOn    piazza.TimeStamp `json:"createdOn"`
+	AlertID      piazza.Ident     `json:"alertId,omitempty"`
+	AlertPending bool             `json:"alertPending,omitempty"`
+	Version      int64            `json:"version,omitempty"`
 }
 
 //-CRON-------------------------------------------------------------------------
 
 const CronDBMapping = "Cron"
 
+// The missed run policies of a repeating event: skip the runs missed while
+// the service was down, fire once for all of them, or fire each of them
+const (
+	CronMissedRunSkip     = "skip"
+	CronMissedRunFireOnce = "fireOnce"
+	CronMissedRunFireAll  = "fireAll"
+)
+
+// A CronJob is a repeating event as it is kept in the CronDB: the seed event
+// that was posted with a CronSchedule, and the state of its schedule
+type CronJob struct {
+	Event
+	Paused bool `json:"paused"`
+	// LastRun is the scheduled time of the last run that was fired or
+	// skipped; runs since then that are past due were missed
+	LastRun *piazza.TimeStamp `json:"lastRun,omitempty"`
+	// Runs is how many times it has fired, counting those that failed
+	Runs int `json:"runs"`
+	// Version is the version of the stored job; it isn't stored itself
+	Version int64 `json:"version,omitempty"`
+}
+
+// CronJobInfo is a CronJob with the time it will next fire, if it is
+// scheduled, and how many more times it will fire, if that is limited
+type CronJobInfo struct {
+	CronJob
+	NextRun       *piazza.TimeStamp `json:"nextRun,omitempty"`
+	RemainingRuns *int              `json:"remainingRuns,omitempty"`
+}
+
+// CronUpdate changes the schedule or the data of a CronJob; an empty field
+// is left as it is
+type CronUpdate struct {
+	CronSchedule    string                 `json:"cronSchedule"`
+	Data            map[string]interface{} `json:"data"`
+	MissedRunPolicy string                 `json:"missedRunPolicy"`
+	TimeZone        string                 `json:"timeZone"`
+	StartTime       *piazza.TimeStamp      `json:"startTime"`
+	EndTime         *piazza.TimeStamp      `json:"endTime"`
+	MaxRuns         int                    `json:"maxRuns"`
+}
+
+const CronRunDBMapping = "CronRun"
+
+// The states of a CronRun
+const (
+	CronRunFired   = "fired"
+	CronRunFailed  = "failed"
+	CronRunSkipped = "skipped"
+)
+
+// A CronRun records one run of a repeating event: when it was due, when it
+// was fired and the event it posted, or that it was skipped. Missed counts
+// the runs missed while the service was down that this run stands for.
+type CronRun struct {
+	RunID        piazza.Ident      `json:"runId"`
+	CronID       piazza.Ident      `json:"cronId"`
+	ScheduledFor piazza.TimeStamp  `json:"scheduledFor"`
+	FiredOn      *piazza.TimeStamp `json:"firedOn,omitempty"`
+	EventID      piazza.Ident      `json:"eventId,omitempty"`
+	Status       string            `json:"status"`
+	StatusCode   int               `json:"statusCode,omitempty"`
+	Message      string            `json:"message,omitempty"`
+	Missed       int               `json:"missed,omitempty"`
+}
+
 //-- Stats ------------------------------------------------------------
 
 type Stats struct {
@@ -170,14 +426,25 @@ func LoggedError(mssg string, args ...interface{}) error {
 func init() {
 	piazza.JsonResponseDataTypes["*workflow.EventType"] = "eventtype"
 	piazza.JsonResponseDataTypes["[]workflow.EventType"] = "eventtype-list"
+	piazza.JsonResponseDataTypes["*workflow.EventTypeDependencies"] = "eventtypedependencies"
 	piazza.JsonResponseDataTypes["*workflow.Event"] = "event"
 	piazza.JsonResponseDataTypes["[]workflow.Event"] = "event-list"
+	piazza.JsonResponseDataTypes["*workflow.EventResults"] = "eventresults"
 	piazza.JsonResponseDataTypes["*workflow.Trigger"] = "trigger"
 	piazza.JsonResponseDataTypes["[]workflow.Trigger"] = "trigger-list"
+	piazza.JsonResponseDataTypes["[]workflow.TriggerTestResult"] = "triggertestresult-list"
 	piazza.JsonResponseDataTypes["*workflow.Alert"] = "alert"
 	piazza.JsonResponseDataTypes["[]workflow.Alert"] = "alert-list"
 	piazza.JsonResponseDataTypes["[]workflow.AlertExt"] = "alertext-list"
+	piazza.JsonResponseDataTypes["[]workflow.TrashItem"] = "trash-list"
+	piazza.JsonResponseDataTypes["*workflow.Dispatch"] = "dispatch"
+	piazza.JsonResponseDataTypes["[]workflow.Dispatch"] = "dispatch-list"
+	piazza.JsonResponseDataTypes["*workflow.CronJobInfo"] = "cronjob"
+	piazza.JsonResponseDataTypes["[]workflow.CronJobInfo"] = "cronjob-list"
+	piazza.JsonResponseDataTypes["[]workflow.CronRun"] = "cronrun-list"
 	piazza.JsonResponseDataTypes["workflow.Stats"] = "workflowstats"
+	piazza.JsonResponseDataTypes["*workflow.Backup"] = "backup"
+	piazza.JsonResponseDataTypes["*workflow.RestoreReport"] = "restorereport"
 	piazza.JsonResponseDataTypes["*workflow.TestElasticsearchBody"] = "testelasticsearch"
 	piazza.JsonResponseDataTypes["[]workflow.TestElasticsearchBody"] = "testelasticsearch-list"
 }
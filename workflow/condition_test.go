@@ -0,0 +1,143 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConditionTester struct {
+	suite.Suite
+}
+
+//---------------------------------------------------------------------------
+
+var conditionTestMapping = `{
+	"num": "integer",
+	"str": "string",
+	"flag": "boolean",
+	"when": "date",
+	"tags": "[string]",
+	"loc": "geo_point",
+	"inner": {
+		"val": "double"
+	}
+}`
+
+var conditionTestData = `{
+	"num": 17,
+	"str": "The Quick brown_fox jumped",
+	"flag": true,
+	"when": "2016-07-04T12:00:00Z",
+	"tags": ["Alpha", "beta"],
+	"loc": {"lat": 38.9, "lon": -77.03},
+	"inner": {"val": 2.5}
+}`
+
+// Each condition, with whether Elasticsearch matches it against the test data
+var conditionTests = []struct {
+	condition string
+	matches   bool
+}{
+	{`{"match_all": {}}`, true},
+	{`{"query": {"match": {"data.num": 17}}}`, true},
+	{`{"match": {"data.num": "17"}}`, true},
+	{`{"match": {"data.num": 18}}`, false},
+	{`{"match": {"num": 17}}`, false},
+	{`{"match": {"data.str": "quick"}}`, true},
+	{`{"match": {"data.str": "QUICK slow"}}`, true},
+	{`{"match": {"data.str": {"query": "quick slow", "operator": "and"}}}`, false},
+	{`{"match": {"data.str": {"query": "quick jumped", "operator": "and"}}}`, true},
+	{`{"match": {"data.str": "brown"}}`, false},
+	{`{"match": {"data.str": "brown_fox"}}`, true},
+	{`{"term": {"data.str": "quick"}}`, true},
+	{`{"term": {"data.str": "Quick"}}`, false},
+	{`{"term": {"data.num": {"value": 17}}}`, true},
+	{`{"term": {"data.flag": true}}`, true},
+	{`{"term": {"data.flag": "false"}}`, false},
+	{`{"terms": {"data.tags": ["gamma", "alpha"]}}`, true},
+	{`{"terms": {"data.tags": ["gamma", "Alpha"]}}`, false},
+	{`{"range": {"data.num": {"gte": 17, "lt": 20}}}`, true},
+	{`{"range": {"data.num": {"gt": 17}}}`, false},
+	{`{"range": {"data.inner.val": {"from": 1, "to": 2.5, "include_upper": false}}}`, false},
+	{`{"range": {"data.when": {"gte": "2016-07-01", "lte": "2016-07-31"}}}`, true},
+	{`{"range": {"data.when": {"gt": "now-1d"}}}`, false},
+	{`{"exists": {"field": "data.inner.val"}}`, true},
+	{`{"exists": {"field": "data.missing"}}`, false},
+	{`{"geo_distance": {"distance": "20km", "data.loc": {"lat": 39.0, "lon": -77.0}}}`, true},
+	{`{"geo_distance": {"distance": "5mi", "data.loc": "39.0,-77.0"}}`, false},
+	{`{"geo_distance": {"distance": 12000, "data.loc": [-77.0, 39.0]}}`, true},
+	{`{"bool": {"must": [{"match": {"data.num": 17}}, {"term": {"data.flag": true}}]}}`, true},
+	{`{"bool": {"must": {"match": {"data.num": 17}}, "must_not": {"term": {"data.str": "fox"}}}}`, true},
+	{`{"bool": {"must_not": [{"term": {"data.str": "quick"}}]}}`, false},
+	{`{"bool": {"should": [{"term": {"data.num": 1}}, {"term": {"data.num": 17}}]}}`, true},
+	{`{"bool": {"should": [{"term": {"data.num": 1}}, {"term": {"data.num": 2}}]}}`, false},
+	{`{"bool": {"must": {"term": {"data.num": 17}}, "should": {"term": {"data.num": 2}}}}`, true},
+	{`{"bool": {"should": [{"term": {"data.num": 17}}, {"term": {"data.flag": true}}, {"term": {"data.num": 2}}], "minimum_should_match": 2}}`, true},
+	{`{"bool": {"should": [{"term": {"data.num": 17}}, {"term": {"data.num": 2}}], "minimum_should_match": "100%"}}`, false},
+	{`{"bool": {"filter": {"range": {"data.num": {"lte": 17}}}}}`, true},
+}
+
+var conditionErrorTests = []string{
+	`{}`,
+	`{"match": {"data.num": 17}, "term": {"data.num": 17}}`,
+	`{"fuzzy": {"data.str": "quik"}}`,
+	`{"match": {"data.num": 17, "data.str": "x"}}`,
+	`{"terms": {"data.tags": "alpha"}}`,
+	`{"range": {"data.num": {"above": 3}}}`,
+	`{"geo_distance": {"distance": "12 parsecs", "data.loc": "39.0,-77.0"}}`,
+	`{"bool": {"must": "x"}}`,
+}
+
+func (suite *ConditionTester) Test30Conditions() {
+	assert := assert.New(suite.T())
+
+	var mapping, data map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(conditionTestMapping), &mapping))
+	assert.NoError(json.Unmarshal([]byte(conditionTestData), &data))
+	doc := newConditionDoc(data, mapping)
+
+	for i, test := range conditionTests {
+		var condition map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(test.condition), &condition), "condition %d", i)
+		node, err := compileCondition(condition)
+		if !assert.NoError(err, "condition %d", i) {
+			continue
+		}
+		assert.Equal(test.matches, node.matches(doc), "condition %d: %s", i, test.condition)
+	}
+}
+
+func (suite *ConditionTester) Test31ConditionErrors() {
+	assert := assert.New(suite.T())
+
+	for i, test := range conditionErrorTests {
+		var condition map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(test), &condition), "condition %d", i)
+		_, err := compileCondition(condition)
+		assert.Error(err, "condition %d: %s", i, test)
+	}
+}
+
+func (suite *ConditionTester) Test32Analyze() {
+	assert := assert.New(suite.T())
+
+	assert.Equal([]string{"the", "quick", "brown_fox", "can't", "u.s.a", "3.14"},
+		analyze("The QUICK brown_fox -- can't U.S.A. 3.14!"))
+	assert.Empty(analyze(" ,;- "))
+}
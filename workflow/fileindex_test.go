@@ -0,0 +1,142 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+type FileIndexTester struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *FileIndexTester) SetupTest() {
+	dir, err := ioutil.TempDir("", "pz-workflow-fileindex")
+	assert.NoError(suite.T(), err)
+	suite.dir = dir
+}
+
+func (suite *FileIndexTester) TearDownTest() {
+	_ = os.RemoveAll(suite.dir)
+}
+
+//---------------------------------------------------------------------------
+
+func (suite *FileIndexTester) Test40FileIndexRestart() {
+	assert := assert.New(suite.T())
+
+	esi, err := NewFileIndex(suite.dir, "things")
+	assert.NoError(err)
+	assert.NoError(esi.SetMapping("Thing", `{"Thing":{"properties":{"name":{"type":"string"}}}}`))
+	assert.NoError(esi.Create(""))
+	for _, id := range []string{"a", "b", "c"} {
+		_, err = esi.PostData("Thing", id, map[string]interface{}{"name": "thing " + id})
+		assert.NoError(err)
+	}
+	resp, err := esi.PutData("Thing", "a", map[string]interface{}{"name": "thing a again"})
+	assert.NoError(err)
+	assert.Equal(2, resp.Version)
+	_, err = esi.DeleteByID("Thing", "b")
+	assert.NoError(err)
+	_, err = esi.AddPercolationQuery("q", `{"query":{"match":{"name":"again"}}}`)
+	assert.NoError(err)
+	assert.NoError(esi.Close())
+
+	_, err = esi.PostData("Thing", "d", map[string]interface{}{})
+	assert.Error(err, "a closed index can't be changed")
+
+	esi, err = NewFileIndex(suite.dir, "things")
+	assert.NoError(err)
+	defer esi.Close()
+
+	result, err := esi.FilterByMatchAll("Thing", &piazza.JsonPagination{PerPage: 10, SortBy: "name", Order: piazza.SortOrderAscending})
+	assert.NoError(err)
+	assert.EqualValues(2, result.TotalHits())
+	assert.Equal("a", result.GetHit(0).ID)
+	assert.Equal("c", result.GetHit(1).ID)
+
+	// versions carry over, and the mapping still analyzes name
+	resp, err = esi.PutData("Thing", "a", map[string]interface{}{"name": "thing a once more"})
+	assert.NoError(err)
+	assert.Equal(3, resp.Version)
+	result, err = esi.SearchByJSON("Thing", `{"query":{"match":{"name":"MORE"}}}`)
+	assert.NoError(err)
+	assert.EqualValues(1, result.TotalHits())
+
+	percolated, err := esi.AddPercolationDocument("Thing", map[string]interface{}{"name": "again and again"})
+	assert.NoError(err)
+	assert.EqualValues(1, percolated.Total)
+}
+
+func (suite *FileIndexTester) Test41FileIndexRecovery() {
+	assert := assert.New(suite.T())
+
+	esi, err := NewFileIndex(suite.dir, "eventtypes")
+	assert.NoError(err)
+	db, err := NewEventTypeDB(nil, esi)
+	assert.NoError(err)
+	eventType := &EventType{
+		EventTypeID: "et1",
+		Name:        "ET1",
+		Mapping:     map[string]interface{}{"num": "integer"},
+		CreatedOn:   piazza.NewTimeStamp(),
+	}
+	assert.NoError(db.PostData(eventType))
+	for i := 0; i < 5; i++ {
+		_, err = esi.PutData(EventTypeDBMapping, "et1", eventType)
+		assert.NoError(err)
+	}
+	assert.NoError(esi.Close())
+
+	// a crash part way through writing a record leaves it cut short
+	path := filepath.Join(suite.dir, "eventtypes"+fileIndexSuffix)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(err)
+	_, err = file.WriteString(`{"op":"put","type":"EventType","id":"et2","sour`)
+	assert.NoError(err)
+	assert.NoError(file.Close())
+
+	esi, err = NewFileIndex(suite.dir, "eventtypes")
+	assert.NoError(err)
+	defer esi.Close()
+	db, err = NewEventTypeDB(nil, esi)
+	assert.NoError(err)
+	got, found, err := db.GetOne("et1", "pz-workflow")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal("ET1", got.Name)
+	_, found, _ = db.GetOne("et2", "pz-workflow")
+	assert.False(found)
+
+	// reopening rewrote the log as the current contents: the create, the
+	// mapping and one put
+	byts, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(3, bytes.Count(byts, []byte("\n")))
+
+	// a record that is complete but wrong isn't skipped over
+	assert.NoError(esi.Close())
+	assert.NoError(ioutil.WriteFile(path, append(byts, []byte("{\"op\":\"explode\"}\n")...), 0644))
+	_, err = NewFileIndex(suite.dir, "eventtypes")
+	assert.Error(err)
+}
@@ -0,0 +1,370 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// memoryCluster is a MigrationCluster of indices that are their mappings
+// and the ids of the documents in them.
+type memoryCluster struct {
+	indices   map[string]map[string]interface{}
+	documents map[string][]string
+	aliases   map[string][]string
+	changes   int
+}
+
+func newMemoryCluster() *memoryCluster {
+	return &memoryCluster{
+		indices:   map[string]map[string]interface{}{},
+		documents: map[string][]string{},
+		aliases:   map[string][]string{},
+	}
+}
+
+func (cluster *memoryCluster) IndexExists(index string) (bool, error) {
+	_, ok := cluster.indices[index]
+	return ok, nil
+}
+
+func (cluster *memoryCluster) CreateIndex(index string, body json.RawMessage) error {
+	var parsed struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return err
+	}
+	cluster.indices[index] = parsed.Mappings
+	cluster.changes++
+	return nil
+}
+
+func (cluster *memoryCluster) AliasedIndices(alias string) ([]string, error) {
+	indices := append([]string{}, cluster.aliases[alias]...)
+	sort.Strings(indices)
+	return indices, nil
+}
+
+func (cluster *memoryCluster) MoveAlias(alias string, from []string, to string) error {
+	cluster.aliases[alias] = []string{to}
+	cluster.changes++
+	return nil
+}
+
+func (cluster *memoryCluster) Types(index string) ([]string, error) {
+	if indices := cluster.aliases[index]; len(indices) == 1 {
+		index = indices[0]
+	}
+	types := []string{}
+	for typ := range cluster.indices[index] {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+func (cluster *memoryCluster) GetMapping(index string, typ string) (map[string]interface{}, error) {
+	if indices := cluster.aliases[index]; len(indices) == 1 {
+		index = indices[0]
+	}
+	mapping, _ := cluster.indices[index][typ].(map[string]interface{})
+	return mapping, nil
+}
+
+func (cluster *memoryCluster) PutMapping(index string, typ string, mapping interface{}) error {
+	if indices := cluster.aliases[index]; len(indices) == 1 {
+		index = indices[0]
+	}
+	if _, ok := cluster.indices[index]; !ok {
+		return errors.New("no such index")
+	}
+	byts, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	var copied map[string]interface{}
+	if err = json.Unmarshal(byts, &copied); err != nil {
+		return err
+	}
+	// the fields are added to those the type has
+	if existing, ok := cluster.indices[index][typ].(map[string]interface{}); ok {
+		properties, _ := existing["properties"].(map[string]interface{})
+		added, _ := copied["properties"].(map[string]interface{})
+		for key, value := range existing {
+			if _, ok := copied[key]; !ok {
+				copied[key] = value
+			}
+		}
+		if properties != nil {
+			for name, property := range added {
+				properties[name] = property
+			}
+			copied["properties"] = properties
+		}
+	}
+	cluster.indices[index][typ] = copied
+	cluster.changes++
+	return nil
+}
+
+// property returns a property of a type in the index behind an alias.
+func (cluster *memoryCluster) property(alias string, typ string, name string) map[string]interface{} {
+	mapping, _ := cluster.GetMapping(alias, typ)
+	return mapping["properties"].(map[string]interface{})[name].(map[string]interface{})
+}
+
+// index makes an index as the db/ scripts did, with the alias on it and the
+// documents in it.
+func (cluster *memoryCluster) index(schema IndexSchema, documents ...string) error {
+	if err := cluster.CreateIndex(schema.Index, json.RawMessage(schema.Body)); err != nil {
+		return err
+	}
+	cluster.documents[schema.Index] = documents
+	return cluster.MoveAlias(schema.Alias, nil, schema.Index)
+}
+
+// aliased returns the ids of the documents in the indices behind an alias.
+func (cluster *memoryCluster) aliased(alias string) []string {
+	documents := []string{}
+	for _, index := range cluster.aliases[alias] {
+		documents = append(documents, cluster.documents[index]...)
+	}
+	return documents
+}
+
+//---------------------------------------------------------------------------
+
+type MigratorTester struct {
+	suite.Suite
+	cluster  *memoryCluster
+	migrator *Migrator
+}
+
+func (suite *MigratorTester) SetupTest() {
+	records := NewMemoryIndex(migrationIndex)
+	assert.NoError(suite.T(), records.Create(""))
+	assert.NoError(suite.T(), records.SetMapping(MigrationMapping, "{}"))
+
+	suite.cluster = newMemoryCluster()
+	suite.migrator = NewMigrator(suite.cluster, records)
+}
+
+//---------------------------------------------------------------------------
+
+func (suite *MigratorTester) Test44MigratorUpgrade() {
+	assert := assert.New(suite.T())
+	cluster, migrator := suite.cluster, suite.migrator
+
+	// a cluster the db/ scripts made, with an EventType, a trigger's query and
+	// something in each index
+	assert.NoError(cluster.index(eventTypes004, "eventType"))
+	assert.NoError(cluster.index(events005, "event", "query"))
+	assert.NoError(cluster.index(triggers004, "trigger"))
+	assert.NoError(cluster.index(alerts004, "alert"))
+	assert.NoError(cluster.index(crons004, "cron"))
+	assert.NoError(cluster.index(testElasticsearch004, "test"))
+	mappings, err := events005.mappings()
+	assert.NoError(err)
+	properties := map[string]interface{}{}
+	for name, property := range mappings[EventDBMapping].(map[string]interface{})["properties"].(map[string]interface{}) {
+		properties[name] = property
+	}
+	properties["data"] = map[string]interface{}{
+		"dynamic":    "strict",
+		"properties": map[string]interface{}{"size": map[string]interface{}{"type": "integer"}},
+	}
+	assert.NoError(cluster.PutMapping(keyEvents, "MyType", map[string]interface{}{"dynamic": "strict", "properties": properties}))
+	percolator := map[string]interface{}{"properties": map[string]interface{}{"query": map[string]interface{}{"type": "object", "enabled": false}}}
+	assert.NoError(cluster.PutMapping(keyEvents, ".percolator", percolator))
+	cluster.changes = 0
+
+	_, err = migrator.Up()
+	assert.NoError(err)
+
+	// the indices the scripts made are kept, with what is in them, and only
+	// the five new ones are made; eight mappings are put, one of them on the
+	// EventType's type
+	assert.Equal(2*5+8, cluster.changes)
+	for alias, documents := range map[string][]string{
+		keyEventTypes:        {"eventType"},
+		keyEvents:            {"event", "query"},
+		keyTriggers:          {"trigger"},
+		keyAlerts:            {"alert"},
+		keyCrons:             {"cron"},
+		keyTestElasticsearch: {"test"},
+	} {
+		assert.Equal(documents, cluster.aliased(alias), alias)
+	}
+	assert.Equal([]string{"events005"}, cluster.aliases[keyEvents])
+
+	// the EventType's type has the new fields, and keeps its own
+	assert.Equal("integer", cluster.property(keyEvents, "MyType", "maxRuns")["type"])
+	assert.Contains(cluster.property(keyEvents, "MyType", "data")["properties"], "size")
+	assert.Equal("strict", cluster.property(keyEvents, "MyType", "data")["dynamic"])
+	percolatorMapping, err := cluster.GetMapping(keyEvents, ".percolator")
+	assert.NoError(err)
+	assert.Equal(percolator, percolatorMapping)
+
+	diffs, err := migrator.Verify()
+	assert.NoError(err)
+	assert.Empty(diffs)
+}
+
+func (suite *MigratorTester) Test45MigratorUp() {
+	assert := assert.New(suite.T())
+	cluster, migrator := suite.cluster, suite.migrator
+
+	// a cluster the old scripts were part way through: the event types are
+	// done
+	assert.NoError(cluster.CreateIndex("eventtypes004", json.RawMessage(eventTypes004.Body)))
+	assert.NoError(cluster.MoveAlias(keyEventTypes, nil, "eventtypes004"))
+	cluster.changes = 0
+
+	statuses, err := migrator.Status()
+	assert.NoError(err)
+	assert.Len(statuses, len(workflowMigrations))
+	for i, status := range statuses {
+		assert.Equal(i+1, status.Version)
+		assert.False(status.Applied)
+		assert.Nil(status.AppliedOn)
+	}
+
+	done, err := migrator.Up()
+	assert.NoError(err)
+	assert.Len(done, len(workflowMigrations))
+	// the event types index was only given the retention; the other indices
+	// were each made and aliased, and then seven mappings were put
+	creates := 0
+	for _, migration := range workflowMigrations {
+		if strings.HasPrefix(migration.Description, "Create ") {
+			creates++
+		}
+	}
+	assert.Equal(2*(creates-1)+len(workflowMigrations)-creates, cluster.changes)
+	assert.Equal([]string{"events005"}, cluster.aliases[keyEvents])
+	assert.Equal("integer", cluster.property(keyEvents, EventDBMapping, "maxRuns")["type"])
+	assert.Contains(cluster.property(keyTriggers, TriggerDBMapping, "action")["properties"], "type")
+	assert.Equal("not_analyzed", cluster.property(keyLeases, "Lease", "holder")["index"])
+	assert.Contains(cluster.property(keyEventTypes, "EventType", "retention")["properties"], "keep")
+
+	statuses, err = migrator.Status()
+	assert.NoError(err)
+	for _, status := range statuses {
+		assert.True(status.Applied)
+		assert.NotNil(status.AppliedOn)
+	}
+
+	diffs, err := migrator.Verify()
+	assert.NoError(err)
+	assert.Empty(diffs)
+
+	// nothing is applied twice
+	cluster.changes = 0
+	done, err = migrator.Up()
+	assert.NoError(err)
+	assert.Len(done, 0)
+	assert.Equal(0, cluster.changes)
+
+	// a failed migration stops the ones after it, and is tried again
+	tries := 0
+	next := len(workflowMigrations) + 1
+	migrator.Migrations = append(migrator.Migrations,
+		Migration{next + 1, "after", func(MigrationCluster) error { return nil }},
+		Migration{next, "fails", func(MigrationCluster) error {
+			tries++
+			return errors.New("no room")
+		}},
+	)
+	done, err = migrator.Up()
+	assert.Error(err)
+	assert.Contains(err.Error(), fmt.Sprintf("migration %d (fails) failed: no room", next))
+	assert.Len(done, 0)
+	done, err = migrator.Up()
+	assert.Error(err)
+	assert.Equal(2, tries)
+	statuses, err = migrator.Status()
+	assert.NoError(err)
+	assert.Len(statuses, len(workflowMigrations)+2)
+	assert.False(statuses[len(statuses)-2].Applied)
+	assert.False(statuses[len(statuses)-1].Applied)
+
+	migrator.Migrations = append(migrator.Migrations, Migration{next + 1, "again", nil})
+	_, err = migrator.Up()
+	assert.Error(err)
+	assert.Contains(err.Error(), fmt.Sprintf("two migrations numbered %d", next+1))
+}
+
+func (suite *MigratorTester) Test46MigratorVerify() {
+	assert := assert.New(suite.T())
+	cluster, migrator := suite.cluster, suite.migrator
+
+	_, err := migrator.Up()
+	assert.NoError(err)
+
+	cluster.property(keyCrons, "Cron", "runs")["type"] = "long"
+	delete(cluster.property(keyLeases, "Lease", "expires"), "format")
+	cronRun, _ := cluster.GetMapping(keyCronRuns, "CronRun")
+	cronRun["properties"].(map[string]interface{})["extra"] = map[string]interface{}{"type": "boolean"}
+	delete(cluster.indices["dispatches001"], "Dispatch")
+
+	diffs, err := migrator.Verify()
+	assert.NoError(err)
+	assert.Equal([]string{
+		`crons/Cron.properties.runs.type: expected "integer", found "long"`,
+		`leases/Lease.properties.expires.format: missing`,
+		`cronruns/CronRun.properties.extra: not expected, found {"type":"boolean"}`,
+		`dispatches/Dispatch: missing`,
+	}, diffs)
+}
+
+func (suite *MigratorTester) Test47MigratorModernize() {
+	assert := assert.New(suite.T())
+	cluster, migrator := suite.cluster, suite.migrator
+
+	assert.NoError(migrator.modernize())
+	for _, schema := range migrator.Schemas {
+		assert.NotContains(schema.Body, `"string"`)
+		assert.NotContains(schema.Body, "index.version.created")
+		// an index of Elasticsearch 6 has one type, besides the default
+		mappings, err := schema.mappings()
+		assert.NoError(err)
+		delete(mappings, "_default_")
+		assert.True(len(mappings) <= 1, "%s has %d types", schema.Index, len(mappings))
+	}
+
+	_, err := migrator.Up()
+	assert.NoError(err)
+
+	holder := cluster.property(keyLeases, "Lease", "holder")
+	assert.Equal("keyword", holder["type"])
+	assert.NotContains(holder, "index")
+	message := cluster.property(keyCronRuns, "CronRun", "message")
+	assert.Equal("keyword", message["type"])
+	assert.Equal(false, message["index"])
+	assert.Equal("text", cluster.property(keyTestElasticsearch, "TestElasticsearch", "data")["type"])
+	assert.Equal("keyword", cluster.property(keyTriggers, "Trigger", "action")["properties"].(map[string]interface{})["type"].(map[string]interface{})["type"])
+
+	diffs, err := migrator.Verify()
+	assert.NoError(err)
+	assert.Empty(diffs)
+}
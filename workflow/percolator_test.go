@@ -0,0 +1,207 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// directIndex answers the DirectAccess requests of an esPercolator with the
+// responses of Elasticsearch 6, and records them.
+type directIndex struct {
+	elasticsearch.IIndex
+	requests []string
+	bodies   []interface{}
+	answers  []string
+}
+
+func (esi *directIndex) DirectAccess(verb string, endpoint string, input interface{}, output interface{}) error {
+	esi.requests = append(esi.requests, verb+" "+endpoint)
+	esi.bodies = append(esi.bodies, input)
+	answer := esi.answers[0]
+	esi.answers = esi.answers[1:]
+	return json.Unmarshal([]byte(answer), output)
+}
+
+//---------------------------------------------------------------------------
+
+type PercolatorTester struct {
+	suite.Suite
+	cluster *MemoryCluster
+	esi     *PercolatorIndex
+}
+
+func (suite *PercolatorTester) SetupTest() {
+	queries := NewMemoryIndex(keyEvents + "-queries")
+	assert.NoError(suite.T(), queries.Create(""))
+
+	suite.cluster = NewMemoryCluster()
+	suite.esi = NewPercolatorIndex(suite.cluster, suite.cluster.Alias(keyEvents), queries, events005Cron.Body)
+}
+
+//---------------------------------------------------------------------------
+
+func (suite *PercolatorTester) Test48PercolatorIndex() {
+	assert := assert.New(suite.T())
+	cluster, esi := suite.cluster, suite.esi
+
+	assert.False(usesPercolatorField("2.4.1"))
+	assert.True(usesPercolatorField("5.6.0"))
+	assert.True(usesPercolatorField("6.8.23"))
+	assert.False(usesPercolatorField(""))
+
+	// with no types there is nothing to search
+	result, err := esi.FilterByMatchAll("", &piazza.JsonPagination{PerPage: 10})
+	assert.NoError(err)
+	assert.Len(*result.GetHits(), 0)
+	_, err = esi.FilterByMatchAll("Alpha", &piazza.JsonPagination{PerPage: 10})
+	assert.Error(err)
+
+	for _, name := range []string{"Alpha", "Beta"} {
+		jsn, err := ConstructEventMappingSchema(name, map[string]interface{}{"num": "integer", "name": "string"})
+		assert.NoError(err)
+		assert.NoError(esi.SetMapping(name, jsn))
+	}
+	ok, err := esi.TypeExists("Alpha")
+	assert.NoError(err)
+	assert.True(ok)
+	ok, err = esi.TypeExists("Gamma")
+	assert.NoError(err)
+	assert.False(ok)
+	ok, err = cluster.IndexExists(esi.TypeIndexName("Alpha"))
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(keyEvents+"-type-416c706861", esi.TypeIndexName("Alpha"))
+	types, err := esi.GetTypes()
+	assert.NoError(err)
+	assert.Len(types, 2)
+	assert.Contains(types, "Alpha")
+	assert.Contains(types, "Beta")
+
+	// the index of a type has the _default_ properties, and strings are text
+	mapping, err := esi.GetMapping("Alpha")
+	assert.NoError(err)
+	properties := mapping.(map[string]interface{})["Alpha"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal("keyword", properties["eventId"].(map[string]interface{})["type"])
+	data := properties["data"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal("text", data["name"].(map[string]interface{})["type"])
+	assert.Equal("integer", data["num"].(map[string]interface{})["type"])
+
+	for i, name := range []string{"Alpha", "Beta"} {
+		_, err = esi.PostData(name, "e"+name, map[string]interface{}{
+			"eventId": "e" + name,
+			"data":    map[string]interface{}{"num": i + 1, "name": "a " + name},
+		})
+		assert.NoError(err)
+	}
+	_, err = esi.PostData("Gamma", "eGamma", map[string]interface{}{"eventId": "eGamma"})
+	assert.Error(err)
+	got, err := esi.GetByID("Alpha", "eAlpha")
+	assert.NoError(err)
+	assert.True(got.Found)
+	ok, err = esi.ItemExists("Beta", "eAlpha")
+	assert.NoError(err)
+	assert.False(ok)
+
+	result, err = esi.FilterByMatchAll("", &piazza.JsonPagination{PerPage: 10})
+	assert.NoError(err)
+	assert.Len(*result.GetHits(), 2)
+	result, err = esi.FilterByTermQuery("Beta", "data.num", 2, &piazza.JsonPagination{PerPage: 10})
+	assert.NoError(err)
+	assert.Len(*result.GetHits(), 1)
+
+	// the queries are matched against the documents of a type
+	_, err = esi.AddPercolationQuery("q1", `{"query":{"match":{"data.num":1}}}`)
+	assert.NoError(err)
+	matches, err := esi.AddPercolationDocument("Alpha", map[string]interface{}{"data": map[string]interface{}{"num": 1}})
+	assert.NoError(err)
+	assert.Len(matches.Matches, 1)
+	assert.Equal("q1", matches.Matches[0].Id)
+	matches, err = esi.AddPercolationDocument("Alpha", map[string]interface{}{"data": map[string]interface{}{"num": 2}})
+	assert.NoError(err)
+	assert.Len(matches.Matches, 0)
+	_, err = esi.AddPercolationDocument("Gamma", map[string]interface{}{})
+	assert.Error(err)
+	_, err = esi.DeletePercolationQuery("q1")
+	assert.NoError(err)
+	matches, err = esi.AddPercolationDocument("Alpha", map[string]interface{}{"data": map[string]interface{}{"num": 1}})
+	assert.NoError(err)
+	assert.Len(matches.Matches, 0)
+
+	// dropping a type drops its index
+	assert.NoError(esi.DeleteType("Alpha"))
+	ok, err = cluster.IndexExists(esi.TypeIndexName("Alpha"))
+	assert.NoError(err)
+	assert.False(ok)
+	types, err = esi.GetTypes()
+	assert.NoError(err)
+	assert.Equal([]string{"Beta"}, types)
+	result, err = esi.FilterByMatchAll("", &piazza.JsonPagination{PerPage: 10})
+	assert.NoError(err)
+	assert.Len(*result.GetHits(), 1)
+
+	assert.NoError(esi.Delete())
+	types, err = esi.GetTypes()
+	assert.NoError(err)
+	assert.Len(types, 0)
+}
+
+func (suite *PercolatorTester) Test49ESPercolator() {
+	assert := assert.New(suite.T())
+
+	esi := &directIndex{answers: []string{
+		`{"error":{"type":"index_not_found_exception"},"status":404}`,
+		`{"acknowledged":true}`,
+		`{"_id":"q1","_version":1,"result":"created"}`,
+		`{"hits":{"total":1,"hits":[{"_index":"events-queries","_id":"q1"}]}}`,
+		`{"_id":"q1","result":"deleted"}`,
+		`{"_id":"q1","result":"not_found"}`,
+	}}
+	percolator, err := newESPercolator(&esMigrationCluster{esi: esi}, "events-queries")
+	assert.NoError(err)
+
+	// a bare condition is put under query
+	resp, err := percolator.AddPercolationQuery("q1", `{"match":{"data.num":1}}`)
+	assert.NoError(err)
+	assert.True(resp.Created)
+	assert.Equal(map[string]interface{}{"query": map[string]interface{}{"match": map[string]interface{}{"data.num": float64(1)}}}, esi.bodies[2])
+
+	matches, err := percolator.AddPercolationDocument("Alpha", map[string]interface{}{"data": map[string]interface{}{"num": 1}})
+	assert.NoError(err)
+	assert.Len(matches.Matches, 1)
+	assert.Equal("q1", matches.Matches[0].Id)
+	percolate := esi.bodies[3].(map[string]interface{})["query"].(map[string]interface{})["percolate"].(map[string]interface{})
+	assert.Equal("query", percolate["field"])
+
+	deleted, err := percolator.DeletePercolationQuery("q1")
+	assert.NoError(err)
+	assert.True(deleted.Found)
+	_, err = percolator.DeletePercolationQuery("q1")
+	assert.Error(err)
+
+	assert.Equal([]string{
+		"GET /events-queries/_settings",
+		"PUT /events-queries",
+		"PUT /events-queries/queries/q1?refresh=true",
+		"POST /events-queries/_search",
+		"DELETE /events-queries/queries/q1?refresh=true",
+		"DELETE /events-queries/queries/q1?refresh=true",
+	}, esi.requests)
+}
@@ -0,0 +1,317 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// The replies a fakeBroker gives to a published message.
+const (
+	fakeAck    = "ack"
+	fakeNack   = "nack"
+	fakeSilent = "silent"
+)
+
+// fakeBroker stands in for RabbitMQ. It counts what the Publisher asks of it,
+// and can refuse or hold up a dial.
+type fakeBroker struct {
+	lock     sync.Mutex
+	refuse   error
+	hold     chan struct{}
+	reply    string
+	conns    []*fakeConnection
+	channels []*fakeChannel
+	declares int
+	messages []string
+}
+
+func (broker *fakeBroker) dial(address string) (amqpConnection, error) {
+	broker.lock.Lock()
+	hold, refuse := broker.hold, broker.refuse
+	broker.lock.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	if refuse != nil {
+		return nil, refuse
+	}
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	conn := &fakeConnection{broker: broker}
+	broker.conns = append(broker.conns, conn)
+	return conn, nil
+}
+
+func (broker *fakeBroker) set(change func()) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	change()
+}
+
+func (broker *fakeBroker) counts() (int, int, int) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	return len(broker.conns), len(broker.channels), broker.declares
+}
+
+func (broker *fakeBroker) channel(i int) *fakeChannel {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	return broker.channels[i]
+}
+
+type fakeConnection struct {
+	broker *fakeBroker
+	closes chan *amqp.Error
+	closed bool
+}
+
+func (conn *fakeConnection) Channel() (amqpChannel, error) {
+	conn.broker.lock.Lock()
+	defer conn.broker.lock.Unlock()
+	ch := &fakeChannel{broker: conn.broker}
+	conn.broker.channels = append(conn.broker.channels, ch)
+	return ch, nil
+}
+
+func (conn *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	conn.closes = receiver
+	return receiver
+}
+
+func (conn *fakeConnection) Close() error {
+	conn.broker.lock.Lock()
+	defer conn.broker.lock.Unlock()
+	if !conn.closed {
+		conn.closed = true
+		close(conn.closes)
+	}
+	return nil
+}
+
+// drop closes the connection as the broker would.
+func (conn *fakeConnection) drop() {
+	conn.broker.lock.Lock()
+	defer conn.broker.lock.Unlock()
+	conn.closes <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "broker shut down"}
+}
+
+type fakeChannel struct {
+	broker   *fakeBroker
+	confirms chan amqp.Confirmation
+	tag      uint64
+	closed   bool
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = confirm
+	return confirm
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+	ch.broker.declares++
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+	ch.broker.messages = append(ch.broker.messages, string(msg.Body))
+	ch.tag++
+	switch ch.broker.reply {
+	case fakeAck, "":
+		ch.confirms <- amqp.Confirmation{DeliveryTag: ch.tag, Ack: true}
+	case fakeNack:
+		ch.confirms <- amqp.Confirmation{DeliveryTag: ch.tag, Ack: false}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+	ch.closed = true
+	return nil
+}
+
+func (ch *fakeChannel) isClosed() bool {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+	return ch.closed
+}
+
+// eventually polls the condition until it holds, or a second has passed.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------
+
+type PublisherTester struct {
+	suite.Suite
+	broker    *fakeBroker
+	publisher *Publisher
+}
+
+func (suite *PublisherTester) SetupTest() {
+	suite.broker = &fakeBroker{}
+	suite.publisher = newPublisher(func() (string, error) { return "amqp://broker/", nil }, suite.broker.dial)
+	suite.publisher.ConfirmTimeout = 20 * time.Millisecond
+	suite.publisher.ReconnectDelay = time.Millisecond
+}
+
+func (suite *PublisherTester) TearDownTest() {
+	suite.publisher.Close()
+}
+
+//---------------------------------------------------------------------------
+
+func (suite *PublisherTester) Test50PublisherChannels() {
+	assert := assert.New(suite.T())
+	broker, publisher := suite.broker, suite.publisher
+
+	// one connection and one channel, reused, and the queue declared once
+	assert.NoError(publisher.Publish("Piazza", "jobs", true, "1"))
+	assert.NoError(publisher.Publish("Piazza", "jobs", true, "2"))
+	conns, channels, declares := broker.counts()
+	assert.Equal([]int{1, 1, 1}, []int{conns, channels, declares})
+
+	// a nack fails the message, but the channel is still good
+	broker.set(func() { broker.reply = fakeNack })
+	err := publisher.Publish("Piazza", "jobs", true, "3")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "nacked")
+	}
+	_, channels, _ = broker.counts()
+	assert.Equal(1, channels)
+	assert.False(broker.channel(0).isClosed())
+
+	// a confirm that doesn't come in time discards the channel, as it would
+	// be read as the next message's
+	broker.set(func() { broker.reply = fakeSilent })
+	err = publisher.Publish("Piazza", "jobs", true, "4")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "no ack")
+	}
+	assert.True(broker.channel(0).isClosed())
+	broker.set(func() { broker.reply = fakeAck })
+	assert.NoError(publisher.Publish("Piazza", "jobs", true, "5"))
+	conns, channels, declares = broker.counts()
+	assert.Equal([]int{1, 2, 1}, []int{conns, channels, declares})
+
+	// no more than Channels are kept idle
+	publisher.Channels = 1
+	taken := []*publisherChannel{}
+	for i := 0; i < 3; i++ {
+		pc, err := publisher.getChannel()
+		assert.NoError(err)
+		taken = append(taken, pc)
+	}
+	for _, pc := range taken {
+		publisher.putChannel(pc)
+	}
+	assert.Len(publisher.idle, 1)
+	_, channels, _ = broker.counts()
+	assert.Equal(4, channels)
+	assert.True(broker.channel(3).isClosed())
+
+	publisher.Close()
+	err = publisher.Publish("Piazza", "jobs", true, "6")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "closed")
+	}
+}
+
+func (suite *PublisherTester) Test51PublisherReconnect() {
+	assert := assert.New(suite.T())
+	broker, publisher := suite.broker, suite.publisher
+
+	assert.NoError(publisher.Publish("Piazza", "jobs", true, "1"))
+	first := broker.conns[0]
+
+	// while the broker is down, publishing fails at once, and the
+	// publisher reconnects in the background
+	broker.set(func() { broker.refuse = errors.New("connection refused") })
+	first.drop()
+	assert.True(eventually(func() bool {
+		publisher.lock.Lock()
+		defer publisher.lock.Unlock()
+		return publisher.conn == nil
+	}))
+	assert.True(broker.channel(0).isClosed())
+	err := publisher.Publish("Piazza", "jobs", true, "2")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "not connected")
+	}
+	broker.set(func() { broker.refuse = nil })
+	assert.True(eventually(func() bool {
+		return publisher.Publish("Piazza", "jobs", true, "3") == nil
+	}))
+	conns, channels, declares := broker.counts()
+	assert.Equal([]int{2, 2, 2}, []int{conns, channels, declares})
+
+	// a dial under way isn't waited on
+	publisher.Close()
+	suite.SetupTest()
+	broker, publisher = suite.broker, suite.publisher
+	hold := make(chan struct{})
+	broker.set(func() { broker.hold = hold })
+	done := make(chan error)
+	go func() {
+		done <- publisher.Publish("Piazza", "jobs", true, "4")
+	}()
+	assert.True(eventually(func() bool {
+		publisher.lock.Lock()
+		defer publisher.lock.Unlock()
+		return publisher.dialing
+	}))
+	err = publisher.Publish("Piazza", "jobs", true, "5")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "not connected")
+	}
+	close(hold)
+	assert.NoError(<-done)
+	assert.Equal([]string{"4"}, broker.messages)
+
+	// nor is the address of a broker that can't be found
+	publisher.Close()
+	publisher = NewPublisher(func() (string, error) {
+		return "", errors.New("no broker")
+	})
+	err = publisher.Publish("Piazza", "jobs", true, "6")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "address")
+	}
+	publisher.Close()
+}